@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg"
+	"github.com/flanksource/postgres/pkg/server"
+)
+
+// createBackupCommand creates the backup command
+func createBackupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup [DATABASE...]",
+		Short: "Create PostgreSQL backup",
+		Long: `Dump the given databases, or every database that allows connections except templates, with pg_dump and
+the roles and tablespaces with pg_dumpall --globals-only
+
+The archives are written into a new directory under --output-dir named after the start time, e.g.
+backups/20250102T030405Z, followed by a manifest.json with the server and pg_dump versions and the size, SHA-256
+checksum and duration of each archive. A backup directory without manifest.json is incomplete.
+
+Examples:
+  postgres-cli server backup
+  postgres-cli server backup orders customers --output-dir /backups
+  postgres-cli server backup --dump-format directory --jobs 4 --compress 6`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := server.DefaultBackupOptions()
+			opts.Databases = args
+			opts.OutputDir, _ = cmd.Flags().GetString("output-dir")
+			format, _ := cmd.Flags().GetString("dump-format")
+			opts.Format = server.BackupFormat(format)
+			opts.Jobs, _ = cmd.Flags().GetInt("jobs")
+			opts.Compression, _ = cmd.Flags().GetInt("compress")
+			opts.Globals, _ = cmd.Flags().GetBool("globals")
+
+			dir, err := postgres.BackupWithOptions(opts)
+			if err != nil {
+				return fmt.Errorf("backup failed: %w", err)
+			}
+			if postgres.DryRun {
+				return nil
+			}
+			manifest, err := server.ReadBackupManifest(dir)
+			if err != nil {
+				return err
+			}
+			clicky.MustPrint(manifest)
+			return nil
+		},
+	}
+	defaults := server.DefaultBackupOptions()
+	cmd.Flags().StringP("output-dir", "o", defaults.OutputDir, "Directory the backup directory is created in")
+	cmd.Flags().String("dump-format", string(defaults.Format), "pg_dump archive format: custom or directory")
+	cmd.Flags().IntP("jobs", "j", defaults.Jobs, "Tables dumped in parallel per database (directory format only)")
+	cmd.Flags().IntP("compress", "Z", defaults.Compression, "Compression level 0-9 (-1 = pg_dump default)")
+	cmd.Flags().Bool("globals", defaults.Globals, "Dump roles and tablespaces with pg_dumpall --globals-only")
+	cmd.AddCommand(createBackupVerifyCommand())
+	return cmd
+}
+
+// createBackupVerifyCommand creates the backup verify command
+func createBackupVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [BACKUP]",
+		Short: "Verify a backup by restoring it into a temporary cluster",
+		Long: `Restore a backup into a temporary cluster in a scratch directory, which only listens on a private Unix
+socket, check it and remove it
+
+BACKUP is a backup directory or pg_dump archive, the latest complete backup in --backup-dir by default. With --walg
+the latest WAL-G base backup, or the one named BACKUP, is fetched with the walg: settings of --pgconfig and
+recovered up to its consistent point, with archiving disabled.
+
+Every table and B-tree index of the restored databases is checked with amcheck, then each --assert query must
+return true. An assertion runs in the restored database when a single one is restored, otherwise in postgres,
+unless it is prefixed by a database name and a colon. The result of each step is printed with its duration and the
+command fails if any of them failed.
+
+Examples:
+  postgres-cli server backup verify
+  postgres-cli server backup verify backups/20250102T030405Z --assert "orders: SELECT count(*) > 1000 FROM orders"
+  postgres-cli server backup verify --walg --pgconfig pgconfig.yaml --scratch-dir /var/tmp --keep`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := server.DefaultVerifyOptions()
+			if len(args) > 0 {
+				opts.Backup = args[0]
+			}
+			opts.BackupDir, _ = cmd.Flags().GetString("backup-dir")
+			opts.Databases, _ = cmd.Flags().GetStringSlice("databases")
+			opts.Amcheck, _ = cmd.Flags().GetBool("amcheck")
+			opts.ScratchDir, _ = cmd.Flags().GetString("scratch-dir")
+			opts.Keep, _ = cmd.Flags().GetBool("keep")
+			opts.Jobs, _ = cmd.Flags().GetInt("jobs")
+			opts.Timeout, _ = cmd.Flags().GetDuration("timeout")
+			assertions, _ := cmd.Flags().GetStringArray("assert")
+			for _, assertion := range assertions {
+				opts.Assertions = append(opts.Assertions, server.ParseAssertion(assertion))
+			}
+			if walg, _ := cmd.Flags().GetBool("walg"); walg {
+				pgconfigFile, _ := cmd.Flags().GetString("pgconfig")
+				if pgconfigFile == "" {
+					return fmt.Errorf("--walg requires --pgconfig with the walg: settings")
+				}
+				pgconfig, err := pkg.LoadConfig(pgconfigFile)
+				if err != nil {
+					return fmt.Errorf("failed to load %s: %w", pgconfigFile, err)
+				}
+				if pgconfig.Walg == nil || !pgconfig.Walg.Enabled {
+					return fmt.Errorf("WAL-G is not enabled in %s", pgconfigFile)
+				}
+				opts.WalG = pgconfig.Walg
+			}
+
+			result, err := postgres.VerifyBackup(opts)
+			if err != nil {
+				return fmt.Errorf("backup verification failed: %w", err)
+			}
+			if postgres.DryRun {
+				return nil
+			}
+			clicky.MustPrint(result)
+			if !result.Passed {
+				return fmt.Errorf("backup %s failed verification", result.Backup)
+			}
+			return nil
+		},
+	}
+	defaults := server.DefaultVerifyOptions()
+	cmd.Flags().String("backup-dir", defaults.BackupDir, "Directory searched for the latest complete backup")
+	cmd.Flags().StringSlice("databases", nil, "Databases to restore from a logical backup (default: all)")
+	cmd.Flags().StringArray("assert", nil, "[DATABASE:] query that must return true, e.g. \"SELECT count(*) > 0 FROM orders\" (repeatable)")
+	cmd.Flags().Bool("amcheck", defaults.Amcheck, "Check tables and indexes with amcheck")
+	cmd.Flags().String("scratch-dir", "", "Directory for the temporary cluster (default: system temporary directory)")
+	cmd.Flags().Bool("keep", false, "Keep the temporary cluster when the verification fails")
+	cmd.Flags().IntP("jobs", "j", defaults.Jobs, "Tables restored in parallel")
+	cmd.Flags().Duration("timeout", defaults.Timeout, "Maximum time to recover a WAL-G base backup")
+	cmd.Flags().Bool("walg", false, "Verify a WAL-G base backup instead of a logical backup")
+	cmd.Flags().String("pgconfig", os.Getenv("PG_CONFIG_FILE"), "YAML configuration with the walg: settings")
+	return cmd
+}
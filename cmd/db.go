@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg"
+)
+
+// createDatabaseCommand creates the db command group
+func createDatabaseCommand() *cobra.Command {
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage PostgreSQL databases",
+		Long: `Create, drop, rename, clone and list databases
+
+Databases can also be declared in the databases: section of the YAML passed to auto-start --pgconfig,
+where they are created if missing and their owner, tablespace and connection limit reconciled on every start.`,
+	}
+	dbCmd.AddCommand(
+		createDatabaseListCommand(),
+		createDatabaseCreateCommand(),
+		createDatabaseDropCommand(),
+		createDatabaseRenameCommand(),
+		createDatabaseCloneCommand(),
+	)
+	return dbCmd
+}
+
+func createDatabaseListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List databases with their size and number of connections",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			databases, err := postgres.ListDatabases()
+			if err != nil {
+				return fmt.Errorf("failed to list databases: %w", err)
+			}
+			clicky.MustPrint(databases)
+			return nil
+		},
+	}
+}
+
+func createDatabaseCreateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a database",
+		Long: `Create a database
+
+A database with its own --encoding, --locale or --locale-provider is copied from template0 unless
+--template is given, as template1 can contain data that depends on its locale.
+
+Examples:
+  postgres-cli server db create app --owner app
+  postgres-cli server db create app --encoding UTF8 --locale en_US.UTF-8
+  postgres-cli server db create app --locale-provider icu --icu-locale de-DE`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database := pkg.DatabaseConf{Name: args[0]}
+			database.Owner, _ = cmd.Flags().GetString("owner")
+			database.Template, _ = cmd.Flags().GetString("template")
+			database.Encoding, _ = cmd.Flags().GetString("encoding")
+			database.Locale, _ = cmd.Flags().GetString("locale")
+			database.LocaleProvider, _ = cmd.Flags().GetString("locale-provider")
+			database.IcuLocale, _ = cmd.Flags().GetString("icu-locale")
+			database.Tablespace, _ = cmd.Flags().GetString("tablespace")
+			if cmd.Flags().Changed("connection-limit") {
+				limit, _ := cmd.Flags().GetInt("connection-limit")
+				database.ConnectionLimit = &limit
+			}
+			if err := postgres.CreateDatabaseWithOptions(database); err != nil {
+				return fmt.Errorf("failed to create database %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Database %s created", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().String("owner", "", "Role that owns the database")
+	cmd.Flags().String("template", "", "Database to copy, defaults to template1 or template0 when a locale is given")
+	cmd.Flags().String("encoding", "", "Character set encoding, e.g. UTF8")
+	cmd.Flags().String("locale", "", "Collation and character classification, e.g. en_US.UTF-8")
+	cmd.Flags().String("locale-provider", "", "Locale provider: libc, icu or builtin")
+	cmd.Flags().String("icu-locale", "", "ICU locale, requires --locale-provider icu")
+	cmd.Flags().String("tablespace", "", "Default tablespace")
+	cmd.Flags().Int("connection-limit", -1, "Maximum concurrent connections (-1 = no limit)")
+	return cmd
+}
+
+func createDatabaseDropCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "drop NAME",
+		Short: "Drop a database",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ifExists, _ := cmd.Flags().GetBool("if-exists")
+			force, _ := cmd.Flags().GetBool("force")
+			if err := postgres.DropDatabase(args[0], ifExists, force); err != nil {
+				return fmt.Errorf("failed to drop database %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Database %s dropped", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().Bool("if-exists", false, "Do not fail if the database does not exist")
+	cmd.Flags().Bool("force", false, "Terminate the connections to the database first")
+	return cmd
+}
+
+func createDatabaseRenameCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rename NAME NEW_NAME",
+		Short: "Rename a database, which must have no connections",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := postgres.RenameDatabase(args[0], args[1]); err != nil {
+				return fmt.Errorf("failed to rename database %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Database %s renamed to %s", args[0], args[1])
+			return nil
+		},
+	}
+}
+
+func createDatabaseCloneCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "clone SOURCE TARGET",
+		Short: "Create TARGET as a copy of SOURCE",
+		Long: `Create TARGET as a copy of SOURCE using it as the template
+
+SOURCE must have no other connections while it is copied, use --terminate to end them first.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			owner, _ := cmd.Flags().GetString("owner")
+			terminate, _ := cmd.Flags().GetBool("terminate")
+			if err := postgres.CloneDatabase(args[0], args[1], owner, terminate); err != nil {
+				return fmt.Errorf("failed to clone database %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Database %s cloned to %s", args[0], args[1])
+			return nil
+		},
+	}
+	cmd.Flags().String("owner", "", "Role that owns the copy, defaults to the current user")
+	cmd.Flags().Bool("terminate", false, "Terminate the connections to SOURCE first")
+	return cmd
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg/server"
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+// createEntrypointCommand creates the container entrypoint command
+func createEntrypointCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "entrypoint [-- command...]",
+		SilenceUsage: true,
+		Short:        "Container entrypoint compatible with the official postgres image",
+		Long: `Prepare the data directory and exec PostgreSQL, following the contract of the official postgres image.
+
+- POSTGRES_USER, POSTGRES_PASSWORD, POSTGRES_DB, POSTGRES_INITDB_ARGS, POSTGRES_INITDB_WALDIR and
+  POSTGRES_HOST_AUTH_METHOD are read from the environment, or from the file named by the *_FILE variant
+- When started as root, PGDATA is created and owned by the postgres user and root privileges are dropped
+- An empty data directory is initialized, POSTGRES_DB is created and the *.sh, *.sql, *.sql.gz, *.sql.xz and
+  *.sql.zst files in --init-scripts-dir are run in order against a server listening on a private socket
+- The auto-start tasks (upgrade, pg_tune, pg_hba.conf) run, then PostgreSQL is exec'd unless UPGRADE_ONLY=true,
+  with --supervise it is run as a child of postgres-cli instead (see postgres-cli run)
+
+Without a command or with only flags (e.g. -- -c shared_buffers=1GB) postgres is started, any other
+command is exec'd as given without touching the data directory.`,
+		RunE: runEntrypoint,
+	}
+	addAutoStartFlags(cmd)
+	addRunFlags(cmd)
+	cmd.Flags().String("init-scripts-dir", server.DefaultInitScriptsDir, "Directory with initialization scripts run when the cluster is created")
+	cmd.Flags().Bool("supervise", false, "Keep postgres-cli as the parent of PostgreSQL to forward signals, restart crashes and reap zombies")
+	return cmd
+}
+
+func runEntrypoint(cmd *cobra.Command, args []string) error {
+	argv, isServer := server.ServerCommand(args)
+	if !isServer {
+		return execCommand(argv)
+	}
+
+	env, err := server.SetupDockerEnv()
+	if err != nil {
+		return err
+	}
+
+	if utils.IsRunningAsRoot() && !postgres.DryRun {
+		uid, gid := utils.LookupUserIDs("postgres")
+		clicky.Warnf("⚠️  Running as root, preparing %s for the postgres user (%d:%d) and dropping privileges", postgres.DataDir, uid, gid)
+		for _, dir := range []string{postgres.DataDir, env.WALDir} {
+			if dir == "" {
+				continue
+			}
+			if err := utils.FixOwnership(dir, uid, gid); err != nil {
+				return err
+			}
+		}
+		if err := utils.DropPrivileges(uid, gid); err != nil {
+			return err
+		}
+	}
+
+	// The POSTGRES_* variables of the official image take the place of the connection flags
+	if !cmd.Flags().Changed("username") && os.Getenv("PG_USER") == "" {
+		postgres.Username = env.User
+	}
+	if postgres.Password.IsEmpty() {
+		postgres.Password = env.Password
+	}
+	if env.HostAuthMethod != "" && !cmd.Flags().Changed("auth-method") {
+		authMethod = env.HostAuthMethod
+	}
+
+	initScriptsDir, _ := cmd.Flags().GetString("init-scripts-dir")
+	if err := postgres.SetupDockerCluster(env, initScriptsDir); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	if err := runAutoStart(cmd, nil); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(os.Getenv("UPGRADE_ONLY"), "true") {
+		clicky.Infof("UPGRADE_ONLY is set, exiting without starting PostgreSQL")
+		return nil
+	}
+
+	if supervise, _ := cmd.Flags().GetBool("supervise"); supervise {
+		runOpts, err := runOptionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		runOpts.Args = argv[1:]
+		return postgres.RunWithOptions(runOpts)
+	}
+
+	argv[0] = filepath.Join(postgres.BinDir, "postgres")
+	return execCommand(argv)
+}
+
+// execCommand replaces postgres-cli with argv, so that the server receives the container's signals directly
+func execCommand(argv []string) error {
+	path, err := osexec.LookPath(argv[0])
+	if err != nil {
+		return fmt.Errorf("command %s not found: %w", argv[0], err)
+	}
+	if postgres.DryRun {
+		clicky.Infof("[DRYRUN] exec %s", strings.Join(argv, " "))
+		return nil
+	}
+
+	env := os.Environ()
+	if postgres.DataDir != "" {
+		env = append(env, "PGDATA="+postgres.DataDir)
+	}
+	clicky.Infof("🚀 Starting %s", strings.Join(argv, " "))
+	return syscall.Exec(path, argv, env)
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/flanksource/clicky"
 	"github.com/samber/lo"
@@ -52,6 +53,34 @@ func getPostgresPassword() utils.SensitiveString {
 	return utils.NewSensitiveString("")
 }
 
+// connectionFlags maps the connection flags to the libpq parameters they override
+var connectionFlags = map[string]string{
+	"host":     "host",
+	"port":     "port",
+	"username": "user",
+	"password": "password",
+	"database": "dbname",
+}
+
+// applyConnection resolves --dsn, the pg_service.conf service it names or PGSERVICE and the PG* environment
+// variables into postgres. Connection flags that are given explicitly take precedence, the defaults of the
+// others are only used for the parameters that are not set anywhere.
+func applyConnection(cmd *cobra.Command) error {
+	dsn, _ := cmd.Flags().GetString("dsn")
+	params, err := server.ResolveConnectionParams(dsn)
+	if err != nil {
+		return fmt.Errorf("invalid connection settings: %w", err)
+	}
+	// lib/pq panics on PGSERVICE and friends, they are removed once here instead of around every connection
+	server.HideUnsupportedEnv()
+	for flag, param := range connectionFlags {
+		if cmd.Flags().Changed(flag) {
+			delete(params, param)
+		}
+	}
+	return postgres.ApplyConnectionParams(params)
+}
+
 func main() {
 	clicky.Infof("%s", GetVersionInfo())
 
@@ -77,6 +106,10 @@ This unified tool combines PostgreSQL server management, configuration generatio
 				postgres.Config = config.DefaultPostgresConf()
 			}
 
+			if err := applyConnection(cmd); err != nil {
+				return err
+			}
+
 			password, _ := cmd.Flags().GetString("password")
 			if password != "" {
 				postgres.Password = utils.NewSensitiveString(password)
@@ -85,6 +118,9 @@ This unified tool combines PostgreSQL server management, configuration generatio
 			if postgres.Password.IsEmpty() {
 				postgres.Password = getPostgresPassword()
 			}
+			if err := postgres.LoadPgpass(); err != nil {
+				return err
+			}
 			if err := postgres.Validate(); err != nil {
 				return err
 			}
@@ -102,6 +138,7 @@ This unified tool combines PostgreSQL server management, configuration generatio
 	rootCmd.PersistentFlags().StringVarP(&postgres.Database, "database", "d", lo.CoalesceOrEmpty(os.Getenv("PG_DATABASE"), "postgres"), "PostgreSQL database name")
 	rootCmd.PersistentFlags().StringVarP(&postgres.Host, "host", "", lo.CoalesceOrEmpty(os.Getenv("PG_HOST"), "localhost"), "PostgreSQL host")
 	rootCmd.PersistentFlags().IntVarP(&postgres.Port, "port", "p", lo.CoalesceOrEmpty(getIntVar("PG_PORT"), 5432), "PostgreSQL port")
+	rootCmd.PersistentFlags().String("dsn", "", "Connection string, as a postgres:// URI or libpq key=value pairs, e.g. 'service=prod sslmode=verify-full'")
 	rootCmd.PersistentFlags().StringVar(&postgres.DataDir, "data-dir", os.Getenv("PGDATA"), "PostgreSQL data directory (auto-detected if not specified)")
 	rootCmd.PersistentFlags().StringVar(&postgres.BinDir, "bin-dir", "", "PostgreSQL binary directory (auto-detected if not specified)")
 	rootCmd.PersistentFlags().BoolVar(&postgres.DryRun, "dry-run", false, "Enable dry-run mode to simulate actions without making changes")
@@ -115,6 +152,8 @@ This unified tool combines PostgreSQL server management, configuration generatio
 	rootCmd.AddCommand(
 		createServerCommands(),
 		createAutoStartCommand(),
+		createEntrypointCommand(),
+		createRunCommand(),
 		createVersionCommand(),
 	)
 
@@ -137,18 +176,28 @@ This command can automatically:
 - Upgrade PostgreSQL to a target version if needed
 - Optimize configuration using pg_tune
 - Reset the superuser password
+- Reconcile the roles and databases declared in --pgconfig
+- Archive the WAL with WAL-G when walg.enabled is set in --pgconfig
 
 Examples:
   postgres-cli auto-start                           Start PostgreSQL normally
   postgres-cli auto-start --auto-init               Initialize and start if needed
   postgres-cli auto-start --pg-tune                 Optimize config before starting
   postgres-cli auto-start --auto-upgrade            Upgrade if needed, then start
+  postgres-cli auto-start --auto-upgrade --link     Upgrade using hard links, then start
+  postgres-cli auto-start --auto-upgrade --stepwise Upgrade one installed major at a time, then start
   postgres-cli auto-start --auto-reset-password     Reset password, then start
   postgres-cli auto-start --auto-init --pg-tune     Initialize, optimize, then start
+  postgres-cli auto-start --pgconfig pgconfig.yaml  Create or update the declared roles and databases, then start
   postgres-cli auto-start --dry-run                 Validate permissions without starting`,
 		RunE: runAutoStart,
 	}
+	addAutoStartFlags(cmd)
+	return cmd
+}
 
+// addAutoStartFlags registers the flags of the tasks auto-start runs before PostgreSQL is started
+func addAutoStartFlags(cmd *cobra.Command) {
 	cmd.Flags().IntVar(&opts.MaxConnections, "max-connections", getIntVar("PG_TUNE_MAX_CONNECTIONS"), "Max connections for pg_tune (0 = auto-calculate)")
 	cmd.Flags().IntVar(&opts.MemoryMB, "memory", getIntVar("PG_TUNE_MEMORY"), "Override detected memory in MB for pg_tune")
 	cmd.Flags().IntVar(&opts.Cores, "cpus", getIntVar("PG_TUNE_CPUS"), "Override detected CPU count for pg_tune")
@@ -158,9 +207,10 @@ Examples:
 	cmd.Flags().Bool("auto-upgrade", true, "Automatically upgrade PostgreSQL if version mismatch detected")
 	cmd.Flags().Bool("auto-reset-password", false, "Reset postgres superuser password on start")
 	cmd.Flags().Bool("auto-init", true, "Automatically initialize database if data directory doesn't exist")
-	cmd.Flags().Int("upgrade-to", 0, "Target PostgreSQL version for upgrade (default: auto-detect latest)")
-
-	return cmd
+	cmd.Flags().Int("upgrade-to", 0, "Target PostgreSQL version for upgrade (default: latest installed)")
+	cmd.Flags().String("pgconfig", os.Getenv("PG_CONFIG_FILE"), "YAML configuration whose roles: and databases: are reconciled on every start")
+	cmd.Flags().Int("backup-warn-percent", 20, "Warn when upgrade snapshots and leftovers use more than this share of the data volume (0 = never)")
+	addUpgradeFlags(cmd)
 }
 
 // runAutoStart handles the auto-start command execution
@@ -169,6 +219,7 @@ func runAutoStart(cmd *cobra.Command, args []string) error {
 	autoUpgrade, _ := cmd.Flags().GetBool("auto-upgrade")
 	autoResetPassword, _ := cmd.Flags().GetBool("auto-reset-password")
 	upgradeTo, _ := cmd.Flags().GetInt("upgrade-to")
+	pgconfigFile, _ := cmd.Flags().GetString("pgconfig")
 
 	// Log current user context
 	uid, gid, username, err := utils.GetCurrentUserInfo()
@@ -194,6 +245,18 @@ func runAutoStart(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	var pgconfig *pkg.PgconfigSchemaJson
+	if pgconfigFile != "" {
+		if pgconfig, err = pkg.LoadConfig(pgconfigFile); err != nil {
+			return fmt.Errorf("failed to load %s: %w", pgconfigFile, err)
+		}
+	}
+
+	// Resume or roll back an upgrade that was interrupted, before anything inspects the data directory
+	if err := postgres.RecoverUpgrade(); err != nil {
+		return fmt.Errorf("failed to recover interrupted upgrade: %w", err)
+	}
+
 	// Step 1: Auto-init if data directory doesn't exist
 	if !postgres.Exists() {
 		if autoInit {
@@ -216,19 +279,31 @@ func runAutoStart(cmd *cobra.Command, args []string) error {
 
 		targetVersion := upgradeTo
 		if targetVersion == 0 {
-			// Auto-detect latest available version (default to 17)
-			targetVersion = 17
+			// Auto-detect the latest installed version
+			if targetVersion, err = server.LatestInstalledVersion(); err != nil {
+				return fmt.Errorf("failed to detect target PostgreSQL version: %w", err)
+			}
 		}
 
 		if currentVersion < targetVersion {
-			if err := postgres.Upgrade(targetVersion); err != nil {
+			upgradeOpts := upgradeOptionsFromFlags(cmd)
+			if err := postgres.UpgradeWithOptions(targetVersion, upgradeOpts); err != nil {
 				return fmt.Errorf("failed to upgrade PostgreSQL: %w", err)
 			}
+			if upgradeOpts.PostUpgrade && !postgres.DryRun {
+				postUpgradeAnalyzeHint()
+			}
 		} else {
 			fmt.Printf("✅ PostgreSQL is already at version %d (target: %d)\n", currentVersion, targetVersion)
 		}
 	}
 
+	if warnPercent, _ := cmd.Flags().GetInt("backup-warn-percent"); warnPercent > 0 && !postgres.DryRun {
+		if _, err := postgres.WarnUpgradeArtifactUsage(warnPercent); err != nil {
+			clicky.Warnf("⚠️  Failed to check the size of upgrade snapshots: %v", err)
+		}
+	}
+
 	// Step 3: Run pg_tune if requested
 	if opts.Enabled {
 
@@ -256,6 +331,15 @@ func runAutoStart(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Archive the WAL with WAL-G, or stop archiving when it is no longer enabled
+	var walg *pkg.WalgConf
+	if pgconfig != nil {
+		walg = pgconfig.Walg
+	}
+	if err := postgres.ConfigureWalgArchive(walg); err != nil {
+		return fmt.Errorf("failed to configure WAL-G archiving: %w", err)
+	}
+
 	// Step 4: Reset password if requested
 	if autoResetPassword {
 
@@ -270,12 +354,25 @@ func runAutoStart(cmd *cobra.Command, args []string) error {
 
 	}
 
-	if createDb != "" {
-
-		if err := postgres.CreateDatabase(createDb); err != nil {
-			//FIXME
-			fmt.Printf("❌ Failed to create database '%s': %v\n", createDb, err)
-			// return fmt.Errorf("failed to create database '%s': %w", createDb, err)
+	// The databases and roles are created on a single temporary server
+	if createDb != "" || pgconfig != nil {
+		if err := postgres.WithTemporaryServer(func() error {
+			if createDb != "" {
+				if err := postgres.CreateDatabase(createDb); err != nil {
+					return fmt.Errorf("failed to create database '%s': %w", createDb, err)
+				}
+			}
+			if pgconfig != nil {
+				if err := postgres.ReconcileRoles(pgconfig.Roles); err != nil {
+					return fmt.Errorf("failed to reconcile roles: %w", err)
+				}
+				if err := postgres.ReconcileDatabases(pgconfig.Databases); err != nil {
+					return fmt.Errorf("failed to reconcile databases: %w", err)
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
 
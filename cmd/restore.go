@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg/server"
+)
+
+// createRestoreCommand creates the restore command
+func createRestoreCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore PATH [DATABASE...]",
+		Short: "Restore a backup with pg_restore",
+		Long: `Restore the given databases, or all of them, from a backup directory created by the backup command, or a
+single pg_dump archive in the custom or directory format
+
+The roles and tablespaces in globals.sql are restored first, except for the connected role which keeps its
+password, then each database is restored into a database with the same name, or --target, which is created when
+it does not exist. The restore stops at the first error and fails before starting when the server or pg_restore is
+older than the server or pg_dump the backup was taken with. Restored databases are analyzed, and a summary with
+the number of tables, size and duration of each database is printed.
+
+Examples:
+  postgres-cli server restore backups/20250102T030405Z
+  postgres-cli server restore backups/20250102T030405Z orders --target orders_drill --jobs 4
+  postgres-cli server restore backups/20250102T030405Z --create --clean
+  postgres-cli server restore orders.dump --target orders --schema sales --table invoices --no-owner`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := server.DefaultRestoreOptions()
+			opts.Databases = args[1:]
+			opts.Target, _ = cmd.Flags().GetString("target")
+			opts.Clean, _ = cmd.Flags().GetBool("clean")
+			opts.Create, _ = cmd.Flags().GetBool("create")
+			opts.Jobs, _ = cmd.Flags().GetInt("jobs")
+			opts.Schemas, _ = cmd.Flags().GetStringArray("schema")
+			opts.Tables, _ = cmd.Flags().GetStringArray("table")
+			opts.Globals, _ = cmd.Flags().GetBool("globals")
+			opts.NoOwner, _ = cmd.Flags().GetBool("no-owner")
+			opts.Analyze, _ = cmd.Flags().GetBool("analyze")
+
+			summary, err := postgres.RestoreWithOptions(args[0], opts)
+			if err != nil {
+				return fmt.Errorf("restore failed: %w", err)
+			}
+			if postgres.DryRun {
+				return nil
+			}
+			clicky.MustPrint(summary)
+			return nil
+		},
+	}
+	defaults := server.DefaultRestoreOptions()
+	cmd.Flags().String("target", "", "Database to restore into, when restoring a single database (default: its original name)")
+	cmd.Flags().Bool("clean", false, "Drop the objects before recreating them, or the whole database with --create")
+	cmd.Flags().Bool("create", false, "Create the database with its original name, owner, encoding and locale")
+	cmd.Flags().IntP("jobs", "j", defaults.Jobs, "Tables restored in parallel")
+	cmd.Flags().StringArrayP("schema", "n", nil, "Only restore this schema (repeatable)")
+	cmd.Flags().StringArrayP("table", "t", nil, "Only restore this table (repeatable)")
+	cmd.Flags().Bool("globals", defaults.Globals, "Restore the roles and tablespaces of the backup first")
+	cmd.Flags().Bool("no-owner", false, "Do not restore the ownership of objects")
+	cmd.Flags().Bool("analyze", defaults.Analyze, "Run ANALYZE on the restored databases")
+	return cmd
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg"
+)
+
+// createRoleCommand creates the role command group
+func createRoleCommand() *cobra.Command {
+	roleCmd := &cobra.Command{
+		Use:   "role",
+		Short: "Manage PostgreSQL roles",
+		Long: `Create, change, drop and list roles and their memberships
+
+Roles can also be declared in the roles: section of the YAML passed to auto-start --pgconfig, where they
+are reconciled on every start.`,
+	}
+	roleCmd.AddCommand(
+		createRoleListCommand(),
+		createRoleCreateCommand(),
+		createRoleAlterCommand(),
+		createRoleDropCommand(),
+		createRoleMembershipCommand("grant", "Make MEMBER a member of ROLE", postgres.GrantRole),
+		createRoleMembershipCommand("revoke", "Remove MEMBER from ROLE", postgres.RevokeRole),
+	)
+	return roleCmd
+}
+
+func createRoleListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List roles, without the predefined pg_* roles",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			roles, err := postgres.ListRoles()
+			if err != nil {
+				return fmt.Errorf("failed to list roles: %w", err)
+			}
+			clicky.MustPrint(roles)
+			return nil
+		},
+	}
+}
+
+func createRoleCreateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a role, with LOGIN unless --login=false",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := postgres.CreateRole(roleFromFlags(cmd, args[0])); err != nil {
+				return fmt.Errorf("failed to create role %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Role %s created", args[0])
+			return nil
+		},
+	}
+	addRoleFlags(cmd)
+	return cmd
+}
+
+func createRoleAlterCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alter NAME",
+		Short: "Change the attributes of a role that are given as flags",
+		Long: `Change the attributes of a role that are given as flags, the others are left unchanged
+
+With --member-of the role is made a member of exactly the listed roles, other memberships are revoked.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := postgres.AlterRole(roleFromFlags(cmd, args[0])); err != nil {
+				return fmt.Errorf("failed to alter role %s: %w", args[0], err)
+			}
+			return nil
+		},
+	}
+	addRoleFlags(cmd)
+	return cmd
+}
+
+func createRoleDropCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "drop NAME",
+		Short: "Drop a role",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ifExists, _ := cmd.Flags().GetBool("if-exists")
+			if err := postgres.DropRole(args[0], ifExists); err != nil {
+				return fmt.Errorf("failed to drop role %s: %w", args[0], err)
+			}
+			clicky.Infof("✅ Role %s dropped", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().Bool("if-exists", false, "Do not fail if the role does not exist")
+	return cmd
+}
+
+func createRoleMembershipCommand(use, short string, fn func(role, member string) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " ROLE MEMBER",
+		Short: short,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := fn(args[0], args[1]); err != nil {
+				return fmt.Errorf("failed to %s %s: %w", use, args[0], err)
+			}
+			return nil
+		},
+	}
+}
+
+// addRoleFlags registers the role attributes, only the flags that are given are applied
+func addRoleFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("login", true, "Allow the role to log in")
+	cmd.Flags().Bool("superuser", false, "Make the role a superuser")
+	cmd.Flags().Bool("createdb", false, "Allow the role to create databases")
+	cmd.Flags().Bool("createrole", false, "Allow the role to create roles")
+	cmd.Flags().Bool("inherit", true, "Inherit the privileges of the roles it is a member of")
+	cmd.Flags().Bool("replication", false, "Allow the role to initiate streaming replication")
+	cmd.Flags().Int("connection-limit", -1, "Maximum concurrent connections (-1 = no limit)")
+	cmd.Flags().String("valid-until", "", "Timestamp after which the password is no longer valid, or infinity")
+	cmd.Flags().StringSlice("member-of", nil, "Roles this role is a member of")
+	cmd.Flags().String("password-env", "", "Environment variable with the password, <NAME>_FILE is read as a file")
+	cmd.Flags().String("password-file", "", "File with the password")
+	cmd.MarkFlagsMutuallyExclusive("password-env", "password-file")
+}
+
+func roleFromFlags(cmd *cobra.Command, name string) pkg.RoleConf {
+	role := pkg.RoleConf{Name: name}
+	flags := map[string]**bool{
+		"login":       &role.Login,
+		"superuser":   &role.Superuser,
+		"createdb":    &role.CreateDB,
+		"createrole":  &role.CreateRole,
+		"inherit":     &role.Inherit,
+		"replication": &role.Replication,
+	}
+	for flag, attribute := range flags {
+		if cmd.Flags().Changed(flag) {
+			value, _ := cmd.Flags().GetBool(flag)
+			*attribute = &value
+		}
+	}
+	if cmd.Flags().Changed("connection-limit") {
+		limit, _ := cmd.Flags().GetInt("connection-limit")
+		role.ConnectionLimit = &limit
+	}
+	if cmd.Flags().Changed("member-of") {
+		role.MemberOf, _ = cmd.Flags().GetStringSlice("member-of")
+		if role.MemberOf == nil {
+			role.MemberOf = []string{}
+		}
+	}
+	role.ValidUntil, _ = cmd.Flags().GetString("valid-until")
+	role.PasswordEnv, _ = cmd.Flags().GetString("password-env")
+	role.PasswordFile, _ = cmd.Flags().GetString("password-file")
+	return role
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flanksource/postgres/pkg/server"
+	"github.com/flanksource/postgres/pkg/supervisor"
+)
+
+// createRunCommand creates the command that runs PostgreSQL in the foreground under supervision
+func createRunCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "run [-- postgres args...]",
+		SilenceUsage: true,
+		Short:        "Run PostgreSQL in the foreground, supervised by postgres-cli",
+		Long: `Run the postmaster as a child of postgres-cli, which stays in the foreground (e.g. as the PID 1 of a container).
+
+- SIGTERM stops PostgreSQL with the --shutdown-mode, SIGINT with a fast and SIGQUIT with an immediate shutdown
+- A shutdown that takes longer than --shutdown-timeout is escalated to immediate, then the server is killed
+- SIGHUP reloads the configuration
+- Crashes are restarted according to --restart with an exponential backoff
+- The server log is streamed to stdout, logging_collector is turned off unless --logging-collector is set
+- Orphaned processes are reaped when running as PID 1
+- With --pgbouncer and --postgrest, PgBouncer and PostgREST are started once PostgreSQL accepts connections
+  and stopped before it, using pgbouncer.ini and postgrest.conf from --services-dir (generated if missing)
+- With --health-port, the health server serves the health checks and takes the scheduled backups until
+  the processes are stopped
+
+Examples:
+  postgres-cli run                                   Run until stopped with a fast shutdown
+  postgres-cli run --shutdown-mode smart             Wait for clients to disconnect on SIGTERM
+  postgres-cli run -- -c shared_buffers=1GB          Pass settings to postgres
+  postgres-cli run --pgbouncer --log-dir /var/log    Run PgBouncer in front of PostgreSQL, logging to files
+  postgres-cli run --health-port 8080                Serve the health checks on port 8080`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := runOptionsFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			opts.Args = args
+			return postgres.RunWithOptions(opts)
+		},
+	}
+	addRunFlags(cmd)
+	return cmd
+}
+
+// addRunFlags registers the flags controlling how a supervised PostgreSQL is stopped and restarted
+func addRunFlags(cmd *cobra.Command) {
+	defaults := server.DefaultRunOptions()
+	cmd.Flags().String("shutdown-mode", string(defaults.Shutdown.Mode), "Shutdown mode on SIGTERM: smart, fast or immediate")
+	cmd.Flags().Duration("shutdown-timeout", defaults.Shutdown.Timeout, "Escalate to an immediate shutdown after this long, then kill the server (0 = wait forever)")
+	cmd.Flags().String("restart", string(defaults.Restart), "Restart PostgreSQL when it exits: always, on-failure or never")
+	cmd.Flags().Int("max-restarts", defaults.MaxRestarts, "Give up after this many consecutive crashes (0 = unlimited)")
+	cmd.Flags().Duration("restart-backoff", defaults.Backoff, "Delay before the first restart, doubled after each consecutive crash")
+	cmd.Flags().Duration("max-restart-backoff", defaults.MaxBackoff, "Maximum delay between restarts")
+	cmd.Flags().Bool("logging-collector", false, "Keep logging_collector from postgresql.conf instead of streaming the server log to stdout")
+	cmd.Flags().Bool("pgbouncer", os.Getenv("PGBOUNCER_ENABLED") == "true", "Run PgBouncer once PostgreSQL is ready (default $PGBOUNCER_ENABLED)")
+	cmd.Flags().Bool("postgrest", os.Getenv("POSTGREST_ENABLED") == "true", "Run PostgREST once PostgreSQL is ready (default $POSTGREST_ENABLED)")
+	cmd.Flags().String("services-dir", "", "Directory with pgbouncer.ini and postgrest.conf (default: parent of the data directory)")
+	cmd.Flags().String("log-dir", "", "Also write the output of every service to <log-dir>/<service>.log")
+	cmd.Flags().Duration("archive-check-timeout", defaults.ArchiveCheckTimeout, "Once PostgreSQL is ready, wait this long for a WAL segment to be archived by WAL-G (0 = do not check)")
+	cmd.Flags().Int("health-port", defaultHealthPort(), "Serve the health checks and take the scheduled backups on this port (0 = disabled, default $HEALTH_PORT when $HEALTH_SERVICE_ENABLED)")
+}
+
+// defaultHealthPort is $HEALTH_PORT (8080) when $HEALTH_SERVICE_ENABLED is true, otherwise the health server is disabled
+func defaultHealthPort() int {
+	if os.Getenv("HEALTH_SERVICE_ENABLED") != "true" {
+		return 0
+	}
+	if port, err := strconv.Atoi(os.Getenv("HEALTH_PORT")); err == nil {
+		return port
+	}
+	return 8080
+}
+
+func runOptionsFromFlags(cmd *cobra.Command) (server.RunOptions, error) {
+	opts := server.DefaultRunOptions()
+	mode, _ := cmd.Flags().GetString("shutdown-mode")
+	opts.Shutdown.Mode = server.ShutdownMode(mode)
+	opts.Shutdown.Timeout, _ = cmd.Flags().GetDuration("shutdown-timeout")
+	restart, _ := cmd.Flags().GetString("restart")
+	opts.Restart = supervisor.RestartPolicy(restart)
+	opts.MaxRestarts, _ = cmd.Flags().GetInt("max-restarts")
+	opts.Backoff, _ = cmd.Flags().GetDuration("restart-backoff")
+	opts.MaxBackoff, _ = cmd.Flags().GetDuration("max-restart-backoff")
+	opts.MaxBackoff = max(opts.MaxBackoff, opts.Backoff)
+	opts.LoggingCollector, _ = cmd.Flags().GetBool("logging-collector")
+	opts.LogDir, _ = cmd.Flags().GetString("log-dir")
+	opts.ArchiveCheckTimeout, _ = cmd.Flags().GetDuration("archive-check-timeout")
+	if port, _ := cmd.Flags().GetInt("health-port"); port > 0 {
+		opts.HealthServer = server.NewHealthServer(port, postgres.DataDir)
+	}
+
+	var services server.ServiceOptions
+	services.PgBouncer, _ = cmd.Flags().GetBool("pgbouncer")
+	services.PostgREST, _ = cmd.Flags().GetBool("postgrest")
+	services.ConfigDir, _ = cmd.Flags().GetString("services-dir")
+	var err error
+	if opts.Services, err = postgres.Services(services); err != nil {
+		return opts, fmt.Errorf("failed to configure services: %w", err)
+	}
+	return opts, nil
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg/server"
 )
 
 // createServerCommands creates the server command group
@@ -22,32 +26,63 @@ func createServerCommands() *cobra.Command {
 		createHealthCommand(),
 		createInitDBCommand(),
 		createResetPasswordCommand(),
+		createRoleCommand(),
+		createDatabaseCommand(),
 		createUpgradeCommand(),
 		createBackupCommand(),
+		createRestoreCommand(),
 		createSQLCommand(),
 		createStatusCommand(),
 		createStartCommand(),
 		createStopCommand(),
 		createRestartCommand(),
+		createAnalyzeUpgradeCommand(),
 	)
 
 	return serverCmd
 }
 
 func createStopCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "stop",
 		Short: "Stop PostgreSQL server",
-		Long:  "Stop the PostgreSQL server gracefully",
-		RunE: func(cmd *cobra.Command, args []string) error {
+		Long: `Stop the PostgreSQL server gracefully
 
-			if err := postgres.Stop(); err != nil {
+- A CHECKPOINT is run first, so that the shutdown checkpoint has little left to write
+- A smart shutdown refuses new connections and gives active queries --drain to finish, then idle
+  sessions are terminated with pg_terminate_backend
+- A shutdown mode that does not stop the server within --timeout is escalated: smart → fast → immediate`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := postgres.StopWithOptions(stopOptionsFromFlags(cmd)); err != nil {
 				return fmt.Errorf("failed to stop PostgreSQL: %w", err)
 			}
 			fmt.Println("PostgreSQL server stopped successfully")
 			return nil
 		},
 	}
+	addStopFlags(cmd)
+	return cmd
+}
+
+// addStopFlags registers the flags controlling how the server is drained and stopped
+func addStopFlags(cmd *cobra.Command) {
+	defaults := server.DefaultStopOptions()
+	cmd.Flags().String("mode", string(defaults.Mode), "Initial shutdown mode: smart, fast or immediate")
+	cmd.Flags().Duration("timeout", defaults.StageTimeout, "Escalate to the next shutdown mode after this long (0 = wait forever)")
+	cmd.Flags().Duration("drain", defaults.DrainPeriod, "Time given to active queries once new connections are refused (smart mode)")
+	cmd.Flags().Bool("checkpoint", defaults.Checkpoint, "Run a CHECKPOINT before shutting down")
+	cmd.Flags().Bool("terminate-idle", defaults.TerminateIdle, "Terminate idle sessions after the drain period (smart mode)")
+}
+
+func stopOptionsFromFlags(cmd *cobra.Command) server.StopOptions {
+	opts := server.DefaultStopOptions()
+	mode, _ := cmd.Flags().GetString("mode")
+	opts.Mode = server.ShutdownMode(mode)
+	opts.StageTimeout, _ = cmd.Flags().GetDuration("timeout")
+	opts.DrainPeriod, _ = cmd.Flags().GetDuration("drain")
+	opts.Checkpoint, _ = cmd.Flags().GetBool("checkpoint")
+	opts.TerminateIdle, _ = cmd.Flags().GetBool("terminate-idle")
+	return opts
 }
 
 func createStartCommand() *cobra.Command {
@@ -67,13 +102,12 @@ func createStartCommand() *cobra.Command {
 }
 
 func createRestartCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "restart",
 		Short: "Restart PostgreSQL server",
-		Long:  "Restart the PostgreSQL server gracefully",
+		Long:  "Restart the PostgreSQL server gracefully, stopping it like the stop command",
 		RunE: func(cmd *cobra.Command, args []string) error {
-
-			if err := postgres.Stop(); err != nil {
+			if err := postgres.StopWithOptions(stopOptionsFromFlags(cmd)); err != nil {
 				fmt.Println("Failed to stop postgres " + err.Error())
 			}
 			if err := postgres.Start(); err != nil {
@@ -83,6 +117,8 @@ func createRestartCommand() *cobra.Command {
 			return nil
 		},
 	}
+	addStopFlags(cmd)
+	return cmd
 }
 
 // createHealthCommand creates the health command
@@ -124,7 +160,10 @@ func createResetPasswordCommand() *cobra.Command {
 	resetPasswordCmd := &cobra.Command{
 		Use:   "reset-password",
 		Short: "Reset PostgreSQL password",
-		Long:  "Reset the PostgreSQL superuser password",
+		Long: `Reset the password of --username to --password
+
+A stopped server is not started, the password is set in single-user mode (postgres --single), which works
+without the current credentials. Only a SCRAM-SHA-256 verifier of the password is sent to the server.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if postgres.Password.IsEmpty() {
 				return fmt.Errorf("password is required")
@@ -145,40 +184,176 @@ func createUpgradeCommand() *cobra.Command {
 	upgradeCmd := &cobra.Command{
 		Use:   "upgrade",
 		Short: "Upgrade PostgreSQL to target version",
-		Long:  "Upgrade PostgreSQL data directory to the specified target version",
+		Long: `Upgrade PostgreSQL data directory to the specified target version
+
+The upgrade path is planned from the PostgreSQL installations found on this host. By default
+pg_upgrade jumps directly to the target (the latest installed version if --target-version is not
+given), with --stepwise every installed major version in between is visited.
+
+With --strategy=logical, PostgreSQL keeps serving while the new cluster is initialized on
+--replication-port, given the schema and filled through logical replication. Once replication has
+caught up the old cluster is made read-only, sequences are copied and the data directories are swapped.
+Progress is shown by server status.
+
+With --check, nothing is changed: the current cluster is started and inspected for extensions missing
+from the target version, reg* columns, unknown settings, missing locales, prepared transactions and
+replication slots. Findings are printed as a table (or --format json) and the command fails if any
+finding would make the upgrade fail.
+
+With --rollback, the pre-upgrade snapshots in backups/data-N are listed and validated, the newest
+one older than the current version (or --target-version) is swapped back into the data directory
+and the old version is started. Rollback is refused if WAL was written after the upgrade unless --force is given.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			targetVersion, _ := cmd.Flags().GetInt("target-version")
-			if targetVersion == 0 {
-				return fmt.Errorf("target-version is required")
+			rollback, _ := cmd.Flags().GetBool("rollback")
+			force, _ := cmd.Flags().GetBool("force")
+			check, _ := cmd.Flags().GetBool("check")
+
+			if check {
+				report, err := postgres.CheckUpgrade(targetVersion)
+				if err != nil {
+					return fmt.Errorf("upgrade check failed: %w", err)
+				}
+				// The report is printed even without findings, so that --format json always writes a document
+				clicky.MustPrint(report)
+				if len(report.Findings) == 0 {
+					clicky.Infof("✅ No incompatibilities found upgrading PostgreSQL %d to %d", report.FromVersion, report.ToVersion)
+					return nil
+				}
+				if report.HasErrors() {
+					return fmt.Errorf("upgrade from %d to %d is blocked by incompatibilities", report.FromVersion, report.ToVersion)
+				}
+				return nil
+			}
+
+			if rollback {
+				if err := postgres.Rollback(server.RollbackOptions{Version: targetVersion, Force: force}); err != nil {
+					return fmt.Errorf("failed to roll back: %w", err)
+				}
+				fmt.Println("PostgreSQL rolled back successfully")
+				return nil
 			}
 
-			if err := postgres.Upgrade(targetVersion); err != nil {
+			opts := upgradeOptionsFromFlags(cmd)
+			if err := postgres.UpgradeWithOptions(targetVersion, opts); err != nil {
 				return fmt.Errorf("failed to upgrade: %w", err)
 			}
-			fmt.Printf("PostgreSQL upgraded to version %d successfully\n", targetVersion)
+			fmt.Println("PostgreSQL upgraded successfully")
+			if opts.PostUpgrade && !postgres.DryRun {
+				postUpgradeAnalyzeHint()
+			}
 			return nil
 		},
 	}
-	upgradeCmd.Flags().IntP("target-version", "t", 0, "Target PostgreSQL version (required)")
-	upgradeCmd.MarkFlagRequired("target-version")
+	upgradeCmd.Flags().IntP("target-version", "t", 0, "Target PostgreSQL version (default: latest installed)")
+	upgradeCmd.Flags().Bool("check", false, "Only report incompatibilities with the target version, without upgrading")
+	upgradeCmd.Flags().Bool("rollback", false, "Roll back to a pre-upgrade snapshot in backups/data-N")
+	upgradeCmd.Flags().Bool("force", false, "Roll back even if WAL was written after the upgrade, discarding those changes")
+	addUpgradeFlags(upgradeCmd)
+	upgradeCmd.MarkFlagsMutuallyExclusive("check", "rollback")
+	upgradeCmd.AddCommand(createUpgradePruneCommand())
 	return upgradeCmd
 }
 
-// createBackupCommand creates the backup command
-func createBackupCommand() *cobra.Command {
-	return &cobra.Command{
-		Use:   "backup",
-		Short: "Create PostgreSQL backup",
-		Long:  "Create a backup of the PostgreSQL instance using pg_dump",
-		RunE: func(cmd *cobra.Command, args []string) error {
+// createUpgradePruneCommand creates the command that removes old pre-upgrade snapshots and leftovers
+func createUpgradePruneCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old pre-upgrade snapshots and leftover upgrade directories",
+		Long: `List the pre-upgrade snapshots in backups/data-N and the directories left in upgrades/ by failed
+upgrades, with their size and age, and remove the ones outside the retention policy.
 
-			if err := postgres.Backup(); err != nil {
-				return fmt.Errorf("backup failed: %w", err)
+Snapshots are kept newest version first up to --keep, and removed once older than --max-age. WAL and
+tablespace directories outside the data directory that only a removed snapshot uses are removed with it.
+Nothing is removed while an upgrade is in progress. Use --dry-run to only list what would be removed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy := retentionPolicyFromFlags(cmd, "keep", "max-age")
+			clicky.Infof("🧹 Pruning upgrade snapshots with %s", policy)
+			artifacts, err := postgres.PruneUpgradeArtifacts(policy)
+			if err != nil {
+				return fmt.Errorf("failed to prune: %w", err)
+			}
+			if len(artifacts) == 0 {
+				clicky.Infof("✅ No upgrade snapshots or leftovers found")
+				return nil
 			}
-			fmt.Println("Backup completed successfully")
+			clicky.MustPrint(artifacts)
 			return nil
 		},
 	}
+	cmd.Flags().Int("keep", 1, "Number of snapshots to keep, newest version first (0 = no limit, default from upgrade.backups.keep)")
+	cmd.Flags().Duration("max-age", 0, "Remove snapshots older than this (0 = no limit, default from upgrade.backups.max-age)")
+	return cmd
+}
+
+// retentionPolicyFromFlags overrides the retention properties with the flags that were given
+func retentionPolicyFromFlags(cmd *cobra.Command, keepFlag, maxAgeFlag string) server.RetentionPolicy {
+	policy := server.DefaultRetentionPolicy()
+	if cmd.Flags().Changed(keepFlag) {
+		policy.Keep, _ = cmd.Flags().GetInt(keepFlag)
+	}
+	if cmd.Flags().Changed(maxAgeFlag) {
+		policy.MaxAge, _ = cmd.Flags().GetDuration(maxAgeFlag)
+	}
+	return policy
+}
+
+// addUpgradeFlags registers the pg_upgrade transfer mode, parallelism and snapshot flags
+func addUpgradeFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("link", false, "Hard link data files instead of copying them (the old cluster is unusable once the new one starts)")
+	cmd.Flags().Bool("clone", false, "Clone data files using copy-on-write reflinks (requires filesystem support)")
+	cmd.Flags().Bool("copy", false, "Copy data files into the new cluster (default)")
+	cmd.MarkFlagsMutuallyExclusive("link", "clone", "copy")
+	cmd.Flags().Int("jobs", 0, "Number of parallel pg_upgrade jobs (0 = detected CPU count)")
+	cmd.Flags().String("backup-strategy", string(server.BackupStrategyCopy), "Pre-upgrade snapshot in backups/data-N: copy, clone or none")
+	cmd.Flags().Bool("stepwise", false, "Upgrade through every installed major version instead of jumping directly to the target")
+	cmd.Flags().Bool("post-upgrade", false, "Update extensions, report collation changes and regenerate statistics in the background after upgrading")
+	cmd.Flags().String("strategy", string(server.UpgradeStrategyPgUpgrade), "Upgrade strategy: pg_upgrade (offline) or logical (replicate while serving, short cutover)")
+	cmd.Flags().Int("replication-port", 0, "Port for the new cluster while it replicates with --strategy=logical (default port + 1)")
+	cmd.Flags().Int("keep-backups", 1, "Snapshots to keep after upgrading, older ones are pruned (0 = keep all, default from upgrade.backups.keep)")
+	cmd.Flags().Duration("backup-max-age", 0, "Prune snapshots older than this after upgrading (0 = no limit, default from upgrade.backups.max-age)")
+}
+
+func upgradeOptionsFromFlags(cmd *cobra.Command) server.UpgradeOptions {
+	opts := server.UpgradeOptions{}
+	if link, _ := cmd.Flags().GetBool("link"); link {
+		opts.Mode = server.UpgradeModeLink
+	} else if clone, _ := cmd.Flags().GetBool("clone"); clone {
+		opts.Mode = server.UpgradeModeClone
+	} else {
+		opts.Mode = server.UpgradeModeCopy
+	}
+	opts.Jobs, _ = cmd.Flags().GetInt("jobs")
+	backup, _ := cmd.Flags().GetString("backup-strategy")
+	opts.Backup = server.BackupStrategy(backup)
+	opts.Stepwise, _ = cmd.Flags().GetBool("stepwise")
+	opts.PostUpgrade, _ = cmd.Flags().GetBool("post-upgrade")
+	strategy, _ := cmd.Flags().GetString("strategy")
+	opts.Strategy = server.UpgradeStrategy(strategy)
+	opts.ReplicationPort, _ = cmd.Flags().GetInt("replication-port")
+	opts.Retention = retentionPolicyFromFlags(cmd, "keep-backups", "backup-max-age")
+	return opts
+}
+
+// postUpgradeAnalyzeHint tells where the planner statistics of an upgraded cluster are regenerated, a process
+// started here would be inherited by a postmaster exec'd afterwards, which treats its crash as a backend crash
+func postUpgradeAnalyzeHint() {
+	clicky.Infof("📊 Planner statistics are regenerated once PostgreSQL runs under postgres-cli run or entrypoint --supervise, otherwise run postgres-cli server analyze-upgrade")
+}
+
+// createAnalyzeUpgradeCommand creates the command that regenerates statistics after an upgrade
+func createAnalyzeUpgradeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "analyze-upgrade",
+		Short: "Regenerate planner statistics after an upgrade",
+		Long:  "Wait for PostgreSQL to accept connections, then run vacuumdb --all --analyze-in-stages if the last upgrade left it pending",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			timeout, _ := cmd.Flags().GetDuration("wait")
+			return postgres.RunPostUpgradeAnalyze(timeout)
+		},
+	}
+	cmd.Flags().Duration("wait", time.Hour, "How long to wait for PostgreSQL to accept connections")
+	return cmd
 }
 
 // createSQLCommand creates the sql command
@@ -186,7 +361,22 @@ func createSQLCommand() *cobra.Command {
 	sqlCmd := &cobra.Command{
 		Use:   "sql",
 		Short: "Execute SQL query",
-		Long:  "Execute a SQL query and return results",
+		Long: `Execute a SQL query or a script of several statements and stream the results
+
+Statements are run one at a time and stop at the first error, which makes the command exit non-zero. With
+--single-transaction the script is rolled back when a statement fails, otherwise the statements before it are
+committed. Rows are written as they are read, one result per statement that returns rows, in the --format
+table (default), json, csv, markdown or yaml.
+
+Variables given with --var name=value are referenced as :name and sent as bind parameters, so values are never
+interpolated into the SQL.
+
+Examples:
+  postgres-cli server sql -q "SELECT version()"
+  postgres-cli server sql -q "SELECT * FROM users WHERE email = :email" --var email=alice@example.com --format json
+  postgres-cli server sql -f migration.sql --single-transaction --timeout 5m
+  cat report.sql | postgres-cli server sql -f - --format csv > report.csv`,
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			query, _ := cmd.Flags().GetString("query")
 			file, _ := cmd.Flags().GetString("file")
@@ -194,6 +384,12 @@ func createSQLCommand() *cobra.Command {
 			var sqlQuery string
 			if query != "" {
 				sqlQuery = query
+			} else if file == "-" {
+				data, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return fmt.Errorf("failed to read SQL from stdin: %w", err)
+				}
+				sqlQuery = string(data)
 			} else if file != "" {
 				data, err := os.ReadFile(file)
 				if err != nil {
@@ -204,21 +400,53 @@ func createSQLCommand() *cobra.Command {
 				return fmt.Errorf("either --query or --file must be specified")
 			}
 
-			results, err := postgres.SQL(sqlQuery)
+			opts, err := sqlOptionsFromFlags(cmd)
 			if err != nil {
-				return fmt.Errorf("failed to execute SQL: %w", err)
+				return err
+			}
+			format, _ := cmd.Flags().GetString("format")
+			out, err := server.NewResultWriter(format, os.Stdout)
+			if err != nil {
+				return err
 			}
 
-			fmt.Println(clicky.MustFormat(results))
-
+			results, err := postgres.ExecScript(sqlQuery, opts, out)
+			for _, result := range results {
+				clicky.Infof("✅ line %d: %d rows (%s)", result.Line, result.Rows, result.Duration.Round(time.Millisecond))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to execute SQL: %w", err)
+			}
 			return nil
 		},
 	}
+	defaults := server.DefaultSQLOptions()
 	sqlCmd.Flags().StringP("query", "q", "", "SQL query to execute")
+	sqlCmd.Flags().StringP("file", "f", "", "File with the SQL statements to execute, - for stdin")
+	sqlCmd.MarkFlagsMutuallyExclusive("query", "file")
+	sqlCmd.Flags().StringArray("var", nil, "Variable referenced as :name, as name=value (repeatable)")
+	sqlCmd.Flags().Duration("timeout", defaults.Timeout, "Cancel a statement that runs for longer (0 = no timeout)")
+	sqlCmd.Flags().Bool("single-transaction", defaults.SingleTransaction, "Run all statements in one transaction, rolled back on error")
 
 	return sqlCmd
 }
 
+func sqlOptionsFromFlags(cmd *cobra.Command) (server.SQLOptions, error) {
+	opts := server.DefaultSQLOptions()
+	opts.Timeout, _ = cmd.Flags().GetDuration("timeout")
+	opts.SingleTransaction, _ = cmd.Flags().GetBool("single-transaction")
+	vars, _ := cmd.Flags().GetStringArray("var")
+	opts.Vars = map[string]string{}
+	for _, v := range vars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return opts, fmt.Errorf("invalid --var %q, expected name=value", v)
+		}
+		opts.Vars[name] = value
+	}
+	return opts, nil
+}
+
 // createStatusCommand creates the status command
 func createStatusCommand() *cobra.Command {
 	return &cobra.Command{
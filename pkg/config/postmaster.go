@@ -126,7 +126,7 @@ func EnsureIncludeDirective(postgresConfPath, includeFile string) error {
 
 	// Add the include directive
 	writer.WriteString("\n")
-	writer.WriteString("# Include pg_tune optimizations\n")
+	writer.WriteString(fmt.Sprintf("# Include %s, managed by postgres-cli\n", includeFile))
 	writer.WriteString(fmt.Sprintf("include_if_exists '%s'\n", includeFile))
 
 	if err := writer.Flush(); err != nil {
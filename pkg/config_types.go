@@ -78,13 +78,43 @@ type WalgConf struct {
 	NetworkRateLimitBps  *int    `json:"network_rate_limit_bps,omitempty" yaml:"network_rate_limit_bps,omitempty" jsonschema:"description=Network rate limit in bytes per second,minimum=0"`
 	BackupSchedule       string  `json:"backup_schedule,omitempty" yaml:"backup_schedule,omitempty" jsonschema:"description=Backup schedule in cron format"`
 	BackupRetainCount    int     `json:"backup_retain_count,omitempty" yaml:"backup_retain_count,omitempty" jsonschema:"description=Number of backups to retain,default=7,minimum=1"`
-	RetentionPolicy      *string `json:"retention_policy,omitempty" yaml:"retention_policy,omitempty" jsonschema:"description=Retention policy configuration"`
+	RetentionPolicy      *string `json:"retention_policy,omitempty" yaml:"retention_policy,omitempty" jsonschema:"description=Maximum age of the backups kept in addition to the newest backup_retain_count, e.g. 30d"`
 	PostgresqlDataDir    string  `json:"postgresql_data_dir,omitempty" yaml:"postgresql_data_dir,omitempty" jsonschema:"description=PostgreSQL data directory path,default=/var/lib/postgresql/data"`
 	PostgresqlPassword   *string `json:"postgresql_password,omitempty" yaml:"postgresql_password,omitempty" jsonschema:"description=PostgreSQL database password for WAL-G"`
 	StreamCreateCommand  *string `json:"stream_create_command,omitempty" yaml:"stream_create_command,omitempty" jsonschema:"description=Command to create streaming backup"`
 	StreamRestoreCommand *string `json:"stream_restore_command,omitempty" yaml:"stream_restore_command,omitempty" jsonschema:"description=Command to restore from streaming backup"`
 }
 
+// RoleConf represents a role reconciled on every auto-start, unset attributes are left unchanged
+type RoleConf struct {
+	Name            string   `json:"name" yaml:"name" jsonschema:"description=Role name,required"`
+	Login           *bool    `json:"login,omitempty" yaml:"login,omitempty" jsonschema:"description=Allow the role to log in,default=true"`
+	Superuser       *bool    `json:"superuser,omitempty" yaml:"superuser,omitempty" jsonschema:"description=Make the role a superuser,default=false"`
+	CreateDB        *bool    `json:"createdb,omitempty" yaml:"createdb,omitempty" jsonschema:"description=Allow the role to create databases,default=false"`
+	CreateRole      *bool    `json:"createrole,omitempty" yaml:"createrole,omitempty" jsonschema:"description=Allow the role to create roles,default=false"`
+	Inherit         *bool    `json:"inherit,omitempty" yaml:"inherit,omitempty" jsonschema:"description=Inherit the privileges of the roles it is a member of,default=true"`
+	Replication     *bool    `json:"replication,omitempty" yaml:"replication,omitempty" jsonschema:"description=Allow the role to initiate streaming replication,default=false"`
+	ConnectionLimit *int     `json:"connection_limit,omitempty" yaml:"connection_limit,omitempty" jsonschema:"description=Maximum concurrent connections (-1 = no limit),minimum=-1"`
+	ValidUntil      string   `json:"valid_until,omitempty" yaml:"valid_until,omitempty" jsonschema:"description=Timestamp after which the password is no longer valid or infinity"`
+	MemberOf        []string `json:"member_of,omitempty" yaml:"member_of,omitempty" jsonschema:"description=Roles this role is a member of, when set memberships that are not listed are revoked"`
+	PasswordEnv     string   `json:"password_env,omitempty" yaml:"password_env,omitempty" jsonschema:"description=Environment variable with the password, <NAME>_FILE is read as a file"`
+	PasswordFile    string   `json:"password_file,omitempty" yaml:"password_file,omitempty" jsonschema:"description=File with the password"`
+}
+
+// DatabaseConf represents a database reconciled on every auto-start, encoding, locale and template only apply
+// when the database is created
+type DatabaseConf struct {
+	Name            string `json:"name" yaml:"name" jsonschema:"description=Database name,required"`
+	Owner           string `json:"owner,omitempty" yaml:"owner,omitempty" jsonschema:"description=Role owning the database"`
+	Template        string `json:"template,omitempty" yaml:"template,omitempty" jsonschema:"description=Database to copy, template0 when encoding or locale are set,default=template1"`
+	Encoding        string `json:"encoding,omitempty" yaml:"encoding,omitempty" jsonschema:"description=Character set encoding,default=UTF8"`
+	Locale          string `json:"locale,omitempty" yaml:"locale,omitempty" jsonschema:"description=Collation and character classification (LC_COLLATE and LC_CTYPE)"`
+	LocaleProvider  string `json:"locale_provider,omitempty" yaml:"locale_provider,omitempty" jsonschema:"description=Locale provider,enum=libc,enum=icu,enum=builtin"`
+	IcuLocale       string `json:"icu_locale,omitempty" yaml:"icu_locale,omitempty" jsonschema:"description=ICU locale when locale_provider is icu"`
+	Tablespace      string `json:"tablespace,omitempty" yaml:"tablespace,omitempty" jsonschema:"description=Default tablespace"`
+	ConnectionLimit *int   `json:"connection_limit,omitempty" yaml:"connection_limit,omitempty" jsonschema:"description=Maximum concurrent connections (-1 = no limit),minimum=-1"`
+}
+
 // PgHBAEntry represents a pg_hba.conf rule element
 type PgHBAEntry struct {
 	Type     ConnectionType    `json:"type,omitempty" yaml:"type,omitempty"`
@@ -140,4 +170,6 @@ type PgconfigSchemaJson struct {
 	Postgrest *PostgrestConf `json:"postgrest,omitempty" yaml:"postgrest,omitempty"`
 	Walg      *WalgConf      `json:"walg,omitempty" yaml:"walg,omitempty"`
 	Pgaudit   *PGAuditConf   `json:"pgaudit,omitempty" yaml:"pgaudit,omitempty"`
+	Roles     []RoleConf     `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Databases []DatabaseConf `json:"databases,omitempty" yaml:"databases,omitempty"`
 }
@@ -204,7 +204,7 @@ func (g *PgBouncerConfigGenerator) generatePgBouncerSection() string {
 
 	// Connection settings
 	sb.WriteString(";; Connection Settings\n")
-	sb.WriteString(fmt.Sprintf("listen_address = %s\n", g.config.ListenAddress))
+	sb.WriteString(fmt.Sprintf("listen_addr = %s\n", g.config.ListenAddress))
 	sb.WriteString(fmt.Sprintf("listen_port = %d\n", g.config.ListenPort))
 	sb.WriteString("\n")
 
@@ -0,0 +1,36 @@
+package health
+
+import "fmt"
+
+// BackupScheduler interface defines the methods needed to monitor scheduled backups, implemented by
+// server.BackupScheduler
+type BackupScheduler interface {
+	Health() error
+}
+
+// BackupScheduleChecker reports whether the last scheduled backup succeeded
+type BackupScheduleChecker struct {
+	scheduler BackupScheduler
+}
+
+// NewBackupScheduleChecker creates a new scheduled backup health checker
+func NewBackupScheduleChecker(scheduler BackupScheduler) *BackupScheduleChecker {
+	return &BackupScheduleChecker{
+		scheduler: scheduler,
+	}
+}
+
+// Status implements the health.ICheckable interface
+func (c *BackupScheduleChecker) Status() (interface{}, error) {
+	if c.scheduler == nil {
+		return map[string]interface{}{
+			"status": "unknown",
+			"error":  "backup scheduler not configured",
+		}, fmt.Errorf("backup scheduler not configured")
+	}
+
+	if err := c.scheduler.Health(); err != nil {
+		return "unhealthy", err
+	}
+	return "healthy", nil
+}
@@ -23,6 +23,7 @@ type Config struct {
 	PostgresService  Postgres
 	PgBouncerService PgBouncer
 	WalgService      WalG
+	BackupScheduler  BackupScheduler // Scheduled backups, nil disables the check
 
 	// PostgREST configuration
 	PostgRESTURL   string
@@ -35,8 +36,8 @@ type Config struct {
 	BackupLocation string
 
 	// Supervisor configuration
-	SupervisorEnabled bool     // Whether to monitor supervisor
-	EnabledServices   []string // Services that should be running
+	Processes       Processes // Processes run by postgres-cli, nil disables the check
+	EnabledServices []string  // Services that should be running
 
 	// Thresholds
 	DiskSpaceThreshold   float64 // Percentage (e.g., 90.0 for 90%)
@@ -131,8 +132,15 @@ func (hc *HealthChecker) setupChecks() error {
 		}
 	}
 
+	// Scheduled backups check
+	if hc.config.BackupScheduler != nil {
+		if err := hc.addBackupScheduleCheck(); err != nil {
+			return fmt.Errorf("failed to add backup schedule check: %w", err)
+		}
+	}
+
 	// Supervisor health check
-	if hc.config.SupervisorEnabled {
+	if hc.config.Processes != nil {
 		if err := hc.addSupervisorCheck(); err != nil {
 			return fmt.Errorf("failed to add supervisor check: %w", err)
 		}
@@ -267,9 +275,21 @@ func (hc *HealthChecker) addWalgCheck() error {
 	})
 }
 
+// addBackupScheduleCheck adds monitoring of the scheduled backups
+func (hc *HealthChecker) addBackupScheduleCheck() error {
+	checker := NewBackupScheduleChecker(hc.config.BackupScheduler)
+
+	return hc.h.AddCheck(&health.Config{
+		Name:     "backup-schedule",
+		Checker:  checker,
+		Interval: 60 * time.Second, // Check every minute
+		Fatal:    false,
+	})
+}
+
 // addSupervisorCheck adds supervisor process monitoring
 func (hc *HealthChecker) addSupervisorCheck() error {
-	checker := NewSupervisorChecker(hc.config.EnabledServices)
+	checker := NewSupervisorChecker(hc.config.Processes, hc.config.EnabledServices)
 
 	return hc.h.AddCheck(&health.Config{
 		Name:     "supervisor",
@@ -143,6 +143,19 @@ func TestPgBouncerChecker(t *testing.T) {
 	}
 }
 
+func TestBackupScheduleChecker(t *testing.T) {
+	// mockPgBouncer fails its Health method like a scheduler whose last backup failed
+	if status, err := NewBackupScheduleChecker(&mockPgBouncer{}).Status(); err != nil || status != "healthy" {
+		t.Errorf("Expected a healthy status, got %v, %v", status, err)
+	}
+	if status, err := NewBackupScheduleChecker(&mockPgBouncer{shouldFail: true}).Status(); err == nil || status != "unhealthy" {
+		t.Errorf("Expected an unhealthy status, got %v, %v", status, err)
+	}
+	if _, err := NewBackupScheduleChecker(nil).Status(); err == nil {
+		t.Error("Expected an error without a scheduler")
+	}
+}
+
 func TestMemoryUsageChecker(t *testing.T) {
 	checker := NewMemoryUsageChecker(95.0) // Very high threshold to ensure test passes
 	status, err := checker.Status()
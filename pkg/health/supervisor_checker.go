@@ -2,81 +2,51 @@ package health
 
 import (
 	"fmt"
-	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/flanksource/postgres/pkg/supervisor"
 )
 
-// SupervisorChecker monitors supervisord managed processes
+// Processes interface defines the methods needed to monitor the processes run by postgres-cli,
+// implemented by supervisor.Manager
+type Processes interface {
+	Status() []supervisor.Status
+}
+
+// SupervisorChecker monitors the processes managed by postgres-cli run
 type SupervisorChecker struct {
+	processes       Processes
 	EnabledServices []string // Services that should be running (based on configuration)
 }
 
 // NewSupervisorChecker creates a new supervisor health checker
-func NewSupervisorChecker(enabledServices []string) *SupervisorChecker {
+func NewSupervisorChecker(processes Processes, enabledServices []string) *SupervisorChecker {
 	return &SupervisorChecker{
+		processes:       processes,
 		EnabledServices: enabledServices,
 	}
 }
 
 // Status implements the health.ICheckable interface
 func (c *SupervisorChecker) Status() (interface{}, error) {
+	statuses := c.processes.Status()
 	status := map[string]interface{}{
-		"timestamp":          time.Now(),
-		"supervisor_running": false,
-		"processes":          []map[string]interface{}{},
-		"enabled_services":   c.EnabledServices,
+		"timestamp":        time.Now(),
+		"processes":        statuses,
+		"enabled_services": c.EnabledServices,
 	}
 
-	// Check if supervisorctl is available
-	if _, err := exec.LookPath("supervisorctl"); err != nil {
-		return status, fmt.Errorf("supervisorctl not available: %w", err)
+	processStates := make(map[string]supervisor.State)
+	for _, process := range statuses {
+		processStates[process.Name] = process.State
 	}
 
-	// Get supervisord status
-	output, err := exec.Command("supervisorctl", "status").CombinedOutput()
-	if err != nil {
-		return status, fmt.Errorf("supervisorctl status failed: %w, output: %s", err, string(output))
-	}
-
-	status["supervisor_running"] = true
-	processes := []map[string]interface{}{}
-	processStates := make(map[string]string)
-
-	// Parse supervisor output
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		parts := strings.Fields(line)
-		if len(parts) >= 2 {
-			processName := parts[0]
-			processStatus := parts[1]
-			processStates[processName] = processStatus
-
-			process := map[string]interface{}{
-				"name":   processName,
-				"status": processStatus,
-			}
-
-			if len(parts) > 2 {
-				process["details"] = strings.Join(parts[2:], " ")
-			}
-
-			processes = append(processes, process)
-		}
-	}
-
-	status["processes"] = processes
-
 	// Check if all enabled services are running
 	var unhealthyServices []string
 	for _, service := range c.EnabledServices {
 		if state, exists := processStates[service]; exists {
-			if !isProcessHealthy(state) {
+			if state != supervisor.StateRunning {
 				unhealthyServices = append(unhealthyServices, fmt.Sprintf("%s (%s)", service, state))
 			}
 		} else {
@@ -91,14 +61,3 @@ func (c *SupervisorChecker) Status() (interface{}, error) {
 	status["status"] = "healthy"
 	return status, nil
 }
-
-// isProcessHealthy returns true if the process state indicates it's healthy
-func isProcessHealthy(state string) bool {
-	healthyStates := []string{"RUNNING"}
-	for _, healthyState := range healthyStates {
-		if state == healthyState {
-			return true
-		}
-	}
-	return false
-}
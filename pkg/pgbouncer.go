@@ -4,12 +4,17 @@ import (
 	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/flanksource/postgres/pkg/supervisor"
 	_ "github.com/lib/pq"
 )
 
@@ -25,6 +30,37 @@ func NewPgBouncer(config *PgBouncerConf) *PgBouncer {
 	}
 }
 
+// Service returns PgBouncer running with the configuration file at configPath as a service of a supervisor.Manager.
+// It is stopped with SIGINT, which waits for running transactions to finish, escalated to SIGQUIT.
+func (p *PgBouncer) Service(configPath string) *supervisor.Service {
+	host, port := "localhost", 6432
+	if p.Config != nil && p.Config.ListenAddress != "" {
+		host = p.Config.ListenAddress
+	}
+	if p.Config != nil && p.Config.ListenPort != 0 {
+		port = p.Config.ListenPort
+	}
+	return &supervisor.Service{
+		Name:              "pgbouncer",
+		Path:              "pgbouncer",
+		Args:              []string{configPath},
+		Dir:               filepath.Dir(configPath),
+		Ready:             supervisor.TCPReady(dialAddress(host, port)),
+		StopSignal:        func(os.Signal) syscall.Signal { return syscall.SIGINT },
+		EscalationSignals: []syscall.Signal{syscall.SIGQUIT},
+		ReloadSignal:      syscall.SIGHUP,
+	}
+}
+
+// dialAddress returns the address to connect to a server listening on host, wildcard addresses are reached on localhost
+func dialAddress(host string, port int) string {
+	host = strings.TrimSpace(strings.Split(host, ",")[0])
+	if host == "" || host == "*" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // Health performs a comprehensive health check of the PgBouncer service
 func (p *PgBouncer) Health() error {
 	if p == nil {
@@ -8,12 +8,15 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/flanksource/deps"
 	"github.com/flanksource/postgres/pkg/jwt"
+	"github.com/flanksource/postgres/pkg/supervisor"
 	"github.com/flanksource/postgres/pkg/utils"
 )
 
@@ -103,14 +106,24 @@ func (p *PostgREST) Health() error {
 	return nil
 }
 
-// Start starts the PostgREST service (placeholder for future implementation)
-func (p *PostgREST) Start() error {
-	return fmt.Errorf("PostgREST start functionality not yet implemented")
-}
-
-// Stop stops the PostgREST service (placeholder for future implementation)
-func (p *PostgREST) Stop() error {
-	return fmt.Errorf("PostgREST stop functionality not yet implemented")
+// Service returns PostgREST running with the configuration file at configPath as a service of a supervisor.Manager,
+// it is ready once the server port accepts connections and reloads its configuration on SIGUSR2
+func (p *PostgREST) Service(configPath string) *supervisor.Service {
+	host, port := "localhost", 3000
+	if p.Config != nil && p.Config.ServerHost != nil {
+		host = *p.Config.ServerHost
+	}
+	if p.Config != nil && p.Config.ServerPort != nil {
+		port = *p.Config.ServerPort
+	}
+	return &supervisor.Service{
+		Name:         "postgrest",
+		Path:         "postgrest",
+		Args:         []string{configPath},
+		Dir:          filepath.Dir(configPath),
+		Ready:        supervisor.TCPReady(dialAddress(host, port)),
+		ReloadSignal: syscall.SIGUSR2,
+	}
 }
 
 // GetOpenAPISchema retrieves the OpenAPI schema from PostgREST
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/properties"
+
+	"github.com/flanksource/postgres/pkg"
+	"github.com/flanksource/postgres/pkg/config"
+)
+
+// walgConfFile is the include of postgresql.conf with the WAL-G archiving settings, it is rewritten on every start
+const walgConfFile = "postgresql.walg.conf"
+
+// WalgArchiveOptions controls how ConfigureWalgArchiveWithOptions wires WAL-G into PostgreSQL
+type WalgArchiveOptions struct {
+	// EnvFile is the script exporting the WAL-G environment, walg.env next to the data directory when empty so
+	// that the credentials are not part of the base backups
+	EnvFile string
+	// ArchiveTimeout switches to a new WAL segment after this long, so that quiet periods are archived too (0 = never)
+	ArchiveTimeout time.Duration
+}
+
+// DefaultWalgArchiveOptions switches WAL segments every minute, the walg.env-file and walg.archive-timeout
+// properties change the defaults
+func DefaultWalgArchiveOptions() WalgArchiveOptions {
+	return WalgArchiveOptions{
+		EnvFile:        properties.String("", "walg.env-file"),
+		ArchiveTimeout: properties.Duration(time.Minute, "walg.archive-timeout"),
+	}
+}
+
+// ConfigureWalgArchive archives the WAL with wal-g wal-push when conf is enabled, see ConfigureWalgArchiveWithOptions
+func (p *Postgres) ConfigureWalgArchive(conf *pkg.WalgConf) error {
+	return p.ConfigureWalgArchiveWithOptions(conf, DefaultWalgArchiveOptions())
+}
+
+// ConfigureWalgArchiveWithOptions writes the WAL-G environment into an env file readable only by its owner, and
+// archive_mode, archive_command, restore_command and archive_timeout into postgresql.walg.conf, which is included by
+// postgresql.conf. When WAL-G is disabled the include is removed so that archiving stops. The settings take
+// effect on the next start.
+func (p *Postgres) ConfigureWalgArchiveWithOptions(conf *pkg.WalgConf, opts WalgArchiveOptions) error {
+	include := filepath.Join(p.DataDir, walgConfFile)
+	if conf == nil || !conf.Enabled {
+		if _, err := os.Stat(include); err != nil {
+			return nil
+		}
+		if p.DryRun {
+			clicky.Infof("[DRYRUN] skipping removal of %s", include)
+			return nil
+		}
+		if err := os.Remove(include); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", include, err)
+		}
+		clicky.Infof("WAL-G is disabled, removed the archiving settings in %s", include)
+		return nil
+	}
+
+	envFile := opts.EnvFile
+	if envFile == "" {
+		envFile = filepath.Join(filepath.Dir(p.DataDir), "walg.env")
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping WAL-G archiving setup in %s and %s", include, envFile)
+		return nil
+	}
+	if err := writeFileAtomic(envFile, []byte(shellEnvFile(pkg.NewWalG(conf).Environment()))); err != nil {
+		return fmt.Errorf("failed to write the WAL-G environment: %w", err)
+	}
+	if err := writeFileAtomic(include, []byte(walgArchiveSettings(envFile, opts.ArchiveTimeout))); err != nil {
+		return fmt.Errorf("failed to write %s: %w", walgConfFile, err)
+	}
+	if err := config.EnsureIncludeDirective(filepath.Join(p.DataDir, "postgresql.conf"), walgConfFile); err != nil {
+		return fmt.Errorf("failed to update postgresql.conf: %w", err)
+	}
+	clicky.Infof("✅ WAL is archived with wal-g wal-push, settings in %s", include)
+	return nil
+}
+
+// walgArchiveSettings returns the settings archiving the WAL with WAL-G, the restore_command is only used when the
+// server is started in recovery, e.g. for a point in time recovery
+func walgArchiveSettings(envFile string, archiveTimeout time.Duration) string {
+	return fmt.Sprintf(`# Managed by postgres-cli from the walg configuration, changes are overwritten on start
+archive_mode = on
+archive_command = %s
+restore_command = %s
+archive_timeout = '%ds'
+`, quoteSetting(walgCommand(envFile, `wal-push "%p"`)), quoteSetting(walgCommand(envFile, `wal-fetch "%f" "%p"`)),
+		int(archiveTimeout.Seconds()))
+}
+
+// walgCommand returns a shell command running wal-g with the environment in envFile
+func walgCommand(envFile, args string) string {
+	return fmt.Sprintf(". %s && exec wal-g %s", shellQuote(envFile), args)
+}
+
+// quoteSetting quotes a postgresql.conf string value
+func quoteSetting(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// ArchiverStatus is the row of pg_stat_archiver
+type ArchiverStatus struct {
+	ArchivedCount    int64      `json:"archived_count"`
+	LastArchivedWAL  string     `json:"last_archived_wal,omitempty"`
+	LastArchivedTime *time.Time `json:"last_archived_time,omitempty"`
+	FailedCount      int64      `json:"failed_count"`
+	LastFailedWAL    string     `json:"last_failed_wal,omitempty"`
+	LastFailedTime   *time.Time `json:"last_failed_time,omitempty"`
+}
+
+// CheckArchiving switches to a new WAL segment and waits until pg_stat_archiver reports the previous one as
+// archived. It fails as soon as the archive_command fails, or when the segment is not archived within timeout.
+func (p *Postgres) CheckArchiving(timeout time.Duration) (*ArchiverStatus, error) {
+	var status *ArchiverStatus
+	err := p.WithConnection(func(db *sql.DB) error {
+		var err error
+		status, err = checkArchiving(db, timeout)
+		return err
+	})
+	return status, err
+}
+
+// reportArchiving warns when WAL-G, if configured, does not archive a WAL segment of the running server within
+// timeout. Unlike CheckArchiving it never starts a temporary server, the running one may be restarting.
+func (p *Postgres) reportArchiving(timeout time.Duration) {
+	if _, err := os.Stat(filepath.Join(p.DataDir, walgConfFile)); err != nil {
+		return
+	}
+	db, err := p.GetConnection()
+	if err != nil {
+		clicky.Warnf("⚠️  Failed to check WAL archiving with WAL-G: %v", err)
+		return
+	}
+	defer db.Close()
+	if status, err := checkArchiving(db, timeout); err != nil {
+		clicky.Warnf("⚠️  WAL archiving with WAL-G is not working: %v", err)
+	} else {
+		clicky.Infof("✅ WAL archiving with WAL-G works, last archived segment %s", status.LastArchivedWAL)
+	}
+}
+
+func checkArchiving(db *sql.DB, timeout time.Duration) (*ArchiverStatus, error) {
+	var recovery bool
+	if err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&recovery); err != nil {
+		return nil, err
+	}
+	if recovery {
+		return nil, fmt.Errorf("the server is in recovery, the WAL is archived by the primary")
+	}
+	before, err := archiverStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	// pg_switch_wal does nothing without WAL activity since the last switch, committing a transaction id makes sure
+	// there is some
+	if _, err := db.Exec("SELECT txid_current()"); err != nil {
+		return nil, err
+	}
+	var segment string
+	if err := db.QueryRow("SELECT pg_walfile_name(pg_switch_wal())").Scan(&segment); err != nil {
+		return nil, fmt.Errorf("failed to switch WAL segment: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := archiverStatus(db)
+		if err != nil {
+			return nil, err
+		}
+		if walArchived(status.LastArchivedWAL, segment) {
+			return status, nil
+		}
+		if status.FailedCount > before.FailedCount {
+			return status, fmt.Errorf("archive_command failed for %s, see the server log", status.LastFailedWAL)
+		}
+		if time.Now().After(deadline) {
+			return status, fmt.Errorf("%s was not archived within %s", segment, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func archiverStatus(db *sql.DB) (*ArchiverStatus, error) {
+	var lastArchivedWAL, lastFailedWAL sql.NullString
+	var lastArchivedTime, lastFailedTime sql.NullTime
+	status := &ArchiverStatus{}
+	if err := db.QueryRow(`SELECT archived_count, last_archived_wal, last_archived_time, failed_count, last_failed_wal, last_failed_time
+FROM pg_stat_archiver`).Scan(&status.ArchivedCount, &lastArchivedWAL, &lastArchivedTime, &status.FailedCount, &lastFailedWAL, &lastFailedTime); err != nil {
+		return nil, fmt.Errorf("failed to query pg_stat_archiver: %w", err)
+	}
+	status.LastArchivedWAL, status.LastFailedWAL = lastArchivedWAL.String, lastFailedWAL.String
+	if lastArchivedTime.Valid {
+		status.LastArchivedTime = &lastArchivedTime.Time
+	}
+	if lastFailedTime.Valid {
+		status.LastFailedTime = &lastFailedTime.Time
+	}
+	return status, nil
+}
+
+// walArchived returns whether segment has been archived when lastArchived is the last archived file, which can also
+// be a timeline history or backup label file
+func walArchived(lastArchived, segment string) bool {
+	return len(lastArchived) == len(segment) && lastArchived >= segment
+}
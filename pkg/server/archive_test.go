@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+func TestWalgArchiveSettings(t *testing.T) {
+	expected := `# Managed by postgres-cli from the walg configuration, changes are overwritten on start
+archive_mode = on
+archive_command = '. ''/var/lib/postgresql/wal-g''\''''s.env'' && exec wal-g wal-push "%p"'
+restore_command = '. ''/var/lib/postgresql/wal-g''\''''s.env'' && exec wal-g wal-fetch "%f" "%p"'
+archive_timeout = '300s'
+`
+	if settings := walgArchiveSettings("/var/lib/postgresql/wal-g's.env", 5*time.Minute); settings != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, settings)
+	}
+}
+
+func TestConfigureWalgArchive(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "postgresql.conf"), []byte("port = 5432\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Postgres{DataDir: dataDir}
+	prefix := "file:///backups"
+	conf := &pkg.WalgConf{Enabled: true, FilePrefix: &prefix}
+
+	// Configuring twice keeps a single include
+	for range 2 {
+		if err := p.ConfigureWalgArchiveWithOptions(conf, WalgArchiveOptions{ArchiveTimeout: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	envFile := filepath.Join(filepath.Dir(dataDir), "walg.env")
+	info, err := os.Stat(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the env file to only be readable by its owner, got %s", info.Mode())
+	}
+	if env, _ := os.ReadFile(envFile); !strings.Contains(string(env), "export WALG_FILE_PREFIX='file:///backups'\n") {
+		t.Errorf("expected the storage prefix in the env file, got %s", env)
+	}
+	if settings, _ := os.ReadFile(filepath.Join(dataDir, walgConfFile)); string(settings) != walgArchiveSettings(envFile, time.Minute) {
+		t.Errorf("unexpected settings %s", settings)
+	}
+	postgresConf, _ := os.ReadFile(filepath.Join(dataDir, "postgresql.conf"))
+	if count := strings.Count(string(postgresConf), "include_if_exists '"+walgConfFile+"'"); count != 1 {
+		t.Errorf("expected postgresql.conf to include %s once, got\n%s", walgConfFile, postgresConf)
+	}
+
+	conf.Enabled = false
+	if err := p.ConfigureWalgArchive(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, walgConfFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the archiving settings to be removed once WAL-G is disabled, got %v", err)
+	}
+	if err := p.ConfigureWalgArchive(nil); err != nil {
+		t.Errorf("expected nothing to do without WAL-G, got %v", err)
+	}
+}
+
+func TestWalArchived(t *testing.T) {
+	tests := []struct {
+		lastArchived string
+		archived     bool
+	}{
+		{lastArchived: "", archived: false},
+		{lastArchived: "000000010000000000000002", archived: false},
+		{lastArchived: "000000010000000000000003", archived: true},
+		{lastArchived: "000000010000000100000000", archived: true},
+		{lastArchived: "000000020000000000000001", archived: true},
+		{lastArchived: "00000002.history", archived: false},
+		{lastArchived: "000000010000000000000003.00000028.backup", archived: false},
+	}
+	for _, tt := range tests {
+		if archived := walArchived(tt.lastArchived, "000000010000000000000003"); archived != tt.archived {
+			t.Errorf("%q: expected archived=%v, got %v", tt.lastArchived, tt.archived, archived)
+		}
+	}
+}
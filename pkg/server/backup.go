@@ -0,0 +1,422 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/properties"
+)
+
+// BackupFormat is the pg_dump archive format
+type BackupFormat string
+
+const (
+	// BackupFormatCustom writes a single compressed file per database
+	BackupFormatCustom BackupFormat = "custom"
+	// BackupFormatDirectory writes a directory per database with a file per table, and can be dumped in parallel
+	BackupFormatDirectory BackupFormat = "directory"
+)
+
+// BackupManifestFile is written into the backup directory once every archive has been written, a backup
+// directory without it is incomplete
+const BackupManifestFile = "manifest.json"
+
+// backupManifestVersion is the version of the manifest format
+const backupManifestVersion = 1
+
+// globalsFile is the pg_dumpall --globals-only script in the backup directory
+const globalsFile = "globals.sql"
+
+// BackupOptions controls what BackupWithOptions dumps and where
+type BackupOptions struct {
+	// OutputDir is where the backup directory, named after the start time, is created
+	OutputDir string
+	// Databases to dump, all the databases that allow connections except templates when empty
+	Databases []string
+	Format    BackupFormat
+	// Jobs is the number of tables dumped in parallel, only the directory format supports more than 1
+	Jobs int
+	// Compression is the pg_dump compression level from 0 (none) to 9, -1 uses the pg_dump default
+	Compression int
+	// Globals dumps the roles and tablespaces with pg_dumpall --globals-only
+	Globals bool
+}
+
+// DefaultBackupOptions dumps every database and the globals in the custom format, the output directory can be
+// changed with the backup.dir property
+func DefaultBackupOptions() BackupOptions {
+	return BackupOptions{
+		OutputDir:   properties.String("backups", "backup.dir"),
+		Format:      BackupFormatCustom,
+		Jobs:        1,
+		Compression: -1,
+		Globals:     true,
+	}
+}
+
+func (o BackupOptions) validate() error {
+	if o.Format != BackupFormatCustom && o.Format != BackupFormatDirectory {
+		return fmt.Errorf("invalid backup format %q, expected custom or directory", o.Format)
+	}
+	if o.Jobs < 1 {
+		return fmt.Errorf("jobs must be at least 1")
+	}
+	if o.Jobs > 1 && o.Format != BackupFormatDirectory {
+		return fmt.Errorf("parallel jobs require the directory format")
+	}
+	if o.Compression < -1 || o.Compression > 9 {
+		return fmt.Errorf("invalid compression level %d, expected 0-9", o.Compression)
+	}
+	if o.OutputDir == "" {
+		return fmt.Errorf("output directory not specified")
+	}
+	return nil
+}
+
+// BackupManifest describes a logical backup, it is written as manifest.json into the backup directory
+type BackupManifest struct {
+	ManifestVersion int          `json:"manifest_version"`
+	StartedAt       time.Time    `json:"started_at"`
+	FinishedAt      time.Time    `json:"finished_at"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Server          BackupServer `json:"server"`
+	PgDumpVersion   string       `json:"pg_dump_version"`
+	Format          BackupFormat `json:"format"`
+	Compression     int          `json:"compression"`
+	Jobs            int          `json:"jobs"`
+	// Size is the total size of the archives
+	Size      int64           `json:"size" pretty:"format=bytes"`
+	Globals   *BackupArchive  `json:"globals,omitempty"`
+	Databases []BackupArchive `json:"databases"`
+}
+
+// BackupServer is the server a backup was taken from
+type BackupServer struct {
+	Version    string `json:"version"`
+	VersionNum int    `json:"version_num"`
+	Host       string `json:"host,omitempty"`
+	Port       int    `json:"port,omitempty"`
+}
+
+// BackupArchive is a pg_dump archive or the globals script of a backup
+type BackupArchive struct {
+	Database string `json:"database,omitempty"`
+	// Path is relative to the backup directory
+	Path string `json:"path"`
+	Size int64  `json:"size" pretty:"format=bytes"`
+	// SHA256 is the checksum of the file, or for a directory of its sha256sum style listing
+	SHA256          string  `json:"sha256"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// DatabaseSize is the size of the database when it was dumped
+	DatabaseSize int64 `json:"database_size,omitempty" pretty:"format=bytes"`
+}
+
+// Backup dumps every database and the globals into a new directory under the backup.dir property
+func (p *Postgres) Backup() error {
+	_, err := p.BackupWithOptions(DefaultBackupOptions())
+	return err
+}
+
+// BackupWithOptions dumps the databases with pg_dump and the roles and tablespaces with pg_dumpall into a
+// directory under opts.OutputDir named after the start time, and writes a manifest with the server version and
+// the size, checksum and duration of each archive. It returns the path of the backup directory.
+func (p *Postgres) BackupWithOptions(opts BackupOptions) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+	if err := p.ensureBinDir(); err != nil {
+		return "", fmt.Errorf("failed to resolve binary directory: %w", err)
+	}
+	manifest := &BackupManifest{
+		ManifestVersion: backupManifestVersion,
+		StartedAt:       time.Now().UTC(),
+		Format:          opts.Format,
+		Compression:     opts.Compression,
+		Jobs:            opts.Jobs,
+		PgDumpVersion:   toolVersion(filepath.Join(p.BinDir, "pg_dump")),
+	}
+	dir := filepath.Join(opts.OutputDir, manifest.StartedAt.Format("20060102T150405Z"))
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping backup to %s", dir)
+		return dir, nil
+	}
+
+	err := p.WithConnection(func(db *sql.DB) error {
+		if err := db.QueryRow("SELECT current_setting('server_version'), current_setting('server_version_num')::int").
+			Scan(&manifest.Server.Version, &manifest.Server.VersionNum); err != nil {
+			return fmt.Errorf("failed to get the server version: %w", err)
+		}
+		manifest.Server.Host, manifest.Server.Port = p.Host, p.Port
+
+		sizes, err := backupDatabases(db, opts.Databases)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+
+		if opts.Globals {
+			archive, err := p.dumpGlobals(dir)
+			if err != nil {
+				return err
+			}
+			manifest.Globals = archive
+			manifest.Size += archive.Size
+		}
+		names := map[string]bool{globalsFile: true, BackupManifestFile: true}
+		for _, database := range sortedKeys(sizes) {
+			archive, err := p.dumpDatabase(dir, archiveName(database, opts.Format, names), database, opts)
+			if err != nil {
+				return err
+			}
+			archive.DatabaseSize = sizes[database]
+			manifest.Databases = append(manifest.Databases, *archive)
+			manifest.Size += archive.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return dir, err
+	}
+
+	manifest.FinishedAt = time.Now().UTC()
+	manifest.DurationSeconds = manifest.FinishedAt.Sub(manifest.StartedAt).Seconds()
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return dir, err
+	}
+	clicky.Infof("✅ Backup of %d databases written to %s (%s)", len(manifest.Databases), dir,
+		time.Duration(manifest.DurationSeconds*float64(time.Second)).Round(time.Second))
+	return dir, nil
+}
+
+// backupDatabases returns the size of the databases to dump, all those that allow connections except templates
+// when none are selected
+func backupDatabases(db *sql.DB, selected []string) (map[string]int64, error) {
+	rows, err := db.Query("SELECT datname, pg_database_size(oid) FROM pg_database WHERE datallowconn AND NOT datistemplate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var size int64
+		if err := rows.Scan(&name, &size); err != nil {
+			return nil, fmt.Errorf("failed to scan database: %w", err)
+		}
+		sizes[name] = size
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return sizes, nil
+	}
+	selectedSizes := map[string]int64{}
+	for _, name := range selected {
+		size, ok := sizes[name]
+		if !ok {
+			return nil, fmt.Errorf("database %s does not exist or does not allow connections", name)
+		}
+		selectedSizes[name] = size
+	}
+	return selectedSizes, nil
+}
+
+func (p *Postgres) dumpGlobals(dir string) (*BackupArchive, error) {
+	clicky.Infof("🗄️  Dumping roles and tablespaces")
+	start := time.Now()
+	path := filepath.Join(dir, globalsFile)
+	if _, err := p.runClient("pg_dumpall", "--globals-only", "--no-password", "--file", path,
+		"--dbname", p.ConnInfo(p.Database)); err != nil {
+		return nil, err
+	}
+	return newBackupArchive(dir, globalsFile, "", time.Since(start))
+}
+
+func (p *Postgres) dumpDatabase(dir, name, database string, opts BackupOptions) (*BackupArchive, error) {
+	clicky.Infof("🗄️  Dumping database %s", database)
+	start := time.Now()
+	args := []string{"--format", string(opts.Format), "--no-password", "--file", filepath.Join(dir, name)}
+	if opts.Jobs > 1 {
+		args = append(args, "--jobs", strconv.Itoa(opts.Jobs))
+	}
+	if opts.Compression >= 0 {
+		args = append(args, "--compress", strconv.Itoa(opts.Compression))
+	}
+	if _, err := p.runClient("pg_dump", append(args, "--dbname", p.ConnInfo(database))...); err != nil {
+		return nil, fmt.Errorf("failed to dump %s: %w", database, err)
+	}
+	return newBackupArchive(dir, name, database, time.Since(start))
+}
+
+// runClient runs a client binary from BinDir with the connection of p and returns its output
+func (p *Postgres) runClient(name string, args ...string) (string, error) {
+	cmd := clicky.Exec(filepath.Join(p.BinDir, name), args...)
+	cmd.Env = p.ClientEnv()
+	process := cmd.Run()
+	if process.Err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", name, process.Err, process.Out())
+	}
+	return process.Out(), nil
+}
+
+// toolVersion returns the version printed by a binary, e.g. "pg_dump (PostgreSQL) 17.5"
+func toolVersion(path string) string {
+	process := clicky.Exec(path, "--version").Run()
+	if process.Err != nil {
+		return ""
+	}
+	return strings.TrimSpace(process.GetStdout())
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// archiveName returns a file name for the archive of database that is not in names yet, database names can
+// contain any character
+func archiveName(database string, format BackupFormat, names map[string]bool) string {
+	base := unsafeFileChars.ReplaceAllString(database, "_")
+	ext := ".dump"
+	if format == BackupFormatDirectory {
+		ext = ""
+	}
+	name := base + ext
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	names[name] = true
+	return name
+}
+
+func newBackupArchive(dir, name, database string, duration time.Duration) (*BackupArchive, error) {
+	size, checksum, err := archiveChecksum(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &BackupArchive{
+		Database:        database,
+		Path:            name,
+		Size:            size,
+		SHA256:          checksum,
+		DurationSeconds: duration.Seconds(),
+	}, nil
+}
+
+// archiveChecksum returns the size and SHA-256 of a file, or for a directory the total size of its files and
+// the SHA-256 of their "<sha256>  <path>" listing sorted by path, as printed by sha256sum
+func archiveChecksum(path string) (int64, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	if !info.IsDir() {
+		return fileChecksum(path)
+	}
+
+	var total int64
+	var listing []string
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		size, checksum, err := fileChecksum(file)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(path, file)
+		listing = append(listing, checksum+"  "+filepath.ToSlash(rel)+"\n")
+		total += size
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	// WalkDir visits the files in lexical order
+	sum := sha256.Sum256([]byte(strings.Join(listing, "")))
+	return total, hex.EncodeToString(sum[:]), nil
+}
+
+func fileChecksum(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, BackupManifestFile), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadBackupManifest reads the manifest of a backup directory, path can be the directory or its manifest.json
+func ReadBackupManifest(path string) (*BackupManifest, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, BackupManifestFile)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest %s: %w", path, err)
+	}
+	if manifest.ManifestVersion > backupManifestVersion {
+		return nil, fmt.Errorf("backup manifest %s has version %d, this version of postgres-cli reads up to %d",
+			path, manifest.ManifestVersion, backupManifestVersion)
+	}
+	return manifest, nil
+}
+
+// ListBackups returns the complete backups in dir, the directories with a manifest, oldest first
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var backups []string
+	// The directories are named after the start time, so ReadDir returns them oldest first
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(path, BackupManifestFile)); entry.IsDir() && err == nil {
+			backups = append(backups, path)
+		}
+	}
+	return backups, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
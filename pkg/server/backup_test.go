@@ -0,0 +1,160 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*BackupOptions)
+		err    string
+	}{
+		{name: "defaults", modify: func(o *BackupOptions) {}},
+		{name: "parallel directory", modify: func(o *BackupOptions) { o.Format, o.Jobs = BackupFormatDirectory, 4 }},
+		{name: "parallel custom", modify: func(o *BackupOptions) { o.Jobs = 4 }, err: "directory format"},
+		{name: "plain format", modify: func(o *BackupOptions) { o.Format = "plain" }, err: "invalid backup format"},
+		{name: "compression", modify: func(o *BackupOptions) { o.Compression = 10 }, err: "compression level"},
+		{name: "no output dir", modify: func(o *BackupOptions) { o.OutputDir = "" }, err: "output directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultBackupOptions()
+			tt.modify(&opts)
+			err := opts.validate()
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	names := map[string]bool{globalsFile: true}
+	for _, tt := range []struct {
+		database string
+		format   BackupFormat
+		expected string
+	}{
+		{database: "orders", format: BackupFormatCustom, expected: "orders.dump"},
+		{database: "../../etc", format: BackupFormatCustom, expected: ".._.._etc.dump"},
+		{database: "a/b", format: BackupFormatDirectory, expected: "a_b"},
+		{database: "a b", format: BackupFormatDirectory, expected: "a_b-2"},
+		{database: "globals.sql", format: BackupFormatDirectory, expected: "globals.sql-2"},
+	} {
+		if name := archiveName(tt.database, tt.format, names); name != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.database, tt.expected, name)
+		}
+	}
+}
+
+func TestArchiveChecksum(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "orders.dump")
+	if err := os.WriteFile(file, []byte("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	size, checksum, err := archiveChecksum(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256sum of "hello\n"
+	if size != 6 || checksum != "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03" {
+		t.Errorf("unexpected size %d and checksum %s", size, checksum)
+	}
+
+	write := func(root string, files map[string]string) {
+		for name, content := range files {
+			path := filepath.Join(root, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	write(a, map[string]string{"toc.dat": "toc", "3001.dat.gz": "data", "sub/x": "x"})
+	write(b, map[string]string{"sub/x": "x", "3001.dat.gz": "data", "toc.dat": "toc"})
+	sizeA, checksumA, err := archiveChecksum(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, checksumB, _ := archiveChecksum(b)
+	if sizeA != 8 || checksumA != checksumB {
+		t.Errorf("expected identical directories to have the same checksum, got %d %s %s", sizeA, checksumA, checksumB)
+	}
+	write(b, map[string]string{"toc.dat": "changed"})
+	if _, changed, _ := archiveChecksum(b); changed == checksumA {
+		t.Error("expected a changed file to change the checksum")
+	}
+}
+
+func TestReadBackupManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := &BackupManifest{
+		ManifestVersion: backupManifestVersion,
+		StartedAt:       time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Server:          BackupServer{Version: "17.5", VersionNum: 170005},
+		Format:          BackupFormatCustom,
+		Compression:     -1,
+		Jobs:            1,
+		Globals:         &BackupArchive{Path: globalsFile, Size: 10},
+		Databases:       []BackupArchive{{Database: "orders", Path: "orders.dump", Size: 20, DatabaseSize: 100}},
+	}
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, filepath.Join(dir, BackupManifestFile)} {
+		read, err := ReadBackupManifest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, manifest) {
+			t.Errorf("expected %+v, got %+v", manifest, read)
+		}
+	}
+
+	manifest.ManifestVersion = backupManifestVersion + 1
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBackupManifest(dir); err == nil {
+		t.Error("expected an error for a newer manifest version")
+	}
+	if _, err := ReadBackupManifest(t.TempDir()); err == nil {
+		t.Error("expected an error for an incomplete backup")
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20250102T030405Z", "20250101T000000Z", "20250103T000000Z"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"20250102T030405Z", "20250101T000000Z"} {
+		if err := writeBackupManifest(filepath.Join(dir, name), &BackupManifest{ManifestVersion: backupManifestVersion}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the incomplete backup without a manifest is ignored
+	expected := []string{filepath.Join(dir, "20250101T000000Z"), filepath.Join(dir, "20250102T030405Z")}
+	if !reflect.DeepEqual(backups, expected) {
+		t.Errorf("expected %v, got %v", expected, backups)
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/clicky"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+// DatabaseInfo is a database as reported by pg_database and pg_stat_database
+type DatabaseInfo struct {
+	Name            string `json:"name"`
+	Owner           string `json:"owner"`
+	Encoding        string `json:"encoding"`
+	Collate         string `json:"collate"`
+	Ctype           string `json:"ctype"`
+	Tablespace      string `json:"tablespace"`
+	ConnectionLimit int    `json:"connection_limit"`
+	Template        bool   `json:"template"`
+	// Size is 0 for the databases the user cannot connect to
+	Size        int64 `json:"size" pretty:"format=bytes"`
+	Connections int   `json:"connections"`
+}
+
+const listDatabasesQuery = `SELECT d.datname, pg_get_userbyid(d.datdba), pg_encoding_to_char(d.encoding), d.datcollate,
+  d.datctype, t.spcname, d.datconnlimit, d.datistemplate,
+  CASE WHEN has_database_privilege(d.oid, 'CONNECT') THEN pg_database_size(d.oid) ELSE 0 END,
+  COALESCE(s.numbackends, 0)
+FROM pg_database d
+  JOIN pg_tablespace t ON t.oid = d.dattablespace
+  LEFT JOIN pg_stat_database s ON s.datid = d.oid
+ORDER BY 1`
+
+// localeProviders are the values of CREATE DATABASE ... LOCALE_PROVIDER
+var localeProviders = []string{"libc", "icu", "builtin"}
+
+// ListDatabases returns the databases with their size and number of connections
+func (p *Postgres) ListDatabases() ([]DatabaseInfo, error) {
+	var databases []DatabaseInfo
+	err := p.WithConnection(func(db *sql.DB) error {
+		existing, err := listDatabases(db)
+		for _, database := range existing {
+			databases = append(databases, *database)
+		}
+		return err
+	})
+	slices.SortFunc(databases, func(a, b DatabaseInfo) int { return strings.Compare(a.Name, b.Name) })
+	return databases, err
+}
+
+func listDatabases(db *sql.DB) (map[string]*DatabaseInfo, error) {
+	rows, err := db.Query(listDatabasesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer rows.Close()
+	databases := map[string]*DatabaseInfo{}
+	for rows.Next() {
+		d := &DatabaseInfo{}
+		if err := rows.Scan(&d.Name, &d.Owner, &d.Encoding, &d.Collate, &d.Ctype, &d.Tablespace, &d.ConnectionLimit,
+			&d.Template, &d.Size, &d.Connections); err != nil {
+			return nil, fmt.Errorf("failed to scan database: %w", err)
+		}
+		databases[d.Name] = d
+	}
+	return databases, rows.Err()
+}
+
+// CreateDatabase ensures a database with default options exists
+func (p *Postgres) CreateDatabase(name string) error {
+	if name == "" {
+		return fmt.Errorf("database name not specified")
+	}
+	return p.ReconcileDatabases([]pkg.DatabaseConf{{Name: name}})
+}
+
+// CreateDatabaseWithOptions creates a database, failing if it exists
+func (p *Postgres) CreateDatabaseWithOptions(database pkg.DatabaseConf) error {
+	statement, err := createDatabaseStatement(database)
+	if err != nil {
+		return err
+	}
+	return p.execDatabaseStatements([]string{statement})
+}
+
+// DropDatabase drops a database, force terminates its connections first (PostgreSQL 13+)
+func (p *Postgres) DropDatabase(name string, ifExists, force bool) error {
+	statement := "DROP DATABASE "
+	if ifExists {
+		statement += "IF EXISTS "
+	}
+	statement += pq.QuoteIdentifier(name)
+	if force {
+		statement += " WITH (FORCE)"
+	}
+	return p.execDatabaseStatements([]string{statement})
+}
+
+// RenameDatabase renames a database, which must have no connections
+func (p *Postgres) RenameDatabase(name, newName string) error {
+	if p.Database == name {
+		return fmt.Errorf("cannot rename %s while connected to it, use --database to connect to another database", name)
+	}
+	return p.execDatabaseStatements([]string{
+		"ALTER DATABASE " + pq.QuoteIdentifier(name) + " RENAME TO " + pq.QuoteIdentifier(newName),
+	})
+}
+
+// CloneDatabase creates target as a copy of source, which must have no other connections during the copy.
+// terminate ends the connections to source first.
+func (p *Postgres) CloneDatabase(source, target, owner string, terminate bool) error {
+	if p.Database == source {
+		return fmt.Errorf("cannot clone %s while connected to it, use --database to connect to another database", source)
+	}
+	statements := []string{}
+	if terminate {
+		statements = append(statements, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = "+
+			pq.QuoteLiteral(source)+" AND pid <> pg_backend_pid()")
+	}
+	statement, err := createDatabaseStatement(pkg.DatabaseConf{Name: target, Template: source, Owner: owner})
+	if err != nil {
+		return err
+	}
+	return p.execDatabaseStatements(append(statements, statement))
+}
+
+// ReconcileDatabases creates the databases that do not exist and changes the owner, tablespace and connection
+// limit of the others to match, so it can run on every start. Encoding, locale and template only apply when a
+// database is created, differences are reported. Databases that are not listed are left as is.
+func (p *Postgres) ReconcileDatabases(databases []pkg.DatabaseConf) error {
+	if len(databases) == 0 {
+		return nil
+	}
+	names := map[string]bool{}
+	for i, database := range databases {
+		if database.Name == "" {
+			return fmt.Errorf("databases[%d]: name is required", i)
+		}
+		if names[database.Name] {
+			return fmt.Errorf("database %s is listed twice", database.Name)
+		}
+		names[database.Name] = true
+		if _, err := createDatabaseStatement(database); err != nil {
+			return err
+		}
+	}
+
+	for _, database := range databases {
+		fmt.Printf("🛠️  Ensuring database '%s' exists...\n", database.Name)
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping database creation")
+		return nil
+	}
+	return p.WithConnection(func(db *sql.DB) error {
+		existing, err := listDatabases(db)
+		if err != nil {
+			return err
+		}
+		var statements []string
+		for _, database := range databases {
+			changes, err := databaseStatements(database, existing[database.Name])
+			if err != nil {
+				return err
+			}
+			statements = append(statements, changes...)
+		}
+		return execEach(db, statements)
+	})
+}
+
+// createDatabaseStatement returns the CREATE DATABASE statement for database. A database with its own encoding
+// or locale is copied from template0, as template1 can contain data that depends on its locale.
+func createDatabaseStatement(database pkg.DatabaseConf) (string, error) {
+	if database.Name == "" {
+		return "", fmt.Errorf("database name not specified")
+	}
+	if database.LocaleProvider != "" && !slices.Contains(localeProviders, database.LocaleProvider) {
+		return "", fmt.Errorf("database %s: invalid locale provider %q, expected libc, icu or builtin", database.Name, database.LocaleProvider)
+	}
+	if database.IcuLocale != "" && database.LocaleProvider != "icu" {
+		return "", fmt.Errorf("database %s: icu_locale requires the icu locale provider", database.Name)
+	}
+
+	template := database.Template
+	if template == "" && (database.Encoding != "" || database.Locale != "" || database.LocaleProvider != "") {
+		template = "template0"
+	}
+	var options []string
+	if database.Owner != "" {
+		options = append(options, "OWNER "+pq.QuoteIdentifier(database.Owner))
+	}
+	if template != "" {
+		options = append(options, "TEMPLATE "+pq.QuoteIdentifier(template))
+	}
+	if database.Encoding != "" {
+		options = append(options, "ENCODING "+pq.QuoteLiteral(database.Encoding))
+	}
+	if database.Locale != "" {
+		options = append(options, "LOCALE "+pq.QuoteLiteral(database.Locale))
+	}
+	if database.LocaleProvider != "" {
+		options = append(options, "LOCALE_PROVIDER "+database.LocaleProvider)
+	}
+	if database.IcuLocale != "" {
+		options = append(options, "ICU_LOCALE "+pq.QuoteLiteral(database.IcuLocale))
+	}
+	if database.Tablespace != "" {
+		options = append(options, "TABLESPACE "+pq.QuoteIdentifier(database.Tablespace))
+	}
+	if database.ConnectionLimit != nil {
+		options = append(options, "CONNECTION LIMIT "+strconv.Itoa(*database.ConnectionLimit))
+	}
+
+	statement := "CREATE DATABASE " + pq.QuoteIdentifier(database.Name)
+	if len(options) > 0 {
+		statement += " WITH " + strings.Join(options, " ")
+	}
+	return statement, nil
+}
+
+// databaseStatements returns the statements that bring existing (nil if the database does not exist) to database
+func databaseStatements(database pkg.DatabaseConf, existing *DatabaseInfo) ([]string, error) {
+	if existing == nil {
+		statement, err := createDatabaseStatement(database)
+		if err != nil {
+			return nil, err
+		}
+		return []string{statement}, nil
+	}
+
+	if database.Encoding != "" && !strings.EqualFold(database.Encoding, existing.Encoding) {
+		clicky.Warnf("⚠️  Database %s has encoding %s instead of %s, recreate it to change the encoding", database.Name, existing.Encoding, database.Encoding)
+	}
+	if database.Locale != "" && database.LocaleProvider != "icu" && database.Locale != existing.Collate {
+		clicky.Warnf("⚠️  Database %s has locale %s instead of %s, recreate it to change the locale", database.Name, existing.Collate, database.Locale)
+	}
+
+	name := pq.QuoteIdentifier(database.Name)
+	var statements []string
+	if database.Owner != "" && database.Owner != existing.Owner {
+		statements = append(statements, "ALTER DATABASE "+name+" OWNER TO "+pq.QuoteIdentifier(database.Owner))
+	}
+	if database.Tablespace != "" && database.Tablespace != existing.Tablespace {
+		statements = append(statements, "ALTER DATABASE "+name+" SET TABLESPACE "+pq.QuoteIdentifier(database.Tablespace))
+	}
+	if database.ConnectionLimit != nil && *database.ConnectionLimit != existing.ConnectionLimit {
+		statements = append(statements, "ALTER DATABASE "+name+" WITH CONNECTION LIMIT "+strconv.Itoa(*database.ConnectionLimit))
+	}
+	return statements, nil
+}
+
+func (p *Postgres) execDatabaseStatements(statements []string) error {
+	if p.DryRun {
+		for _, statement := range statements {
+			clicky.Infof("[DRYRUN] %s", statement)
+		}
+		return nil
+	}
+	return p.WithConnection(func(db *sql.DB) error {
+		return execEach(db, statements)
+	})
+}
+
+// execEach runs statements one at a time, CREATE DATABASE and DROP DATABASE cannot run in a transaction
+func execEach(db *sql.DB, statements []string) error {
+	for _, statement := range statements {
+		clicky.SQL(statement)
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+func TestCreateDatabaseStatement(t *testing.T) {
+	limit := 20
+	tests := []struct {
+		name     string
+		database pkg.DatabaseConf
+		expected string
+		err      bool
+	}{
+		{name: "defaults", database: pkg.DatabaseConf{Name: "app"}, expected: `CREATE DATABASE "app"`},
+		{
+			name:     "quoted",
+			database: pkg.DatabaseConf{Name: `a"b; DROP DATABASE x`, Owner: "o'wner"},
+			expected: `CREATE DATABASE "a""b; DROP DATABASE x" WITH OWNER "o'wner"`,
+		},
+		{
+			name:     "locale uses template0",
+			database: pkg.DatabaseConf{Name: "app", Encoding: "UTF8", Locale: "en_US.UTF-8"},
+			expected: `CREATE DATABASE "app" WITH TEMPLATE "template0" ENCODING 'UTF8' LOCALE 'en_US.UTF-8'`,
+		},
+		{
+			name:     "icu",
+			database: pkg.DatabaseConf{Name: "app", LocaleProvider: "icu", IcuLocale: "de-DE", Tablespace: "fast", ConnectionLimit: &limit},
+			expected: `CREATE DATABASE "app" WITH TEMPLATE "template0" LOCALE_PROVIDER icu ICU_LOCALE 'de-DE' TABLESPACE "fast" CONNECTION LIMIT 20`,
+		},
+		{
+			name:     "explicit template",
+			database: pkg.DatabaseConf{Name: "copy", Template: "app", Locale: "C"},
+			expected: `CREATE DATABASE "copy" WITH TEMPLATE "app" LOCALE 'C'`,
+		},
+		{name: "no name", database: pkg.DatabaseConf{}, err: true},
+		{name: "invalid provider", database: pkg.DatabaseConf{Name: "app", LocaleProvider: "icu; DROP"}, err: true},
+		{name: "icu locale without icu", database: pkg.DatabaseConf{Name: "app", IcuLocale: "de-DE"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, err := createDatabaseStatement(tt.database)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error=%v, got %v", tt.err, err)
+			}
+			if statement != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, statement)
+			}
+		})
+	}
+}
+
+func TestDatabaseStatements(t *testing.T) {
+	limit, unlimited := 20, -1
+	existing := &DatabaseInfo{Name: "app", Owner: "postgres", Encoding: "UTF8", Tablespace: "pg_default", ConnectionLimit: -1}
+	tests := []struct {
+		name     string
+		database pkg.DatabaseConf
+		existing *DatabaseInfo
+		expected []string
+	}{
+		{name: "missing", database: pkg.DatabaseConf{Name: "app", Owner: "app"}, expected: []string{`CREATE DATABASE "app" WITH OWNER "app"`}},
+		{name: "unchanged", database: pkg.DatabaseConf{Name: "app", Owner: "postgres", ConnectionLimit: &unlimited}, existing: existing},
+		{name: "creation options are not changed", database: pkg.DatabaseConf{Name: "app", Encoding: "LATIN1"}, existing: existing},
+		{
+			name:     "changed",
+			database: pkg.DatabaseConf{Name: "app", Owner: "app", Tablespace: "fast", ConnectionLimit: &limit},
+			existing: existing,
+			expected: []string{
+				`ALTER DATABASE "app" OWNER TO "app"`,
+				`ALTER DATABASE "app" SET TABLESPACE "fast"`,
+				`ALTER DATABASE "app" WITH CONNECTION LIMIT 20`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements, err := databaseStatements(tt.database, tt.existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(statements, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("expected %v, got %v", tt.expected, statements)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+// envParams maps the libpq environment variables to the connection parameters they set
+var envParams = map[string]string{
+	"PGHOST":            "host",
+	"PGHOSTADDR":        "hostaddr",
+	"PGPORT":            "port",
+	"PGDATABASE":        "dbname",
+	"PGUSER":            "user",
+	"PGPASSWORD":        "password",
+	"PGOPTIONS":         "options",
+	"PGAPPNAME":         "application_name",
+	"PGSSLMODE":         "sslmode",
+	"PGSSLCERT":         "sslcert",
+	"PGSSLKEY":          "sslkey",
+	"PGSSLROOTCERT":     "sslrootcert",
+	"PGSSLSNI":          "sslsni",
+	"PGCONNECT_TIMEOUT": "connect_timeout",
+}
+
+// pqParams are the connection parameters lib/pq understands, it sends any other parameter to the server as a
+// setting, which fails the connection
+var pqParams = []string{
+	"sslmode", "sslcert", "sslkey", "sslrootcert", "sslsni", "application_name", "fallback_application_name",
+	"connect_timeout", "options", "krbsrvname", "krbspn",
+}
+
+// pqUnsupportedEnv are the libpq environment variables lib/pq panics on, they are resolved by
+// ResolveConnectionParams instead and removed from the environment by HideUnsupportedEnv
+var pqUnsupportedEnv = []string{
+	"PGHOSTADDR", "PGSERVICE", "PGSERVICEFILE", "PGREALM", "PGREQUIRESSL", "PGSSLCRL", "PGREQUIREPEER",
+	"PGKRBSRVNAME", "PGGSSLIB", "PGSYSCONFDIR", "PGLOCALEDIR",
+}
+
+var (
+	pqEnvLock sync.Mutex
+	// pqHiddenEnv are the variables of pqUnsupportedEnv removed from the environment by HideUnsupportedEnv
+	pqHiddenEnv = map[string]string{}
+)
+
+// HideUnsupportedEnv removes the libpq variables lib/pq panics on from the environment of the process, they are
+// still used by ResolveConnectionParams and passed to client tools by ClientEnv. It is called at startup before
+// any connection is made or child process started, as changing the environment races with building the
+// environment of child processes.
+func HideUnsupportedEnv() {
+	pqEnvLock.Lock()
+	defer pqEnvLock.Unlock()
+	for _, name := range pqUnsupportedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			pqHiddenEnv[name] = value
+			os.Unsetenv(name) //nolint:errcheck
+		}
+	}
+}
+
+// getenv returns an environment variable, including those removed by HideUnsupportedEnv
+func getenv(name string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	pqEnvLock.Lock()
+	defer pqEnvLock.Unlock()
+	return pqHiddenEnv[name]
+}
+
+// ParseDSN parses a postgres:// or postgresql:// URI or a libpq key=value connection string into its parameters
+func ParseDSN(dsn string) (map[string]string, error) {
+	dsn = strings.TrimSpace(dsn)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return parseURI(dsn)
+	}
+	return parseKeyValues(dsn)
+}
+
+// parseURI parses postgresql://[user[:password]@][host][:port][/dbname][?param=value&...], the host can be a
+// percent-encoded socket directory or [IPv6] address
+func parseURI(uri string) (map[string]string, error) {
+	params := map[string]string{}
+	rest := uri[strings.Index(uri, "://")+3:]
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		// unlike url.ParseQuery, + is not a space
+		for _, pair := range strings.Split(rest[i+1:], "&") {
+			if pair == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(pair, "=")
+			key, err := url.PathUnescape(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid connection URI parameter %s: %w", pair, err)
+			}
+			if params[key], err = url.PathUnescape(value); err != nil {
+				return nil, fmt.Errorf("invalid connection URI parameter %s: %w", pair, err)
+			}
+		}
+		rest = rest[:i]
+	}
+
+	authority, database, _ := strings.Cut(rest, "/")
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		user, password, hasPassword := strings.Cut(authority[:i], ":")
+		if err := setUnescaped(params, "user", user); err != nil {
+			return nil, err
+		}
+		if hasPassword {
+			if err := setUnescaped(params, "password", password); err != nil {
+				return nil, err
+			}
+		}
+		authority = authority[i+1:]
+	}
+	if strings.Contains(authority, ",") {
+		return nil, fmt.Errorf("connection URIs with multiple hosts are not supported")
+	}
+
+	host, port := authority, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid connection URI: missing ] in %s", authority)
+		}
+		host, port = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+	} else if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host, port = host[:i], host[i+1:]
+	}
+	for key, value := range map[string]string{"host": host, "port": port, "dbname": database} {
+		if err := setUnescaped(params, key, value); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// setUnescaped sets a percent-encoded URI component that is not empty, parameters in the query string win
+func setUnescaped(params map[string]string, key, value string) error {
+	if value == "" {
+		return nil
+	}
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return fmt.Errorf("invalid connection URI %s: %w", key, err)
+	}
+	if _, ok := params[key]; !ok {
+		params[key] = unescaped
+	}
+	return nil
+}
+
+// parseKeyValues parses key=value pairs separated by spaces, values can be single quoted and use \ escapes
+func parseKeyValues(dsn string) (map[string]string, error) {
+	params := map[string]string{}
+	s := []rune(dsn)
+	for i := 0; i < len(s); {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		start := i
+		for i < len(s) && s[i] != '=' && !isSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", key)
+		}
+		i++
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+
+		var value strings.Builder
+		quoted := i < len(s) && s[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				value.WriteRune(s[i])
+				continue
+			}
+			if (quoted && s[i] == '\'') || (!quoted && isSpace(s[i])) {
+				break
+			}
+			value.WriteRune(s[i])
+		}
+		if quoted {
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted value for %q in connection string", key)
+			}
+			i++
+		}
+		params[key] = value.String()
+	}
+	return params, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// ResolveConnectionParams resolves the connection parameters the way libpq does: the parameters of dsn take
+// precedence over those of the pg_service.conf service named by its service parameter or PGSERVICE, which take
+// precedence over the PG* environment variables. Parameters that are not set anywhere are left out.
+func ResolveConnectionParams(dsn string) (map[string]string, error) {
+	params, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	service := params["service"]
+	if service == "" {
+		service = getenv("PGSERVICE")
+	}
+	delete(params, "service")
+	if service != "" {
+		serviceParams, err := lookupService(service)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range serviceParams {
+			if _, ok := params[key]; !ok {
+				params[key] = value
+			}
+		}
+	}
+
+	for env, key := range envParams {
+		if value := os.Getenv(env); value != "" {
+			if _, ok := params[key]; !ok {
+				params[key] = value
+			}
+		}
+	}
+
+	// lib/pq has no hostaddr, the address is used as the host when there is no host name
+	if hostaddr, ok := params["hostaddr"]; ok {
+		if params["host"] == "" {
+			params["host"] = hostaddr
+		}
+		delete(params, "hostaddr")
+	}
+	return params, nil
+}
+
+// serviceFiles returns the per-user and system-wide pg_service.conf, the per-user file is searched first
+func serviceFiles() []string {
+	var files []string
+	if file := getenv("PGSERVICEFILE"); file != "" {
+		files = append(files, file)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	sysconfdir := getenv("PGSYSCONFDIR")
+	if sysconfdir == "" {
+		sysconfdir = "/etc/postgresql-common"
+	}
+	return append(files, filepath.Join(sysconfdir, "pg_service.conf"))
+}
+
+func lookupService(name string) (map[string]string, error) {
+	for _, file := range serviceFiles() {
+		params, err := readServiceFile(file, name)
+		if err != nil {
+			return nil, err
+		}
+		if params != nil {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("definition of service %q not found in %s", name, strings.Join(serviceFiles(), " or "))
+}
+
+// readServiceFile returns the parameters of the [name] section of an INI style pg_service.conf, or nil when the
+// file or the section does not exist
+func readServiceFile(file, name string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read service file: %w", err)
+	}
+	defer f.Close()
+
+	var params map[string]string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case strings.HasPrefix(text, "["):
+			if params != nil {
+				return params, nil
+			}
+			if strings.TrimSuffix(strings.TrimPrefix(text, "["), "]") == name {
+				params = map[string]string{}
+			}
+		case params != nil:
+			key, value, ok := strings.Cut(text, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: syntax error in service file", file, line)
+			}
+			params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return params, scanner.Err()
+}
+
+// ApplyConnectionParams sets the connection of p from params, as returned by ResolveConnectionParams. Parameters
+// other than the host, port, user, password and database are kept in ConnectionParams.
+func (p *Postgres) ApplyConnectionParams(params map[string]string) error {
+	if p.ConnectionParams == nil {
+		p.ConnectionParams = map[string]string{}
+	}
+	for key, value := range params {
+		switch key {
+		case "host":
+			p.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid port %q", value)
+			}
+			p.Port = port
+		case "user":
+			p.Username = value
+		case "password":
+			p.Password = utils.NewSensitiveString(value)
+		case "dbname":
+			p.Database = value
+		default:
+			p.ConnectionParams[key] = value
+		}
+	}
+	return nil
+}
+
+// pgpassFile returns PGPASSFILE or ~/.pgpass
+func pgpassFile() string {
+	if file := os.Getenv("PGPASSFILE"); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".pgpass")
+}
+
+// LoadPgpass sets the password from the first matching host:port:database:username:password line of the
+// password file, when no password is set. Like libpq, the file is ignored when others can read it.
+func (p *Postgres) LoadPgpass() error {
+	if !p.Password.IsEmpty() {
+		return nil
+	}
+	file := pgpassFile()
+	if file == "" {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read password file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		clicky.Warnf("⚠️  Password file %s has group or world access, permissions should be u=rw (0600) or less", file)
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read password file: %w", err)
+	}
+
+	// a socket directory matches localhost
+	host := p.Host
+	if host == "" || strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	port := strconv.Itoa(p.Port)
+	if p.Port == 0 {
+		port = "5432"
+	}
+	if password, ok := matchPgpass(string(data), host, port, p.Database, p.Username); ok {
+		logger.Debugf("Using the password for %s@%s:%s/%s from %s", p.Username, host, port, p.Database, file)
+		p.Password = utils.NewSensitiveString(password)
+	}
+	return nil
+}
+
+func matchPgpass(data, host, port, database, user string) (string, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matches := true
+		for i, value := range []string{host, port, database, user} {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4], true
+		}
+	}
+	return "", false
+}
+
+// splitPgpassLine splits a line on the colons that are not escaped with \
+func splitPgpassLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// GetConnectionString returns the key=value connection string for lib/pq. SSL is disabled unless sslmode is
+// set, as lib/pq defaults to require; allow and prefer also connect without SSL as lib/pq cannot fall back.
+func (p *Postgres) GetConnectionString() string {
+	params := map[string]string{"sslmode": "disable"}
+	for _, key := range pqParams {
+		if value, ok := p.ConnectionParams[key]; ok {
+			params[key] = value
+		}
+	}
+	if params["sslmode"] == "allow" || params["sslmode"] == "prefer" {
+		params["sslmode"] = "disable"
+	}
+	for key := range p.ConnectionParams {
+		if !slices.Contains(pqParams, key) {
+			logger.Debugf("Ignoring the connection parameter %s, it is not supported", key)
+		}
+	}
+
+	if p.Database != "" {
+		params["dbname"] = p.Database
+	}
+	if p.Host != "" {
+		params["host"] = p.Host
+	}
+	if p.Port != 0 {
+		params["port"] = strconv.Itoa(p.Port)
+	}
+	if p.Username != "" {
+		params["user"] = p.Username
+	}
+	if p.Password != "" {
+		params["password"] = p.Password.Value()
+	}
+
+	return connString(params)
+}
+
+// connString joins params into a key=value connection string, sorted by key
+func connString(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + quoteConnValue(params[key])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// quoteConnValue quotes a value of a key=value connection string when it is empty or contains spaces,
+// quotes or backslashes
+func quoteConnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r'\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// newConnector creates a lib/pq connector, the libpq variables it panics on are normally removed at startup and
+// only hidden here when the environment was not prepared with HideUnsupportedEnv
+func newConnector(dsn string) (*pq.Connector, error) {
+	HideUnsupportedEnv()
+	return pq.NewConnector(dsn)
+}
+
+// ConnInfo returns the libpq connection string of p for database, for client tools such as pg_dump. It takes
+// precedence over a service in PGSERVICE, the password is passed by ClientEnv so that it is not on the command line.
+func (p *Postgres) ConnInfo(database string) string {
+	params := map[string]string{}
+	for key, value := range p.ConnectionParams {
+		params[key] = value
+	}
+	for key, value := range map[string]string{"host": p.Host, "user": p.Username, "dbname": database} {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	if p.Port != 0 {
+		params["port"] = strconv.Itoa(p.Port)
+	}
+	return connString(params)
+}
+
+// ClientEnv returns the environment of client tools run with ConnInfo, libpq supports the variables removed by
+// HideUnsupportedEnv
+func (p *Postgres) ClientEnv() map[string]string {
+	env := map[string]string{}
+	pqEnvLock.Lock()
+	for name, value := range pqHiddenEnv {
+		env[name] = value
+	}
+	pqEnvLock.Unlock()
+	if !p.Password.IsEmpty() {
+		env["PGPASSWORD"] = p.Password.Value()
+	}
+	return env
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/clicky"
+)
+
+// DefaultInitScriptsDir is where the official postgres image looks for initialization scripts
+const DefaultInitScriptsDir = "/docker-entrypoint-initdb.d"
+
+// ServerCommand returns the command the container runs and whether it is the PostgreSQL server.
+// As in the official image, no arguments or only flags (e.g. -c shared_buffers=1GB) start postgres,
+// any other command is run as given without initializing the cluster.
+func ServerCommand(args []string) ([]string, bool) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return append([]string{"postgres"}, args...), true
+	}
+	return args, args[0] == "postgres"
+}
+
+// SetupDockerCluster initializes an empty data directory the way the official postgres image does:
+// initdb with POSTGRES_USER, POSTGRES_PASSWORD and POSTGRES_INITDB_ARGS, then creates POSTGRES_DB and runs
+// the scripts in initScriptsDir against a server that only listens on a private Unix socket.
+// Nothing is done if the data directory already contains a cluster.
+func (p *Postgres) SetupDockerCluster(env *DockerEnv, initScriptsDir string) error {
+	exists := DatabaseAlreadyExists(p.DataDir)
+	if err := ValidateMinimumEnv(env, exists); err != nil {
+		return err
+	}
+	if exists {
+		clicky.Infof("PostgreSQL database directory %s already contains a cluster, skipping initialization", p.DataDir)
+		return nil
+	}
+
+	if err := p.InitDBWithOptions(InitDBOptions{
+		Username:   env.User,
+		Password:   env.Password,
+		InitDBArgs: env.InitDBArgs,
+		WALDir:     env.WALDir,
+	}); err != nil {
+		return err
+	}
+	if p.DryRun {
+		return nil
+	}
+
+	socketDir, err := os.MkdirTemp("", "postgres-init-")
+	if err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(socketDir)
+
+	temp := &Postgres{
+		Config:   p.Config,
+		DataDir:  p.DataDir,
+		BinDir:   p.BinDir,
+		Host:     socketDir,
+		Port:     p.Port,
+		Username: env.User,
+		Password: env.Password,
+		Database: "postgres",
+	}
+	settings := map[string]string{"unix_socket_directories": socketDir}
+	if p.Port > 0 {
+		settings["port"] = strconv.Itoa(p.Port)
+	}
+	if _, err := temp.StartTempServer(TempServerOptions{UnixSocketOnly: true, Settings: settings}); err != nil {
+		return err
+	}
+
+	if err := temp.initializeDatabase(env, initScriptsDir); err != nil {
+		_ = temp.StopTempServer()
+		return err
+	}
+	if err := temp.StopTempServer(); err != nil {
+		return err
+	}
+	return p.SetupPgHBA(env.AuthMethod())
+}
+
+func (p *Postgres) initializeDatabase(env *DockerEnv, initScriptsDir string) error {
+	if env.Database != "postgres" {
+		if err := p.CreateDatabase(env.Database); err != nil {
+			return fmt.Errorf("failed to create database %s: %w", env.Database, err)
+		}
+	}
+	p.Database = env.Database
+	return p.ProcessInitScripts(initScriptsDir)
+}
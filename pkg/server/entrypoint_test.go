@@ -0,0 +1,117 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+func TestServerCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		argv     []string
+		isServer bool
+	}{
+		{nil, []string{"postgres"}, true},
+		{[]string{"-c", "shared_buffers=1GB"}, []string{"postgres", "-c", "shared_buffers=1GB"}, true},
+		{[]string{"postgres", "-c", "max_connections=50"}, []string{"postgres", "-c", "max_connections=50"}, true},
+		{[]string{"bash"}, []string{"bash"}, false},
+		{[]string{"supervisord", "-c", "/etc/supervisord.conf"}, []string{"supervisord", "-c", "/etc/supervisord.conf"}, false},
+	}
+	for _, tt := range tests {
+		argv, isServer := ServerCommand(tt.args)
+		if !reflect.DeepEqual(argv, tt.argv) || isServer != tt.isServer {
+			t.Errorf("ServerCommand(%v) = %v, %v, want %v, %v", tt.args, argv, isServer, tt.argv, tt.isServer)
+		}
+	}
+}
+
+func TestDockerEnvAuthMethod(t *testing.T) {
+	tests := []struct {
+		env  DockerEnv
+		want string
+	}{
+		{DockerEnv{}, "trust"},
+		{DockerEnv{Password: "secret"}, "scram-sha-256"},
+		{DockerEnv{Password: "secret", HostAuthMethod: "md5"}, "md5"},
+		{DockerEnv{HostAuthMethod: "trust"}, "trust"},
+	}
+	for _, tt := range tests {
+		if got := tt.env.AuthMethod(); got != tt.want {
+			t.Errorf("AuthMethod() with %+v = %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestSetupDockerEnvFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	userFile := filepath.Join(dir, "user")
+	if err := os.WriteFile(userFile, []byte("app\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PGPASSWORD", "fallback")
+	t.Setenv("POSTGRES_PASSWORD_FILE", passwordFile)
+	t.Setenv("POSTGRES_USER_FILE", userFile)
+
+	env, err := SetupDockerEnv()
+	if err != nil {
+		t.Fatalf("SetupDockerEnv failed: %v", err)
+	}
+	if env.Password.Value() != "from-file" {
+		t.Errorf("expected POSTGRES_PASSWORD_FILE to take precedence over PGPASSWORD, got %q", env.Password.Value())
+	}
+	if env.User != "app" || env.Database != "app" {
+		t.Errorf("expected user and database app, got %s and %s", env.User, env.Database)
+	}
+
+	t.Setenv("POSTGRES_PASSWORD", "both")
+	if _, err := SetupDockerEnv(); err == nil {
+		t.Error("expected error when POSTGRES_PASSWORD and POSTGRES_PASSWORD_FILE are both set")
+	}
+}
+
+func TestSetupDockerCluster(t *testing.T) {
+	t.Run("existing cluster is left untouched", func(t *testing.T) {
+		dataDir := t.TempDir()
+		writeFakeCluster(t, dataDir, 17)
+
+		p := &Postgres{DataDir: dataDir, BinDir: "/nonexistent"}
+		if err := p.SetupDockerCluster(&DockerEnv{User: "postgres", Database: "postgres"}, t.TempDir()); err != nil {
+			t.Fatalf("expected existing cluster to be skipped, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, "pg_hba.conf")); !os.IsNotExist(err) {
+			t.Errorf("expected pg_hba.conf not to be written for an existing cluster")
+		}
+	})
+
+	t.Run("password is required", func(t *testing.T) {
+		dataDir := t.TempDir()
+		p := &Postgres{DataDir: dataDir, BinDir: "/nonexistent"}
+		if err := p.SetupDockerCluster(&DockerEnv{User: "postgres", Database: "postgres"}, t.TempDir()); err == nil {
+			t.Error("expected error without POSTGRES_PASSWORD or POSTGRES_HOST_AUTH_METHOD=trust")
+		}
+		if DatabaseAlreadyExists(dataDir) {
+			t.Error("expected data directory not to be initialized")
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dataDir := filepath.Join(t.TempDir(), "data")
+		p := &Postgres{DataDir: dataDir, BinDir: "/nonexistent", DryRun: true}
+		env := &DockerEnv{User: "app", Password: utils.SensitiveString("secret"), Database: "app"}
+		if err := p.SetupDockerCluster(env, t.TempDir()); err != nil {
+			t.Fatalf("dry run failed: %v", err)
+		}
+		if DatabaseAlreadyExists(dataDir) {
+			t.Error("expected dry run not to initialize the data directory")
+		}
+	})
+}
@@ -28,10 +28,14 @@ func SetupDockerEnv() (*DockerEnv, error) {
 	}
 	env.User = userStr
 
-	passwordStr, err := utils.FileEnv("POSTGRES_PASSWORD", "")
+	// PGPASSWORD is what the rest of postgres-cli reads, it is used when POSTGRES_PASSWORD is not set
+	passwordStr, err := utils.FileEnv("PGPASSWORD", "")
 	if err != nil {
 		return nil, err
 	}
+	if passwordStr, err = utils.FileEnv("POSTGRES_PASSWORD", passwordStr); err != nil {
+		return nil, err
+	}
 	env.Password = utils.SensitiveString(passwordStr)
 
 	env.Database, err = utils.FileEnv("POSTGRES_DB", env.User)
@@ -57,6 +61,18 @@ func SetupDockerEnv() (*DockerEnv, error) {
 	return env, nil
 }
 
+// AuthMethod is the pg_hba.conf method for connections from other hosts: POSTGRES_HOST_AUTH_METHOD if set,
+// otherwise scram-sha-256 when a password is set and trust without one
+func (env *DockerEnv) AuthMethod() string {
+	if env.HostAuthMethod != "" {
+		return env.HostAuthMethod
+	}
+	if env.Password.IsEmpty() {
+		return "trust"
+	}
+	return "scram-sha-256"
+}
+
 // ValidateMinimumEnv validates that required environment variables are set
 func ValidateMinimumEnv(env *DockerEnv, databaseExists bool) error {
 	if databaseExists {
@@ -8,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,6 +19,7 @@ import (
 	"github.com/flanksource/postgres/pkg/generators"
 	"github.com/flanksource/postgres/pkg/health"
 	"github.com/flanksource/postgres/pkg/pgtune"
+	"github.com/flanksource/postgres/pkg/supervisor"
 	"github.com/flanksource/postgres/pkg/sysinfo"
 )
 
@@ -32,6 +32,7 @@ type HealthServer struct {
 	DBType        string
 	MaxConn       int
 	server        *http.Server
+	listener      net.Listener
 	healthChecker *health.HealthChecker
 	startTime     time.Time
 
@@ -40,6 +41,16 @@ type HealthServer struct {
 	PgBouncerConfig *pkg.PgBouncerConf
 	PostgRESTConfig *pkg.PostgrestConf
 	WalgConfig      *pkg.WalgConf
+
+	// Processes run by postgres-cli run, set to its supervisor.Manager when the health server runs next to it
+	Processes health.Processes
+
+	// Postgres is the server that is checked and backed up, when nil it is created from PostgresConfig
+	Postgres *Postgres
+
+	// BackupScheduler takes the scheduled backups, when nil it is created from the backup_schedule of
+	// WalgConfig or the backup.schedule property
+	BackupScheduler *BackupScheduler
 }
 
 // NewHealthServer creates a new health check server
@@ -51,8 +62,17 @@ func NewHealthServer(port int, configDir string) *HealthServer {
 	}
 }
 
-// Start starts the health check server
+// Start starts the health check server and serves requests until Stop is called
 func (s *HealthServer) Start() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	return s.server.Serve(s.listener)
+}
+
+// listen binds the port and starts the health checker and the backup scheduler, the requests are served by
+// s.server.Serve(s.listener)
+func (s *HealthServer) listen() error {
 
 	// Initialize health checker if not already set
 	if s.healthChecker == nil {
@@ -70,6 +90,7 @@ func (s *HealthServer) Start() error {
 	mux.HandleFunc("/health/supervisord", s.handleHealthSupervisord)
 	mux.HandleFunc("/health/config", s.handleHealthConfig)
 	mux.HandleFunc("/health/status", s.handleHealthStatus)
+	mux.HandleFunc("/health/backups", s.handleHealthBackups)
 	mux.HandleFunc("/config/postgresql.conf", s.handlePostgreSQLConfig)
 	mux.HandleFunc("/config/pgbouncer.ini", s.handlePgBouncerConfig)
 	mux.HandleFunc("/config/postgrest.conf", s.handlePostgRESTConfig)
@@ -83,6 +104,12 @@ func (s *HealthServer) Start() error {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.Port, err)
+	}
+	s.listener = listener
+
 	log.Printf("Starting health check server on port %d", s.Port)
 
 	// Start the health checker
@@ -94,7 +121,10 @@ func (s *HealthServer) Start() error {
 		}
 	}
 
-	return s.server.ListenAndServe()
+	if s.BackupScheduler != nil {
+		s.BackupScheduler.Start()
+	}
+	return nil
 }
 
 // Stop stops the health check server
@@ -106,6 +136,12 @@ func (s *HealthServer) Stop(ctx context.Context) error {
 		}
 	}
 
+	if s.BackupScheduler != nil {
+		if err := s.BackupScheduler.Stop(ctx); err != nil {
+			log.Printf("Warning: Failed to stop backup scheduler: %v", err)
+		}
+	}
+
 	if s.server != nil {
 		return s.server.Shutdown(ctx)
 	}
@@ -407,7 +443,7 @@ func (s *HealthServer) handleHealthExtensions(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleHealthSupervisord returns supervisord process status
+// handleHealthSupervisord returns the status of the processes run by postgres-cli
 func (s *HealthServer) handleHealthSupervisord(w http.ResponseWriter, r *http.Request) {
 	supervisordStatus := s.getSupervisordStatus()
 
@@ -433,6 +469,20 @@ func (s *HealthServer) handleHealthConfig(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleHealthBackups returns the status of the scheduled backups
+func (s *HealthServer) handleHealthBackups(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"timestamp": time.Now().Unix(),
+		"enabled":   s.BackupScheduler != nil,
+	}
+	if s.BackupScheduler != nil {
+		response["backups"] = s.BackupScheduler.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // isPortOpen checks if a port is open on localhost
 func isPortOpen(port int) bool {
 	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), 3*time.Second)
@@ -537,20 +587,13 @@ func (s *HealthServer) getWALGStatus() ServiceStatus {
 	if !enabled {
 		status.Status = "disabled"
 		status.Details = "WAL-G is not enabled"
+	} else if isPortOpen(5432) {
+		// WAL-G is not a process, PostgreSQL runs wal-g wal-push as its archive_command
+		status.Status = "running"
+		status.Details = "WAL is archived by the archive_command of PostgreSQL"
 	} else {
-		// WAL-G doesn't have a port, check if process is running via supervisorctl
-		if output, err := exec.Command("supervisorctl", "status", "walg").Output(); err == nil {
-			if strings.Contains(string(output), "RUNNING") {
-				status.Status = "running"
-				status.Details = "WAL-G backup service is running"
-			} else {
-				status.Status = "stopped"
-				status.Details = "WAL-G backup service is not running"
-			}
-		} else {
-			status.Status = "unknown"
-			status.Details = "Unable to determine WAL-G status"
-		}
+		status.Status = "stopped"
+		status.Details = "PostgreSQL is not running, no WAL is archived"
 	}
 
 	return status
@@ -616,52 +659,34 @@ func (s *HealthServer) getExtensionVersion(sqlName string) string {
 	return "unknown"
 }
 
-// getSupervisordStatus returns supervisord process status
+// getSupervisordStatus returns the status of the processes run by postgres-cli
 func (s *HealthServer) getSupervisordStatus() map[string]interface{} {
 	status := map[string]interface{}{
 		"running":   false,
-		"processes": []map[string]interface{}{},
+		"processes": []supervisor.Status{},
 	}
 
-	// Check if supervisorctl is available
-	if _, err := exec.LookPath("supervisorctl"); err != nil {
-		status["error"] = "supervisorctl not available"
+	if s.Processes == nil {
+		status["error"] = "processes are not supervised by postgres-cli"
 		return status
 	}
 
-	// Get supervisord status
-	if output, err := exec.Command("supervisorctl", "status").Output(); err == nil {
-		status["running"] = true
-		processes := []map[string]interface{}{}
-
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
-
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				process := map[string]interface{}{
-					"name":   parts[0],
-					"status": parts[1],
-				}
-
-				if len(parts) > 2 {
-					process["details"] = strings.Join(parts[2:], " ")
-				}
+	status["running"] = true
+	status["processes"] = s.Processes.Status()
+	return status
+}
 
-				processes = append(processes, process)
-			}
+// processStatus returns the status of the process named name, if it is supervised
+func (s *HealthServer) processStatus(name string) (supervisor.Status, bool) {
+	if s.Processes == nil {
+		return supervisor.Status{}, false
+	}
+	for _, process := range s.Processes.Status() {
+		if process.Name == name {
+			return process, true
 		}
-
-		status["processes"] = processes
-	} else {
-		status["error"] = fmt.Sprintf("supervisorctl status failed: %v", err)
 	}
-
-	return status
+	return supervisor.Status{}, false
 }
 
 // getConfigValidationStatus returns configuration validation status
@@ -745,7 +770,10 @@ func (s *HealthServer) initializeHealthChecker() {
 	var enabledServices []string
 
 	// Always create PostgreSQL service
-	if s.PostgresConfig != nil {
+	if s.Postgres != nil {
+		postgresService = s.Postgres
+		enabledServices = append(enabledServices, "postgresql")
+	} else if s.PostgresConfig != nil {
 		postgresService = NewPostgres(s.PostgresConfig, s.ConfigDir)
 		enabledServices = append(enabledServices, "postgresql")
 	}
@@ -762,10 +790,9 @@ func (s *HealthServer) initializeHealthChecker() {
 		enabledServices = append(enabledServices, "postgrest")
 	}
 
-	// Create WAL-G service if configured
+	// Create WAL-G service if configured, it runs as the archive_command of PostgreSQL rather than a process
 	if s.WalgConfig != nil && s.WalgConfig.Enabled {
 		walgService = pkg.NewWalG(s.WalgConfig)
-		enabledServices = append(enabledServices, "walg")
 	}
 
 	// Determine WAL directory from PostgreSQL data directory
@@ -786,6 +813,10 @@ func (s *HealthServer) initializeHealthChecker() {
 		}
 	}
 
+	if s.BackupScheduler == nil {
+		s.BackupScheduler = s.newBackupScheduler(postgresService)
+	}
+
 	// Create comprehensive health checker config
 	config := &health.Config{
 		// Service instances
@@ -804,8 +835,8 @@ func (s *HealthServer) initializeHealthChecker() {
 		BackupLocation: backupLocation,
 
 		// Supervisor configuration
-		SupervisorEnabled: true, // Always monitor supervisor processes
-		EnabledServices:   enabledServices,
+		Processes:       s.Processes,
+		EnabledServices: enabledServices,
 
 		// Thresholds
 		DiskSpaceThreshold:   90.0,               // 90%
@@ -814,6 +845,10 @@ func (s *HealthServer) initializeHealthChecker() {
 		WALSizeThreshold:     1024 * 1024 * 1024, // 1GB
 	}
 
+	if s.BackupScheduler != nil {
+		config.BackupScheduler = s.BackupScheduler
+	}
+
 	healthChecker, err := health.NewHealthChecker(config)
 	if err != nil {
 		log.Printf("Warning: Failed to create health checker: %v", err)
@@ -823,6 +858,28 @@ func (s *HealthServer) initializeHealthChecker() {
 	s.healthChecker = healthChecker
 }
 
+// newBackupScheduler schedules WAL-G base backups when WAL-G has a backup_schedule, otherwise logical backups
+// when the backup.schedule property is set
+func (s *HealthServer) newBackupScheduler(postgres *Postgres) *BackupScheduler {
+	opts := DefaultBackupScheduleOptions()
+	if s.WalgConfig != nil && s.WalgConfig.Enabled && s.WalgConfig.BackupSchedule != "" {
+		var err error
+		if opts, err = WalgBackupScheduleOptions(s.WalgConfig); err != nil {
+			log.Printf("Warning: Failed to schedule backups: %v", err)
+			return nil
+		}
+	} else if opts.Schedule == "" || postgres == nil {
+		return nil
+	}
+
+	scheduler, err := NewBackupScheduler(postgres, opts)
+	if err != nil {
+		log.Printf("Warning: Failed to schedule backups: %v", err)
+		return nil
+	}
+	return scheduler
+}
+
 // LoadServiceConfigs loads and hydrates service configurations with defaults
 func (s *HealthServer) LoadServiceConfigs() {
 	// PostgreSQL configuration - always present
@@ -891,6 +948,16 @@ func (s *HealthServer) LoadServiceConfigs() {
 		if filePrefix := os.Getenv("WALG_FILE_PREFIX"); filePrefix != "" {
 			s.WalgConfig.FilePrefix = &filePrefix
 		}
+
+		// Backup schedule and retention
+		s.WalgConfig.BackupSchedule = os.Getenv("WALG_BACKUP_SCHEDULE")
+		s.WalgConfig.BackupRetainCount = 7
+		if retainCount, err := strconv.Atoi(os.Getenv("WALG_BACKUP_RETAIN_COUNT")); err == nil {
+			s.WalgConfig.BackupRetainCount = retainCount
+		}
+		if retentionPolicy := os.Getenv("WALG_RETENTION_POLICY"); retentionPolicy != "" {
+			s.WalgConfig.RetentionPolicy = &retentionPolicy
+		}
 	}
 }
 
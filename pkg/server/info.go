@@ -77,6 +77,11 @@ type PostgresInfo struct {
 	FullVersion      string     `json:"full_version"`
 	WalInfo          WalInfo    `json:"wal_info,omitempty"`
 	Checkpoint       Checkpoint `json:"checkpoint,omitempty"`
+
+	// Outcome of the last upgrade and its post-upgrade tasks
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+	// Journal of an upgrade that is running or was interrupted, including replication progress
+	UpgradeInProgress *UpgradeJournal `json:"upgrade_in_progress,omitempty"`
 }
 
 func calculateDirectorySize(dirPath string) (int64, error) {
@@ -99,6 +104,30 @@ func calculateDirectorySize(dirPath string) (int64, error) {
 	return totalSize, err
 }
 
+// formatRelativeTime describes how long ago t was, e.g. "5 mins ago" or "yesterday"
+func formatRelativeTime(t time.Time) string {
+	since := time.Since(t)
+	switch {
+	case since < time.Minute:
+		return "just now"
+	case since < time.Hour:
+		return plural(int(since/time.Minute), "min") + " ago"
+	case since < 24*time.Hour:
+		return plural(int(since/time.Hour), "hour") + " ago"
+	case since < 48*time.Hour:
+		return "yesterday"
+	default:
+		return plural(int(since/(24*time.Hour)), "day") + " ago"
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
 // calculateDBDirectorySize calculates database size from data directory
 // Excludes temporary files, WAL, backups, and other non-database directories
 func calculateDBDirectorySize(dataDir string) (int64, error) {
@@ -346,6 +375,13 @@ func (p *Postgres) Info() (*PostgresInfo, error) {
 		}
 	}
 
+	if status, err := LoadUpgradeStatus(p.DataDir); err == nil {
+		info.Upgrade = status
+	}
+	if journal, err := LoadUpgradeJournal(p.DataDir); err == nil {
+		info.UpgradeInProgress = journal
+	}
+
 	if sysInfo, err := sysinfo.DetectSystemInfo(); err == nil {
 		info.System = *sysInfo
 	}
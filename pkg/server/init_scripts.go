@@ -82,28 +82,29 @@ func (p *Postgres) processShellScript(file string) error {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	if info.Mode()&0111 != 0 {
-		cmd := clicky.Exec(file)
-		cmd.Env = map[string]string{
-			"PGDATA":     p.DataDir,
-			"PGHOST":     p.Host,
-			"PGPORT":     fmt.Sprintf("%d", p.Port),
-			"PGUSER":     p.Username,
-			"PGDATABASE": p.Database,
-		}
-		if p.Password != "" {
-			cmd.Env["PGPASSWORD"] = string(p.Password)
-		}
-
-		process := cmd.Run()
-		if process.Err != nil {
-			return fmt.Errorf("shell script failed: %w\nStdout: %s\nStderr: %s",
-				process.Err, process.GetStdout(), process.GetStderr())
-		}
-		return nil
+	// The official image sources scripts that are not executable, they are run with bash here so
+	// variables they export are not seen by later scripts
+	cmd := clicky.Exec(file)
+	if info.Mode()&0111 == 0 {
+		cmd = clicky.Exec("bash", file)
+	}
+	cmd.Env = map[string]string{
+		"PGDATA":     p.DataDir,
+		"PGHOST":     p.Host,
+		"PGPORT":     fmt.Sprintf("%d", p.Port),
+		"PGUSER":     p.Username,
+		"PGDATABASE": p.Database,
+	}
+	if p.Password != "" {
+		cmd.Env["PGPASSWORD"] = string(p.Password)
 	}
 
-	return fmt.Errorf("shell script is not executable: %s", file)
+	process := cmd.Run()
+	if process.Err != nil {
+		return fmt.Errorf("shell script failed: %w\nStdout: %s\nStderr: %s",
+			process.Err, process.GetStdout(), process.GetStderr())
+	}
+	return nil
 }
 
 func (p *Postgres) processSQLFile(file string, compressed bool) error {
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/flanksource/clicky"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+// scramIterations is the PostgreSQL default for scram_iterations
+const scramIterations = 4096
+
+// ScramSHA256Verifier returns the SCRAM-SHA-256 verifier PostgreSQL stores in pg_authid for password, setting
+// a role's password to it never sends the plaintext to the server. The password is used as is, without the
+// SASLprep normalization PostgreSQL applies to non-ASCII passwords.
+func ScramSHA256Verifier(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return scramVerifier(password, salt, scramIterations)
+}
+
+func scramVerifier(password string, salt []byte, iterations int) (string, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive the SCRAM key: %w", err)
+	}
+	storedKey := sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	serverKey := hmacSHA256(salted, "Server Key")
+	enc := base64.StdEncoding
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		enc.EncodeToString(salt), enc.EncodeToString(storedKey[:]), enc.EncodeToString(serverKey)), nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// alterPasswordStatement sets the password of role to a SCRAM verifier of password
+func alterPasswordStatement(role string, password utils.SensitiveString) (string, error) {
+	verifier, err := ScramSHA256Verifier(password.Value())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s", pq.QuoteIdentifier(role), pq.QuoteLiteral(verifier)), nil
+}
+
+// ResetPassword sets the password of p.Username. A stopped local server is not started, the password is set
+// in single-user mode instead, which needs neither a listening server nor working credentials. Only the
+// SCRAM verifier of the password is sent to the server.
+func (p *Postgres) ResetPassword(newPassword utils.SensitiveString) error {
+	if newPassword.IsEmpty() {
+		return fmt.Errorf("new password not specified")
+	}
+
+	if p.Username == "" {
+		return fmt.Errorf("PGUSER not specified")
+	}
+
+	offline := !p.IsRemote() && !p.postmasterRunning()
+	if p.DryRun {
+		if offline {
+			clicky.Infof("[DRYRUN] skipping password reset for user %s in single-user mode", p.Username)
+		} else {
+			clicky.Infof("[DRYRUN] skipping password reset for user %s", p.Username)
+		}
+		return nil
+	}
+
+	statement, err := alterPasswordStatement(p.Username, newPassword)
+	if err != nil {
+		return err
+	}
+
+	if offline {
+		clicky.Infof("Resetting password for user %s in single-user mode", p.Username)
+		err = p.singleUser(statement)
+	} else {
+		clicky.Infof("Resetting password for user %s", p.Username)
+		err = p.WithConnection(func(db *sql.DB) error {
+			_, err := db.Exec(statement)
+			return err
+		})
+		if err != nil {
+			err = fmt.Errorf("%w, stop the server to reset the password in single-user mode", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reset password for user %s: %w", p.Username, err)
+	}
+
+	clicky.Infof("✅ Password reset process completed")
+	return nil
+}
+
+// singleUser runs statement with postgres --single, the server must be stopped. exit_on_error makes an error in
+// the statement fail the command.
+func (p *Postgres) singleUser(statement string) error {
+	if err := p.ensureBinDir(); err != nil {
+		return fmt.Errorf("failed to resolve binary directory: %w", err)
+	}
+	if err := p.removeStalePID(); err != nil {
+		return err
+	}
+	database := p.Database
+	if database == "" {
+		database = "postgres"
+	}
+	cmd := osexec.Command(filepath.Join(p.BinDir, "postgres"), "--single", "-D", p.DataDir,
+		"-c", "exit_on_error=on", "-c", "log_statement=none", database)
+	// A newline ends the statement in single-user mode
+	cmd.Stdin = strings.NewReader(strings.ReplaceAll(statement, "\n", " ") + "\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("postgres --single failed: %w\n%s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+func TestScramVerifier(t *testing.T) {
+	salt := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	verifier, err := scramVerifier("secret", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SCRAM-SHA-256$4096:AAECAwQFBgcICQoLDA0ODw==$THoPhoTAuqyoQsK4dUHncUzgfD8fdmhsgKZhWVqNP5U=:7YiHMMi2OcXGRogub03Ek06JRZ9bkhTOdCzHa5iPLiQ="
+	if verifier != expected {
+		t.Errorf("expected %s, got %s", expected, verifier)
+	}
+
+	a, _ := ScramSHA256Verifier("secret")
+	b, _ := ScramSHA256Verifier("secret")
+	if a == b {
+		t.Error("expected a random salt for every verifier")
+	}
+}
+
+func TestAlterPasswordStatement(t *testing.T) {
+	statement, err := alterPasswordStatement(`o"brien`, utils.NewSensitiveString("p'; DROP ROLE postgres; --"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(statement, `ALTER ROLE "o""brien" WITH PASSWORD 'SCRAM-SHA-256$4096:`) {
+		t.Errorf("unexpected statement %s", statement)
+	}
+	if strings.Contains(statement, "DROP ROLE") {
+		t.Errorf("the plaintext password is part of the statement: %s", statement)
+	}
+}
+
+// fakeSingleUser records its arguments and stdin next to itself, failing when the data directory contains fail
+const fakeSingleUser = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args"
+cat > "$dir/stdin"
+if [ -f "$3/fail" ]; then
+  echo 'ERROR:  role "postgres" does not exist'
+  exit 1
+fi
+`
+
+func TestResetPasswordSingleUser(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		dir := t.TempDir()
+		binDir := filepath.Join(dir, "bin")
+		dataDir := filepath.Join(dir, "data")
+		for _, d := range []string{binDir, dataDir} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(binDir, "postgres"), []byte(fakeSingleUser), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if fail {
+			if err := os.WriteFile(filepath.Join(dataDir, "fail"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		p := &Postgres{DataDir: dataDir, BinDir: binDir, Username: "postgres"}
+		err := p.ResetPassword(utils.NewSensitiveString("secret"))
+		if fail {
+			if err == nil || !strings.Contains(err.Error(), "does not exist") {
+				t.Errorf("expected the error of postgres --single, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args, _ := os.ReadFile(filepath.Join(binDir, "args"))
+		if expected := "--single -D " + dataDir + " -c exit_on_error=on -c log_statement=none postgres\n"; string(args) != expected {
+			t.Errorf("expected args %q, got %q", expected, args)
+		}
+		stdin, _ := os.ReadFile(filepath.Join(binDir, "stdin"))
+		if !strings.HasPrefix(string(stdin), `ALTER ROLE "postgres" WITH PASSWORD 'SCRAM-SHA-256$`) || strings.Contains(string(stdin), "secret") {
+			t.Errorf("unexpected statement %q", stdin)
+		}
+	}
+}
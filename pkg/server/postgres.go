@@ -17,7 +17,6 @@ import (
 	"github.com/flanksource/clicky/exec"
 	"github.com/flanksource/commons/logger"
 	"github.com/flanksource/commons/properties"
-	_ "github.com/lib/pq"
 
 	"github.com/flanksource/postgres/pkg"
 	"github.com/flanksource/postgres/pkg/config"
@@ -38,7 +37,9 @@ type Postgres struct {
 	Username   string
 	Password   utils.SensitiveString
 	Database   string
-	DryRun     bool
+	// ConnectionParams are the other libpq connection parameters, e.g. sslmode, sslcert or application_name
+	ConnectionParams map[string]string
+	DryRun           bool
 }
 
 func (p *Postgres) WithoutAuth() *Postgres {
@@ -168,8 +169,12 @@ func (p *Postgres) DetectVersion() (int, error) {
 	return version, nil
 }
 
-// resolveBinDir returns the binary directory for a specific PostgreSQL version
+// resolveBinDir returns the binary directory for a specific PostgreSQL version, preferring an
+// installation discovered on this host over the Debian layout
 func (p *Postgres) resolveBinDir(version int) string {
+	if dir, ok := detectInstalledBinDirs()[version]; ok {
+		return dir
+	}
 	return fmt.Sprintf("/usr/lib/postgresql/%d/bin", version)
 }
 
@@ -277,7 +282,7 @@ func (p *Postgres) GetVersion() PGVersion {
 	}
 
 	versionStr := process.GetStdout()
-	re := regexp.MustCompile(`PostgreSQL (\d+\.\d+(?:\.\d+)?)`)
+	re := regexp.MustCompile(`PostgreSQL\)? (\d+\.\d+(?:\.\d+)?)`)
 	matches := re.FindStringSubmatch(versionStr)
 	if len(matches) < 2 {
 		return ""
@@ -319,36 +324,12 @@ func (p *Postgres) Exists() bool {
 	return true
 }
 
-func (p *Postgres) GetConnectionString() string {
-	connStr := "sslmode=disable"
-
-	if p.Database != "" {
-		connStr += " dbname=" + p.Database
-	}
-
-	if p.Host != "" {
-		connStr += " host=" + p.Host
-	}
-
-	if p.Port != 0 {
-		connStr += " port=" + strconv.Itoa(p.Port)
-	}
-
-	if p.Username != "" {
-		connStr += " user=" + p.Username
-	}
-
-	if p.Password != "" {
-		connStr += " password=" + p.Password.Value()
-	}
-	return connStr
-}
-
 func (p *Postgres) GetConnection() (*sql.DB, error) {
-	db, err := sql.Open("postgres", p.GetConnectionString())
+	connector, err := newConnector(p.GetConnectionString())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
+	db := sql.OpenDB(connector)
 	db.SetConnMaxLifetime(time.Minute * 3)
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
@@ -372,6 +353,25 @@ func (p *Postgres) WithConnection(fn func(db *sql.DB) error) error {
 	return fn(db)
 }
 
+// WithTemporaryServer runs fn with the local server started, so that the WithConnection calls made by fn share a
+// single start and stop instead of starting a temporary server each
+func (p *Postgres) WithTemporaryServer(fn func() error) error {
+	if p.IsRemote() || p.IsRunning() || p.DryRun {
+		return fn()
+	}
+	tempDB := p.WithoutAuth()
+	tempDB.Port = p.Port
+	if err := tempDB.Start(); err != nil {
+		return fmt.Errorf("failed to start PostgreSQL: %w", err)
+	}
+	defer func() {
+		if err := tempDB.Stop(); err != nil {
+			logger.Warnf("failed to stop PostgreSQL: %v", err)
+		}
+	}()
+	return fn()
+}
+
 func (p *Postgres) SQL(sqlQuery string, args ...any) ([]map[string]interface{}, error) {
 	results := []map[string]interface{}{}
 
@@ -419,57 +419,6 @@ func (p *Postgres) SQL(sqlQuery string, args ...any) ([]map[string]interface{},
 	return results, nil
 }
 
-func (p *Postgres) Backup() error {
-	if p.BinDir == "" {
-		return fmt.Errorf("BinDir not specified")
-	}
-
-	host := "localhost"
-	port := 5432
-	user := "postgres"
-	database := "postgres"
-
-	// Use config values if available
-	if p.Config != nil {
-		if p.Config.ListenAddresses != "" && p.Config.ListenAddresses != "*" && p.Config.ListenAddresses != "localhost" {
-			host = p.Config.ListenAddresses
-		}
-		if p.Config.Port != 0 {
-			port = p.Config.Port
-		}
-	}
-
-	backupFile := fmt.Sprintf("%s_backup_%s.sql", database, time.Now().Format("20060102_150405"))
-
-	args := []string{
-		"-h", host,
-		"-p", strconv.Itoa(port),
-		"-U", user,
-		"-d", database,
-		"-f", backupFile,
-		"--verbose",
-		"--no-password",
-	}
-
-	if p.DryRun {
-		clicky.Infof("Dry run enabled, skipping backup execution. Command: pg_dump %s", strings.Join(args, " "))
-		return nil
-	}
-
-	process := clicky.Exec(filepath.Join(p.BinDir, "pg_dump"), args...).Run()
-
-	// Only set password for non-localhost connections or if explicitly provided
-	// No SuperuserPassword field available in PostgresConf
-
-	p.lastStdout = process.GetStdout()
-	p.lastStderr = process.GetStderr()
-
-	if process.Err != nil {
-		return fmt.Errorf("backup failed: %w, output: %s", process.Err, process.Out())
-	}
-
-	return nil
-}
 func (p *Postgres) bin(name string, args ...string) *exec.Process {
 
 	if p.DataDir == "" {
@@ -494,19 +443,6 @@ func WrappedError(err error) exec.WrapperFunc {
 		return nil, err
 	}
 }
-func (p *Postgres) CreateDatabase(name string) error {
-	if name == "" {
-		return fmt.Errorf("database name not specified")
-	}
-
-	fmt.Printf("🛠️  Ensuring database '%s' exists...\n", name)
-	if p.DryRun {
-		clicky.Infof("[DRYRUN] skipping database creation for '%s'", name)
-		return nil
-	}
-	_, err := p.SQL("CREATE DATABASE ?", name)
-	return err
-}
 
 type InitDBOptions struct {
 	Username   string
@@ -602,32 +538,6 @@ func (p *Postgres) InitDBWithOptions(opts InitDBOptions) error {
 	return nil
 }
 
-// ResetPassword resets the PostgreSQL superuser password using a temporary server instance
-func (p *Postgres) ResetPassword(newPassword utils.SensitiveString) error {
-	if newPassword.IsEmpty() {
-		return fmt.Errorf("new password not specified")
-	}
-
-	if p.Username == "" {
-		return fmt.Errorf("PGUSER not specified")
-	}
-
-	if p.DryRun {
-		clicky.Infof("[DRYRUN] skipping password reset for user %s", p.Username)
-		return nil
-	}
-	clicky.Infof("Resetting password for user %s", p.Username)
-
-	psqlProcess, err := p.SQL(fmt.Sprintf("ALTER USER %s PASSWORD '%s'", p.Username, newPassword.Value()))
-	if err != nil {
-		return err
-	}
-	clicky.MustPrint(psqlProcess)
-
-	clicky.Infof("✅ Password reset process completed")
-	return nil
-}
-
 // validateCluster validates a PostgreSQL cluster
 func (p *Postgres) validateCluster(binDir, dataDir string, expectedVersion int) error {
 
@@ -672,8 +582,9 @@ func (p *Postgres) initNewCluster(binDir, dataDir string) error {
 	return nil
 }
 
-// initNewClusterWithConf initializes a new PostgreSQL cluster with specific configuration
-func (p *Postgres) initNewClusterWithConf(binDir, dataDir string, conf config.Conf) error {
+// initNewClusterWithConf initializes a new PostgreSQL cluster with specific configuration,
+// with the WAL in walDir (linked from pg_wal) if it is not empty
+func (p *Postgres) initNewClusterWithConf(binDir, dataDir string, conf config.Conf, walDir string) error {
 	if err := clicky.Exec("mkdir", "-p", dataDir).Run().Result().Error; err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
@@ -687,6 +598,9 @@ func (p *Postgres) initNewClusterWithConf(binDir, dataDir string, conf config.Co
 
 	// Add initdb-specific arguments from configuration
 	args = append(args, conf.AsInitDBArgs()...)
+	if walDir != "" {
+		args = append(args, "--waldir="+walDir)
+	}
 
 	if p.DryRun {
 		clicky.Infof("[DRYRUN] initdb %s", strings.Join(args, " "))
@@ -746,79 +660,66 @@ func (p *Postgres) Pg_ctl(args ...string) *exec.Process {
 	return cmd.Debug()
 }
 
-func (p *Postgres) Stop() error {
-
-	if !p.IsRunning() {
-		logger.Warnf("Postgres is not running")
+// Start starts the server with pg_ctl and waits up to start.timeout for it to accept connections. Fatal
+// conditions are detected from PG_VERSION, postmaster.pid and the server log and returned as a StartupError.
+func (p *Postgres) Start() error {
+	if p.postmasterRunning() {
+		logger.Warnf("Postgres is already running")
 		return nil
 	}
+
 	if p.DryRun {
-		clicky.Infof("[DRYRUN] stopping Postgres %s", p.DataDir)
+		clicky.Infof("[DRYRUN] starting Postgres %s", p.DataDir)
 		return nil
 	}
 
-	clicky.Infof(clicky.Text("").Add(icons.Stop).Appendf("Stopping Postgres.. %s", p.DataDir).Styles("text-orange-500").ANSI())
-
-	res := p.Pg_ctl("stop", "-m", "smart").Run().Result()
-	if res.Error != nil {
-		return fmt.Errorf("failed to stop PostgreSQL: %s", res.Pretty().ANSI())
-	}
+	fmt.Println(clicky.Text("").Add(icons.Start).Appendf("Starting Postgres.. %s", p.DataDir).Styles("text-green-500").ANSI())
 
-	timeout := properties.Duration(30*time.Second, "stop.timeout")
-	startTime := time.Now()
-	for {
-		if !p.IsRunning() {
-			break
-		}
-		if time.Since(startTime) > timeout {
-			return fmt.Errorf("timeout waiting for PostgreSQL to stop")
-		}
-		time.Sleep(1 * time.Second)
+	if err := p.checkDataVersion(); err != nil {
+		return err
 	}
-
-	if p.IsRunning() {
-		return fmt.Errorf("PostgreSQL did not stop successfully")
+	if err := p.removeStalePID(); err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func (p *Postgres) Start() error {
-	if p.IsRunning() {
-		logger.Warnf("Postgres is already running")
-		return nil
+	logFile := p.startupLog()
+	if err := os.MkdirAll(filepath.Dir(logFile), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(logFile), err)
 	}
-
-	if p.DryRun {
-		clicky.Infof("[DRYRUN] starting Postgres %s", p.DataDir)
-		return nil
+	// pg_ctl appends to the log, only the output of this start is diagnosed
+	var offset int64
+	if info, err := os.Stat(logFile); err == nil {
+		offset = info.Size()
 	}
 
-	fmt.Println(clicky.Text("").Add(icons.Start).Appendf("Starting Postgres.. %s", p.DataDir).Styles("text-green-500").ANSI())
-
-	res := p.Pg_ctl("start").WithTimeout(5 * time.Second).Run().Result()
+	res := p.Pg_ctl("start", "--no-wait", "-l", logFile).Run().Result()
 	if res.Error != nil {
-		fmt.Println("failed to start PostgreSQL: %w, continuing anyway", res.Error)
+		if diagnosis := p.diagnoseStartup(offset); diagnosis != nil {
+			return diagnosis
+		}
+		return fmt.Errorf("failed to start PostgreSQL: %s", res.Pretty().ANSI())
 	}
-	fmt.Println(res.Pretty().ANSI())
 
 	timeout := properties.Duration(300*time.Second, "start.timeout")
 	startTime := time.Now()
 	for {
-		if p.IsRunning() {
-			break
+		time.Sleep(500 * time.Millisecond)
+		pidFile, err := readPostmasterPID(p.DataDir)
+		if err == nil && isPostmaster(pidFile.PID, p.DataDir) {
+			if pidFile.Status == "ready" || pidFile.Status == "standby" {
+				return nil
+			}
+		} else if diagnosis := p.diagnoseStartup(offset); diagnosis != nil {
+			// The postmaster removes its pid file when it exits
+			return diagnosis
 		}
 		if time.Since(startTime) > timeout {
-			return fmt.Errorf("timeout waiting for PostgreSQL to start")
+			if diagnosis := p.diagnoseStartup(offset); diagnosis != nil {
+				return fmt.Errorf("timeout waiting for PostgreSQL to start after %s: %w", timeout, diagnosis)
+			}
+			return fmt.Errorf("timeout waiting for PostgreSQL to start after %s, see %s", timeout, logFile)
 		}
-		time.Sleep(1 * time.Second)
-	}
-
-	if !p.IsRunning() {
-		return fmt.Errorf("PostgreSQL did not start successfully")
 	}
-	return nil
-
 }
 
 func (p *Postgres) GetStderr() string {
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+// RestoreOptions controls what RestoreWithOptions restores and how
+type RestoreOptions struct {
+	// Databases to restore from a backup directory, all the databases in its manifest when empty
+	Databases []string
+	// Target is the database to restore into, only when restoring a single database, defaults to its original name
+	Target string
+	// Clean drops the objects in the archive before recreating them, or the whole database with Create
+	Clean bool
+	// Create lets pg_restore create the database with its original name, owner, encoding and locale
+	Create bool
+	// Jobs is the number of tables restored in parallel
+	Jobs int
+	// Schemas and Tables restrict the restore to the given schemas and tables
+	Schemas []string
+	Tables  []string
+	// Globals restores the roles and tablespaces of a backup directory before the databases
+	Globals bool
+	// NoOwner skips restoring the ownership of objects, for servers without the roles of the backup
+	NoOwner bool
+	// Analyze runs ANALYZE on each restored database so the planner has statistics straight away
+	Analyze bool
+}
+
+// DefaultRestoreOptions restores every database and the globals of a backup and analyzes them
+func DefaultRestoreOptions() RestoreOptions {
+	return RestoreOptions{
+		Jobs:    1,
+		Globals: true,
+		Analyze: true,
+	}
+}
+
+// RestoreSummary is the outcome of RestoreWithOptions
+type RestoreSummary struct {
+	Source string `json:"source"`
+	// ServerVersion is the version of the server the backup was taken from
+	ServerVersion   string             `json:"server_version,omitempty"`
+	Globals         bool               `json:"globals"`
+	Databases       []RestoredDatabase `json:"databases"`
+	DurationSeconds float64            `json:"duration_seconds"`
+}
+
+// RestoredDatabase is a database restored from an archive
+type RestoredDatabase struct {
+	Database        string  `json:"database"`
+	Target          string  `json:"target"`
+	Archive         string  `json:"archive"`
+	Tables          int     `json:"tables"`
+	Size            int64   `json:"size" pretty:"format=bytes"`
+	Analyzed        bool    `json:"analyzed"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+const restoredTablesQuery = `SELECT count(*), pg_database_size(current_database())
+FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'`
+
+// Restore restores every database and the globals of a backup directory, or a single pg_dump archive
+func (p *Postgres) Restore(path string) (*RestoreSummary, error) {
+	return p.RestoreWithOptions(path, DefaultRestoreOptions())
+}
+
+// RestoreWithOptions restores a backup directory written by BackupWithOptions, or a single pg_dump archive, with
+// pg_restore. The roles and tablespaces are restored first, then each database into a new or existing database.
+// The restore is refused when the server or pg_restore is older than the server or pg_dump of the backup.
+func (p *Postgres) RestoreWithOptions(path string, opts RestoreOptions) (*RestoreSummary, error) {
+	if opts.Jobs < 1 {
+		return nil, fmt.Errorf("jobs must be at least 1")
+	}
+	if err := p.ensureBinDir(); err != nil {
+		return nil, fmt.Errorf("failed to resolve binary directory: %w", err)
+	}
+	manifest, dir, err := p.loadRestoreSource(path)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := selectRestoreArchives(manifest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	summary := &RestoreSummary{Source: path, ServerVersion: manifest.Server.Version}
+	if p.DryRun {
+		for _, archive := range archives {
+			clicky.Infof("[DRYRUN] skipping restore of %s into database %s", archive.Path, restoreTarget(archive, opts))
+		}
+		return summary, nil
+	}
+
+	err = p.WithConnection(func(db *sql.DB) error {
+		var version string
+		if err := db.QueryRow("SELECT current_setting('server_version')").Scan(&version); err != nil {
+			return fmt.Errorf("failed to get the server version: %w", err)
+		}
+		if err := checkRestoreCompatibility(manifest.Server.Version, manifest.PgDumpVersion, version,
+			toolVersion(filepath.Join(p.BinDir, "pg_restore"))); err != nil {
+			return err
+		}
+
+		if opts.Globals && manifest.Globals != nil {
+			if err := p.restoreGlobals(filepath.Join(dir, manifest.Globals.Path)); err != nil {
+				return err
+			}
+			summary.Globals = true
+		}
+		existing, err := listDatabases(db)
+		if err != nil {
+			return err
+		}
+		for _, archive := range archives {
+			target := restoreTarget(archive, opts)
+			restored, err := p.restoreDatabase(db, filepath.Join(dir, archive.Path), archive.Database, target,
+				existing[target] != nil, opts)
+			if err != nil {
+				return err
+			}
+			summary.Databases = append(summary.Databases, *restored)
+		}
+		return nil
+	})
+	summary.DurationSeconds = time.Since(start).Seconds()
+	if err != nil {
+		return summary, err
+	}
+	clicky.Infof("✅ Restored %d databases from %s (%s)", len(summary.Databases), path,
+		time.Since(start).Round(time.Second))
+	return summary, nil
+}
+
+// loadRestoreSource returns the manifest of a backup directory, or one describing a single pg_dump archive read
+// from its table of contents, and the directory the archive paths are relative to
+func (p *Postgres) loadRestoreSource(path string) (*BackupManifest, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	manifestPath := path
+	if info.IsDir() {
+		manifestPath = filepath.Join(path, BackupManifestFile)
+	}
+	if _, err := os.Stat(manifestPath); err == nil && filepath.Base(manifestPath) == BackupManifestFile {
+		manifest, err := ReadBackupManifest(manifestPath)
+		return manifest, filepath.Dir(manifestPath), err
+	}
+
+	format := BackupFormatCustom
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "toc.dat")); err != nil {
+			return nil, "", fmt.Errorf("%s has no %s, it is an incomplete backup or not a backup directory",
+				path, BackupManifestFile)
+		}
+		format = BackupFormatDirectory
+	}
+	toc, err := p.runClient("pg_restore", "--list", path)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s is not a pg_dump archive: %w", path, err)
+	}
+	header := parseArchiveHeader(toc)
+	return &BackupManifest{
+		Server:        BackupServer{Version: header.ServerVersion},
+		PgDumpVersion: header.DumpVersion,
+		Format:        format,
+		Databases:     []BackupArchive{{Database: header.Database, Path: filepath.Base(path)}},
+	}, filepath.Dir(path), nil
+}
+
+// archiveHeader is the header of `pg_restore --list`
+type archiveHeader struct {
+	Database      string
+	ServerVersion string
+	DumpVersion   string
+}
+
+// parseArchiveHeader reads the header comments printed by `pg_restore --list`, e.g.
+//
+//	;     dbname: orders
+//	;     Dumped from database version: 17.5
+//	;     Dumped by pg_dump version: 17.5
+func parseArchiveHeader(toc string) archiveHeader {
+	header := archiveHeader{}
+	for _, line := range strings.Split(toc, "\n") {
+		line, ok := strings.CutPrefix(line, ";")
+		if !ok {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			break
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		switch key {
+		case "dbname":
+			header.Database = strings.TrimSpace(value)
+		case "Dumped from database version":
+			header.ServerVersion = strings.TrimSpace(value)
+		case "Dumped by pg_dump version":
+			header.DumpVersion = strings.TrimSpace(value)
+		}
+	}
+	return header
+}
+
+// selectRestoreArchives returns the database archives of manifest selected by opts
+func selectRestoreArchives(manifest *BackupManifest, opts RestoreOptions) ([]BackupArchive, error) {
+	archives := manifest.Databases
+	if len(opts.Databases) > 0 {
+		byName := map[string]BackupArchive{}
+		for _, archive := range manifest.Databases {
+			byName[archive.Database] = archive
+		}
+		archives = nil
+		for _, name := range opts.Databases {
+			archive, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("database %s is not in the backup, it contains: %s", name,
+					strings.Join(sortedKeys(byName), ", "))
+			}
+			archives = append(archives, archive)
+		}
+	}
+	if len(archives) == 0 {
+		return nil, fmt.Errorf("the backup contains no databases")
+	}
+	if opts.Target != "" && len(archives) > 1 {
+		return nil, fmt.Errorf("a target database can only be given when restoring a single database")
+	}
+	for _, archive := range archives {
+		target := restoreTarget(archive, opts)
+		if target == "" {
+			return nil, fmt.Errorf("the database name of %s is unknown, a target database must be given", archive.Path)
+		}
+		if opts.Create && target != archive.Database {
+			return nil, fmt.Errorf("create restores %s under its original name, it cannot be restored into %s",
+				archive.Database, target)
+		}
+	}
+	return archives, nil
+}
+
+func restoreTarget(archive BackupArchive, opts RestoreOptions) string {
+	if opts.Target != "" {
+		return opts.Target
+	}
+	return archive.Database
+}
+
+var versionNumber = regexp.MustCompile(`(\d+)(?:\.(\d+))?`)
+
+// majorVersion returns the major version in a version string as a comparable number, e.g. 1700 for
+// "pg_restore (PostgreSQL) 17.5" and 906 for "9.6.24"
+func majorVersion(version string) (int, error) {
+	matches := versionNumber.FindStringSubmatch(version)
+	if matches == nil {
+		return 0, fmt.Errorf("unrecognized version %q", version)
+	}
+	major, _ := strconv.Atoi(matches[1])
+	if major >= 10 {
+		return major * 100, nil
+	}
+	minor, _ := strconv.Atoi(matches[2])
+	return major*100 + minor, nil
+}
+
+func formatMajorVersion(major int) string {
+	if major >= 1000 {
+		return strconv.Itoa(major / 100)
+	}
+	return fmt.Sprintf("%d.%d", major/100, major%100)
+}
+
+// checkRestoreCompatibility fails when a backup of serverVersion dumped by pg_dump dumpVersion cannot be restored
+// into targetVersion with pg_restore restoreVersion: objects of a newer server may not exist in an older one, and
+// pg_restore cannot read the archives of a newer pg_dump. Unknown versions are not checked.
+func checkRestoreCompatibility(serverVersion, dumpVersion, targetVersion, restoreVersion string) error {
+	if source, err := majorVersion(serverVersion); err == nil {
+		target, err := majorVersion(targetVersion)
+		if err != nil {
+			return err
+		}
+		if target < source {
+			return fmt.Errorf("cannot restore a backup of PostgreSQL %s into PostgreSQL %s, restore into the same or a newer version",
+				formatMajorVersion(source), formatMajorVersion(target))
+		}
+		if target > source {
+			clicky.Infof("Restoring a backup of PostgreSQL %s into PostgreSQL %s", formatMajorVersion(source),
+				formatMajorVersion(target))
+		}
+	}
+	dump, dumpErr := majorVersion(dumpVersion)
+	restore, restoreErr := majorVersion(restoreVersion)
+	if dumpErr == nil && restoreErr == nil && restore < dump {
+		return fmt.Errorf("pg_restore %s cannot read archives written by pg_dump %s", formatMajorVersion(restore),
+			formatMajorVersion(dump))
+	}
+	return nil
+}
+
+// restoreGlobals runs a pg_dumpall --globals-only script with psql. The statements changing the connected role are
+// skipped so its password is kept. Roles that already exist fail to be created, so errors are reported but not fatal.
+func (p *Postgres) restoreGlobals(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read globals: %w", err)
+	}
+	file, err := os.CreateTemp("", "globals-*.sql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(globalsScript(string(data), p.Username))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write globals: %w", err)
+	}
+
+	clicky.Infof("🗄️  Restoring roles and tablespaces")
+	output, err := p.runClient("psql", "--no-psqlrc", "--quiet", "--file", file.Name(), "--dbname", p.ConnInfo(p.Database))
+	if err != nil {
+		return err
+	}
+	if failed := strings.Count(output, "ERROR:"); failed > 0 {
+		clicky.Warnf("⚠️  %d statements of %s failed, e.g. for roles that already exist", failed, globalsFile)
+		logger.Debugf("%s", output)
+	}
+	return nil
+}
+
+// globalsScript removes the CREATE ROLE and ALTER ROLE statements for role from a pg_dumpall script, which writes
+// one statement per line
+func globalsScript(script, role string) string {
+	var skip []string
+	for _, name := range []string{role, pq.QuoteIdentifier(role)} {
+		skip = append(skip, "CREATE ROLE "+name+";", "ALTER ROLE "+name+" WITH ")
+	}
+	lines := strings.SplitAfter(script, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		skipped := false
+		for _, prefix := range skip {
+			if strings.HasPrefix(line, prefix) {
+				skipped = true
+				break
+			}
+		}
+		if !skipped {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// restoreDatabase restores an archive into target, creating it when it does not exist
+func (p *Postgres) restoreDatabase(db *sql.DB, archive, database, target string, exists bool, opts RestoreOptions) (*RestoredDatabase, error) {
+	start := time.Now()
+	connect := target
+	if opts.Create {
+		if exists && !opts.Clean {
+			return nil, fmt.Errorf("database %s already exists, use --clean to drop and recreate it", target)
+		}
+		if exists && p.Database == target {
+			return nil, fmt.Errorf("cannot recreate %s while connected to it, use --database to connect to another database", target)
+		}
+		// pg_restore --create connects to another database to create the target
+		connect = p.Database
+		if connect == target {
+			connect = "postgres"
+		}
+	} else if !exists {
+		statement, err := createDatabaseStatement(pkg.DatabaseConf{Name: target, Template: "template0"})
+		if err != nil {
+			return nil, err
+		}
+		if err := execEach(db, []string{statement}); err != nil {
+			return nil, err
+		}
+	}
+
+	clicky.Infof("🗄️  Restoring %s into database %s", filepath.Base(archive), target)
+	if _, err := p.runClient("pg_restore", restoreArgs(archive, opts, p.ConnInfo(connect))...); err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", database, err)
+	}
+
+	restored := &RestoredDatabase{Database: database, Target: target, Archive: archive}
+	conn, err := p.on(target).GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if opts.Analyze {
+		clicky.Infof("📊 Analyzing %s", target)
+		if _, err := conn.Exec("ANALYZE"); err != nil {
+			return nil, fmt.Errorf("failed to analyze %s: %w", target, err)
+		}
+		restored.Analyzed = true
+	}
+	if err := conn.QueryRow(restoredTablesQuery).Scan(&restored.Tables, &restored.Size); err != nil {
+		return nil, fmt.Errorf("failed to count the tables of %s: %w", target, err)
+	}
+	restored.DurationSeconds = time.Since(start).Seconds()
+	return restored, nil
+}
+
+// restoreArgs returns the pg_restore arguments restoring archive into the database of connInfo, stopping at the
+// first error so a partial restore is not reported as a success
+func restoreArgs(archive string, opts RestoreOptions, connInfo string) []string {
+	args := []string{"--no-password", "--exit-on-error"}
+	if opts.Create {
+		args = append(args, "--create")
+	}
+	if opts.Clean {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if opts.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if opts.Jobs > 1 {
+		args = append(args, "--jobs", strconv.Itoa(opts.Jobs))
+	}
+	for _, schema := range opts.Schemas {
+		args = append(args, "--schema", schema)
+	}
+	for _, table := range opts.Tables {
+		args = append(args, "--table", table)
+	}
+	return append(args, "--dbname", connInfo, archive)
+}
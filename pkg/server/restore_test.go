@@ -0,0 +1,121 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArchiveHeader(t *testing.T) {
+	toc := `;
+; Archive created at 2025-01-02 03:04:05 UTC
+;     dbname: orders
+;     TOC Entries: 12
+;     Compression: gzip
+;     Dump Version: 1.16-0
+;     Format: CUSTOM
+;     Dumped from database version: 16.4 (Debian 16.4-1.pgdg120+1)
+;     Dumped by pg_dump version: 17.5
+;
+;
+; Selected TOC Entries:
+;
+215; 1259 16390 TABLE public orders app
+; dbname: not a header
+`
+	expected := archiveHeader{Database: "orders", ServerVersion: "16.4 (Debian 16.4-1.pgdg120+1)", DumpVersion: "17.5"}
+	if header := parseArchiveHeader(toc); header != expected {
+		t.Errorf("expected %+v, got %+v", expected, header)
+	}
+}
+
+func TestCheckRestoreCompatibility(t *testing.T) {
+	tests := []struct {
+		name                          string
+		server, dump, target, restore string
+		err                           bool
+	}{
+		{name: "same version", server: "17.5", dump: "pg_dump (PostgreSQL) 17.5", target: "17.2", restore: "pg_restore (PostgreSQL) 17.2"},
+		{name: "newer server", server: "9.6.24", dump: "pg_dump (PostgreSQL) 17.5", target: "17.5", restore: "pg_restore (PostgreSQL) 17.5"},
+		{name: "older server", server: "17.5", target: "16.9 (Debian 16.9-1)", err: true},
+		{name: "older minor of 9.x", server: "9.6.24", target: "9.5.25", err: true},
+		{name: "older pg_restore", server: "16.4", dump: "17.5", target: "17.5", restore: "pg_restore (PostgreSQL) 16.4", err: true},
+		{name: "unknown versions", target: "17.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRestoreCompatibility(tt.server, tt.dump, tt.target, tt.restore)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error=%v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestSelectRestoreArchives(t *testing.T) {
+	manifest := &BackupManifest{Databases: []BackupArchive{
+		{Database: "app", Path: "app.dump"},
+		{Database: "orders", Path: "orders.dump"},
+	}}
+	tests := []struct {
+		name     string
+		opts     RestoreOptions
+		expected []string
+		err      bool
+	}{
+		{name: "all", expected: []string{"app.dump", "orders.dump"}},
+		{name: "selected", opts: RestoreOptions{Databases: []string{"orders"}, Target: "orders_copy"}, expected: []string{"orders.dump"}},
+		{name: "missing", opts: RestoreOptions{Databases: []string{"billing"}}, err: true},
+		{name: "target for several", opts: RestoreOptions{Target: "copy"}, err: true},
+		{name: "create renamed", opts: RestoreOptions{Databases: []string{"app"}, Target: "copy", Create: true}, err: true},
+		{name: "create", opts: RestoreOptions{Create: true, Clean: true}, expected: []string{"app.dump", "orders.dump"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archives, err := selectRestoreArchives(manifest, tt.opts)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error=%v, got %v", tt.err, err)
+			}
+			var paths []string
+			for _, archive := range archives {
+				paths = append(paths, archive.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, paths)
+			}
+		})
+	}
+
+	if _, err := selectRestoreArchives(&BackupManifest{Databases: []BackupArchive{{Path: "a.dump"}}}, RestoreOptions{}); err == nil {
+		t.Error("expected an error for an archive without a database name and no target")
+	}
+}
+
+func TestGlobalsScript(t *testing.T) {
+	script := `CREATE ROLE app;
+ALTER ROLE app WITH NOSUPERUSER INHERIT LOGIN PASSWORD 'SCRAM-SHA-256$4096:a';
+CREATE ROLE postgres;
+ALTER ROLE postgres WITH SUPERUSER INHERIT LOGIN PASSWORD 'SCRAM-SHA-256$4096:b';
+CREATE ROLE postgres_ro;
+GRANT app TO postgres GRANTED BY postgres;
+`
+	expected := `CREATE ROLE app;
+ALTER ROLE app WITH NOSUPERUSER INHERIT LOGIN PASSWORD 'SCRAM-SHA-256$4096:a';
+CREATE ROLE postgres_ro;
+GRANT app TO postgres GRANTED BY postgres;
+`
+	if filtered := globalsScript(script, "postgres"); filtered != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, filtered)
+	}
+	if filtered := globalsScript(`ALTER ROLE "Admin" WITH LOGIN;`+"\n", "Admin"); filtered != "" {
+		t.Errorf("expected the quoted role to be removed, got %s", filtered)
+	}
+}
+
+func TestRestoreArgs(t *testing.T) {
+	opts := RestoreOptions{Clean: true, Create: true, NoOwner: true, Jobs: 4, Schemas: []string{"sales"}, Tables: []string{"orders"}}
+	expected := []string{"--no-password", "--exit-on-error", "--create", "--clean", "--if-exists", "--no-owner", "--jobs", "4",
+		"--schema", "sales", "--table", "orders", "--dbname", "dbname=postgres", "/backups/orders.dump"}
+	if args := restoreArgs("/backups/orders.dump", opts, "dbname=postgres"); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
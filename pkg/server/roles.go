@@ -0,0 +1,378 @@
+package server
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/clicky"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg"
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+// RoleInfo is a role as reported by pg_roles
+type RoleInfo struct {
+	Name            string   `json:"name"`
+	Login           bool     `json:"login"`
+	Superuser       bool     `json:"superuser"`
+	CreateDB        bool     `json:"createdb"`
+	CreateRole      bool     `json:"createrole"`
+	Inherit         bool     `json:"inherit"`
+	Replication     bool     `json:"replication"`
+	ConnectionLimit int      `json:"connection_limit"`
+	ValidUntil      string   `json:"valid_until,omitempty"`
+	MemberOf        []string `json:"member_of,omitempty"`
+	// verifier is the stored password, only superusers can read it
+	verifier string
+}
+
+// listRolesQuery excludes the predefined pg_* roles
+const listRolesQuery = `SELECT r.rolname, r.rolcanlogin, r.rolsuper, r.rolcreatedb, r.rolcreaterole, r.rolinherit,
+  r.rolreplication, r.rolconnlimit, COALESCE(r.rolvaliduntil::text, ''),
+  ARRAY(SELECT g.rolname FROM pg_auth_members m JOIN pg_roles g ON g.oid = m.roleid WHERE m.member = r.oid ORDER BY 1)
+FROM pg_roles r WHERE r.rolname !~ '^pg_' ORDER BY 1`
+
+// ListRoles returns the roles other than the predefined pg_* roles
+func (p *Postgres) ListRoles() ([]RoleInfo, error) {
+	var roles []RoleInfo
+	err := p.WithConnection(func(db *sql.DB) error {
+		existing, err := listRoles(db)
+		for _, role := range existing {
+			roles = append(roles, *role)
+		}
+		return err
+	})
+	slices.SortFunc(roles, func(a, b RoleInfo) int { return strings.Compare(a.Name, b.Name) })
+	return roles, err
+}
+
+func listRoles(db *sql.DB) (map[string]*RoleInfo, error) {
+	rows, err := db.Query(listRolesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+	roles := map[string]*RoleInfo{}
+	for rows.Next() {
+		role := &RoleInfo{}
+		if err := rows.Scan(&role.Name, &role.Login, &role.Superuser, &role.CreateDB, &role.CreateRole, &role.Inherit,
+			&role.Replication, &role.ConnectionLimit, &role.ValidUntil, pq.Array(&role.MemberOf)); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		roles[role.Name] = role
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Without superuser privileges passwords are always set, as they cannot be compared
+	if verifiers, err := db.Query("SELECT rolname, COALESCE(rolpassword, '') FROM pg_authid"); err == nil {
+		defer verifiers.Close()
+		for verifiers.Next() {
+			var name, verifier string
+			if err := verifiers.Scan(&name, &verifier); err == nil && roles[name] != nil {
+				roles[name].verifier = verifier
+			}
+		}
+	}
+	return roles, nil
+}
+
+// CreateRole creates a role with the attributes, password and memberships of role, LOGIN is the default
+func (p *Postgres) CreateRole(role pkg.RoleConf) error {
+	password, err := rolePassword(role)
+	if err != nil {
+		return err
+	}
+	statements, err := roleStatements(role, nil, password)
+	if err != nil {
+		return err
+	}
+	return p.execRoleStatements(append(statements, membershipStatements(role, nil)...))
+}
+
+// AlterRole changes the attributes of an existing role that are set in role. When role.MemberOf is set, the
+// memberships that are not listed are revoked.
+func (p *Postgres) AlterRole(role pkg.RoleConf) error {
+	password, err := rolePassword(role)
+	if err != nil {
+		return err
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping changes to role %s", role.Name)
+		return nil
+	}
+	return p.WithConnection(func(db *sql.DB) error {
+		existing, err := listRoles(db)
+		if err != nil {
+			return err
+		}
+		if existing[role.Name] == nil {
+			return fmt.Errorf("role %s does not exist", role.Name)
+		}
+		if role.ValidUntil, err = normalizeValidUntil(db, role.ValidUntil); err != nil {
+			return err
+		}
+		statements, err := roleStatements(role, existing[role.Name], password)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, membershipStatements(role, existing[role.Name])...)
+		if len(statements) == 0 {
+			clicky.Infof("✅ Role %s is up to date", role.Name)
+			return nil
+		}
+		return execStatements(db, statements)
+	})
+}
+
+// DropRole drops a role, the objects it owns must be reassigned or dropped first
+func (p *Postgres) DropRole(name string, ifExists bool) error {
+	statement := "DROP ROLE "
+	if ifExists {
+		statement += "IF EXISTS "
+	}
+	return p.execRoleStatements([]string{statement + pq.QuoteIdentifier(name)})
+}
+
+// GrantRole makes member a member of role
+func (p *Postgres) GrantRole(role, member string) error {
+	return p.execRoleStatements([]string{"GRANT " + pq.QuoteIdentifier(role) + " TO " + pq.QuoteIdentifier(member)})
+}
+
+// RevokeRole removes member from role
+func (p *Postgres) RevokeRole(role, member string) error {
+	return p.execRoleStatements([]string{"REVOKE " + pq.QuoteIdentifier(role) + " FROM " + pq.QuoteIdentifier(member)})
+}
+
+// ReconcileRoles creates the roles that do not exist and changes the attributes, passwords and memberships of the
+// others to match, only changes are applied so it can run on every start. Roles that are not listed are left as is.
+func (p *Postgres) ReconcileRoles(roles []pkg.RoleConf) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	passwords := map[string]string{}
+	for i, role := range roles {
+		if role.Name == "" {
+			return fmt.Errorf("roles[%d]: name is required", i)
+		}
+		if _, ok := passwords[role.Name]; ok {
+			return fmt.Errorf("role %s is listed twice", role.Name)
+		}
+		password, err := rolePassword(role)
+		if err != nil {
+			return err
+		}
+		passwords[role.Name] = password
+	}
+
+	clicky.Infof("🛠️  Reconciling %d roles", len(roles))
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping role reconciliation")
+		return nil
+	}
+	return p.WithConnection(func(db *sql.DB) error {
+		existing, err := listRoles(db)
+		if err != nil {
+			return err
+		}
+		var statements []string
+		for _, role := range roles {
+			if role.ValidUntil, err = normalizeValidUntil(db, role.ValidUntil); err != nil {
+				return err
+			}
+			roleChanges, err := roleStatements(role, existing[role.Name], passwords[role.Name])
+			if err != nil {
+				return err
+			}
+			statements = append(statements, roleChanges...)
+		}
+		// Memberships come last, a role can be a member of a role created further down the list
+		for _, role := range roles {
+			statements = append(statements, membershipStatements(role, existing[role.Name])...)
+		}
+		if len(statements) == 0 {
+			clicky.Infof("✅ Roles are up to date")
+			return nil
+		}
+		return execStatements(db, statements)
+	})
+}
+
+// rolePassword reads the password of role from role.PasswordEnv (or the file in <PasswordEnv>_FILE) or
+// role.PasswordFile, it returns an empty password when neither is set
+func rolePassword(role pkg.RoleConf) (string, error) {
+	if role.PasswordEnv != "" && role.PasswordFile != "" {
+		return "", fmt.Errorf("role %s: only one of password_env and password_file can be set", role.Name)
+	}
+	if role.PasswordEnv != "" {
+		password, err := utils.FileEnv(role.PasswordEnv, "")
+		if err != nil {
+			return "", fmt.Errorf("role %s: %w", role.Name, err)
+		}
+		if password == "" {
+			return "", fmt.Errorf("role %s: %s is not set", role.Name, role.PasswordEnv)
+		}
+		return password, nil
+	}
+	if role.PasswordFile != "" {
+		content, err := os.ReadFile(role.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("role %s: failed to read password: %w", role.Name, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return "", nil
+}
+
+// normalizeValidUntil formats a timestamp like pg_roles.rolvaliduntil::text, so that it can be compared
+func normalizeValidUntil(db *sql.DB, validUntil string) (string, error) {
+	if validUntil == "" {
+		return "", nil
+	}
+	var normalized string
+	if err := db.QueryRow("SELECT $1::timestamptz::text", validUntil).Scan(&normalized); err != nil {
+		return "", fmt.Errorf("invalid valid_until %q: %w", validUntil, err)
+	}
+	return normalized, nil
+}
+
+// roleStatements returns the CREATE ROLE or ALTER ROLE statement that brings existing (nil if the role does not
+// exist) to role, or nothing when it already matches
+func roleStatements(role pkg.RoleConf, existing *RoleInfo, password string) ([]string, error) {
+	if existing == nil {
+		existing = &RoleInfo{Inherit: true, ConnectionLimit: -1}
+		if role.Login == nil {
+			login := true
+			role.Login = &login
+		}
+	}
+	var options []string
+	flag := func(desired *bool, current bool, name string) {
+		if desired == nil || (*desired == current && existing.Name != "") {
+			return
+		}
+		if *desired {
+			options = append(options, name)
+		} else {
+			options = append(options, "NO"+name)
+		}
+	}
+	flag(role.Login, existing.Login, "LOGIN")
+	flag(role.Superuser, existing.Superuser, "SUPERUSER")
+	flag(role.CreateDB, existing.CreateDB, "CREATEDB")
+	flag(role.CreateRole, existing.CreateRole, "CREATEROLE")
+	flag(role.Inherit, existing.Inherit, "INHERIT")
+	flag(role.Replication, existing.Replication, "REPLICATION")
+	if role.ConnectionLimit != nil && *role.ConnectionLimit != existing.ConnectionLimit {
+		options = append(options, "CONNECTION LIMIT "+strconv.Itoa(*role.ConnectionLimit))
+	}
+	if role.ValidUntil != "" && role.ValidUntil != existing.ValidUntil {
+		options = append(options, "VALID UNTIL "+pq.QuoteLiteral(role.ValidUntil))
+	}
+	if password != "" && !scramVerifierMatches(existing.verifier, password) {
+		verifier, err := ScramSHA256Verifier(password)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, "PASSWORD "+pq.QuoteLiteral(verifier))
+	}
+
+	if existing.Name == "" {
+		statement := "CREATE ROLE " + pq.QuoteIdentifier(role.Name)
+		if len(options) > 0 {
+			statement += " WITH " + strings.Join(options, " ")
+		}
+		return []string{statement}, nil
+	}
+	if len(options) == 0 {
+		return nil, nil
+	}
+	return []string{"ALTER ROLE " + pq.QuoteIdentifier(role.Name) + " WITH " + strings.Join(options, " ")}, nil
+}
+
+// membershipStatements grants the memberships in role.MemberOf that existing does not have, and revokes the ones
+// that are not listed when role.MemberOf is set
+func membershipStatements(role pkg.RoleConf, existing *RoleInfo) []string {
+	var current []string
+	if existing != nil {
+		current = existing.MemberOf
+	}
+	var statements []string
+	for _, group := range role.MemberOf {
+		if !slices.Contains(current, group) {
+			statements = append(statements, "GRANT "+pq.QuoteIdentifier(group)+" TO "+pq.QuoteIdentifier(role.Name))
+		}
+	}
+	if role.MemberOf != nil {
+		for _, group := range current {
+			if !slices.Contains(role.MemberOf, group) {
+				statements = append(statements, "REVOKE "+pq.QuoteIdentifier(group)+" FROM "+pq.QuoteIdentifier(role.Name))
+			}
+		}
+	}
+	return statements
+}
+
+// scramVerifierMatches reports whether verifier, as stored in pg_authid, was computed from password
+func scramVerifierMatches(verifier, password string) bool {
+	match := scramVerifierPattern.FindStringSubmatch(verifier)
+	if match == nil {
+		return false
+	}
+	iterations, err := strconv.Atoi(match[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(match[2])
+	if err != nil {
+		return false
+	}
+	expected, err := scramVerifier(password, salt, iterations)
+	return err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(verifier)) == 1
+}
+
+var scramVerifierPattern = regexp.MustCompile(`^SCRAM-SHA-256\$(\d+):([^$]+)\$[^:]+:.+$`)
+
+var passwordLiteral = regexp.MustCompile(`PASSWORD '[^']*'`)
+
+// redactPasswords hides the password verifiers of a statement that is printed
+func redactPasswords(statement string) string {
+	return passwordLiteral.ReplaceAllString(statement, "PASSWORD '********'")
+}
+
+func (p *Postgres) execRoleStatements(statements []string) error {
+	if p.DryRun {
+		for _, statement := range statements {
+			clicky.Infof("[DRYRUN] %s", redactPasswords(statement))
+		}
+		return nil
+	}
+	return p.WithConnection(func(db *sql.DB) error {
+		return execStatements(db, statements)
+	})
+}
+
+// execStatements runs statements in a transaction
+func execStatements(db *sql.DB, statements []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, statement := range statements {
+		clicky.SQL(redactPasswords(statement))
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("%s: %w", redactPasswords(statement), err)
+		}
+	}
+	return tx.Commit()
+}
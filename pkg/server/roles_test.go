@@ -0,0 +1,177 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+func TestRoleStatements(t *testing.T) {
+	yes, no := true, false
+	limit := 10
+	verifier, err := ScramSHA256Verifier("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &RoleInfo{Name: "app", Login: true, Inherit: true, ConnectionLimit: -1, verifier: verifier}
+
+	tests := []struct {
+		name     string
+		role     pkg.RoleConf
+		existing *RoleInfo
+		password string
+		expected string
+	}{
+		{
+			name:     "create with login by default",
+			role:     pkg.RoleConf{Name: "app"},
+			expected: `CREATE ROLE "app" WITH LOGIN`,
+		},
+		{
+			name:     "create group role",
+			role:     pkg.RoleConf{Name: "readers", Login: &no, Inherit: &yes},
+			expected: `CREATE ROLE "readers" WITH NOLOGIN INHERIT`,
+		},
+		{
+			name:     "create with options",
+			role:     pkg.RoleConf{Name: `we"ird`, CreateDB: &yes, ConnectionLimit: &limit, ValidUntil: "2030-01-01 00:00:00+00"},
+			expected: `CREATE ROLE "we""ird" WITH LOGIN CREATEDB CONNECTION LIMIT 10 VALID UNTIL '2030-01-01 00:00:00+00'`,
+		},
+		{
+			name:     "create with password",
+			role:     pkg.RoleConf{Name: "app"},
+			password: "secret",
+			expected: `CREATE ROLE "app" WITH LOGIN PASSWORD 'SCRAM-SHA-256$4096:`,
+		},
+		{
+			name:     "unchanged",
+			role:     pkg.RoleConf{Name: "app", Login: &yes, Inherit: &yes},
+			existing: app,
+			password: "secret",
+		},
+		{
+			name:     "changed attributes",
+			role:     pkg.RoleConf{Name: "app", Login: &yes, Superuser: &no, Replication: &yes, ConnectionLimit: &limit},
+			existing: app,
+			expected: `ALTER ROLE "app" WITH REPLICATION CONNECTION LIMIT 10`,
+		},
+		{
+			name:     "changed password",
+			role:     pkg.RoleConf{Name: "app"},
+			existing: app,
+			password: "changed",
+			expected: `ALTER ROLE "app" WITH PASSWORD 'SCRAM-SHA-256$4096:`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements, err := roleStatements(tt.role, tt.existing, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expected == "" {
+				if len(statements) > 0 {
+					t.Fatalf("expected no statements, got %v", statements)
+				}
+				return
+			}
+			if len(statements) != 1 || !strings.HasPrefix(statements[0], tt.expected) {
+				t.Errorf("expected %s, got %v", tt.expected, statements)
+			}
+			if strings.Contains(strings.Join(statements, ""), tt.password) && tt.password != "" {
+				t.Errorf("the plaintext password is part of %v", statements)
+			}
+		})
+	}
+}
+
+func TestMembershipStatements(t *testing.T) {
+	existing := &RoleInfo{Name: "app", MemberOf: []string{"readers", "legacy"}}
+	tests := []struct {
+		name     string
+		memberOf []string
+		existing *RoleInfo
+		expected []string
+	}{
+		{name: "new role", memberOf: []string{"readers"}, expected: []string{`GRANT "readers" TO "app"`}},
+		{name: "memberships not managed", existing: existing},
+		{
+			name:     "declared memberships",
+			memberOf: []string{"readers", "writers"},
+			existing: existing,
+			expected: []string{`GRANT "writers" TO "app"`, `REVOKE "legacy" FROM "app"`},
+		},
+		{
+			name:     "no memberships",
+			memberOf: []string{},
+			existing: existing,
+			expected: []string{`REVOKE "readers" FROM "app"`, `REVOKE "legacy" FROM "app"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements := membershipStatements(pkg.RoleConf{Name: "app", MemberOf: tt.memberOf}, tt.existing)
+			if strings.Join(statements, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("expected %v, got %v", tt.expected, statements)
+			}
+		})
+	}
+}
+
+func TestScramVerifierMatches(t *testing.T) {
+	verifier, err := ScramSHA256Verifier("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scramVerifierMatches(verifier, "secret") {
+		t.Error("expected the verifier to match its password")
+	}
+	for _, other := range []string{"Secret", "secret ", ""} {
+		if scramVerifierMatches(verifier, other) {
+			t.Errorf("expected %q not to match", other)
+		}
+	}
+	if scramVerifierMatches("md5a4e1e6f8b2ed3c1f6e4a1c2b3d4e5f6a", "secret") {
+		t.Error("expected an md5 password not to match")
+	}
+	if scramVerifierMatches("", "secret") {
+		t.Error("expected a missing password not to match")
+	}
+}
+
+func TestRolePassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APP_PASSWORD", "from-env")
+	t.Setenv("OTHER_PASSWORD_FILE", file)
+
+	tests := []struct {
+		name     string
+		role     pkg.RoleConf
+		expected string
+		err      bool
+	}{
+		{name: "no password", role: pkg.RoleConf{Name: "app"}},
+		{name: "env", role: pkg.RoleConf{Name: "app", PasswordEnv: "APP_PASSWORD"}, expected: "from-env"},
+		{name: "env file", role: pkg.RoleConf{Name: "app", PasswordEnv: "OTHER_PASSWORD"}, expected: "from-file"},
+		{name: "file", role: pkg.RoleConf{Name: "app", PasswordFile: file}, expected: "from-file"},
+		{name: "unset env", role: pkg.RoleConf{Name: "app", PasswordEnv: "MISSING_PASSWORD"}, err: true},
+		{name: "both", role: pkg.RoleConf{Name: "app", PasswordEnv: "APP_PASSWORD", PasswordFile: file}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password, err := rolePassword(tt.role)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error=%v, got %v", tt.err, err)
+			}
+			if password != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, password)
+			}
+		})
+	}
+}
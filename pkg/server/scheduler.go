@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/duration"
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/commons/properties"
+	"github.com/robfig/cron/v3"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+// BackupScheduleOptions controls when BackupScheduler takes backups and which ones it keeps
+type BackupScheduleOptions struct {
+	// Schedule is a cron expression with 5 fields, or a descriptor such as @daily or @every 6h
+	Schedule string
+	// WalG takes base backups with wal-g backup-push, logical backups are taken with BackupWithOptions when nil
+	WalG *pkg.WalgConf
+	// Backup controls the logical backups, its OutputDir must only contain scheduled backups as they are pruned
+	Backup BackupOptions
+	// RetainCount keeps the newest backups (0 = no limit)
+	RetainCount int
+	// MaxAge keeps the backups younger than this (0 = no limit), a backup kept by either rule is not deleted
+	MaxAge time.Duration
+}
+
+// DefaultBackupScheduleOptions takes logical backups on the backup.schedule property and keeps the newest
+// backup.retain-count (7) and those younger than backup.max-age
+func DefaultBackupScheduleOptions() BackupScheduleOptions {
+	return BackupScheduleOptions{
+		Schedule:    properties.String("", "backup.schedule"),
+		Backup:      DefaultBackupOptions(),
+		RetainCount: properties.Int(7, "backup.retain-count"),
+		MaxAge:      properties.Duration(0, "backup.max-age"),
+	}
+}
+
+// WalgBackupScheduleOptions takes WAL-G base backups on the backup_schedule of conf and keeps its
+// backup_retain_count newest backups and those younger than its retention_policy, e.g. 30d
+func WalgBackupScheduleOptions(conf *pkg.WalgConf) (BackupScheduleOptions, error) {
+	opts := DefaultBackupScheduleOptions()
+	opts.Schedule, opts.WalG, opts.RetainCount, opts.MaxAge = conf.BackupSchedule, conf, conf.BackupRetainCount, 0
+	if conf.RetentionPolicy != nil && *conf.RetentionPolicy != "" {
+		maxAge, err := duration.ParseDuration(*conf.RetentionPolicy)
+		if err != nil {
+			return opts, fmt.Errorf("invalid retention_policy %q, expected a maximum age such as 30d: %w", *conf.RetentionPolicy, err)
+		}
+		opts.MaxAge = time.Duration(maxAge)
+	}
+	return opts, nil
+}
+
+// BackupRun is a backup taken by BackupScheduler
+type BackupRun struct {
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// Backup is the directory of a logical backup
+	Backup string `json:"backup,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Deleted are the logical backups deleted by the retention
+	Deleted        []string `json:"deleted,omitempty"`
+	RetentionError string   `json:"retention_error,omitempty"`
+}
+
+// BackupScheduleStatus is the state of a BackupScheduler
+type BackupScheduleStatus struct {
+	Schedule    string     `json:"schedule"`
+	Type        string     `json:"type"`
+	RetainCount int        `json:"retain_count,omitempty"`
+	MaxAge      string     `json:"max_age,omitempty"`
+	Running     bool       `json:"running"`
+	NextRun     time.Time  `json:"next_run"`
+	LastRun     *BackupRun `json:"last_run,omitempty"`
+	LastSuccess *BackupRun `json:"last_success,omitempty"`
+	LastFailure *BackupRun `json:"last_failure,omitempty"`
+	// SkippedRuns counts the runs skipped because the previous backup was still running
+	SkippedRuns int        `json:"skipped_runs"`
+	LastSkipped *time.Time `json:"last_skipped,omitempty"`
+}
+
+// BackupScheduler takes backups on a cron schedule and applies the retention after each successful one. A run
+// is skipped while the previous backup is still running.
+type BackupScheduler struct {
+	opts     BackupScheduleOptions
+	schedule cron.Schedule
+	cron     *cron.Cron
+	// backup takes a backup and returns its path, if any
+	backup func() (string, error)
+	// retain applies the retention and returns the deleted backups
+	retain func() ([]string, error)
+
+	mu     sync.Mutex
+	status BackupScheduleStatus
+}
+
+// NewBackupScheduler returns a scheduler taking backups of p, it does not run until started
+func NewBackupScheduler(p *Postgres, opts BackupScheduleOptions) (*BackupScheduler, error) {
+	schedule, err := cron.ParseStandard(opts.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup schedule %q: %w", opts.Schedule, err)
+	}
+	s := &BackupScheduler{
+		opts:     opts,
+		schedule: schedule,
+		status:   BackupScheduleStatus{Schedule: opts.Schedule, Type: "logical", RetainCount: opts.RetainCount},
+	}
+	if opts.MaxAge > 0 {
+		s.status.MaxAge = opts.MaxAge.String()
+	}
+
+	if opts.WalG != nil {
+		if !opts.WalG.Enabled {
+			return nil, fmt.Errorf("WAL-G is disabled")
+		}
+		walg := pkg.NewWalG(opts.WalG)
+		s.status.Type = "wal-g"
+		s.backup = func() (string, error) { return "", walg.BackupPush() }
+		s.retain = func() ([]string, error) { return nil, walg.ApplyRetention(opts.RetainCount, opts.MaxAge) }
+		return s, nil
+	}
+
+	if err := opts.Backup.validate(); err != nil {
+		return nil, err
+	}
+	s.backup = func() (string, error) {
+		dir, err := p.BackupWithOptions(opts.Backup)
+		if err != nil && dir != "" {
+			// A backup directory without a manifest is neither restored nor pruned
+			if _, statErr := os.Stat(filepath.Join(dir, BackupManifestFile)); os.IsNotExist(statErr) {
+				if err := os.RemoveAll(dir); err != nil {
+					logger.Warnf("failed to remove the incomplete backup %s: %v", dir, err)
+				}
+			}
+		}
+		return dir, err
+	}
+	s.retain = func() ([]string, error) {
+		return pruneBackups(opts.Backup.OutputDir, opts.RetainCount, opts.MaxAge, time.Now())
+	}
+	return s, nil
+}
+
+// Start runs the scheduled backups in the background until Stop is called
+func (s *BackupScheduler) Start() {
+	s.cron = cron.New()
+	s.cron.Schedule(s.schedule, cron.FuncJob(s.run))
+	s.cron.Start()
+	clicky.Infof("🗓️  Scheduled %s backups on %q, next at %s", s.status.Type, s.opts.Schedule,
+		s.schedule.Next(time.Now()).Format(time.RFC3339))
+}
+
+// Stop stops scheduling backups and waits for a running backup to finish or ctx to be done
+func (s *BackupScheduler) Stop(ctx context.Context) error {
+	if s.cron == nil {
+		return nil
+	}
+	select {
+	case <-s.cron.Stop().Done():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("backup still running: %w", ctx.Err())
+	}
+}
+
+// Status returns the outcome of the last runs and when the next one is due
+func (s *BackupScheduler) Status() BackupScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.NextRun = s.schedule.Next(time.Now())
+	return status
+}
+
+// Health returns an error when the last backup or its retention failed, or when a run was skipped since the last
+// successful backup
+func (s *BackupScheduler) Health() error {
+	status := s.Status()
+	if last := status.LastRun; last != nil {
+		if last.Error != "" {
+			return fmt.Errorf("the backup started at %s failed: %s", last.Started.Format(time.RFC3339), last.Error)
+		}
+		if last.RetentionError != "" {
+			return fmt.Errorf("failed to apply the retention after the backup started at %s: %s",
+				last.Started.Format(time.RFC3339), last.RetentionError)
+		}
+	}
+	if status.LastSkipped != nil && (status.LastSuccess == nil || status.LastSkipped.After(status.LastSuccess.Started)) {
+		return fmt.Errorf("the backup due at %s was skipped as the previous one was still running",
+			status.LastSkipped.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// run takes a backup and applies the retention, unless the previous backup is still running
+func (s *BackupScheduler) run() {
+	started := time.Now()
+	s.mu.Lock()
+	if s.status.Running {
+		s.status.SkippedRuns++
+		s.status.LastSkipped = &started
+		s.mu.Unlock()
+		clicky.Warnf("⚠️  Skipping the scheduled backup, the previous one is still running")
+		return
+	}
+	s.status.Running = true
+	s.mu.Unlock()
+
+	clicky.Infof("💾 Starting the scheduled %s backup", s.status.Type)
+	run := &BackupRun{Started: started}
+	var err error
+	if run.Backup, err = s.backup(); err != nil {
+		run.Error = err.Error()
+		clicky.Warnf("❌ Scheduled backup failed: %v", err)
+	} else if run.Deleted, err = s.retain(); err != nil {
+		run.RetentionError = err.Error()
+		clicky.Warnf("⚠️  Failed to apply the backup retention: %v", err)
+	} else {
+		clicky.Infof("✅ Scheduled backup finished in %s", time.Since(started).Round(time.Second))
+	}
+	run.DurationSeconds = time.Since(started).Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.LastRun = run
+	if run.Error == "" {
+		s.status.LastSuccess = run
+	} else {
+		s.status.LastFailure = run
+	}
+}
+
+// pruneBackups deletes the complete backups in dir that are neither among the newest retainCount nor younger than
+// maxAge, a zero value disables a rule
+func pruneBackups(dir string, retainCount int, maxAge time.Duration, now time.Time) ([]string, error) {
+	if retainCount <= 0 && maxAge <= 0 {
+		return nil, nil
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for i, backup := range backups {
+		if retainCount > 0 && len(backups)-i <= retainCount {
+			continue
+		}
+		if maxAge > 0 {
+			manifest, err := ReadBackupManifest(backup)
+			if err != nil {
+				return deleted, err
+			}
+			if now.Sub(manifest.StartedAt) <= maxAge {
+				continue
+			}
+		}
+		if err := os.RemoveAll(backup); err != nil {
+			return deleted, fmt.Errorf("failed to delete %s: %w", backup, err)
+		}
+		clicky.Infof("🗑️  Deleted backup %s", backup)
+		deleted = append(deleted, backup)
+	}
+	return deleted, nil
+}
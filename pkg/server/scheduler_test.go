@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+func TestNewBackupScheduler(t *testing.T) {
+	retention := "30d"
+	tests := []struct {
+		name string
+		opts func() (BackupScheduleOptions, error)
+		typ  string
+		err  string
+	}{
+		{name: "logical", opts: func() (BackupScheduleOptions, error) {
+			opts := DefaultBackupScheduleOptions()
+			opts.Schedule = "0 2 * * *"
+			return opts, nil
+		}, typ: "logical"},
+		{name: "descriptor", opts: func() (BackupScheduleOptions, error) {
+			opts := DefaultBackupScheduleOptions()
+			opts.Schedule = "@every 6h"
+			return opts, nil
+		}, typ: "logical"},
+		{name: "invalid schedule", opts: func() (BackupScheduleOptions, error) {
+			opts := DefaultBackupScheduleOptions()
+			opts.Schedule = "0 2 * *"
+			return opts, nil
+		}, err: "invalid backup schedule"},
+		{name: "invalid backup options", opts: func() (BackupScheduleOptions, error) {
+			opts := DefaultBackupScheduleOptions()
+			opts.Schedule, opts.Backup.Jobs = "@daily", 4
+			return opts, nil
+		}, err: "directory format"},
+		{name: "wal-g", opts: func() (BackupScheduleOptions, error) {
+			return WalgBackupScheduleOptions(&pkg.WalgConf{Enabled: true, BackupSchedule: "@daily", BackupRetainCount: 7, RetentionPolicy: &retention})
+		}, typ: "wal-g"},
+		{name: "wal-g disabled", opts: func() (BackupScheduleOptions, error) {
+			return WalgBackupScheduleOptions(&pkg.WalgConf{BackupSchedule: "@daily"})
+		}, err: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.opts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			scheduler, err := NewBackupScheduler(&Postgres{}, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := scheduler.Status(); status.Type != tt.typ || !status.NextRun.After(time.Now()) {
+				t.Errorf("expected a %s schedule with a next run, got %+v", tt.typ, status)
+			}
+		})
+	}
+
+	invalid := "a month"
+	if _, err := WalgBackupScheduleOptions(&pkg.WalgConf{Enabled: true, RetentionPolicy: &invalid}); err == nil {
+		t.Error("expected an error for an invalid retention_policy")
+	}
+	opts, err := WalgBackupScheduleOptions(&pkg.WalgConf{Enabled: true, BackupRetainCount: 3, RetentionPolicy: &retention})
+	if err != nil || opts.RetainCount != 3 || opts.MaxAge != 30*24*time.Hour {
+		t.Errorf("expected the retention of the WAL-G configuration, got %+v, %v", opts, err)
+	}
+}
+
+func TestBackupSchedulerRun(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var retained int
+	opts := DefaultBackupScheduleOptions()
+	opts.Schedule = "@daily"
+	s, err := NewBackupScheduler(&Postgres{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backup = func() (string, error) {
+		close(started)
+		<-release
+		return "backups/1", nil
+	}
+	s.retain = func() ([]string, error) {
+		retained++
+		return []string{"backups/0"}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+	<-started
+
+	// A run while the backup is in progress is skipped
+	s.run()
+	if status := s.Status(); status.SkippedRuns != 1 || !status.Running {
+		t.Fatalf("expected the run to be skipped, got %+v", status)
+	}
+	close(release)
+	<-done
+
+	if s.status.Running || retained != 1 || s.status.LastSuccess == nil || s.status.LastFailure != nil {
+		t.Fatalf("expected a successful run, got %+v", s.status)
+	}
+	if !reflect.DeepEqual(s.status.LastRun.Deleted, []string{"backups/0"}) {
+		t.Errorf("expected the deleted backups, got %v", s.status.LastRun.Deleted)
+	}
+	if err := s.Health(); err == nil || !strings.Contains(err.Error(), "skipped") {
+		t.Errorf("expected the skipped run to be reported, got %v", err)
+	}
+
+	s.backup = func() (string, error) { return "", nil }
+	s.run()
+	if err := s.Health(); err != nil {
+		t.Errorf("expected the scheduler to be healthy, got %v", err)
+	}
+
+	s.retain = func() ([]string, error) { return nil, fmt.Errorf("access denied") }
+	s.run()
+	if err := s.Health(); err == nil || !strings.Contains(err.Error(), "retention") {
+		t.Errorf("expected the retention failure to be reported, got %v", err)
+	}
+
+	s.backup = func() (string, error) { return "", fmt.Errorf("disk full") }
+	s.run()
+	if err := s.Health(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected the failed backup to be reported, got %v", err)
+	}
+	if retained != 2 || s.status.LastFailure != s.status.LastRun {
+		t.Errorf("expected no retention after a failed backup, got %+v", s.status)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	now := time.Date(2025, 1, 31, 2, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		retainCount int
+		maxAge      time.Duration
+		deleted     []string
+	}{
+		{name: "keep everything"},
+		{name: "count", retainCount: 2, deleted: []string{"20250101T020000Z", "20250120T020000Z"}},
+		{name: "age", maxAge: 7 * 24 * time.Hour, deleted: []string{"20250101T020000Z", "20250120T020000Z"}},
+		{name: "count or age", retainCount: 1, maxAge: 14 * 24 * time.Hour, deleted: []string{"20250101T020000Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range []string{"20250101T020000Z", "20250120T020000Z", "20250129T020000Z", "20250130T020000Z"} {
+				started, _ := time.Parse("20060102T150405Z", name)
+				if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := writeBackupManifest(filepath.Join(dir, name), &BackupManifest{ManifestVersion: 1, StartedAt: started}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Incomplete backups are left alone
+			if err := os.Mkdir(filepath.Join(dir, "20241201T020000Z"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, err := pruneBackups(dir, tt.retainCount, tt.maxAge, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, path := range deleted {
+				names = append(names, filepath.Base(path))
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("expected %s to be deleted", path)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.deleted) {
+				t.Errorf("expected %v to be deleted, got %v", tt.deleted, names)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "20241201T020000Z")); err != nil {
+				t.Errorf("expected the incomplete backup to be kept: %v", err)
+			}
+		})
+	}
+}
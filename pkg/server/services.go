@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg"
+	"github.com/flanksource/postgres/pkg/generators"
+	"github.com/flanksource/postgres/pkg/pgtune"
+	"github.com/flanksource/postgres/pkg/supervisor"
+	"github.com/flanksource/postgres/pkg/sysinfo"
+)
+
+// ServiceOptions selects the services run next to PostgreSQL by RunWithOptions
+type ServiceOptions struct {
+	PgBouncer bool
+	PostgREST bool
+	// ConfigDir contains pgbouncer.ini and postgrest.conf, defaults to the parent of the data directory.
+	// Missing files are generated from the detected resources.
+	ConfigDir string
+}
+
+// Services returns the PgBouncer and PostgREST services selected by opts, both depend on PostgreSQL
+func (p *Postgres) Services(opts ServiceOptions) ([]*supervisor.Service, error) {
+	if !opts.PgBouncer && !opts.PostgREST {
+		return nil, nil
+	}
+	if opts.ConfigDir == "" {
+		opts.ConfigDir = filepath.Dir(p.DataDir)
+	}
+	g := &serviceConfigs{p: p, dir: opts.ConfigDir}
+
+	var services []*supervisor.Service
+	if opts.PgBouncer {
+		s, err := g.pgBouncer()
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	if opts.PostgREST {
+		s, err := g.postgREST()
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	for _, s := range services {
+		s.DependsOn = []string{"postgresql"}
+	}
+	return services, nil
+}
+
+// serviceConfigs generates the service configuration files, tuning for the detected resources only once
+type serviceConfigs struct {
+	p       *Postgres
+	dir     string
+	sysInfo *sysinfo.SystemInfo
+	params  *pgtune.TunedParameters
+}
+
+func (g *serviceConfigs) pgBouncer() (*supervisor.Service, error) {
+	path := filepath.Join(g.dir, "pgbouncer.ini")
+	config := &pkg.PgBouncerConf{}
+	if content, err := os.ReadFile(path); err == nil {
+		config.ListenAddress = configValue(content, "listen_addr")
+		config.ListenPort, _ = strconv.Atoi(configValue(content, "listen_port"))
+	} else {
+		if err := g.tune(); err != nil {
+			return nil, err
+		}
+		generator := generators.NewPgBouncerConfigGenerator(g.sysInfo, g.params)
+		generator.SetDatabaseConfig("postgres", "localhost", g.port(), "postgres", g.user())
+		config = generator.GenerateConfig()
+		if err := g.write(path, generator.GenerateConfigFile()); err != nil {
+			return nil, err
+		}
+	}
+	return pkg.NewPgBouncer(config).Service(path), nil
+}
+
+func (g *serviceConfigs) postgREST() (*supervisor.Service, error) {
+	path := filepath.Join(g.dir, "postgrest.conf")
+	config := &pkg.PostgrestConf{}
+	if content, err := os.ReadFile(path); err == nil {
+		if host := configValue(content, "server-host"); host != "" {
+			config.ServerHost = &host
+		}
+		if port, err := strconv.Atoi(configValue(content, "server-port")); err == nil {
+			config.ServerPort = &port
+		}
+	} else {
+		if err := g.tune(); err != nil {
+			return nil, err
+		}
+		generator := generators.NewPostgRESTConfigGenerator(g.sysInfo, g.params)
+		generator.SetDatabaseConfig("postgres", "localhost", g.port(), g.user(), g.p.Password.Value())
+		content, err := generator.GenerateConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate postgrest.conf: %w", err)
+		}
+		if config, err = generator.GenerateConfig(); err != nil {
+			return nil, fmt.Errorf("failed to generate postgrest.conf: %w", err)
+		}
+		if err := g.write(path, content); err != nil {
+			return nil, err
+		}
+	}
+	return pkg.NewPostgREST(config).Service(path), nil
+}
+
+func (g *serviceConfigs) tune() error {
+	if g.params != nil {
+		return nil
+	}
+	sysInfo, err := sysinfo.DetectSystemInfo()
+	if err != nil {
+		return fmt.Errorf("failed to detect system info: %w", err)
+	}
+	resources := sysInfo.Container
+	if resources.Memory == 0 {
+		resources.Memory = sysInfo.System.Memory
+	}
+	if resources.CPUs == 0 {
+		resources.CPUs = sysInfo.System.CPUs
+	}
+	params, err := pgtune.CalculateOptimalConfig(&pgtune.TuningConfig{
+		Resources:         resources,
+		DBType:            "web",
+		PostgreSQLVersion: sysInfo.PostgreSQLVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to calculate optimal config: %w", err)
+	}
+	if params.MaxConnections == 0 {
+		params.MaxConnections = pgtune.GetRecommendedMaxConnections("web")
+	}
+	g.sysInfo, g.params = sysInfo, params
+	return nil
+}
+
+func (g *serviceConfigs) write(path, content string) error {
+	if g.p.DryRun {
+		clicky.Infof("[DRYRUN] Would generate %s", path)
+		return nil
+	}
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", g.dir, err)
+	}
+	// The files contain database credentials
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	clicky.Infof("📝 Generated %s", path)
+	return nil
+}
+
+func (g *serviceConfigs) port() int {
+	if g.p.Port != 0 {
+		return g.p.Port
+	}
+	return 5432
+}
+
+func (g *serviceConfigs) user() string {
+	if g.p.Username != "" {
+		return g.p.Username
+	}
+	return "postgres"
+}
+
+// configValue returns the value of key in an ini style configuration file, without quotes
+func configValue(content []byte, key string) string {
+	re := regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(key) + `\s*=\s*"?([^"\r\n]*?)"?\s*$`)
+	if match := re.FindSubmatch(content); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
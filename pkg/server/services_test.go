@@ -0,0 +1,64 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServicesUseExistingConfigs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"pgbouncer.ini":  "[pgbouncer]\nlisten_addr = 127.0.0.1\nlisten_port = 6433\n",
+		"postgrest.conf": "server-host = \"0.0.0.0\"\nserver-port = 3001\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Postgres{DataDir: filepath.Join(dir, "data")}
+	services, err := p.Services(ServiceOptions{PgBouncer: true, PostgREST: true, ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(services))
+	}
+	for i, want := range []string{"pgbouncer", "postgrest"} {
+		s := services[i]
+		if s.Name != want {
+			t.Errorf("expected service %d to be %s, got %s", i, want, s.Name)
+		}
+		if strings.Join(s.DependsOn, ",") != "postgresql" {
+			t.Errorf("expected %s to depend on postgresql, got %v", s.Name, s.DependsOn)
+		}
+		if len(s.Args) != 1 || filepath.Dir(s.Args[0]) != dir {
+			t.Errorf("expected %s to use its config in %s, got %v", s.Name, dir, s.Args)
+		}
+	}
+
+	if services, err := p.Services(ServiceOptions{}); err != nil || len(services) != 0 {
+		t.Errorf("expected no services by default, got %v, %v", services, err)
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	content := []byte("[pgbouncer]\n;listen_port = 1\nlisten_port = 6432\nserver-host = \"0.0.0.0\"\nempty =\n")
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"listen_port", "6432"},
+		{"server-host", "0.0.0.0"},
+		{"empty", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if got := configValue(content, tt.key); got != tt.want {
+			t.Errorf("configValue(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/properties"
+)
+
+// SQLOptions controls how ExecScript runs a script
+type SQLOptions struct {
+	// Timeout cancels a statement that runs for longer, 0 waits forever
+	Timeout time.Duration
+	// SingleTransaction runs the whole script in one transaction, which is rolled back when a statement fails
+	SingleTransaction bool
+	// Vars are referenced as :name in the script and sent as bind parameters, never interpolated
+	Vars map[string]string
+}
+
+// DefaultSQLOptions runs each statement in its own transaction, the timeout can be set with the sql.timeout property
+func DefaultSQLOptions() SQLOptions {
+	return SQLOptions{
+		Timeout: properties.Duration(0, "sql.timeout"),
+	}
+}
+
+// Statement is a single statement of a script, with :name variables replaced by $N bind parameters
+type Statement struct {
+	SQL  string
+	Args []any
+	// Line is the line of the script the statement starts on
+	Line int
+	// ReturnsRows is set for statements that produce a result set (SELECT, RETURNING, ...), others are run
+	// with Exec to report the number of affected rows
+	ReturnsRows bool
+}
+
+// StatementResult is the outcome of a statement run by ExecScript
+type StatementResult struct {
+	Line     int
+	Rows     int64
+	Duration time.Duration
+}
+
+// rowStatements are the leading keywords of statements that return rows
+var rowStatements = map[string]bool{
+	"select": true, "with": true, "values": true, "table": true, "show": true, "explain": true, "fetch": true,
+}
+
+// ExecScript runs the statements of script one at a time, streaming the rows of each statement to out as they
+// are read. It stops at the first failing statement, statements before it stay committed unless
+// SingleTransaction is set.
+func (p *Postgres) ExecScript(script string, opts SQLOptions, out ResultWriter) ([]StatementResult, error) {
+	statements, err := SplitStatements(script, opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("no SQL statements to execute")
+	}
+	if p.DryRun {
+		for _, statement := range statements {
+			clicky.Infof("[DRYRUN] %s %v", statement.SQL, statement.Args)
+		}
+		return nil, nil
+	}
+
+	var results []StatementResult
+	err = p.WithConnection(func(db *sql.DB) error {
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		defer conn.Close()
+
+		var runner sqlRunner = conn
+		var tx *sql.Tx
+		if opts.SingleTransaction {
+			if tx, err = conn.BeginTx(ctx, nil); err != nil {
+				return fmt.Errorf("failed to begin transaction: %w", err)
+			}
+			defer tx.Rollback() //nolint:errcheck
+			runner = tx
+		}
+
+		for _, statement := range statements {
+			result, err := runStatement(ctx, runner, statement, opts.Timeout, out)
+			if err != nil {
+				if opts.SingleTransaction {
+					return fmt.Errorf("statement at line %d: %w, the transaction was rolled back", statement.Line, err)
+				}
+				return fmt.Errorf("statement at line %d: %w", statement.Line, err)
+			}
+			results = append(results, result)
+		}
+		if tx != nil {
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("failed to commit: %w", err)
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// sqlRunner is implemented by *sql.Conn and *sql.Tx
+type sqlRunner interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func runStatement(ctx context.Context, runner sqlRunner, statement Statement, timeout time.Duration, out ResultWriter) (StatementResult, error) {
+	result := StatementResult{Line: statement.Line}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	clicky.SQL(statement.SQL)
+	start := time.Now()
+	err := func() error {
+		if !statement.ReturnsRows {
+			res, err := runner.ExecContext(ctx, statement.SQL, statement.Args...)
+			if err != nil {
+				return err
+			}
+			result.Rows, _ = res.RowsAffected()
+			return nil
+		}
+
+		rows, err := runner.QueryContext(ctx, statement.SQL, statement.Args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			return fmt.Errorf("failed to get columns: %w", err)
+		}
+		if len(types) == 0 {
+			// e.g. a WITH query around an INSERT without RETURNING
+			for rows.Next() {
+			}
+			return rows.Err()
+		}
+		columns := make([]string, len(types))
+		for i, t := range types {
+			columns[i] = t.Name()
+		}
+		if err := out.Begin(columns); err != nil {
+			return err
+		}
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(pointers...); err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			for i, t := range types {
+				values[i] = columnValue(t.DatabaseTypeName(), values[i])
+			}
+			if err := out.Row(values); err != nil {
+				return err
+			}
+			result.Rows++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return out.End()
+	}()
+	result.Duration = time.Since(start)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return result, fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return result, err
+}
+
+// columnValue converts the values lib/pq returns as raw bytes: bytea is shown in the hex format used by
+// PostgreSQL, other types it does not decode (numeric, name, uuid, ...) are text
+func columnValue(databaseType string, value any) any {
+	b, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+	if databaseType == "BYTEA" {
+		return fmt.Sprintf("\\x%x", b)
+	}
+	return string(b)
+}
+
+// SplitStatements splits script on the semicolons that are outside of string literals, quoted identifiers,
+// dollar quoted strings and comments, dropping the statements that are empty or only comments. Outside of those,
+// :name is replaced by a bind parameter when name is one of vars, :: casts and other colons are left as is.
+// SQL-standard function bodies (BEGIN ATOMIC ... END) are not supported, they are split at their semicolons.
+func SplitStatements(script string, vars map[string]string) ([]Statement, error) {
+	var statements []Statement
+	var current strings.Builder
+	var args []any
+	params := map[string]int{}
+	line, start := 1, 1
+	empty, firstWord, returning := true, "", false
+
+	flush := func() {
+		if !empty {
+			statements = append(statements, Statement{
+				SQL:         strings.TrimSpace(current.String()),
+				Args:        args,
+				Line:        start,
+				ReturnsRows: rowStatements[firstWord] || returning,
+			})
+		}
+		current.Reset()
+		args, params = nil, map[string]int{}
+		empty, firstWord, returning = true, "", false
+	}
+	// emit writes script[i:end] to the current statement, counting the lines
+	emit := func(i, end int) {
+		current.WriteString(script[i:end])
+		line += strings.Count(script[i:end], "\n")
+	}
+	// content marks the start of the statement at the first character that is not a comment or space
+	content := func() {
+		if empty {
+			empty, start = false, line
+		}
+	}
+
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == ';':
+			flush()
+			i++
+
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			emit(i, i+end)
+			i += end
+
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end, depth := i+2, 1
+			for end < len(script) && depth > 0 {
+				switch {
+				case strings.HasPrefix(script[end:], "/*"):
+					depth, end = depth+1, end+2
+				case strings.HasPrefix(script[end:], "*/"):
+					depth, end = depth-1, end+2
+				default:
+					end++
+				}
+			}
+			if depth > 0 {
+				return nil, fmt.Errorf("line %d: unterminated /* comment", line)
+			}
+			emit(i, end)
+			i = end
+
+		case c == '\'':
+			content()
+			escapes := i > 0 && (script[i-1] == 'E' || script[i-1] == 'e') && (i == 1 || !isIdentifierChar(script[i-2]))
+			end := i + 1
+			for ; end < len(script); end++ {
+				if escapes && script[end] == '\\' {
+					end++
+					continue
+				}
+				if script[end] == '\'' {
+					if end+1 < len(script) && script[end+1] == '\'' {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			if end >= len(script) {
+				return nil, fmt.Errorf("line %d: unterminated string literal", line)
+			}
+			emit(i, end+1)
+			i = end + 1
+
+		case c == '"':
+			content()
+			end := i + 1
+			for ; end < len(script); end++ {
+				if script[end] == '"' {
+					if end+1 < len(script) && script[end+1] == '"' {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			if end >= len(script) {
+				return nil, fmt.Errorf("line %d: unterminated quoted identifier", line)
+			}
+			emit(i, end+1)
+			i = end + 1
+
+		case c == '$' && (i == 0 || !isIdentifierChar(script[i-1])) && dollarTag(script[i:]) != "":
+			content()
+			tag := dollarTag(script[i:])
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated dollar quoted string %s", line, tag)
+			}
+			end += i + 2*len(tag)
+			emit(i, end)
+			i = end
+
+		case c == ':' && strings.HasPrefix(script[i:], "::"):
+			content()
+			emit(i, i+2)
+			i += 2
+
+		case c == ':' && i+1 < len(script) && isIdentifierStart(script[i+1]):
+			content()
+			end := i + 1
+			for end < len(script) && isIdentifierChar(script[end]) {
+				end++
+			}
+			name := script[i+1 : end]
+			value, ok := vars[name]
+			if !ok {
+				emit(i, end)
+				i = end
+				break
+			}
+			if _, ok := params[name]; !ok {
+				args = append(args, value)
+				params[name] = len(args)
+			}
+			current.WriteString("$" + strconv.Itoa(params[name]))
+			i = end
+
+		case c == '\\' && empty:
+			return nil, fmt.Errorf("line %d: psql meta-commands are not supported", line)
+
+		case isIdentifierStart(c) && (i == 0 || !isIdentifierChar(script[i-1])):
+			content()
+			end := i + 1
+			for end < len(script) && isIdentifierChar(script[end]) {
+				end++
+			}
+			word := strings.ToLower(script[i:end])
+			if firstWord == "" {
+				firstWord = word
+			}
+			if word == "returning" {
+				returning = true
+			}
+			emit(i, end)
+			i = end
+
+		default:
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				content()
+			}
+			emit(i, i+1)
+			i++
+		}
+	}
+	flush()
+	return statements, nil
+}
+
+// dollarTag returns the $tag$ s starts with, or "" if it does not start a dollar quoted string
+func dollarTag(s string) string {
+	end := 1
+	for end < len(s) && s[end] != '$' {
+		if !isIdentifierChar(s[end]) || (end == 1 && !isIdentifierStart(s[end])) {
+			return ""
+		}
+		end++
+	}
+	if end >= len(s) {
+		return ""
+	}
+	return s[:end+1]
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
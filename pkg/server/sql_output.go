@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ResultWriter streams the rows of the statements that return rows, Begin and End are called once per statement
+type ResultWriter interface {
+	Begin(columns []string) error
+	Row(values []any) error
+	End() error
+}
+
+// SQLFormats are the formats accepted by NewResultWriter
+var SQLFormats = []string{"table", "json", "csv", "markdown", "yaml"}
+
+// tablePageSize is the number of rows a table is aligned over, as aligning needs the rows to be held in memory
+const tablePageSize = 1000
+
+// NewResultWriter returns a ResultWriter that writes format to w without buffering the result. A script with
+// several statements returning rows produces a JSON array, CSV table or YAML document per statement.
+func NewResultWriter(format string, w io.Writer) (ResultWriter, error) {
+	switch format {
+	case "", "table", "pretty":
+		return &tableWriter{w: w}, nil
+	case "json":
+		return &jsonWriter{w: w}, nil
+	case "csv":
+		return &csvWriter{w: w}, nil
+	case "markdown", "md":
+		return &markdownWriter{w: w}, nil
+	case "yaml", "yml":
+		return &yamlWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q, expected one of %s", format, strings.Join(SQLFormats, ", "))
+}
+
+// formatValue is the text of a value in the table, CSV and markdown formats, NULL is empty
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// tableWriter aligns the columns over pages of tablePageSize rows
+type tableWriter struct {
+	w       io.Writer
+	tw      *tabwriter.Writer
+	rows    int
+	results int
+}
+
+func (t *tableWriter) Begin(columns []string) error {
+	if t.results > 0 {
+		fmt.Fprintln(t.w)
+	}
+	t.results++
+	t.rows = 0
+	t.tw = tabwriter.NewWriter(t.w, 0, 0, 2, ' ', 0)
+	separators := make([]string, len(columns))
+	for i, column := range columns {
+		separators[i] = strings.Repeat("-", len(column))
+	}
+	fmt.Fprintln(t.tw, strings.Join(columns, "\t"))
+	fmt.Fprintln(t.tw, strings.Join(separators, "\t"))
+	return nil
+}
+
+func (t *tableWriter) Row(values []any) error {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cells[i] = strings.NewReplacer("\t", " ", "\n", `\n`, "\r", `\r`).Replace(formatValue(value))
+	}
+	fmt.Fprintln(t.tw, strings.Join(cells, "\t"))
+	if t.rows++; t.rows%tablePageSize == 0 {
+		return t.tw.Flush()
+	}
+	return nil
+}
+
+func (t *tableWriter) End() error {
+	return t.tw.Flush()
+}
+
+// jsonWriter writes an array of objects, with the keys in the order of the columns
+type jsonWriter struct {
+	w       io.Writer
+	columns []string
+	rows    int
+}
+
+func (j *jsonWriter) Begin(columns []string) error {
+	j.columns, j.rows = columns, 0
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonWriter) Row(values []any) error {
+	var row strings.Builder
+	if j.rows > 0 {
+		row.WriteString(",")
+	}
+	row.WriteString("\n  {")
+	for i, value := range values {
+		key, _ := json.Marshal(j.columns[i])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", j.columns[i], err)
+		}
+		if i > 0 {
+			row.WriteString(", ")
+		}
+		row.Write(key)
+		row.WriteString(": ")
+		row.Write(data)
+	}
+	row.WriteString("}")
+	j.rows++
+	_, err := io.WriteString(j.w, row.String())
+	return err
+}
+
+func (j *jsonWriter) End() error {
+	end := "]\n"
+	if j.rows > 0 {
+		end = "\n]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+type csvWriter struct {
+	w       io.Writer
+	cw      *csv.Writer
+	results int
+}
+
+func (c *csvWriter) Begin(columns []string) error {
+	if c.results > 0 {
+		fmt.Fprintln(c.w)
+	}
+	c.results++
+	c.cw = csv.NewWriter(c.w)
+	return c.cw.Write(columns)
+}
+
+func (c *csvWriter) Row(values []any) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = formatValue(value)
+	}
+	return c.cw.Write(record)
+}
+
+func (c *csvWriter) End() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+type markdownWriter struct {
+	w       io.Writer
+	results int
+}
+
+func (m *markdownWriter) Begin(columns []string) error {
+	if m.results > 0 {
+		fmt.Fprintln(m.w)
+	}
+	m.results++
+	separators := make([]string, len(columns))
+	for i := range columns {
+		separators[i] = "---"
+	}
+	_, err := fmt.Fprintf(m.w, "%s\n%s\n", markdownRow(columns), markdownRow(separators))
+	return err
+}
+
+func (m *markdownWriter) Row(values []any) error {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cells[i] = formatValue(value)
+	}
+	_, err := fmt.Fprintln(m.w, markdownRow(cells))
+	return err
+}
+
+func (m *markdownWriter) End() error {
+	return nil
+}
+
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>").Replace(cell)
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// yamlWriter writes a list of mappings, with the keys in the order of the columns
+type yamlWriter struct {
+	w       io.Writer
+	columns []string
+	rows    int
+	results int
+}
+
+func (y *yamlWriter) Begin(columns []string) error {
+	if y.results > 0 {
+		if _, err := io.WriteString(y.w, "---\n"); err != nil {
+			return err
+		}
+	}
+	y.results++
+	y.columns, y.rows = columns, 0
+	return nil
+}
+
+func (y *yamlWriter) Row(values []any) error {
+	row := &yaml.Node{Kind: yaml.MappingNode}
+	for i, value := range values {
+		node := &yaml.Node{}
+		if err := node.Encode(value); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", y.columns[i], err)
+		}
+		row.Content = append(row.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: y.columns[i]}, node)
+	}
+	data, err := yaml.Marshal(&yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{row}})
+	if err != nil {
+		return err
+	}
+	y.rows++
+	_, err = y.w.Write(data)
+	return err
+}
+
+func (y *yamlWriter) End() error {
+	if y.rows == 0 {
+		_, err := io.WriteString(y.w, "[]\n")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		vars     map[string]string
+		expected []Statement
+		err      bool
+	}{
+		{
+			name:   "statements",
+			script: "SELECT 1;\nINSERT INTO t VALUES (1);\n\nUPDATE t SET a = 2 RETURNING a",
+			expected: []Statement{
+				{SQL: "SELECT 1", Line: 1, ReturnsRows: true},
+				{SQL: "INSERT INTO t VALUES (1)", Line: 2},
+				{SQL: "UPDATE t SET a = 2 RETURNING a", Line: 4, ReturnsRows: true},
+			},
+		},
+		{
+			name:   "quoted semicolons",
+			script: `SELECT 'a;b', "c;d", E'\';', $$;$$, $fn$ SELECT 1; $fn$; SELECT 'it''s;'`,
+			expected: []Statement{
+				{SQL: `SELECT 'a;b', "c;d", E'\';', $$;$$, $fn$ SELECT 1; $fn$`, Line: 1, ReturnsRows: true},
+				{SQL: `SELECT 'it''s;'`, Line: 1, ReturnsRows: true},
+			},
+		},
+		{
+			name:   "comments",
+			script: "-- setup;\n/* a /* nested; */ comment; */\nCREATE TABLE t (a int); -- trailing;\n-- only a comment;",
+			expected: []Statement{
+				{SQL: "-- setup;\n/* a /* nested; */ comment; */\nCREATE TABLE t (a int)", Line: 3},
+			},
+		},
+		{
+			name:   "variables",
+			script: "SELECT :id::int, :name, ':id', :other, :id;\nDELETE FROM t WHERE id = :id",
+			vars:   map[string]string{"id": "42", "name": "o'brien"},
+			expected: []Statement{
+				{SQL: "SELECT $1::int, $2, ':id', :other, $1", Args: []any{"42", "o'brien"}, Line: 1, ReturnsRows: true},
+				{SQL: "DELETE FROM t WHERE id = $1", Args: []any{"42"}, Line: 2},
+			},
+		},
+		{
+			name:     "positional parameters are not dollar quotes",
+			script:   "SELECT $1, a$b$ FROM t",
+			expected: []Statement{{SQL: "SELECT $1, a$b$ FROM t", Line: 1, ReturnsRows: true}},
+		},
+		{name: "empty", script: " ;\n; -- nothing"},
+		{name: "unterminated string", script: "SELECT 'a;", err: true},
+		{name: "unterminated dollar quote", script: "DO $$ BEGIN; END", err: true},
+		{name: "meta-command", script: "SELECT 1;\n\\connect other", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements, err := SplitStatements(tt.script, tt.vars)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error=%v, got %v", tt.err, err)
+			}
+			if !reflect.DeepEqual(statements, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, statements)
+			}
+		})
+	}
+}
+
+func TestResultWriter(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := [][]any{
+		{int64(1), "a|b", created},
+		{int64(2), nil, created},
+	}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{format: "table", expected: "id  name  created\n--  ----  -------\n1   a|b   2024-01-02T03:04:05Z\n2         2024-01-02T03:04:05Z\n"},
+		{format: "json", expected: "[\n  {\"id\": 1, \"name\": \"a|b\", \"created\": \"2024-01-02T03:04:05Z\"},\n  {\"id\": 2, \"name\": null, \"created\": \"2024-01-02T03:04:05Z\"}\n]\n"},
+		{format: "csv", expected: "id,name,created\n1,a|b,2024-01-02T03:04:05Z\n2,,2024-01-02T03:04:05Z\n"},
+		{format: "markdown", expected: "| id | name | created |\n| --- | --- | --- |\n| 1 | a\\|b | 2024-01-02T03:04:05Z |\n| 2 |  | 2024-01-02T03:04:05Z |\n"},
+		{format: "yaml", expected: "- id: 1\n  name: a|b\n  created: 2024-01-02T03:04:05Z\n- id: 2\n  name: null\n  created: 2024-01-02T03:04:05Z\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var out bytes.Buffer
+			w, err := NewResultWriter(tt.format, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Begin([]string{"id", "name", "created"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range rows {
+				if err := w.Row(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.End(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, out.String())
+			}
+		})
+	}
+
+	if _, err := NewResultWriter("html", &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
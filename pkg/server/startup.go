@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/flanksource/clicky"
+)
+
+// StartupError is a fatal condition that keeps PostgreSQL from starting, detected from the server log,
+// postmaster.pid or PG_VERSION
+type StartupError struct {
+	Reason string
+	// Detail is the log line the condition was detected from
+	Detail string
+	// Hint suggests how to fix the condition
+	Hint string
+}
+
+func (e *StartupError) Error() string {
+	msg := e.Reason
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Hint != "" {
+		msg += " (" + e.Hint + ")"
+	}
+	return msg
+}
+
+// startupDiagnosis recognizes a fatal condition from the message of a FATAL or PANIC log line
+type startupDiagnosis struct {
+	pattern *regexp.Regexp
+	reason  string
+	hint    string
+}
+
+var startupDiagnoses = []startupDiagnosis{
+	{
+		pattern: regexp.MustCompile(`could not bind .* address .*: Address already in use|Is another postmaster already running on port`),
+		reason:  "port already in use",
+		hint:    "stop the other server or change the port setting",
+	},
+	{
+		pattern: regexp.MustCompile(`lock file "(.*)" already exists`),
+		reason:  "lock file owned by another server",
+		hint:    "stop the other server using the data directory or socket, or remove the lock file if it is not running",
+	},
+	{
+		pattern: regexp.MustCompile(`could not (?:create|map anonymous|attach to|resize) shared memory|huge pages`),
+		reason:  "shared memory allocation failed",
+		hint:    "lower shared_buffers or max_connections, set huge_pages=off or enlarge /dev/shm (e.g. --shm-size for docker)",
+	},
+	{
+		pattern: regexp.MustCompile(`invalid value for parameter|unrecognized configuration parameter|parameter ".*" requires|configuration file ".*" contains errors|syntax error in file`),
+		reason:  "invalid configuration",
+		hint:    "fix the setting in postgresql.conf, postgresql.auto.conf or the -c arguments",
+	},
+	{
+		pattern: regexp.MustCompile(`could not load (?:pg_hba|pg_ident)\.conf|could not open (?:configuration )?file ".*pg_(?:hba|ident)\.conf"`),
+		reason:  "missing or invalid client authentication configuration",
+		hint:    "recreate pg_hba.conf, e.g. by running postgres-cli auto-start",
+	},
+	{
+		pattern: regexp.MustCompile(`data directory ".*" has (?:invalid permissions|wrong ownership)|Permission denied|could not change directory to`),
+		reason:  "permission denied",
+		hint:    "the data directory must be owned by the postgres user with mode 0700 or 0750, run as root to let the entrypoint fix it",
+	},
+	{
+		pattern: regexp.MustCompile(`database files are incompatible with server|initialized by PostgreSQL version .*, which is not compatible`),
+		reason:  "data directory version does not match the server",
+		hint:    "upgrade the data directory with postgres-cli server upgrade or use the binaries of the matching version",
+	},
+}
+
+var (
+	logSeverityPattern = regexp.MustCompile(`\b(DEBUG[1-5]|INFO|NOTICE|WARNING|ERROR|LOG|FATAL|PANIC|DETAIL|HINT|CONTEXT|STATEMENT|QUERY|LOCATION):\s`)
+	logPIDPattern      = regexp.MustCompile(`\[(\d+)\]`)
+)
+
+// logMessage is a message of the server log with its DETAIL and HINT lines
+type logMessage struct {
+	pid      string
+	severity string
+	lines    []string
+}
+
+// parseServerLog groups the lines of a server log written with the default log_line_prefix ('%m [%p] ') into
+// messages. DETAIL and HINT lines belong to the last message of the same process, lines without a severity
+// continue the previous message.
+func parseServerLog(log string) []*logMessage {
+	var messages []*logMessage
+	var last *logMessage
+	lastByPID := map[string]*logMessage{}
+	for _, line := range strings.Split(log, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		match := logSeverityPattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			if last != nil {
+				last.lines = append(last.lines, line)
+			}
+			continue
+		}
+		severity := line[match[2]:match[3]]
+		var pid string
+		if m := logPIDPattern.FindStringSubmatch(line[:match[0]]); m != nil {
+			pid = m[1]
+		}
+		switch severity {
+		case "DETAIL", "HINT", "CONTEXT", "STATEMENT", "QUERY", "LOCATION":
+			if message := lastByPID[pid]; message != nil {
+				message.lines = append(message.lines, line)
+				last = message
+				continue
+			}
+		}
+		last = &logMessage{pid: pid, severity: severity, lines: []string{line}}
+		lastByPID[pid] = last
+		messages = append(messages, last)
+	}
+	return messages
+}
+
+// diagnoseStartupLog returns the fatal condition a server log ends with, or nil if it contains no FATAL or
+// PANIC error
+func diagnoseStartupLog(log string) *StartupError {
+	messages := parseServerLog(log)
+	// Clients connecting during startup log FATAL errors too, the postmaster's own comes last
+	fatal := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].severity == "FATAL" || messages[i].severity == "PANIC" {
+			fatal = i
+			break
+		}
+	}
+	if fatal < 0 {
+		return nil
+	}
+	// The cause is often logged by the same process before the FATAL error, e.g. the bind errors before "could
+	// not create any TCP/IP sockets", or in its DETAIL and HINT lines. Warnings and the messages of other
+	// processes are unrelated to it.
+	var related []*logMessage
+	for _, message := range messages[:fatal] {
+		if message.pid == messages[fatal].pid && message.severity == "LOG" {
+			related = append(related, message)
+		}
+	}
+	for _, message := range append(related, messages[fatal]) {
+		for _, line := range message.lines {
+			for _, d := range startupDiagnoses {
+				if d.pattern.MatchString(line) {
+					return &StartupError{Reason: d.reason, Detail: strings.TrimSpace(message.lines[0]), Hint: d.hint}
+				}
+			}
+		}
+	}
+	return &StartupError{Reason: "PostgreSQL failed to start", Detail: strings.TrimSpace(messages[fatal].lines[0])}
+}
+
+// startupLog is the file pg_ctl writes the server output to until the logging collector takes over
+func (p *Postgres) startupLog() string {
+	return filepath.Join(p.DataDir, "log", "startup.log")
+}
+
+// diagnoseStartup looks for a fatal condition in the part of the startup log written after offset
+func (p *Postgres) diagnoseStartup(offset int64) *StartupError {
+	f, err := os.Open(p.startupLog())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	return diagnoseStartupLog(string(content))
+}
+
+// postmasterPIDFile is the content of postmaster.pid, see https://www.postgresql.org/docs/current/storage-file-layout.html
+type postmasterPIDFile struct {
+	PID     int
+	DataDir string
+	Port    int
+	// SocketDir is the first of the unix_socket_directories, empty without one
+	SocketDir string
+	// Status is empty until the postmaster is ready ("ready", "standby", "starting" or "stopping")
+	Status string
+}
+
+func readPostmasterPID(dataDir string) (*postmasterPIDFile, error) {
+	content, err := os.ReadFile(filepath.Join(dataDir, "postmaster.pid"))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid in postmaster.pid: %q", lines[0])
+	}
+	pidFile := &postmasterPIDFile{PID: pid}
+	if len(lines) > 1 {
+		pidFile.DataDir = strings.TrimSpace(lines[1])
+	}
+	if len(lines) > 3 {
+		pidFile.Port, _ = strconv.Atoi(strings.TrimSpace(lines[3]))
+	}
+	if len(lines) > 4 {
+		pidFile.SocketDir = strings.TrimSpace(lines[4])
+	}
+	if len(lines) > 7 {
+		pidFile.Status = strings.TrimSpace(lines[7])
+	}
+	return pidFile, nil
+}
+
+// isPostmaster reports whether pid is a live postgres process running in dataDir. Without /proc a live
+// process is assumed to be the postmaster, as removing the lock file of a running server corrupts it.
+func isPostmaster(pid int, dataDir string) bool {
+	if pid <= 0 || syscall.Kill(pid, 0) == syscall.ESRCH {
+		return false
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return true
+	}
+	if name := strings.TrimSpace(string(comm)); name != "postgres" && name != "postmaster" {
+		return false
+	}
+	// The postmaster changes into its data directory
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil && dataDir != "" {
+		if abs, err := filepath.Abs(dataDir); err == nil {
+			if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+				abs = resolved
+			}
+			return cwd == abs
+		}
+	}
+	return true
+}
+
+// postmasterRunning reports whether the postmaster in postmaster.pid is running, unlike IsRunning a PID reused
+// by another process is not mistaken for it
+func (p *Postgres) postmasterRunning() bool {
+	pidFile, err := readPostmasterPID(p.DataDir)
+	return err == nil && isPostmaster(pidFile.PID, p.DataDir)
+}
+
+// removeStalePID removes a postmaster.pid left behind by a server that is no longer running, e.g. after a
+// container was killed and its PID was reused by another process
+func (p *Postgres) removeStalePID() error {
+	pidFile, err := readPostmasterPID(p.DataDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	path := filepath.Join(p.DataDir, "postmaster.pid")
+	if err != nil {
+		return &StartupError{Reason: "unreadable postmaster.pid", Detail: err.Error(), Hint: "remove " + path + " if no postmaster is running"}
+	}
+	if isPostmaster(pidFile.PID, p.DataDir) {
+		return &StartupError{
+			Reason: "PostgreSQL is already running",
+			Detail: fmt.Sprintf("postmaster pid %d owns %s", pidFile.PID, p.DataDir),
+			Hint:   "stop it first",
+		}
+	}
+	clicky.Warnf("⚠️  Removing stale postmaster.pid, pid %d is not a running postmaster", pidFile.PID)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale %s: %w", path, err)
+	}
+	return nil
+}
+
+// checkDataVersion fails if the data directory was initialized by another major version than the binaries
+func (p *Postgres) checkDataVersion() error {
+	dataVersion, err := readPGVersion(p.DataDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &StartupError{Reason: "data directory is not initialized", Detail: err.Error(), Hint: "run postgres-cli server initdb"}
+		}
+		return &StartupError{Reason: "invalid PG_VERSION", Detail: err.Error()}
+	}
+	binVersion := string(p.GetVersion())
+	if binVersion == "" {
+		return nil
+	}
+	if major := strings.Split(binVersion, ".")[0]; major != strconv.Itoa(dataVersion) {
+		return &StartupError{
+			Reason: "data directory version does not match the server",
+			Detail: fmt.Sprintf("PG_VERSION is %d, %s is PostgreSQL %s", dataVersion, p.BinDir, binVersion),
+			Hint:   fmt.Sprintf("upgrade with postgres-cli server upgrade --target-version=%s or use the PostgreSQL %d binaries", major, dataVersion),
+		}
+	}
+	return nil
+}
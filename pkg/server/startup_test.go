@@ -0,0 +1,230 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDiagnoseStartupLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    string
+		reason string
+	}{
+		{
+			name: "port in use",
+			log: `2025-01-01 00:00:00.000 UTC [42] LOG:  starting PostgreSQL 17.5 on x86_64-pc-linux-gnu
+2025-01-01 00:00:00.001 UTC [42] LOG:  could not bind IPv4 address "0.0.0.0": Address already in use
+2025-01-01 00:00:00.001 UTC [42] HINT:  Is another postmaster already running on port 5432? If not, wait a few seconds and retry.
+2025-01-01 00:00:00.002 UTC [42] FATAL:  could not create any TCP/IP sockets`,
+			reason: "port already in use",
+		},
+		{
+			name: "socket lock file",
+			log: `2025-01-01 00:00:00.001 UTC [42] FATAL:  lock file "/var/run/postgresql/.s.PGSQL.5432.lock" already exists
+2025-01-01 00:00:00.001 UTC [42] HINT:  Is another postmaster (PID 7) using socket file "/var/run/postgresql/.s.PGSQL.5432"?`,
+			reason: "lock file owned by another server",
+		},
+		{
+			name: "shared memory",
+			log: `2025-01-01 00:00:00.001 UTC [42] FATAL:  could not map anonymous shared memory: Cannot allocate memory
+2025-01-01 00:00:00.001 UTC [42] HINT:  This error usually means that PostgreSQL's request for a shared memory segment exceeded available memory.`,
+			reason: "shared memory allocation failed",
+		},
+		{
+			name:   "huge pages",
+			log:    `2025-01-01 00:00:00.001 UTC [42] FATAL:  could not map anonymous shared memory: Cannot allocate memory (huge pages)`,
+			reason: "shared memory allocation failed",
+		},
+		{
+			name: "invalid setting",
+			log: `2025-01-01 00:00:00.001 UTC [42] LOG:  invalid value for parameter "shared_buffers": "lots"
+2025-01-01 00:00:00.001 UTC [42] FATAL:  configuration file "/data/postgresql.conf" contains errors`,
+			reason: "invalid configuration",
+		},
+		{
+			name:   "missing pg_hba.conf",
+			log:    `2025-01-01 00:00:00.001 UTC [42] FATAL:  could not load pg_hba.conf`,
+			reason: "missing or invalid client authentication configuration",
+		},
+		{
+			name: "permissions",
+			log: `2025-01-01 00:00:00.001 UTC [42] FATAL:  data directory "/data" has invalid permissions
+2025-01-01 00:00:00.001 UTC [42] DETAIL:  Permissions should be u=rwx (0700) or u=rwx,g=rx (0750).`,
+			reason: "permission denied",
+		},
+		{
+			name: "version mismatch",
+			log: `2025-01-01 00:00:00.001 UTC [42] FATAL:  database files are incompatible with server
+2025-01-01 00:00:00.001 UTC [42] DETAIL:  The data directory was initialized by PostgreSQL version 16, which is not compatible with this version 17.5.`,
+			reason: "data directory version does not match the server",
+		},
+		{
+			name: "unknown fatal error",
+			log: `2025-01-01 00:00:00.001 UTC [43] FATAL:  the database system is starting up
+2025-01-01 00:00:00.002 UTC [42] FATAL:  could not open recovery signal file`,
+			reason: "PostgreSQL failed to start",
+		},
+		{
+			name: "unrelated warning",
+			log: `2025-01-01 00:00:00.000 UTC [42] WARNING:  could not open directory "pg_tblspc/16384/PG_17_202406281": Permission denied
+2025-01-01 00:00:00.001 UTC [42] FATAL:  could not load pg_hba.conf`,
+			reason: "missing or invalid client authentication configuration",
+		},
+		{
+			name: "other process",
+			log: `2025-01-01 00:00:00.000 UTC [43] LOG:  could not open file "base/5/1259": Permission denied
+2025-01-01 00:00:00.001 UTC [42] LOG:  background worker "logical replication launcher" (PID 43) exited with exit code 1
+2025-01-01 00:00:00.002 UTC [42] FATAL:  could not open recovery signal file`,
+			reason: "PostgreSQL failed to start",
+		},
+		{
+			name: "no error",
+			log:  `2025-01-01 00:00:00.001 UTC [42] LOG:  database system is ready to accept connections`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnosis := diagnoseStartupLog(tt.log)
+			if tt.reason == "" {
+				if diagnosis != nil {
+					t.Fatalf("expected no diagnosis, got %v", diagnosis)
+				}
+				return
+			}
+			if diagnosis == nil {
+				t.Fatalf("expected %q, got no diagnosis", tt.reason)
+			}
+			if diagnosis.Reason != tt.reason {
+				t.Errorf("expected %q, got %q (%v)", tt.reason, diagnosis.Reason, diagnosis)
+			}
+		})
+	}
+}
+
+func TestDiagnoseStartupIgnoresPreviousStarts(t *testing.T) {
+	p := &Postgres{DataDir: t.TempDir()}
+	if err := os.MkdirAll(filepath.Dir(p.startupLog()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	previous := "2025-01-01 00:00:00.001 UTC [42] FATAL:  could not load pg_hba.conf\n"
+	if err := os.WriteFile(p.startupLog(), []byte(previous), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if diagnosis := p.diagnoseStartup(int64(len(previous))); diagnosis != nil {
+		t.Errorf("expected no diagnosis, got %v", diagnosis)
+	}
+	if diagnosis := p.diagnoseStartup(0); diagnosis == nil {
+		t.Error("expected the pg_hba.conf error to be diagnosed")
+	}
+}
+
+func TestReadPostmasterPID(t *testing.T) {
+	dir := t.TempDir()
+	content := "42\n/data\n1700000000\n5433\n/var/run/postgresql\n*\n  5432001  0\nready   \n"
+	if err := os.WriteFile(filepath.Join(dir, "postmaster.pid"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pidFile, err := readPostmasterPID(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := postmasterPIDFile{PID: 42, DataDir: "/data", Port: 5433, SocketDir: "/var/run/postgresql", Status: "ready"}
+	if *pidFile != expected {
+		t.Errorf("expected %+v, got %+v", expected, *pidFile)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "postmaster.pid"), []byte("not a pid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPostmasterPID(dir); err == nil {
+		t.Error("expected an error for an invalid pid")
+	}
+}
+
+func TestRemoveStalePID(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     int
+		removed bool
+	}{
+		// The test binary is alive but is not a postmaster
+		{name: "reused pid", pid: os.Getpid(), removed: true},
+		{name: "dead pid", pid: 1 << 22, removed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat("/proc/self/comm"); err != nil {
+				t.Skip("requires /proc")
+			}
+			p := &Postgres{DataDir: t.TempDir()}
+			path := filepath.Join(p.DataDir, "postmaster.pid")
+			if err := os.WriteFile(path, []byte(strconv.Itoa(tt.pid)+"\n"+p.DataDir+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.removeStalePID(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) != tt.removed {
+				t.Errorf("expected removed=%v, got %v", tt.removed, err)
+			}
+		})
+	}
+
+	t.Run("no pid file", func(t *testing.T) {
+		p := &Postgres{DataDir: t.TempDir()}
+		if err := p.removeStalePID(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCheckDataVersion(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\necho 'postgres (PostgreSQL) 17.5'\n"
+	if err := os.WriteFile(filepath.Join(binDir, "postgres"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		pgVersion string
+		reason    string
+	}{
+		{name: "matching version", pgVersion: "17\n"},
+		{name: "older data directory", pgVersion: "16\n", reason: "data directory version does not match the server"},
+		{name: "not initialized", reason: "data directory is not initialized"},
+		{name: "invalid PG_VERSION", pgVersion: "seventeen\n", reason: "invalid PG_VERSION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Postgres{DataDir: t.TempDir(), BinDir: binDir}
+			if tt.pgVersion != "" {
+				if err := os.WriteFile(filepath.Join(p.DataDir, "PG_VERSION"), []byte(tt.pgVersion), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := p.checkDataVersion()
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var startupErr *StartupError
+			if !errors.As(err, &startupErr) {
+				t.Fatalf("expected a StartupError, got %v", err)
+			}
+			if startupErr.Reason != tt.reason {
+				t.Errorf("expected %q, got %q", tt.reason, startupErr.Reason)
+			}
+		})
+	}
+}
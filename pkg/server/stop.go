@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/clicky/api/icons"
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/commons/properties"
+)
+
+// shutdownModes are the shutdown modes in escalation order
+var shutdownModes = []ShutdownMode{ShutdownSmart, ShutdownFast, ShutdownImmediate}
+
+// clientSessions selects the client sessions in pg_stat_activity other than the one running the query
+const clientSessions = `FROM pg_stat_activity WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()`
+
+// StopOptions controls how Stop shuts the server down. The shutdown starts with Mode and is escalated to the
+// next mode (smart → fast → immediate) whenever the server is still running after StageTimeout.
+type StopOptions struct {
+	Mode ShutdownMode
+	// StageTimeout is how long each shutdown mode is given before escalating, 0 waits forever
+	StageTimeout time.Duration
+	// Checkpoint runs a CHECKPOINT before the shutdown, so that the shutdown checkpoint has little left to write
+	Checkpoint bool
+	// DrainPeriod is how long active queries are given to finish once a smart shutdown refuses new connections,
+	// it comes before the StageTimeout of the smart shutdown
+	DrainPeriod time.Duration
+	// TerminateIdle ends the idle sessions with pg_terminate_backend after the drain period, so that clients
+	// holding a connection open (e.g. pools) do not block a smart shutdown
+	TerminateIdle bool
+}
+
+// DefaultStopOptions drains the server with a smart shutdown, the timeouts can be changed with the stop.timeout
+// and stop.drain properties
+func DefaultStopOptions() StopOptions {
+	return StopOptions{
+		Mode:          ShutdownSmart,
+		StageTimeout:  properties.Duration(30*time.Second, "stop.timeout"),
+		Checkpoint:    true,
+		DrainPeriod:   properties.Duration(10*time.Second, "stop.drain"),
+		TerminateIdle: true,
+	}
+}
+
+func (o StopOptions) validate() error {
+	if !slices.Contains(shutdownModes, o.Mode) {
+		return fmt.Errorf("invalid shutdown mode %q, expected smart, fast or immediate", o.Mode)
+	}
+	return nil
+}
+
+// stages returns the shutdown modes tried in order
+func (o StopOptions) stages() []ShutdownMode {
+	return shutdownModes[slices.Index(shutdownModes, o.Mode):]
+}
+
+// Stop shuts the server down with DefaultStopOptions
+func (p *Postgres) Stop() error {
+	return p.StopWithOptions(DefaultStopOptions())
+}
+
+// StopWithOptions runs a CHECKPOINT, then requests a shutdown with opts.Mode. A smart shutdown refuses new
+// connections while active queries get opts.DrainPeriod to finish, after which idle sessions are terminated.
+// The shutdown is escalated up to immediate when a mode does not stop the server within opts.StageTimeout.
+func (p *Postgres) StopWithOptions(opts StopOptions) error {
+	if !p.IsRunning() {
+		logger.Warnf("Postgres is not running")
+		return nil
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] stopping Postgres %s with a %s shutdown", p.DataDir, opts.Mode)
+		return nil
+	}
+
+	clicky.Infof(clicky.Text("").Add(icons.Stop).Appendf("Stopping Postgres.. %s", p.DataDir).Styles("text-orange-500").ANSI())
+
+	// A session opened before the shutdown keeps working after new connections are refused
+	session, err := p.openStopSession()
+	if err != nil {
+		logger.Warnf("Unable to connect to PostgreSQL, skipping the checkpoint and connection draining: %v", err)
+	}
+	defer func() { session.close() }()
+
+	if opts.Checkpoint && session != nil {
+		clicky.Infof("Running CHECKPOINT")
+		start := time.Now()
+		if err := session.exec(opts.StageTimeout, "CHECKPOINT"); err != nil {
+			logger.Warnf("CHECKPOINT failed: %v", err)
+		} else {
+			clicky.Infof("CHECKPOINT completed in %s", time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	start := time.Now()
+	for i, mode := range opts.stages() {
+		if i == 0 {
+			clicky.Infof("Requesting %s shutdown", mode)
+		} else {
+			clicky.Warnf("⚠️  PostgreSQL is still running after %s, escalating to %s shutdown", opts.StageTimeout, mode)
+		}
+		res := p.Pg_ctl("stop", "-m", string(mode), "--no-wait").Run().Result()
+		if res.Error != nil && p.IsRunning() {
+			return fmt.Errorf("failed to stop PostgreSQL: %s", res.Pretty().ANSI())
+		}
+
+		if mode == ShutdownSmart && session != nil {
+			session.drain(opts)
+		}
+		// Our own session would hold up a smart shutdown
+		session.close()
+		session = nil
+
+		if p.waitForStop(opts.StageTimeout) {
+			clicky.Infof("PostgreSQL stopped with a %s shutdown in %s", mode, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+	}
+	return fmt.Errorf("PostgreSQL did not stop within %s of an immediate shutdown", opts.StageTimeout)
+}
+
+// waitForStop polls until the server is no longer running, returning false after timeout (0 = wait forever)
+func (p *Postgres) waitForStop(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for p.IsRunning() {
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return true
+}
+
+// stopSession is a connection pinned for the duration of the shutdown
+type stopSession struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func (p *Postgres) openStopSession() (*stopSession, error) {
+	db, err := p.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err == nil {
+		err = conn.PingContext(ctx)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stopSession{db: db, conn: conn}, nil
+}
+
+func (s *stopSession) close() {
+	if s == nil {
+		return
+	}
+	s.conn.Close()
+	s.db.Close()
+}
+
+// exec runs query, giving up after timeout (0 = no timeout)
+func (s *stopSession) exec(timeout time.Duration, query string) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	_, err := s.conn.ExecContext(ctx, query)
+	return err
+}
+
+func (s *stopSession) count(query string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var n int
+	err := s.conn.QueryRowContext(ctx, query).Scan(&n)
+	return n, err
+}
+
+// drain waits for the active queries to finish, then terminates the idle sessions
+func (s *stopSession) drain(opts StopOptions) {
+	if opts.DrainPeriod > 0 {
+		clicky.Infof("Refusing new connections, waiting up to %s for active queries to finish", opts.DrainPeriod)
+		deadline := time.Now().Add(opts.DrainPeriod)
+		for {
+			active, err := s.count("SELECT count(*) " + clientSessions + " AND state <> 'idle'")
+			if err != nil {
+				logger.Warnf("Unable to count active queries: %v", err)
+				break
+			}
+			if active == 0 {
+				clicky.Infof("No active queries left")
+				break
+			}
+			if time.Now().After(deadline) {
+				clicky.Warnf("⚠️  %d sessions still active after %s", active, opts.DrainPeriod)
+				break
+			}
+			time.Sleep(min(time.Second, time.Until(deadline)+time.Millisecond))
+		}
+	}
+
+	if opts.TerminateIdle {
+		terminated, err := s.count("SELECT count(pg_terminate_backend(pid)) " + clientSessions + " AND state = 'idle'")
+		if err != nil {
+			logger.Warnf("Unable to terminate idle sessions: %v", err)
+		} else if terminated > 0 {
+			clicky.Infof("Terminated %d idle sessions", terminated)
+		}
+	}
+}
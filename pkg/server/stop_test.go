@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStopOptionsStages(t *testing.T) {
+	tests := []struct {
+		mode    ShutdownMode
+		want    []ShutdownMode
+		wantErr bool
+	}{
+		{mode: ShutdownSmart, want: []ShutdownMode{ShutdownSmart, ShutdownFast, ShutdownImmediate}},
+		{mode: ShutdownFast, want: []ShutdownMode{ShutdownFast, ShutdownImmediate}},
+		{mode: ShutdownImmediate, want: []ShutdownMode{ShutdownImmediate}},
+		{mode: "graceful", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			opts := DefaultStopOptions()
+			opts.Mode = tt.mode
+			if err := opts.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := opts.stages(); !slices.Equal(got, tt.want) {
+				t.Errorf("stages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForStop(t *testing.T) {
+	p := &Postgres{DataDir: t.TempDir()}
+	pidFile := filepath.Join(p.DataDir, "postmaster.pid")
+	// The test process stands in for a running postmaster
+	if err := os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), p.DataDir)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.waitForStop(300 * time.Millisecond) {
+		t.Fatal("expected a running server to time out")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.Remove(pidFile)
+	}()
+	if !p.waitForStop(5 * time.Second) {
+		t.Fatal("expected the server to stop once postmaster.pid is removed")
+	}
+}
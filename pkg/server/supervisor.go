@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/properties"
+	"github.com/flanksource/postgres/pkg/supervisor"
+)
+
+// ShutdownMode is the PostgreSQL shutdown mode, see https://www.postgresql.org/docs/current/server-shutdown.html
+type ShutdownMode string
+
+const (
+	// ShutdownSmart waits for all clients to disconnect
+	ShutdownSmart ShutdownMode = "smart"
+	// ShutdownFast rolls back open transactions and disconnects clients
+	ShutdownFast ShutdownMode = "fast"
+	// ShutdownImmediate exits without a shutdown checkpoint, the next start runs crash recovery
+	ShutdownImmediate ShutdownMode = "immediate"
+)
+
+// Signal returns the signal the postmaster interprets as this shutdown mode
+func (m ShutdownMode) Signal() syscall.Signal {
+	switch m {
+	case ShutdownSmart:
+		return syscall.SIGTERM
+	case ShutdownImmediate:
+		return syscall.SIGQUIT
+	default:
+		return syscall.SIGINT
+	}
+}
+
+// ShutdownPolicy controls how a termination signal sent to the supervisor stops the server.
+// SIGTERM, which container runtimes send on stop, is translated to Mode, SIGINT and SIGQUIT keep
+// their PostgreSQL meaning (fast and immediate). A shutdown that takes longer than Timeout is
+// escalated to immediate, and the server is killed if it is still running after another Timeout.
+type ShutdownPolicy struct {
+	Mode    ShutdownMode
+	Timeout time.Duration
+}
+
+// modeFor returns the shutdown mode a signal received by the supervisor is forwarded as
+func (s ShutdownPolicy) modeFor(sig os.Signal) ShutdownMode {
+	switch sig {
+	case syscall.SIGINT:
+		return ShutdownFast
+	case syscall.SIGQUIT:
+		return ShutdownImmediate
+	default:
+		return s.Mode
+	}
+}
+
+type RunOptions struct {
+	// Args are passed to postgres after -D <data dir>, e.g. -c shared_buffers=1GB
+	Args     []string
+	Shutdown ShutdownPolicy
+	Restart  supervisor.RestartPolicy
+	// MaxRestarts gives up after this many consecutive crashes, 0 = unlimited
+	MaxRestarts int
+	// Backoff is the delay before the first restart, doubled after each consecutive crash up to MaxBackoff.
+	// A server that stayed up for longer than MaxBackoff is no longer counted as crashing.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// LoggingCollector keeps the logging_collector setting of postgresql.conf, by default it is turned
+	// off so that the server log is streamed to Output
+	LoggingCollector bool
+	// Output receives the stdout and stderr of the server, defaults to os.Stdout
+	Output io.Writer
+	// ReapOrphans also reaps the zombie children no one waits for, which is needed when running as PID 1 so
+	// that orphaned processes do not linger. The commands run by the HealthServer are left to their Wait.
+	ReapOrphans bool
+	// Services are started once PostgreSQL is ready (e.g. PgBouncer and PostgREST, see Services), the
+	// restart settings and shutdown timeout above apply to those that do not set their own
+	Services []*supervisor.Service
+	// LogDir receives a <service>.log file with the output of every service in addition to Output
+	LogDir string
+	// HealthServer is started with the processes and stopped after them, it serves the health checks and
+	// takes the scheduled backups of the server
+	HealthServer *HealthServer
+	// ArchiveCheckTimeout is how long WAL-G is given to archive a WAL segment once the server is first ready,
+	// when archiving is configured (0 = do not check)
+	ArchiveCheckTimeout time.Duration
+}
+
+func DefaultRunOptions() RunOptions {
+	return RunOptions{
+		Shutdown: ShutdownPolicy{
+			Mode:    ShutdownFast,
+			Timeout: properties.Duration(30*time.Second, "stop.timeout"),
+		},
+		Restart:             supervisor.RestartOnFailure,
+		Backoff:             time.Second,
+		MaxBackoff:          30 * time.Second,
+		ReapOrphans:         os.Getpid() == 1,
+		ArchiveCheckTimeout: time.Minute,
+	}
+}
+
+func (o RunOptions) validate() error {
+	switch o.Shutdown.Mode {
+	case ShutdownSmart, ShutdownFast, ShutdownImmediate:
+	default:
+		return fmt.Errorf("invalid shutdown mode %q, expected smart, fast or immediate", o.Shutdown.Mode)
+	}
+	switch o.Restart {
+	case supervisor.RestartAlways, supervisor.RestartOnFailure, supervisor.RestartNever:
+	default:
+		return fmt.Errorf("invalid restart policy %q, expected always, on-failure or never", o.Restart)
+	}
+	if o.Restart != supervisor.RestartNever && o.Backoff <= 0 {
+		return fmt.Errorf("restart backoff must be positive")
+	}
+	return nil
+}
+
+// Run starts the postmaster as a child process and supervises it until it is stopped by a signal
+func (p *Postgres) Run() error {
+	return p.RunWithOptions(DefaultRunOptions())
+}
+
+// RunWithOptions runs PostgreSQL in the foreground: termination signals are forwarded according to
+// the shutdown policy, SIGHUP reloads the configuration, crashes are restarted with backoff and the
+// server log is streamed to the output. Unlike Start, the calling process stays the parent of the
+// postmaster, so it can be the PID 1 of a container. The additional opts.Services are started once
+// the server accepts connections and stopped before it.
+func (p *Postgres) RunWithOptions(opts RunOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := p.ensureBinDir(); err != nil {
+		return fmt.Errorf("failed to resolve binary directory: %w", err)
+	}
+	if p.postmasterRunning() {
+		return fmt.Errorf("PostgreSQL is already running in %s", p.DataDir)
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] running %s", strings.Join(p.postmasterArgs(opts), " "))
+		return nil
+	}
+	if err := p.checkDataVersion(); err != nil {
+		return err
+	}
+	if err := p.removeStalePID(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	return p.supervise(opts, signals)
+}
+
+func (p *Postgres) postmasterArgs(opts RunOptions) []string {
+	args := []string{filepath.Join(p.BinDir, "postgres"), "-D", p.DataDir}
+	if !opts.LoggingCollector {
+		args = append(args, "-c", "logging_collector=off")
+	}
+	return append(args, opts.Args...)
+}
+
+// Service returns the postmaster as a service of a supervisor.Manager
+func (p *Postgres) Service(opts RunOptions) *supervisor.Service {
+	args := p.postmasterArgs(opts)
+	service := &supervisor.Service{
+		Name:        "postgresql",
+		Path:        args[0],
+		Args:        args[1:],
+		Env:         []string{"PGDATA=" + p.DataDir},
+		Ready:       p.postmasterReady,
+		Restart:     opts.Restart,
+		MaxRestarts: opts.MaxRestarts,
+		Backoff:     opts.Backoff,
+		MaxBackoff:  opts.MaxBackoff,
+		StopSignal: func(sig os.Signal) syscall.Signal {
+			mode := opts.Shutdown.modeFor(sig)
+			clicky.Infof("Stopping PostgreSQL with a %s shutdown", mode)
+			return mode.Signal()
+		},
+		// A shutdown that times out is escalated to immediate, then the server is killed
+		StopTimeout:       opts.Shutdown.Timeout,
+		EscalationSignals: []syscall.Signal{ShutdownImmediate.Signal()},
+		ReloadSignal:      syscall.SIGHUP,
+	}
+	if opts.ArchiveCheckTimeout > 0 {
+		service.OnReady = func() { p.reportArchiving(opts.ArchiveCheckTimeout) }
+	}
+	return service
+}
+
+// Manager returns the supervisor.Manager RunWithOptions runs, its Status reports the state of PostgreSQL
+// and opts.Services
+func (p *Postgres) Manager(opts RunOptions) (*supervisor.Manager, error) {
+	services := []*supervisor.Service{p.Service(opts)}
+	for _, s := range opts.Services {
+		if s.Restart == "" {
+			s.Restart, s.MaxRestarts = opts.Restart, opts.MaxRestarts
+			s.Backoff, s.MaxBackoff = opts.Backoff, opts.MaxBackoff
+		}
+		if s.StopTimeout == 0 {
+			s.StopTimeout = opts.Shutdown.Timeout
+		}
+		services = append(services, s)
+	}
+	if opts.LogDir != "" {
+		for _, s := range services {
+			if s.LogFile == "" {
+				s.LogFile = filepath.Join(opts.LogDir, s.Name+".log")
+			}
+		}
+	}
+
+	manager, err := supervisor.NewManager(services...)
+	if err != nil {
+		return nil, err
+	}
+	manager.Output = opts.Output
+	manager.ReapOrphans = opts.ReapOrphans
+	return manager, nil
+}
+
+// supervise runs PostgreSQL and opts.Services until stopped by one of signals or the restart policy gives up
+func (p *Postgres) supervise(opts RunOptions, signals <-chan os.Signal) error {
+	manager, err := p.Manager(opts)
+	if err != nil {
+		return err
+	}
+	// Planner statistics left pending by an upgrade are regenerated by the supervisor once the server accepts
+	// connections, rather than by a process the postmaster would inherit
+	go func() {
+		if err := p.RunPostUpgradeAnalyze(time.Hour); err != nil {
+			clicky.Warnf("⚠️  Failed to regenerate planner statistics: %v", err)
+		}
+	}()
+	if opts.HealthServer != nil {
+		if opts.HealthServer.Processes == nil {
+			opts.HealthServer.Processes = manager
+		}
+		stop, err := p.startHealthServer(opts.HealthServer, opts.Shutdown.Timeout)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	return manager.Run(signals)
+}
+
+// startHealthServer serves the health checks of p in the background, the returned function stops the server and
+// waits up to timeout (0 = forever) for a running backup
+func (p *Postgres) startHealthServer(s *HealthServer, timeout time.Duration) (func(), error) {
+	if s.Postgres == nil {
+		s.Postgres = p
+	}
+	if err := s.listen(); err != nil {
+		return nil, fmt.Errorf("failed to start the health server: %w", err)
+	}
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			clicky.Warnf("⚠️  Health server stopped: %v", err)
+		}
+	}()
+	return func() {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := s.Stop(ctx); err != nil {
+			clicky.Warnf("⚠️  Failed to stop the health server: %v", err)
+		}
+	}, nil
+}
+
+// postmasterReady checks the status in postmaster.pid, which is set once the postmaster with pid accepts
+// connections
+func (p *Postgres) postmasterReady(pid int) error {
+	pidFile, err := readPostmasterPID(p.DataDir)
+	if err != nil {
+		return fmt.Errorf("postmaster.pid not found: %w", err)
+	}
+	if pidFile.PID != pid {
+		return fmt.Errorf("postmaster.pid belongs to pid %d", pidFile.PID)
+	}
+	switch pidFile.Status {
+	case "ready", "standby":
+		return nil
+	case "":
+		return fmt.Errorf("postmaster is starting")
+	default:
+		return fmt.Errorf("postmaster is %s", pidFile.Status)
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flanksource/postgres/pkg/supervisor"
+)
+
+// fakePostmaster counts its starts in $PGDATA/starts and exits with the code on the matching line of
+// $PGDATA/exit-codes, otherwise it reports the signals it receives until one of them stops it.
+// With $PGDATA/stubborn present it ignores smart and fast shutdown requests.
+const fakePostmaster = `#!/bin/sh
+n=$(( $(cat "$PGDATA/starts" 2>/dev/null || echo 0) + 1 ))
+echo $n > "$PGDATA/starts"
+code=$(sed -n "${n}p" "$PGDATA/exit-codes" 2>/dev/null)
+if [ -n "$code" ]; then
+  echo "crashing with $code"
+  exit $code
+fi
+if [ -f "$PGDATA/stubborn" ]; then
+  trap 'echo "ignoring TERM"' TERM
+  trap 'echo "ignoring INT"' INT
+else
+  trap 'echo "received TERM"; exit 0' TERM
+  trap 'echo "received INT"; exit 0' INT
+fi
+trap 'echo "received QUIT"; exit 0' QUIT
+trap 'echo "received HUP"' HUP
+echo "ready $*"
+while true; do sleep 0.05; done
+`
+
+type supervisedServer struct {
+	p       *Postgres
+	output  string
+	signals chan os.Signal
+	done    chan error
+}
+
+func startSupervised(t *testing.T, opts RunOptions, files map[string]string) *supervisedServer {
+	t.Helper()
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	dataDir := filepath.Join(dir, "data")
+	for _, d := range []string{binDir, dataDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "postgres"), []byte(fakePostmaster), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dataDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output, err := os.Create(filepath.Join(dir, "output.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { output.Close() })
+	opts.Output = output
+
+	s := &supervisedServer{
+		p:       &Postgres{DataDir: dataDir, BinDir: binDir},
+		output:  output.Name(),
+		signals: make(chan os.Signal, 1),
+		done:    make(chan error, 1),
+	}
+	go func() { s.done <- s.p.supervise(opts, s.signals) }()
+	return s
+}
+
+func (s *supervisedServer) waitForOutput(t *testing.T, text string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if content, _ := os.ReadFile(s.output); strings.Contains(string(content), text) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	content, _ := os.ReadFile(s.output)
+	t.Fatalf("timed out waiting for %q in output:\n%s", text, content)
+}
+
+func (s *supervisedServer) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-s.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the supervisor to exit")
+		return nil
+	}
+}
+
+func (s *supervisedServer) starts(t *testing.T) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(s.p.DataDir, "starts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func testRunOptions() RunOptions {
+	return RunOptions{
+		Shutdown:   ShutdownPolicy{Mode: ShutdownFast, Timeout: 5 * time.Second},
+		Restart:    supervisor.RestartOnFailure,
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+}
+
+func TestSuperviseForwardsSignals(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   ShutdownMode
+		signal syscall.Signal
+		want   string
+	}{
+		{name: "SIGTERM with fast policy", mode: ShutdownFast, signal: syscall.SIGTERM, want: "received INT"},
+		{name: "SIGTERM with smart policy", mode: ShutdownSmart, signal: syscall.SIGTERM, want: "received TERM"},
+		{name: "SIGINT", mode: ShutdownSmart, signal: syscall.SIGINT, want: "received INT"},
+		{name: "SIGQUIT", mode: ShutdownFast, signal: syscall.SIGQUIT, want: "received QUIT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testRunOptions()
+			opts.Shutdown.Mode = tt.mode
+			s := startSupervised(t, opts, nil)
+			s.waitForOutput(t, "ready -D "+s.p.DataDir+" -c logging_collector=off")
+
+			s.signals <- syscall.SIGHUP
+			s.waitForOutput(t, "received HUP")
+			s.signals <- tt.signal
+			if err := s.wait(t); err != nil {
+				t.Fatalf("expected a clean shutdown, got %v", err)
+			}
+			s.waitForOutput(t, tt.want)
+			if starts := s.starts(t); starts != "1" {
+				t.Errorf("expected a single start, got %s", starts)
+			}
+		})
+	}
+}
+
+func TestSuperviseRestartsAfterCrash(t *testing.T) {
+	opts := testRunOptions()
+	// Waits on any child like PID 1 does, the test starts no other processes meanwhile
+	opts.ReapOrphans = true
+	s := startSupervised(t, opts, map[string]string{"exit-codes": "1\n3\n"})
+	s.waitForOutput(t, "ready")
+	s.signals <- syscall.SIGTERM
+	if err := s.wait(t); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if starts := s.starts(t); starts != "3" {
+		t.Errorf("expected 3 starts, got %s", starts)
+	}
+}
+
+func TestSuperviseGivesUpAfterMaxRestarts(t *testing.T) {
+	opts := testRunOptions()
+	opts.MaxRestarts = 2
+	s := startSupervised(t, opts, map[string]string{"exit-codes": "1\n1\n1\n1\n"})
+	err := s.wait(t)
+	if err == nil || !strings.Contains(err.Error(), "giving up after 2 restarts") {
+		t.Fatalf("expected the supervisor to give up, got %v", err)
+	}
+	if starts := s.starts(t); starts != "3" {
+		t.Errorf("expected 3 starts, got %s", starts)
+	}
+}
+
+func TestSuperviseDoesNotRestartCleanExit(t *testing.T) {
+	s := startSupervised(t, testRunOptions(), map[string]string{"exit-codes": "0\n"})
+	if err := s.wait(t); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if starts := s.starts(t); starts != "1" {
+		t.Errorf("expected a single start, got %s", starts)
+	}
+}
+
+func TestSuperviseEscalatesShutdown(t *testing.T) {
+	opts := testRunOptions()
+	opts.Shutdown.Timeout = 200 * time.Millisecond
+	s := startSupervised(t, opts, map[string]string{"stubborn": ""})
+	s.waitForOutput(t, "ready")
+
+	s.signals <- syscall.SIGTERM
+	if err := s.wait(t); err != nil {
+		t.Fatalf("expected the escalated shutdown to succeed, got %v", err)
+	}
+	s.waitForOutput(t, "ignoring INT")
+	s.waitForOutput(t, "received QUIT")
+}
+
+func TestSuperviseRunsHealthServer(t *testing.T) {
+	// Reserve a port, the test only talks to the health server over HTTP while it runs
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	health := NewHealthServer(port, t.TempDir())
+	opts := DefaultBackupScheduleOptions()
+	opts.Schedule = "@daily"
+	if health.BackupScheduler, err = NewBackupScheduler(&Postgres{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	runOpts := testRunOptions()
+	runOpts.HealthServer = health
+	s := startSupervised(t, runOpts, nil)
+	s.waitForOutput(t, "ready")
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/live", port)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("expected the health server to be running: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected /live to return 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/health/supervisord", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"name":"postgresql"`) {
+		t.Errorf("expected the supervised postgresql process, got %s", body)
+	}
+
+	s.signals <- syscall.SIGTERM
+	if err := s.wait(t); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if health.Postgres != s.p {
+		t.Error("expected the health server to check the supervised server")
+	}
+	if health.BackupScheduler.cron == nil {
+		t.Error("expected the backup scheduler to be started")
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("expected the health server to be stopped with the processes")
+	}
+}
+
+func TestPostmasterReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		pidFile string
+		wantErr string
+	}{
+		{name: "missing", wantErr: "postmaster.pid not found"},
+		{name: "other postmaster", pidFile: "99\n/data\n", wantErr: "belongs to pid 99"},
+		{name: "starting", pidFile: "42\n/data\n1700000000\n5432\n/tmp\n*\n  1234 5\n", wantErr: "postmaster is starting"},
+		{name: "recovering", pidFile: "42\n/data\n1700000000\n5432\n/tmp\n*\n  1234 5\nstarting\n", wantErr: "postmaster is starting"},
+		{name: "ready", pidFile: "42\n/data\n1700000000\n5432\n/tmp\n*\n  1234 5\nready   \n"},
+		{name: "standby", pidFile: "42\n/data\n1700000000\n5432\n/tmp\n*\n  1234 5\nstandby \n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Postgres{DataDir: t.TempDir()}
+			if tt.pidFile != "" {
+				if err := os.WriteFile(filepath.Join(p.DataDir, "postmaster.pid"), []byte(tt.pidFile), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := p.postmasterReady(42)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected ready, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package server
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/flanksource/clicky"
@@ -14,6 +16,8 @@ import (
 type TempServerOptions struct {
 	UnixSocketOnly bool
 	Port           int
+	// Settings are passed to the server as -c name=value and are not persisted
+	Settings map[string]string
 }
 
 // StartTempServer starts a temporary PostgreSQL server for initialization tasks
@@ -41,6 +45,9 @@ func (p *Postgres) StartTempServer(opts TempServerOptions) (*exec.Process, error
 	} else if opts.Port > 0 {
 		pgOptions = append(pgOptions, "-c", fmt.Sprintf("port=%d", opts.Port))
 	}
+	for _, name := range slices.Sorted(maps.Keys(opts.Settings)) {
+		pgOptions = append(pgOptions, "-c", fmt.Sprintf("%s=%s", name, opts.Settings[name]))
+	}
 
 	if len(pgOptions) > 0 {
 		args = append(args, "-o")
@@ -4,14 +4,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flanksource/clicky"
 	"github.com/flanksource/clicky/api/icons"
+	"github.com/flanksource/commons/logger"
 )
 
 func (p *Postgres) Upgrade(targetVersion int) error {
+	return p.UpgradeWithOptions(targetVersion, UpgradeOptions{})
+}
+
+func (p *Postgres) UpgradeWithOptions(targetVersion int, opts UpgradeOptions) error {
+	if err := opts.applyDefaults(); err != nil {
+		return err
+	}
+
+	// Resume or roll back a previous upgrade that was interrupted
+	if err := p.RecoverUpgrade(); err != nil {
+		return fmt.Errorf("failed to recover interrupted upgrade: %w", err)
+	}
 
 	// Detect current version
 	currentVersion, err := p.DetectVersion()
@@ -19,23 +32,49 @@ func (p *Postgres) Upgrade(targetVersion int) error {
 		return fmt.Errorf("failed to detect current PostgreSQL version: %w", err)
 	}
 
+	installed := InstalledVersions()
+	if targetVersion == 0 {
+		if len(installed) == 0 {
+			return fmt.Errorf("no PostgreSQL installations found to upgrade to")
+		}
+		targetVersion = installed[len(installed)-1]
+	}
+
 	// Validate versions
 	if currentVersion >= targetVersion {
 		fmt.Printf("✅ PostgreSQL %d is already at or above target version %d\n", currentVersion, targetVersion)
 		return nil
 	}
 
-	fmt.Printf("🚀 Starting PostgreSQL upgrade process from 🔍  %d to 🎯 %d...\n", currentVersion, targetVersion)
-
-	if currentVersion < 14 || targetVersion > 17 {
-		return fmt.Errorf("invalid version range. Current: %d, Target: %d. Supported versions: 14-17", currentVersion, targetVersion)
+	path, err := planUpgradePath(currentVersion, targetVersion, installed, opts.Stepwise)
+	if err != nil {
+		return fmt.Errorf("cannot upgrade from %d to %d: %w", currentVersion, targetVersion, err)
 	}
 
+	fmt.Printf("🚀 Starting PostgreSQL upgrade process from 🔍  %d to 🎯 %d via %v...\n", currentVersion, targetVersion, path)
+
 	// Check if data exists
 	if !p.Exists() {
 		return fmt.Errorf("PostgreSQL data directory does not exist at %s", p.DataDir)
 	}
 
+	if err := p.checkSnapshotTablespaces(opts); err != nil {
+		return err
+	}
+	if err := p.checkUpgradeDiskSpace(opts); err != nil {
+		return err
+	}
+
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] upgrading PostgreSQL %d to %d via %v in %s (strategy=%s, mode=%s, jobs=%d, backup=%s)",
+			currentVersion, targetVersion, path, p.DataDir, opts.Strategy, opts.Mode, opts.Jobs, opts.Backup)
+		return nil
+	}
+
+	if opts.Strategy == UpgradeStrategyLogical {
+		return p.upgradeLogical(currentVersion, targetVersion, opts)
+	}
+
 	// Ensure PostgreSQL is stopped before upgrade
 	if p.IsRunning() {
 		fmt.Println("🛑 Stopping PostgreSQL for upgrade...")
@@ -44,6 +83,12 @@ func (p *Postgres) Upgrade(targetVersion int) error {
 		}
 	}
 
+	journal := NewUpgradeJournal(p.DataDir, currentVersion, path[0], targetVersion)
+	journal.Mode = opts.Mode
+	if err := journal.Record(UpgradeStepBackup); err != nil {
+		return err
+	}
+
 	// Setup backup directory structure
 	backupDir := filepath.Join(p.DataDir, "backups")
 	if err := os.MkdirAll(backupDir, 0750); err != nil {
@@ -54,32 +99,76 @@ func (p *Postgres) Upgrade(targetVersion int) error {
 	originalBackupPath := filepath.Join(backupDir, fmt.Sprintf("data-%d", currentVersion))
 	fmt.Printf("📦 Backing up current data to %s...\n", originalBackupPath)
 
-	if err := p.backupDataDirectory(originalBackupPath); err != nil {
-		return fmt.Errorf("failed to backup data directory: %w", err)
+	if err := p.backupDataDirectory(originalBackupPath, opts.Backup); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to backup data directory: %w", err))
 	}
 
-	// Perform sequential upgrades
-	for version := currentVersion; version < targetVersion; version++ {
-		nextVersion := version + 1
+	// Perform the planned upgrades, a single hop unless stepwise
+	version := currentVersion
+	for _, nextVersion := range path {
 		fmt.Println(clicky.Text("").Add(icons.ArrowUp).Append(" Upgrading Postgres from", "font-bold text-red-500").Append(version).Append("to").Append(nextVersion).String())
 
-		if err := p.upgradeSingle(version, nextVersion); err != nil {
+		journal.FromVersion = version
+		journal.ToVersion = nextVersion
+		// The pre-upgrade snapshot still uses the external WAL and tablespace directories of the original cluster,
+		// which pg_upgrade leaves untouched as link mode is refused with tablespaces (see checkSnapshotTablespaces)
+		keepOldFiles := version == currentVersion && opts.Backup != BackupStrategyNone
+		if err := p.upgradeSingle(journal, opts, keepOldFiles); err != nil {
 			return fmt.Errorf("upgrade from %d to %d failed: %w", version, nextVersion, err)
 		}
+		version = nextVersion
 	}
 
+	return p.completeUpgrade(currentVersion, targetVersion, originalBackupPath, opts)
+}
+
+// completeUpgrade records the finished upgrade and runs the optional post-upgrade tasks
+func (p *Postgres) completeUpgrade(currentVersion, targetVersion int, originalBackupPath string, opts UpgradeOptions) error {
 	// Update binary directory for new version
 	p.BinDir = p.resolveBinDir(targetVersion)
 
+	status := &UpgradeStatus{
+		FromVersion:     currentVersion,
+		ToVersion:       targetVersion,
+		UpgradedAt:      time.Now(),
+		ExtensionScript: UpgradeTask{State: UpgradeTaskSkipped},
+		Collations:      UpgradeTask{State: UpgradeTaskSkipped},
+		Analyze:         UpgradeTask{State: UpgradeTaskSkipped},
+		dataDir:         p.DataDir,
+	}
+	if opts.PostUpgrade {
+		fmt.Println("🧩 Running post-upgrade tasks...")
+		if err := p.finalizeUpgrade(status); err != nil {
+			logger.Warnf("post-upgrade tasks did not complete: %v", err)
+		}
+	}
+	if err := status.save(); err != nil {
+		logger.Warnf("failed to record upgrade status: %v", err)
+	}
+	// Record where the upgraded cluster starts once the post-upgrade tasks have stopped it, so that a later
+	// rollback can tell whether data was written since
+	if opts.Backup != BackupStrategyNone {
+		if err := p.writeSnapshotMetadata(originalBackupPath, currentVersion, targetVersion); err != nil {
+			logger.Warnf("failed to record snapshot metadata, rollback will require --force: %v", err)
+		}
+	}
+	if opts.Retention != (RetentionPolicy{}) {
+		if _, err := p.PruneUpgradeArtifacts(opts.Retention); err != nil {
+			logger.Warnf("failed to prune upgrade snapshots: %v", err)
+		}
+	}
+
 	fmt.Printf("\n🎉 All upgrades completed successfully!\n")
 	fmt.Printf("✅ Final version: PostgreSQL %d\n", targetVersion)
-	fmt.Printf("💾 Original data preserved in %s\n", originalBackupPath)
+	if opts.Backup != BackupStrategyNone {
+		fmt.Printf("💾 Original data preserved in %s\n", originalBackupPath)
+	}
 
 	return nil
 }
 
-// runPgUpgrade executes the pg_upgrade command
-func (p *Postgres) runPgUpgrade(oldBinDir, newBinDir, oldDataDir, newDataDir string) error {
+// runPgUpgrade executes the pg_upgrade command, when check is true only the compatibility check is run
+func (p *Postgres) runPgUpgrade(oldBinDir, newBinDir, oldDataDir, newDataDir string, opts UpgradeOptions, check bool) error {
 	// Create socket directory
 	socketDir := "/var/run/postgresql"
 	if err := os.MkdirAll(socketDir, 0755); err != nil {
@@ -97,36 +186,30 @@ func (p *Postgres) runPgUpgrade(oldBinDir, newBinDir, oldDataDir, newDataDir str
 	}
 	defer os.Chdir(originalDir)
 
-	// Run compatibility check first
 	// Use --socketdir to explicitly control where pg_upgrade creates Unix sockets
 	// This is critical when running as postgres user to avoid permission issues
-	checkArgs := []string{
+	args := []string{
 		"--old-bindir=" + oldBinDir,
 		"--new-bindir=" + newBinDir,
 		"--old-datadir=" + oldDataDir,
 		"--new-datadir=" + newDataDir,
 		"--socketdir=" + socketDir,
-		"--check",
 	}
-
-	fmt.Println("Checking cluster compatibility...")
-	fmt.Println("pg_upgrade check args:", strings.Join(checkArgs, "\n"))
-	checkProcess := clicky.Exec(filepath.Join(newBinDir, "pg_upgrade"), checkArgs...).Run()
-	if checkProcess.Err != nil {
-		return fmt.Errorf("pg_upgrade compatibility check failed: %w, output: %s", checkProcess.Err, checkProcess.Out())
-	}
-
-	// Run the actual upgrade
-	upgradeArgs := []string{
-		"--old-bindir=" + oldBinDir,
-		"--new-bindir=" + newBinDir,
-		"--old-datadir=" + oldDataDir,
-		"--new-datadir=" + newDataDir,
-		"--socketdir=" + socketDir,
+	args = append(args, opts.pgUpgradeArgs()...)
+
+	if check {
+		args = append(args, "--check")
+		fmt.Println("Checking cluster compatibility...")
+		fmt.Println("pg_upgrade check args:", strings.Join(args, "\n"))
+		checkProcess := clicky.Exec(filepath.Join(newBinDir, "pg_upgrade"), args...).Run()
+		if checkProcess.Err != nil {
+			return fmt.Errorf("pg_upgrade compatibility check failed: %w, output: %s", checkProcess.Err, checkProcess.Out())
+		}
+		return nil
 	}
 
 	fmt.Println("Performing upgrade...")
-	upgradeProcess := clicky.Exec(filepath.Join(newBinDir, "pg_upgrade"), upgradeArgs...).Run()
+	upgradeProcess := clicky.Exec(filepath.Join(newBinDir, "pg_upgrade"), args...).Run()
 
 	// if !upgradeProcess.IsOk() {
 	fmt.Println(upgradeProcess.Pretty().ANSI())
@@ -143,67 +226,13 @@ func (p *Postgres) runPgUpgrade(oldBinDir, newBinDir, oldDataDir, newDataDir str
 	return nil
 }
 
-// moveUpgradedData moves the upgraded data from upgrade directory to main data directory
-func (p *Postgres) moveUpgradedData(newDataDir string) error {
-	// Remove all files from main data directory except backups and upgrades
-	entries, err := os.ReadDir(p.DataDir)
-	if err != nil {
-		return fmt.Errorf("failed to read data directory: %w", err)
-	}
-
-	for _, entry := range entries {
-		name := entry.Name()
-		if name == "backups" || name == "upgrades" {
-			continue
-		}
-
-		path := filepath.Join(p.DataDir, name)
-		if err := os.RemoveAll(path); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", path, err)
-		}
-	}
-
-	// Move all files from new data directory to main data directory
-	newEntries, err := os.ReadDir(newDataDir)
-	if err != nil {
-		return fmt.Errorf("failed to read new data directory: %w", err)
-	}
-
-	for _, entry := range newEntries {
-		name := entry.Name()
-		sourcePath := filepath.Join(newDataDir, name)
-		destPath := filepath.Join(p.DataDir, name)
-
-		if err := os.Rename(sourcePath, destPath); err != nil {
-			return fmt.Errorf("failed to move %s: %w", name, err)
-		}
-	}
-
-	// Clean up the upgrade directory
-	if err := os.RemoveAll(filepath.Dir(newDataDir)); err != nil {
-		fmt.Printf("Warning: failed to clean up upgrade directory: %v\n", err)
-	}
-
-	return nil
-}
-
-// backupDataDirectory creates a backup of the current data directory
-func (p *Postgres) backupDataDirectory(backupPath string) error {
-	if err := os.MkdirAll(backupPath, 0750); err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
-	}
-
-	clicky.Exec("cp", "-a", filepath.Join(p.DataDir, "main"), backupPath)
-
-	return nil
-}
-
-// upgradeSingle performs a single version upgrade (e.g., 14 -> 15)
-func (p *Postgres) upgradeSingle(fromVersion, toVersion int) error {
+// upgradeSingle performs a single pg_upgrade run (e.g., 14 -> 17), recording each step in the journal.
+// Unless keepOldFiles is set, the old cluster's external WAL and tablespace directories are removed afterwards.
+func (p *Postgres) upgradeSingle(journal *UpgradeJournal, opts UpgradeOptions, keepOldFiles bool) error {
+	fromVersion, toVersion := journal.FromVersion, journal.ToVersion
 	oldBinDir := p.resolveBinDir(fromVersion)
 	newBinDir := p.resolveBinDir(toVersion)
-	upgradeDir := filepath.Join(p.DataDir, "upgrades")
-	newDataDir := filepath.Join(upgradeDir, strconv.Itoa(toVersion))
+	newDataDir := journal.NewDataDir()
 
 	// Clean up any existing upgrade directory from previous failed attempts
 	if _, err := os.Stat(newDataDir); err == nil {
@@ -217,7 +246,7 @@ func (p *Postgres) upgradeSingle(fromVersion, toVersion int) error {
 
 	// Validate current cluster
 	if err := p.validateCluster(oldBinDir, p.DataDir, fromVersion); err != nil {
-		return fmt.Errorf("pre-upgrade validation failed: %w", err)
+		return p.abortUpgrade(journal, fmt.Errorf("pre-upgrade validation failed: %w", err))
 	}
 
 	// Start old cluster temporarily to detect settings
@@ -229,7 +258,7 @@ func (p *Postgres) upgradeSingle(fromVersion, toVersion int) error {
 	}
 
 	if err := oldServer.Start(); err != nil {
-		return fmt.Errorf("failed to start old cluster for detection: %w", err)
+		return p.abortUpgrade(journal, fmt.Errorf("failed to start old cluster for detection: %w", err))
 	}
 
 	info, _ := oldServer.Info()
@@ -240,12 +269,12 @@ func (p *Postgres) upgradeSingle(fromVersion, toVersion int) error {
 	oldConf, err := oldServer.GetCurrentConf()
 	if err != nil {
 		oldServer.Stop()
-		return fmt.Errorf("failed to detect old cluster configuration: %w", err)
+		return p.abortUpgrade(journal, fmt.Errorf("failed to detect old cluster configuration: %w", err))
 	}
 
 	// Stop old cluster
 	if err := oldServer.Stop(); err != nil {
-		return fmt.Errorf("failed to stop old cluster: %w", err)
+		return p.abortUpgrade(journal, fmt.Errorf("failed to stop old cluster: %w", err))
 	}
 
 	// Extract initdb-applicable settings
@@ -254,30 +283,68 @@ func (p *Postgres) upgradeSingle(fromVersion, toVersion int) error {
 
 	fmt.Printf("✅ Pre-upgrade checks completed for PostgreSQL %d\n", fromVersion)
 
+	if err := p.prepareExternalPaths(journal, keepOldFiles); err != nil {
+		return p.abortUpgrade(journal, err)
+	}
+
 	// Initialize new cluster with detected settings
+	if err := journal.Record(UpgradeStepInitDB); err != nil {
+		return err
+	}
 	fmt.Printf("🔧 Initializing PostgreSQL %d cluster...\n", toVersion)
-	if err := p.initNewClusterWithConf(newBinDir, newDataDir, initdbConf); err != nil {
-		return fmt.Errorf("failed to initialize new cluster: %w", err)
+	if err := p.initNewClusterWithConf(newBinDir, newDataDir, initdbConf, journal.WALDir); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to initialize new cluster: %w", err))
+	}
+
+	if err := journal.Record(UpgradeStepCheck); err != nil {
+		return err
+	}
+	if err := p.runPgUpgrade(oldBinDir, newBinDir, p.DataDir, newDataDir, opts, true); err != nil {
+		return p.abortUpgrade(journal, err)
 	}
 
 	// Run pg_upgrade
+	if err := journal.Record(UpgradeStepPgUpgrade); err != nil {
+		return err
+	}
 	fmt.Printf("⚡ Performing pg_upgrade from PostgreSQL %d to %d...\n", fromVersion, toVersion)
-	if err := p.runPgUpgrade(oldBinDir, newBinDir, p.DataDir, newDataDir); err != nil {
-		return fmt.Errorf("pg_upgrade failed: %w", err)
+	if err := p.runPgUpgrade(oldBinDir, newBinDir, p.DataDir, newDataDir, opts, false); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("pg_upgrade failed: %w", err))
+	}
+	if err := collectUpgradeScripts(filepath.Dir(p.DataDir), newDataDir); err != nil {
+		logger.Warnf("failed to collect pg_upgrade scripts: %v", err)
+	}
+	if _, err := p.carryOverConfig(p.DataDir, newDataDir, fromVersion, toVersion); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to carry over configuration: %w", err))
 	}
 
 	// Post-upgrade validation
 	fmt.Printf("🔍 Running post-upgrade checks for PostgreSQL %d...\n", toVersion)
 	if err := p.validateCluster(newBinDir, newDataDir, toVersion); err != nil {
-		return fmt.Errorf("post-upgrade validation failed: %w", err)
+		return p.abortUpgrade(journal, fmt.Errorf("post-upgrade validation failed: %w", err))
 	}
 
-	// Move upgraded data to main location
+	// Move upgraded data to main location, from here on an interrupted upgrade is resumed rather than rolled back
+	if err := journal.Record(UpgradeStepSwap); err != nil {
+		return err
+	}
 	fmt.Printf("📦 Moving PostgreSQL %d data to main location...\n", toVersion)
-	if err := p.moveUpgradedData(newDataDir); err != nil {
-		return fmt.Errorf("failed to move upgraded data: %w", err)
+	if err := p.swapDataDirectories(journal); err != nil {
+		return fmt.Errorf("failed to move upgraded data, it will be resumed on next start: %w", err)
+	}
+
+	if err := p.cleanupUpgrade(journal); err != nil {
+		return err
 	}
 
 	fmt.Printf("✅ Upgrade from PostgreSQL %d to %d completed successfully!\n", fromVersion, toVersion)
 	return nil
 }
+
+// abortUpgrade rolls back a failed upgrade step that happened before the swap and returns the original error
+func (p *Postgres) abortUpgrade(journal *UpgradeJournal, cause error) error {
+	if err := p.rollbackInterruptedUpgrade(journal); err != nil {
+		return fmt.Errorf("%w (rollback also failed: %v)", cause, err)
+	}
+	return cause
+}
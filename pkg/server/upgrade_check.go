@@ -0,0 +1,324 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+)
+
+// UpgradeCheckSeverity is how a finding affects the upgrade
+type UpgradeCheckSeverity string
+
+const (
+	// UpgradeCheckError will make pg_upgrade or the new cluster fail
+	UpgradeCheckError UpgradeCheckSeverity = "error"
+	// UpgradeCheckWarning will not fail the upgrade but something is lost or changes behaviour
+	UpgradeCheckWarning UpgradeCheckSeverity = "warning"
+)
+
+type UpgradeFinding struct {
+	Check    string               `json:"check"`
+	Severity UpgradeCheckSeverity `json:"severity"`
+	Database string               `json:"database,omitempty"`
+	Object   string               `json:"object,omitempty"`
+	Message  string               `json:"message"`
+}
+
+// UpgradeCheckReport lists the incompatibilities found between the current cluster and a target version
+type UpgradeCheckReport struct {
+	FromVersion int              `json:"from_version"`
+	ToVersion   int              `json:"to_version"`
+	Findings    []UpgradeFinding `json:"findings"`
+}
+
+// HasErrors returns true if any finding would make the upgrade fail
+func (r *UpgradeCheckReport) HasErrors() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity == UpgradeCheckError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *UpgradeCheckReport) add(findings ...UpgradeFinding) {
+	r.Findings = append(r.Findings, findings...)
+}
+
+// regTypes are the reg* types that reference catalog OIDs which pg_upgrade cannot preserve
+var regTypes = []string{
+	"regcollation", "regconfig", "regdictionary", "regnamespace",
+	"regoper", "regoperator", "regproc", "regprocedure",
+}
+
+// CheckUpgrade inspects the current cluster and reports what would prevent or change an upgrade to
+// targetVersion (the latest installed version if 0), without modifying the data directory.
+// The old cluster is started temporarily if it is not already running.
+func (p *Postgres) CheckUpgrade(targetVersion int) (*UpgradeCheckReport, error) {
+	if journal, err := LoadUpgradeJournal(p.DataDir); err != nil {
+		return nil, err
+	} else if journal != nil {
+		return nil, fmt.Errorf("an interrupted upgrade from %d to %d is pending, run server upgrade to recover it first",
+			journal.FromVersion, journal.ToVersion)
+	}
+
+	currentVersion, err := p.DetectVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect current PostgreSQL version: %w", err)
+	}
+
+	installed := InstalledVersions()
+	if targetVersion == 0 {
+		if len(installed) == 0 {
+			return nil, fmt.Errorf("no PostgreSQL installations found to upgrade to")
+		}
+		targetVersion = installed[len(installed)-1]
+	}
+
+	report := &UpgradeCheckReport{FromVersion: currentVersion, ToVersion: targetVersion, Findings: []UpgradeFinding{}}
+	if currentVersion >= targetVersion {
+		return report, nil
+	}
+	if _, err := planUpgradePath(currentVersion, targetVersion, installed, false); err != nil {
+		return nil, err
+	}
+
+	oldBinDir := p.resolveBinDir(currentVersion)
+	newBinDir := p.resolveBinDir(targetVersion)
+
+	table, err := p.LoadGUCTable(currentVersion, targetVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range upgradeConfFiles {
+		data, err := os.ReadFile(filepath.Join(p.DataDir, file))
+		if err != nil {
+			continue
+		}
+		_, changes := migrateGUCs(file, string(data), table[currentVersion], table[targetVersion], targetVersion)
+		report.add(settingFindings(changes)...)
+	}
+
+	oldServer := &Postgres{DataDir: p.DataDir, BinDir: oldBinDir, Config: p.Config, Port: p.Port}
+	if !oldServer.IsRunning() {
+		if err := oldServer.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start PostgreSQL %d for inspection: %w", currentVersion, err)
+		}
+		defer func() {
+			if err := oldServer.Stop(); err != nil {
+				logger.Warnf("failed to stop PostgreSQL after upgrade check: %v", err)
+			}
+		}()
+	}
+
+	databases, err := oldServer.SQL(`SELECT datname::text, pg_encoding_to_char(encoding)::text AS encoding, datcollate::text, datctype::text
+		FROM pg_database WHERE datallowconn ORDER BY datname`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	if locales, err := availableLocales(); err != nil {
+		report.add(UpgradeFinding{Check: "locale", Severity: UpgradeCheckWarning, Message: fmt.Sprintf("could not list installed locales: %v", err)})
+	} else {
+		for _, row := range databases {
+			report.add(checkDatabaseLocale(
+				fmt.Sprintf("%v", row["datname"]), fmt.Sprintf("%v", row["encoding"]),
+				fmt.Sprintf("%v", row["datcollate"]), fmt.Sprintf("%v", row["datctype"]), locales)...)
+		}
+	}
+
+	prepared, err := oldServer.SQL("SELECT gid, database::text FROM pg_prepared_xacts ORDER BY gid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list prepared transactions: %w", err)
+	}
+	for _, row := range prepared {
+		report.add(UpgradeFinding{
+			Check: "prepared_transactions", Severity: UpgradeCheckError,
+			Database: fmt.Sprintf("%v", row["database"]), Object: fmt.Sprintf("%v", row["gid"]),
+			Message: "prepared transaction must be committed or rolled back before upgrading",
+		})
+	}
+
+	slots, err := oldServer.SQL("SELECT slot_name::text, slot_type, database::text, wal_status FROM pg_replication_slots WHERE NOT temporary ORDER BY slot_name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replication slots: %w", err)
+	}
+	for _, row := range slots {
+		report.add(checkReplicationSlot(currentVersion,
+			fmt.Sprintf("%v", row["slot_name"]), fmt.Sprintf("%v", row["slot_type"]),
+			fmt.Sprintf("%v", row["database"]), fmt.Sprintf("%v", row["wal_status"])))
+	}
+
+	extensionDir := targetExtensionDir(newBinDir, targetVersion)
+	for _, row := range databases {
+		db := oldServer.WithoutAuth()
+		db.Port = oldServer.Port
+		db.Database = fmt.Sprintf("%v", row["datname"])
+
+		extensions, err := db.SQL("SELECT extname::text FROM pg_extension ORDER BY extname")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list extensions in %s: %w", db.Database, err)
+		}
+		var names []string
+		for _, ext := range extensions {
+			names = append(names, fmt.Sprintf("%v", ext["extname"]))
+		}
+		report.add(checkExtensionsAvailable(db.Database, names, extensionDir)...)
+
+		columns, err := db.SQL(fmt.Sprintf(`SELECT n.nspname::text, c.relname::text, a.attname::text, a.atttypid::regtype::text AS type
+			FROM pg_catalog.pg_class c
+			JOIN pg_catalog.pg_namespace n ON c.relnamespace = n.oid
+			JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid
+			WHERE c.relkind IN ('r', 'm') AND a.attnum > 0 AND NOT a.attisdropped
+				AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+				AND a.atttypid::regtype::text IN ('%s')
+			ORDER BY 1, 2, 3`, strings.Join(regTypes, "', '")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check reg* columns in %s: %w", db.Database, err)
+		}
+		for _, col := range columns {
+			report.add(UpgradeFinding{
+				Check: "reg_columns", Severity: UpgradeCheckError, Database: db.Database,
+				Object:  fmt.Sprintf("%v.%v.%v", col["nspname"], col["relname"], col["attname"]),
+				Message: fmt.Sprintf("column of type %v references OIDs that are not preserved by pg_upgrade", col["type"]),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// settingFindings reports the settings that the upgrade will rewrite or comment out
+func settingFindings(changes []GUCChange) []UpgradeFinding {
+	var findings []UpgradeFinding
+	for _, change := range changes {
+		message := fmt.Sprintf("%s, it will be commented out", change.Reason)
+		if change.Action != GUCCommented {
+			name := change.Name
+			if change.NewName != "" {
+				name = change.NewName
+			}
+			message = fmt.Sprintf("%s, it will be %s to %s = '%s'", change.Reason, change.Action, name, change.NewValue)
+		}
+		findings = append(findings, UpgradeFinding{
+			Check: "settings", Severity: UpgradeCheckWarning,
+			Object:  fmt.Sprintf("%s:%d %s", change.File, change.Line, change.Name),
+			Message: message,
+		})
+	}
+	return findings
+}
+
+// checkExtensionsAvailable reports installed extensions with no control file in the target extension directory
+func checkExtensionsAvailable(database string, installed []string, extensionDir string) []UpgradeFinding {
+	var findings []UpgradeFinding
+	for _, name := range installed {
+		if _, err := os.Stat(filepath.Join(extensionDir, name+".control")); err == nil {
+			continue
+		}
+		findings = append(findings, UpgradeFinding{
+			Check: "extensions", Severity: UpgradeCheckError, Database: database, Object: name,
+			Message: fmt.Sprintf("extension is not installed for the target version in %s", extensionDir),
+		})
+	}
+	return findings
+}
+
+// checkReplicationSlot reports slots that pg_upgrade drops or cannot migrate. Slots are only
+// carried over from PostgreSQL 17 onwards, and then only logical slots that have not lost WAL.
+func checkReplicationSlot(fromVersion int, name, slotType, database, walStatus string) UpgradeFinding {
+	finding := UpgradeFinding{Check: "replication_slots", Database: database, Object: name}
+	switch {
+	case fromVersion < 17:
+		finding.Severity = UpgradeCheckWarning
+		finding.Message = fmt.Sprintf("%s slot is not migrated by pg_upgrade from PostgreSQL %d and must be recreated", slotType, fromVersion)
+	case slotType != "logical":
+		finding.Severity = UpgradeCheckWarning
+		finding.Message = "physical slot is not migrated by pg_upgrade and must be recreated"
+	case walStatus == "lost":
+		finding.Severity = UpgradeCheckError
+		finding.Message = "logical slot has lost required WAL and must be dropped before upgrading"
+	default:
+		finding.Severity = UpgradeCheckWarning
+		finding.Message = "logical slot is migrated only if all changes have been consumed before the upgrade"
+	}
+	return finding
+}
+
+// checkDatabaseLocale reports databases whose locale is not installed on this host, or whose
+// encoding does not match the codeset of the locale, the new cluster could not create them
+func checkDatabaseLocale(database, encoding, collate, ctype string, available map[string]bool) []UpgradeFinding {
+	locales := []string{collate}
+	if ctype != collate {
+		locales = append(locales, ctype)
+	}
+
+	var findings []UpgradeFinding
+	for _, locale := range locales {
+		if !localeAvailable(locale, available) {
+			findings = append(findings, UpgradeFinding{
+				Check: "locale", Severity: UpgradeCheckError, Database: database, Object: locale,
+				Message: fmt.Sprintf("locale %s is not installed", locale),
+			})
+		}
+	}
+
+	if codeset := localeCodeset(ctype); codeset == "utf8" && encoding != "UTF8" && encoding != "SQL_ASCII" {
+		findings = append(findings, UpgradeFinding{
+			Check: "encoding", Severity: UpgradeCheckError, Database: database, Object: encoding,
+			Message: fmt.Sprintf("encoding %s does not match locale %s", encoding, ctype),
+		})
+	}
+	return findings
+}
+
+// normalizeLocale lowercases a locale and its codeset the way `locale -a` lists them, e.g. en_US.UTF-8 -> en_us.utf8
+func normalizeLocale(locale string) string {
+	name, codeset, found := strings.Cut(strings.ToLower(strings.TrimSpace(locale)), ".")
+	if !found {
+		return name
+	}
+	return name + "." + strings.ReplaceAll(codeset, "-", "")
+}
+
+func localeCodeset(locale string) string {
+	_, codeset, _ := strings.Cut(normalizeLocale(locale), ".")
+	return codeset
+}
+
+func localeAvailable(locale string, available map[string]bool) bool {
+	switch normalizeLocale(locale) {
+	case "", "c", "posix", "c.utf8":
+		return true
+	}
+	return available[normalizeLocale(locale)]
+}
+
+// availableLocales returns the normalized output of `locale -a`
+func availableLocales() (map[string]bool, error) {
+	process := clicky.Exec("locale", "-a").Run()
+	if process.Err != nil {
+		return nil, process.Err
+	}
+	locales := make(map[string]bool)
+	for _, line := range strings.Split(process.GetStdout(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			locales[normalizeLocale(line)] = true
+		}
+	}
+	return locales, nil
+}
+
+// targetExtensionDir returns the extension directory of the PostgreSQL installation in binDir
+func targetExtensionDir(binDir string, version int) string {
+	process := clicky.Exec(filepath.Join(binDir, "pg_config"), "--sharedir").Run()
+	if process.Err == nil && strings.TrimSpace(process.GetStdout()) != "" {
+		return filepath.Join(strings.TrimSpace(process.GetStdout()), "extension")
+	}
+	return filepath.Join("/usr/share/postgresql", strconv.Itoa(version), "extension")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettingFindings(t *testing.T) {
+	changes := []GUCChange{
+		{File: "postgresql.conf", Line: 3, Name: "wal_keep_segments", Value: "64", Action: GUCRenamed,
+			NewName: "wal_keep_size", NewValue: "1024MB", Reason: "renamed to wal_keep_size in PostgreSQL 13"},
+		{File: "postgresql.auto.conf", Line: 4, Name: "stats_temp_directory", Value: "/tmp", Action: GUCCommented,
+			Reason: "removed in PostgreSQL 15"},
+	}
+
+	findings := settingFindings(changes)
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %d: %+v", len(findings), findings)
+	}
+	for _, f := range findings {
+		if f.Severity != UpgradeCheckWarning {
+			t.Errorf("expected warning severity for %s, settings are migrated by the upgrade", f.Object)
+		}
+	}
+	if findings[0].Object != "postgresql.conf:3 wal_keep_segments" ||
+		findings[0].Message != "renamed to wal_keep_size in PostgreSQL 13, it will be renamed to wal_keep_size = '1024MB'" {
+		t.Errorf("unexpected finding: %+v", findings[0])
+	}
+	if findings[1].Message != "removed in PostgreSQL 15, it will be commented out" {
+		t.Errorf("unexpected finding: %+v", findings[1])
+	}
+}
+
+func TestCheckExtensionsAvailable(t *testing.T) {
+	extensionDir := t.TempDir()
+	for _, name := range []string{"plpgsql", "vector"} {
+		if err := os.WriteFile(filepath.Join(extensionDir, name+".control"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings := checkExtensionsAvailable("app", []string{"plpgsql", "vector", "pg_cron"}, extensionDir)
+	if len(findings) != 1 || findings[0].Object != "pg_cron" || findings[0].Database != "app" {
+		t.Errorf("expected only pg_cron to be missing, got %+v", findings)
+	}
+}
+
+func TestCheckDatabaseLocale(t *testing.T) {
+	available := map[string]bool{"en_us.utf8": true, "de_de.iso88591": true}
+
+	tests := []struct {
+		name                     string
+		encoding, collate, ctype string
+		wantChecks               []string
+	}{
+		{name: "installed locale", encoding: "UTF8", collate: "en_US.UTF-8", ctype: "en_US.UTF-8"},
+		{name: "C locale", encoding: "SQL_ASCII", collate: "C", ctype: "C"},
+		{name: "missing locale", encoding: "UTF8", collate: "fr_FR.UTF-8", ctype: "fr_FR.UTF-8", wantChecks: []string{"locale"}},
+		{name: "missing ctype only", encoding: "UTF8", collate: "C", ctype: "fr_FR.UTF-8", wantChecks: []string{"locale"}},
+		{name: "encoding mismatch", encoding: "LATIN1", collate: "en_US.utf8", ctype: "en_US.utf8", wantChecks: []string{"encoding"}},
+		{name: "latin1 locale", encoding: "LATIN1", collate: "de_DE.ISO-8859-1", ctype: "de_DE.ISO-8859-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := checkDatabaseLocale("app", tt.encoding, tt.collate, tt.ctype, available)
+			if len(findings) != len(tt.wantChecks) {
+				t.Fatalf("expected %v, got %+v", tt.wantChecks, findings)
+			}
+			for i, check := range tt.wantChecks {
+				if findings[i].Check != check {
+					t.Errorf("expected %s finding, got %s", check, findings[i].Check)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckReplicationSlot(t *testing.T) {
+	tests := []struct {
+		name        string
+		fromVersion int
+		slotType    string
+		walStatus   string
+		want        UpgradeCheckSeverity
+	}{
+		{name: "dropped before 17", fromVersion: 16, slotType: "logical", walStatus: "reserved", want: UpgradeCheckWarning},
+		{name: "physical", fromVersion: 17, slotType: "physical", walStatus: "reserved", want: UpgradeCheckWarning},
+		{name: "lost logical", fromVersion: 17, slotType: "logical", walStatus: "lost", want: UpgradeCheckError},
+		{name: "migrated logical", fromVersion: 17, slotType: "logical", walStatus: "reserved", want: UpgradeCheckWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finding := checkReplicationSlot(tt.fromVersion, "slot", tt.slotType, "app", tt.walStatus)
+			if finding.Severity != tt.want {
+				t.Errorf("expected %s, got %s: %s", tt.want, finding.Severity, finding.Message)
+			}
+		})
+	}
+}
+
+func TestUpgradeCheckReportHasErrors(t *testing.T) {
+	report := &UpgradeCheckReport{}
+	report.add(UpgradeFinding{Check: "replication_slots", Severity: UpgradeCheckWarning})
+	if report.HasErrors() {
+		t.Error("expected warnings alone not to block the upgrade")
+	}
+	report.add(UpgradeFinding{Check: "reg_columns", Severity: UpgradeCheckError})
+	if !report.HasErrors() {
+		t.Error("expected errors to block the upgrade")
+	}
+}
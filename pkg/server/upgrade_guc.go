@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg/schemas"
+)
+
+// upgradeConfFiles are carried over from the old cluster, the settings in them are migrated to the new version
+var upgradeConfFiles = []string{"postgresql.conf", "postgresql.tune.conf", "postgresql.auto.conf"}
+
+// upgradeAuthFiles are carried over from the old cluster unchanged
+var upgradeAuthFiles = []string{"pg_hba.conf", "pg_ident.conf"}
+
+// GUCAction is what an upgrade did with a setting the new major version does not accept as is
+type GUCAction string
+
+const (
+	GUCRenamed   GUCAction = "renamed"
+	GUCRewritten GUCAction = "rewritten"
+	GUCCommented GUCAction = "commented"
+)
+
+// GUCChange is a configuration line that was changed while upgrading
+type GUCChange struct {
+	File     string    `json:"file"`
+	Line     int       `json:"line"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Action   GUCAction `json:"action"`
+	NewName  string    `json:"new_name,omitempty"`
+	NewValue string    `json:"new_value,omitempty"`
+	Reason   string    `json:"reason"`
+}
+
+// gucRename is a parameter that was replaced by another one, convert translates the old value if the unit changed
+type gucRename struct {
+	Version int
+	To      string
+	Convert func(value string) (string, error)
+}
+
+var gucRenames = map[string]gucRename{
+	"min_parallel_relation_size": {Version: 10, To: "min_parallel_table_scan_size"},
+	"wal_keep_segments":          {Version: 13, To: "wal_keep_size", Convert: walSegmentsToSize},
+	"force_parallel_mode":        {Version: 16, To: "debug_parallel_query"},
+}
+
+// gucRemovals are parameters removed without a replacement, used to explain why a setting is commented out
+var gucRemovals = map[string]int{
+	"replacement_sort_tuples":     11,
+	"operator_precedence_warning": 14,
+	"stats_temp_directory":        15,
+	"vacuum_defer_cleanup_age":    16,
+	"promote_trigger_file":        16,
+	"old_snapshot_threshold":      17,
+	"db_user_namespace":           17,
+	"trace_recovery_messages":     17,
+}
+
+// gucValueRenames are enum values that are no longer accepted, mapped to their equivalent
+var gucValueRenames = map[string]map[string]string{
+	"wal_level":           {"archive": "replica", "hot_standby": "replica"},
+	"password_encryption": {"on": "md5", "true": "md5", "yes": "md5", "1": "md5"},
+}
+
+// GUCTable holds the parameters known to each installed major version
+type GUCTable map[int]map[string]schemas.Param
+
+// LoadGUCTable runs postgres --describe-config for each version to build the compatibility table
+func (p *Postgres) LoadGUCTable(versions ...int) (GUCTable, error) {
+	table := GUCTable{}
+	for _, version := range versions {
+		if _, ok := table[version]; ok {
+			continue
+		}
+		server := &Postgres{DataDir: p.DataDir, BinDir: p.resolveBinDir(version)}
+		params, err := server.DescribeConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe PostgreSQL %d settings: %w", version, err)
+		}
+		known := make(map[string]schemas.Param, len(params))
+		for _, param := range params {
+			known[strings.ToLower(param.Name)] = param
+		}
+		table[version] = known
+	}
+	return table, nil
+}
+
+// carryOverConfig copies the configuration of the old cluster into the new one, migrating settings that
+// were renamed or removed between fromVersion and toVersion, and prints the changes that were made
+func (p *Postgres) carryOverConfig(oldDataDir, newDataDir string, fromVersion, toVersion int) ([]GUCChange, error) {
+	table, err := p.LoadGUCTable(fromVersion, toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range upgradeAuthFiles {
+		data, err := os.ReadFile(filepath.Join(oldDataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(newDataDir, name), data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	var changes []GUCChange
+	for _, name := range upgradeConfFiles {
+		data, err := os.ReadFile(filepath.Join(oldDataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		content, fileChanges := migrateGUCs(name, string(data), table[fromVersion], table[toVersion], toVersion)
+		if err := os.WriteFile(filepath.Join(newDataDir, name), []byte(content), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		changes = append(changes, fileChanges...)
+	}
+
+	if len(changes) > 0 {
+		clicky.Warnf("⚙️  Migrated %d settings for PostgreSQL %d:", len(changes), toVersion)
+		clicky.MustPrint(changes)
+	}
+	return changes, nil
+}
+
+// migrateGUCs rewrites the lines of a configuration file that toVersion would reject. Renamed parameters
+// and retired enum values are rewritten, unknown parameters are commented out. Comments, includes and
+// extension (dotted) parameters are left untouched.
+func migrateGUCs(file, content string, from, to map[string]schemas.Param, toVersion int) (string, []GUCChange) {
+	if len(to) == 0 {
+		return content, nil
+	}
+	lines := strings.Split(content, "\n")
+	var changes []GUCChange
+	for i, line := range lines {
+		name, value, ok := parseConfLine(line)
+		if !ok || strings.Contains(name, ".") || strings.HasPrefix(name, "include") {
+			continue
+		}
+		change := GUCChange{File: file, Line: i + 1, Name: name, Value: value}
+
+		if _, known := to[name]; known {
+			replacement, ok := gucValueRenames[name][strings.ToLower(value)]
+			if !ok {
+				continue
+			}
+			change.Action = GUCRewritten
+			change.NewValue = replacement
+			change.Reason = fmt.Sprintf("value %s is no longer accepted", value)
+			lines[i] = fmt.Sprintf("%s = '%s'", name, replacement)
+			changes = append(changes, change)
+			continue
+		}
+
+		if rename, ok := gucRenames[name]; ok {
+			if _, known := to[rename.To]; known {
+				newValue := value
+				var err error
+				if rename.Convert != nil {
+					newValue, err = rename.Convert(value)
+				}
+				if err == nil {
+					change.Action = GUCRenamed
+					change.NewName = rename.To
+					change.NewValue = newValue
+					change.Reason = fmt.Sprintf("renamed to %s in PostgreSQL %d", rename.To, rename.Version)
+					lines[i] = fmt.Sprintf("%s = '%s'", rename.To, newValue)
+					changes = append(changes, change)
+					continue
+				}
+				change.Reason = fmt.Sprintf("renamed to %s in PostgreSQL %d, value cannot be converted: %v", rename.To, rename.Version, err)
+			}
+		}
+
+		if change.Reason == "" {
+			if version, ok := gucRemovals[name]; ok {
+				change.Reason = fmt.Sprintf("removed in PostgreSQL %d", version)
+			} else if _, known := from[name]; known {
+				change.Reason = fmt.Sprintf("not supported by PostgreSQL %d", toVersion)
+			} else {
+				change.Reason = "unknown parameter"
+			}
+		}
+		change.Action = GUCCommented
+		lines[i] = fmt.Sprintf("# %s  # %s", strings.TrimSpace(line), change.Reason)
+		changes = append(changes, change)
+	}
+	return strings.Join(lines, "\n"), changes
+}
+
+// parseConfLine returns the lower cased name and unquoted value of a "name = value" or "name value" line
+func parseConfLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+
+	var name, value string
+	if idx := strings.IndexAny(line, "= \t"); idx > 0 {
+		name, value = line[:idx], strings.TrimSpace(line[idx:])
+		value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	} else {
+		return "", "", false
+	}
+
+	if strings.HasPrefix(value, "'") {
+		if end := strings.Index(value[1:], "'"); end >= 0 {
+			value = value[1 : end+1]
+		}
+	} else if idx := strings.Index(value, "#"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return strings.ToLower(name), value, true
+}
+
+// walSegmentsToSize converts wal_keep_segments into wal_keep_size assuming the default 16MB segments
+func walSegmentsToSize(value string) (string, error) {
+	segments, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid segment count %q", value)
+	}
+	return fmt.Sprintf("%dMB", segments*16), nil
+}
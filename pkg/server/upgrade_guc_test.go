@@ -0,0 +1,115 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flanksource/postgres/pkg/schemas"
+)
+
+func gucCatalog(names ...string) map[string]schemas.Param {
+	catalog := map[string]schemas.Param{}
+	for _, name := range names {
+		catalog[name] = schemas.Param{Name: name}
+	}
+	return catalog
+}
+
+func TestMigrateGUCs(t *testing.T) {
+	pg12 := gucCatalog("shared_buffers", "wal_keep_segments", "stats_temp_directory", "vacuum_defer_cleanup_age", "password_encryption", "wal_level")
+	pg17 := gucCatalog("shared_buffers", "wal_keep_size", "password_encryption", "wal_level", "debug_parallel_query")
+
+	content := strings.Join([]string{
+		"# managed by postgres-cli",
+		"shared_buffers = '128MB'",
+		"wal_keep_segments = 64  # keep some WAL",
+		"stats_temp_directory = '/var/run/postgresql/stats'",
+		"vacuum_defer_cleanup_age 0",
+		"password_encryption = on",
+		"pg_stat_statements.max = 1000",
+		"include_if_exists 'postgresql.tune.conf'",
+		"typo_setting = 1",
+		"",
+	}, "\n")
+
+	migrated, changes := migrateGUCs("postgresql.conf", content, pg12, pg17, 17)
+
+	want := strings.Join([]string{
+		"# managed by postgres-cli",
+		"shared_buffers = '128MB'",
+		"wal_keep_size = '1024MB'",
+		"# stats_temp_directory = '/var/run/postgresql/stats'  # removed in PostgreSQL 15",
+		"# vacuum_defer_cleanup_age 0  # removed in PostgreSQL 16",
+		"password_encryption = 'md5'",
+		"pg_stat_statements.max = 1000",
+		"include_if_exists 'postgresql.tune.conf'",
+		"# typo_setting = 1  # unknown parameter",
+		"",
+	}, "\n")
+	if migrated != want {
+		t.Errorf("unexpected migrated file:\n%s\nwant:\n%s", migrated, want)
+	}
+
+	actions := map[string]GUCAction{}
+	for _, change := range changes {
+		actions[change.Name] = change.Action
+	}
+	expected := map[string]GUCAction{
+		"wal_keep_segments":        GUCRenamed,
+		"stats_temp_directory":     GUCCommented,
+		"vacuum_defer_cleanup_age": GUCCommented,
+		"password_encryption":      GUCRewritten,
+		"typo_setting":             GUCCommented,
+	}
+	if len(changes) != len(expected) {
+		t.Errorf("expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+	for name, action := range expected {
+		if actions[name] != action {
+			t.Errorf("expected %s to be %s, got %q", name, action, actions[name])
+		}
+	}
+}
+
+func TestMigrateGUCsRemovedWithoutKnownVersion(t *testing.T) {
+	pg16 := gucCatalog("old_setting")
+	pg17 := gucCatalog("shared_buffers")
+
+	migrated, changes := migrateGUCs("postgresql.auto.conf", "old_setting = 'x'\n", pg16, pg17, 17)
+	if len(changes) != 1 || changes[0].Reason != "not supported by PostgreSQL 17" {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+	if migrated != "# old_setting = 'x'  # not supported by PostgreSQL 17\n" {
+		t.Errorf("unexpected migrated file: %q", migrated)
+	}
+}
+
+func TestMigrateGUCsWithoutCatalog(t *testing.T) {
+	content := "wal_keep_segments = 64\n"
+	migrated, changes := migrateGUCs("postgresql.conf", content, nil, nil, 17)
+	if migrated != content || len(changes) != 0 {
+		t.Errorf("expected file to be left untouched without a catalog, got %q %+v", migrated, changes)
+	}
+}
+
+func TestParseConfLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		name  string
+		value string
+		ok    bool
+	}{
+		{"shared_buffers = '128MB'", "shared_buffers", "128MB", true},
+		{"  Work_Mem=4MB # comment", "work_mem", "4MB", true},
+		{"log_line_prefix = '%m # [%p] '", "log_line_prefix", "%m # [%p] ", true},
+		{"max_connections 100", "max_connections", "100", true},
+		{"# shared_buffers = 1GB", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		name, value, ok := parseConfLine(tt.line)
+		if name != tt.name || value != tt.value || ok != tt.ok {
+			t.Errorf("parseConfLine(%q) = %q, %q, %v, want %q, %q, %v", tt.line, name, value, ok, tt.name, tt.value, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+)
+
+// UpgradeStep is a phase of a single-version upgrade recorded in the upgrade journal
+type UpgradeStep string
+
+const (
+	UpgradeStepBackup    UpgradeStep = "backup"
+	UpgradeStepInitDB    UpgradeStep = "initdb"
+	UpgradeStepCheck     UpgradeStep = "check"
+	UpgradeStepPgUpgrade UpgradeStep = "pg_upgrade"
+	UpgradeStepSwap      UpgradeStep = "swap"
+	UpgradeStepCleanup   UpgradeStep = "cleanup"
+
+	// Steps of the logical replication strategy, the old cluster keeps serving until the cutover
+	UpgradeStepSchema    UpgradeStep = "schema"
+	UpgradeStepReplicate UpgradeStep = "replicate"
+	UpgradeStepCutover   UpgradeStep = "cutover"
+)
+
+const (
+	// upgradeJournalFile lives in PGDATA and is never moved by the swap
+	upgradeJournalFile = "upgrade_journal.json"
+
+	// swapPhaseRetire moves the old cluster out of PGDATA into upgrades/<from>-old
+	swapPhaseRetire = "retire"
+	// swapPhaseInstall moves the new cluster from upgrades/<to> into PGDATA
+	swapPhaseInstall = "install"
+)
+
+// UpgradeJournalEntry records when a step was entered
+type UpgradeJournalEntry struct {
+	Step        UpgradeStep `json:"step"`
+	FromVersion int         `json:"from_version"`
+	ToVersion   int         `json:"to_version"`
+	At          time.Time   `json:"at"`
+}
+
+// UpgradeJournal is persisted to PGDATA before every upgrade step so that an
+// interrupted upgrade can be resumed or rolled back deterministically
+type UpgradeJournal struct {
+	// Version hop currently in progress
+	FromVersion int `json:"from_version"`
+	ToVersion   int `json:"to_version"`
+	// Final version requested by the caller
+	TargetVersion int             `json:"target_version"`
+	Mode          UpgradeMode     `json:"mode,omitempty"`
+	Strategy      UpgradeStrategy `json:"strategy,omitempty"`
+	Step          UpgradeStep     `json:"step"`
+	SwapPhase     string          `json:"swap_phase,omitempty"`
+	StartedAt     time.Time       `json:"started_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+	// SnapshotPath is where the retired cluster is kept on cleanup instead of being removed
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	// Replication is the progress of the logical replication strategy
+	Replication *ReplicationProgress `json:"replication,omitempty"`
+	// CutoverSocketDir is the private socket the old cluster is restarted on for the logical cutover
+	CutoverSocketDir string `json:"cutover_socket_dir,omitempty"`
+	// WALDir is the external WAL directory created for the new cluster, it is removed on rollback
+	WALDir string `json:"wal_dir,omitempty"`
+	// RetiredPaths are directories outside PGDATA only used by the old cluster (external WAL,
+	// tablespace subdirectories), they are removed on cleanup
+	RetiredPaths []string `json:"retired_paths,omitempty"`
+
+	History []UpgradeJournalEntry `json:"history,omitempty"`
+
+	dataDir string
+}
+
+// NewUpgradeJournal creates an in-memory journal, it is only written to disk by Record
+func NewUpgradeJournal(dataDir string, fromVersion, toVersion, targetVersion int) *UpgradeJournal {
+	return &UpgradeJournal{
+		FromVersion:   fromVersion,
+		ToVersion:     toVersion,
+		TargetVersion: targetVersion,
+		StartedAt:     time.Now(),
+		dataDir:       dataDir,
+	}
+}
+
+// LoadUpgradeJournal reads the upgrade journal from the data directory, returning nil if none exists
+func LoadUpgradeJournal(dataDir string) (*UpgradeJournal, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, upgradeJournalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade journal: %w", err)
+	}
+
+	var journal UpgradeJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("upgrade journal %s is corrupt, manual intervention required: %w",
+			filepath.Join(dataDir, upgradeJournalFile), err)
+	}
+	if journal.FromVersion == 0 || journal.ToVersion == 0 || journal.Step == "" {
+		return nil, fmt.Errorf("upgrade journal %s is incomplete, manual intervention required",
+			filepath.Join(dataDir, upgradeJournalFile))
+	}
+	journal.dataDir = dataDir
+	return &journal, nil
+}
+
+// Path returns the location of the journal file
+func (j *UpgradeJournal) Path() string {
+	return filepath.Join(j.dataDir, upgradeJournalFile)
+}
+
+// NewDataDir is where the new cluster for the current hop is initialized
+func (j *UpgradeJournal) NewDataDir() string {
+	return filepath.Join(j.dataDir, "upgrades", strconv.Itoa(j.ToVersion))
+}
+
+// RetiredDataDir is where the old cluster is moved to during the swap
+func (j *UpgradeJournal) RetiredDataDir() string {
+	return filepath.Join(j.dataDir, "upgrades", fmt.Sprintf("%d-old", j.FromVersion))
+}
+
+// Record marks the start of a step and durably writes the journal before the step is executed
+func (j *UpgradeJournal) Record(step UpgradeStep) error {
+	j.Step = step
+	j.SwapPhase = ""
+	j.History = append(j.History, UpgradeJournalEntry{
+		Step:        step,
+		FromVersion: j.FromVersion,
+		ToVersion:   j.ToVersion,
+		At:          time.Now(),
+	})
+	return j.save()
+}
+
+func (j *UpgradeJournal) setSwapPhase(phase string) error {
+	j.SwapPhase = phase
+	return j.save()
+}
+
+func (j *UpgradeJournal) save() error {
+	j.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgrade journal: %w", err)
+	}
+
+	if err := writeFileAtomic(j.Path(), data); err != nil {
+		return fmt.Errorf("failed to write upgrade journal: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic durably replaces path with data, readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Remove deletes the journal once the data directory is in a consistent state
+func (j *UpgradeJournal) Remove() error {
+	if err := os.Remove(j.Path()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upgrade journal: %w", err)
+	}
+	return syncDir(j.dataDir)
+}
+
+// RecoverUpgrade inspects the upgrade journal left behind by an interrupted upgrade and
+// either rolls the data directory back to the old cluster (if the swap had not started)
+// or completes the swap (if pg_upgrade had already succeeded). If the journal and the
+// data directory disagree, it refuses to touch anything and returns an error.
+func (p *Postgres) RecoverUpgrade() error {
+	if p.DataDir == "" {
+		return nil
+	}
+
+	journal, err := LoadUpgradeJournal(p.DataDir)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return nil
+	}
+
+	clicky.Infof("🔍 Found interrupted upgrade %d → %d at step '%s' (started %s)",
+		journal.FromVersion, journal.ToVersion, journal.Step, journal.StartedAt.Format(time.RFC3339))
+
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping recovery of interrupted upgrade")
+		return nil
+	}
+
+	switch journal.Step {
+	case UpgradeStepBackup, UpgradeStepInitDB, UpgradeStepCheck, UpgradeStepPgUpgrade, UpgradeStepRestore,
+		UpgradeStepSchema, UpgradeStepReplicate, UpgradeStepCutover:
+		return p.rollbackInterruptedUpgrade(journal)
+	case UpgradeStepSwap:
+		if err := p.swapDataDirectories(journal); err != nil {
+			return fmt.Errorf("failed to resume data directory swap: %w", err)
+		}
+		return p.cleanupUpgrade(journal)
+	case UpgradeStepCleanup:
+		return p.cleanupUpgrade(journal)
+	default:
+		return fmt.Errorf("upgrade journal %s has unknown step '%s', manual intervention required", journal.Path(), journal.Step)
+	}
+}
+
+// rollbackInterruptedUpgrade discards a partially created new cluster, the old cluster in
+// PGDATA has not been modified before the swap step so it is still usable
+func (p *Postgres) rollbackInterruptedUpgrade(journal *UpgradeJournal) error {
+	version, err := readPGVersion(p.DataDir)
+	if err != nil {
+		return fmt.Errorf("cannot roll back upgrade interrupted at step '%s': %w", journal.Step, err)
+	}
+	if version != journal.FromVersion {
+		return fmt.Errorf("cannot roll back upgrade interrupted at step '%s': journal expects PostgreSQL %d in %s but PG_VERSION is %d, manual intervention required",
+			journal.Step, journal.FromVersion, p.DataDir, version)
+	}
+
+	if journal.Strategy == UpgradeStrategyLogical {
+		p.rollbackLogicalReplication(journal)
+	}
+
+	// In link mode pg_upgrade disables the old cluster by renaming global/pg_control once it has
+	// finished, the new cluster has not been started yet so the old one can safely be re-enabled
+	pgControl := filepath.Join(p.DataDir, "global", "pg_control")
+	if _, err := os.Stat(pgControl); os.IsNotExist(err) {
+		if _, err := os.Stat(pgControl + ".old"); err == nil && journal.Mode == UpgradeModeLink {
+			clicky.Infof("↩️  Re-enabling PostgreSQL %d cluster disabled by pg_upgrade --link", journal.FromVersion)
+			if err := os.Rename(pgControl+".old", pgControl); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", pgControl, err)
+			}
+		} else {
+			return fmt.Errorf("cannot roll back upgrade interrupted at step '%s': %s is missing, manual intervention required", journal.Step, pgControl)
+		}
+	}
+
+	clicky.Infof("↩️  Rolling back interrupted upgrade, PostgreSQL %d data is intact", journal.FromVersion)
+	if err := os.RemoveAll(journal.NewDataDir()); err != nil {
+		return fmt.Errorf("failed to remove partially upgraded cluster: %w", err)
+	}
+	if journal.WALDir != "" {
+		if err := os.RemoveAll(journal.WALDir); err != nil {
+			return fmt.Errorf("failed to remove WAL directory of the partially upgraded cluster: %w", err)
+		}
+	}
+	// pg_upgrade creates the new cluster's subdirectories in the old cluster's tablespaces
+	if journal.ToVersion > journal.FromVersion {
+		dirs, err := tablespaceVersionDirs(p.DataDir, journal.ToVersion)
+		if err != nil {
+			return err
+		}
+		if err := removeExternalPaths(dirs); err != nil {
+			return err
+		}
+	}
+	removeIfEmpty(filepath.Join(p.DataDir, "upgrades"))
+
+	return journal.Remove()
+}
+
+// swapDataDirectories replaces the old cluster in PGDATA with the new cluster. Every move is a
+// single rename and the phase is journaled, so the swap can be re-run after a crash at any point.
+func (p *Postgres) swapDataDirectories(journal *UpgradeJournal) error {
+	newDataDir := journal.NewDataDir()
+	retiredDir := journal.RetiredDataDir()
+
+	if journal.SwapPhase == "" || journal.SwapPhase == swapPhaseRetire {
+		// Nothing from the new cluster has been moved yet, so it must still be complete
+		if version, err := readPGVersion(newDataDir); err != nil || version != journal.ToVersion {
+			return fmt.Errorf("new PostgreSQL %d cluster in %s is missing or incomplete, manual intervention required", journal.ToVersion, newDataDir)
+		}
+
+		if err := journal.setSwapPhase(swapPhaseRetire); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(retiredDir, 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %w", retiredDir, err)
+		}
+
+		entries, err := dataDirEntries(p.DataDir)
+		if err != nil {
+			return err
+		}
+		for _, name := range entries {
+			if err := os.Rename(filepath.Join(p.DataDir, name), filepath.Join(retiredDir, name)); err != nil {
+				return fmt.Errorf("failed to move %s out of the data directory: %w", name, err)
+			}
+		}
+		if err := syncDir(p.DataDir); err != nil {
+			return err
+		}
+
+		if err := journal.setSwapPhase(swapPhaseInstall); err != nil {
+			return err
+		}
+	}
+
+	if journal.SwapPhase != swapPhaseInstall {
+		return fmt.Errorf("upgrade journal %s has unknown swap phase '%s', manual intervention required", journal.Path(), journal.SwapPhase)
+	}
+
+	if version, err := readPGVersion(retiredDir); err != nil || version != journal.FromVersion {
+		return fmt.Errorf("old PostgreSQL %d cluster in %s is missing or incomplete, manual intervention required", journal.FromVersion, retiredDir)
+	}
+
+	entries, err := dataDirEntries(newDataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range entries {
+		dest := filepath.Join(p.DataDir, name)
+		if _, err := os.Lstat(dest); err == nil {
+			return fmt.Errorf("cannot move %s into the data directory, %s already exists, manual intervention required", name, dest)
+		}
+		if err := os.Rename(filepath.Join(newDataDir, name), dest); err != nil {
+			return fmt.Errorf("failed to move %s into the data directory: %w", name, err)
+		}
+	}
+	if err := syncDir(p.DataDir); err != nil {
+		return err
+	}
+
+	if version, err := readPGVersion(p.DataDir); err != nil || version != journal.ToVersion {
+		return fmt.Errorf("data directory does not contain PostgreSQL %d after swap, manual intervention required", journal.ToVersion)
+	}
+
+	return nil
+}
+
+// cleanupUpgrade removes the retired old cluster and the empty upgrade directory
+func (p *Postgres) cleanupUpgrade(journal *UpgradeJournal) error {
+	if version, err := readPGVersion(p.DataDir); err != nil || version != journal.ToVersion {
+		return fmt.Errorf("refusing to clean up upgrade: data directory does not contain PostgreSQL %d, manual intervention required", journal.ToVersion)
+	}
+
+	if journal.Step != UpgradeStepCleanup {
+		if err := journal.Record(UpgradeStepCleanup); err != nil {
+			return err
+		}
+	}
+
+	if journal.SnapshotPath != "" {
+		if err := keepRetiredCluster(journal.RetiredDataDir(), journal.SnapshotPath); err != nil {
+			return err
+		}
+	} else {
+		clicky.Infof("🧹 Removing retired PostgreSQL %d cluster", journal.FromVersion)
+		if err := os.RemoveAll(journal.RetiredDataDir()); err != nil {
+			return fmt.Errorf("failed to remove retired cluster: %w", err)
+		}
+	}
+	if err := removeExternalPaths(journal.RetiredPaths); err != nil {
+		return fmt.Errorf("failed to remove files of the retired cluster: %w", err)
+	}
+	if err := os.RemoveAll(journal.NewDataDir()); err != nil {
+		return fmt.Errorf("failed to remove upgrade directory: %w", err)
+	}
+	removeIfEmpty(filepath.Join(p.DataDir, "upgrades"))
+
+	return journal.Remove()
+}
+
+// keepRetiredCluster moves the retired cluster to snapshotPath, replacing an older snapshot.
+// It is a no-op when the retired cluster has already been moved.
+func keepRetiredCluster(retiredDir, snapshotPath string) error {
+	if _, err := os.Stat(retiredDir); os.IsNotExist(err) {
+		return nil
+	}
+	clicky.Infof("💾 Keeping retired cluster as snapshot %s", snapshotPath)
+	if err := os.MkdirAll(filepath.Dir(snapshotPath), 0750); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := os.RemoveAll(snapshotPath); err != nil {
+		return fmt.Errorf("failed to remove previous snapshot %s: %w", snapshotPath, err)
+	}
+	if err := os.Rename(retiredDir, snapshotPath); err != nil {
+		return fmt.Errorf("failed to move retired cluster to %s: %w", snapshotPath, err)
+	}
+	return syncDir(filepath.Dir(snapshotPath))
+}
+
+// dataDirEntries lists the entries of a data directory that belong to the cluster itself
+func dataDirEntries(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		switch name := entry.Name(); {
+		case name == "backups" || name == "upgrades":
+		case strings.HasPrefix(name, upgradeJournalFile):
+		default:
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func readPGVersion(dataDir string) (int, error) {
+	content, err := os.ReadFile(filepath.Join(dataDir, "PG_VERSION"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read PG_VERSION: %w", err)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid version format in PG_VERSION: %s", strings.TrimSpace(string(content)))
+	}
+	return version, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+func removeIfEmpty(dir string) {
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("not removing %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeFakeCluster creates a minimal data directory layout with the given PG_VERSION
+func writeFakeCluster(t *testing.T, dir string, version int) {
+	t.Helper()
+	for _, sub := range []string{"base", "global", "pg_wal"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"PG_VERSION":        strconv.Itoa(version) + "\n",
+		"postgresql.conf":   "# version " + strconv.Itoa(version) + "\n",
+		"global/marker":     strconv.Itoa(version),
+		"global/pg_control": "control",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readMarker(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "global", "marker"))
+	if err != nil {
+		t.Fatalf("failed to read marker in %s: %v", dir, err)
+	}
+	return string(data)
+}
+
+func TestLoadUpgradeJournalMissing(t *testing.T) {
+	journal, err := LoadUpgradeJournal(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if journal != nil {
+		t.Errorf("expected no journal, got %+v", journal)
+	}
+}
+
+func TestLoadUpgradeJournalCorrupt(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, upgradeJournalFile), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadUpgradeJournal(dataDir); err == nil {
+		t.Error("expected error for corrupt journal")
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.RecoverUpgrade(); err == nil {
+		t.Error("expected RecoverUpgrade to refuse a corrupt journal")
+	}
+}
+
+func TestUpgradeJournalRoundTrip(t *testing.T) {
+	dataDir := t.TempDir()
+	journal := NewUpgradeJournal(dataDir, 15, 16, 17)
+	if err := journal.Record(UpgradeStepInitDB); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadUpgradeJournal(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.FromVersion != 15 || loaded.ToVersion != 16 || loaded.TargetVersion != 17 {
+		t.Errorf("unexpected versions: %+v", loaded)
+	}
+	if loaded.Step != UpgradeStepInitDB {
+		t.Errorf("expected step %s, got %s", UpgradeStepInitDB, loaded.Step)
+	}
+	if len(loaded.History) != 1 {
+		t.Errorf("expected 1 history entry, got %d", len(loaded.History))
+	}
+	if loaded.NewDataDir() != filepath.Join(dataDir, "upgrades", "16") {
+		t.Errorf("unexpected new data dir: %s", loaded.NewDataDir())
+	}
+}
+
+func TestRecoverUpgradeRollsBackBeforeSwap(t *testing.T) {
+	for _, step := range []UpgradeStep{UpgradeStepBackup, UpgradeStepInitDB, UpgradeStepCheck, UpgradeStepPgUpgrade} {
+		t.Run(string(step), func(t *testing.T) {
+			dataDir := t.TempDir()
+			writeFakeCluster(t, dataDir, 16)
+
+			journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+			writeFakeCluster(t, journal.NewDataDir(), 17)
+			if err := journal.Record(step); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &Postgres{DataDir: dataDir}
+			if err := p.RecoverUpgrade(); err != nil {
+				t.Fatalf("RecoverUpgrade failed: %v", err)
+			}
+
+			if marker := readMarker(t, dataDir); marker != "16" {
+				t.Errorf("expected old cluster to be kept, got marker %s", marker)
+			}
+			if _, err := os.Stat(filepath.Join(dataDir, "upgrades")); !os.IsNotExist(err) {
+				t.Errorf("expected upgrades directory to be removed")
+			}
+			if _, err := os.Stat(journal.Path()); !os.IsNotExist(err) {
+				t.Errorf("expected journal to be removed")
+			}
+		})
+	}
+}
+
+func TestRecoverUpgradeReenablesLinkedCluster(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 16)
+	pgControl := filepath.Join(dataDir, "global", "pg_control")
+	if err := os.Rename(pgControl, pgControl+".old"); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+	journal.Mode = UpgradeModeLink
+	writeFakeCluster(t, journal.NewDataDir(), 17)
+	if err := journal.Record(UpgradeStepPgUpgrade); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.RecoverUpgrade(); err != nil {
+		t.Fatalf("RecoverUpgrade failed: %v", err)
+	}
+	if _, err := os.Stat(pgControl); err != nil {
+		t.Errorf("expected pg_control to be restored: %v", err)
+	}
+}
+
+func TestRecoverUpgradeRefusesOnVersionMismatch(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 15)
+
+	journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+	if err := journal.Record(UpgradeStepPgUpgrade); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.RecoverUpgrade(); err == nil {
+		t.Fatal("expected RecoverUpgrade to refuse when PG_VERSION does not match the journal")
+	}
+	if _, err := os.Stat(journal.Path()); err != nil {
+		t.Errorf("expected journal to be kept for manual intervention")
+	}
+}
+
+func TestRecoverUpgradeResumesSwap(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dataDir string, journal *UpgradeJournal)
+	}{
+		{
+			name: "crash before any move",
+			setup: func(t *testing.T, dataDir string, journal *UpgradeJournal) {
+				if err := journal.setSwapPhase(swapPhaseRetire); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "crash during retire",
+			setup: func(t *testing.T, dataDir string, journal *UpgradeJournal) {
+				if err := journal.setSwapPhase(swapPhaseRetire); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(journal.RetiredDataDir(), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(filepath.Join(dataDir, "global"), filepath.Join(journal.RetiredDataDir(), "global")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "crash during install",
+			setup: func(t *testing.T, dataDir string, journal *UpgradeJournal) {
+				if err := os.MkdirAll(journal.RetiredDataDir(), 0700); err != nil {
+					t.Fatal(err)
+				}
+				entries, err := dataDirEntries(dataDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range entries {
+					if err := os.Rename(filepath.Join(dataDir, name), filepath.Join(journal.RetiredDataDir(), name)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := os.Rename(filepath.Join(journal.NewDataDir(), "base"), filepath.Join(dataDir, "base")); err != nil {
+					t.Fatal(err)
+				}
+				if err := journal.setSwapPhase(swapPhaseInstall); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			writeFakeCluster(t, dataDir, 16)
+			if err := os.MkdirAll(filepath.Join(dataDir, "backups", "data-16"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+			writeFakeCluster(t, journal.NewDataDir(), 17)
+			if err := journal.Record(UpgradeStepSwap); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t, dataDir, journal)
+
+			p := &Postgres{DataDir: dataDir}
+			if err := p.RecoverUpgrade(); err != nil {
+				t.Fatalf("RecoverUpgrade failed: %v", err)
+			}
+
+			version, err := readPGVersion(dataDir)
+			if err != nil || version != 17 {
+				t.Errorf("expected PG_VERSION 17 after resume, got %d (%v)", version, err)
+			}
+			if marker := readMarker(t, dataDir); marker != "17" {
+				t.Errorf("expected new cluster in data dir, got marker %s", marker)
+			}
+			if _, err := os.Stat(filepath.Join(dataDir, "backups", "data-16")); err != nil {
+				t.Errorf("expected backups to be left untouched: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dataDir, "upgrades")); !os.IsNotExist(err) {
+				t.Errorf("expected upgrades directory to be removed")
+			}
+			if _, err := os.Stat(journal.Path()); !os.IsNotExist(err) {
+				t.Errorf("expected journal to be removed")
+			}
+		})
+	}
+}
+
+func TestRecoverUpgradeRefusesIncompleteSwap(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 16)
+
+	// The new cluster is missing entirely, resuming would leave PGDATA empty
+	journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+	if err := journal.Record(UpgradeStepSwap); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.RecoverUpgrade(); err == nil {
+		t.Fatal("expected RecoverUpgrade to refuse to swap in a missing cluster")
+	}
+	if marker := readMarker(t, dataDir); marker != "16" {
+		t.Errorf("expected old cluster to be untouched, got marker %s", marker)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/flanksource/clicky"
+)
+
+var versionSuffix = regexp.MustCompile(`-\d+$`)
+
+// externalWALDir returns the target of a symlinked pg_wal (initdb --waldir), or "" if the WAL lives inside the data directory
+func externalWALDir(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, "pg_wal")
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to inspect %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("pg_wal is a symlink to a missing directory: %w", err)
+	}
+	return target, nil
+}
+
+// upgradeWALDir returns the external WAL directory for a new cluster next to the old one,
+// e.g. /wal/pg_wal becomes /wal/pg_wal-17 so the old WAL stays intact for the pre-upgrade snapshot
+func upgradeWALDir(oldWALDir string, version int) string {
+	base := versionSuffix.ReplaceAllString(filepath.Base(oldWALDir), "")
+	return filepath.Join(filepath.Dir(oldWALDir), fmt.Sprintf("%s-%d", base, version))
+}
+
+// tablespaceLocations returns the directories linked from pg_tblspc, keyed by tablespace OID
+func tablespaceLocations(dataDir string) (map[string]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "pg_tblspc"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read pg_tblspc: %w", err)
+	}
+
+	locations := map[string]string{}
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(dataDir, "pg_tblspc", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("tablespace %s points to a missing directory: %w", entry.Name(), err)
+		}
+		locations[entry.Name()] = target
+	}
+	return locations, nil
+}
+
+// tablespaceVersionDirs returns the per-version subdirectories (PG_<version>_<catalog version>) that a
+// cluster of the given major version owns in every tablespace linked from dataDir
+func tablespaceVersionDirs(dataDir string, version int) ([]string, error) {
+	locations, err := tablespaceLocations(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, location := range locations {
+		matches, err := filepath.Glob(filepath.Join(location, fmt.Sprintf("PG_%d_*", version)))
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, matches...)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// clusterExternalPaths returns the directories outside of dataDir that belong to the cluster: its
+// external WAL directory and its subdirectories in every tablespace
+func clusterExternalPaths(dataDir string, version int) ([]string, error) {
+	paths, err := tablespaceVersionDirs(dataDir, version)
+	if err != nil {
+		return nil, err
+	}
+	walDir, err := externalWALDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if walDir != "" {
+		paths = append(paths, walDir)
+	}
+	return paths, nil
+}
+
+// retiredExternalPaths returns the external directories of the cluster in oldDataDir that the cluster
+// replacing it in newDataDir does not share, e.g. when restoring a snapshot that uses the pre-upgrade WAL directory
+func retiredExternalPaths(oldDataDir string, oldVersion int, newDataDir string, newVersion int) ([]string, error) {
+	old, err := clusterExternalPaths(oldDataDir, oldVersion)
+	if err != nil {
+		return nil, err
+	}
+	current, err := clusterExternalPaths(newDataDir, newVersion)
+	if err != nil {
+		return nil, err
+	}
+	var retired []string
+	for _, path := range old {
+		if !slices.Contains(current, path) {
+			retired = append(retired, path)
+		}
+	}
+	return retired, nil
+}
+
+// prepareExternalPaths records in the journal where the new cluster keeps its WAL if the old one uses an
+// external WAL directory, and which directories outside PGDATA can be removed once the upgrade is complete
+func (p *Postgres) prepareExternalPaths(journal *UpgradeJournal, keepOldFiles bool) error {
+	oldWALDir, err := externalWALDir(p.DataDir)
+	if err != nil {
+		return err
+	}
+	journal.WALDir = ""
+	if oldWALDir != "" {
+		journal.WALDir = upgradeWALDir(oldWALDir, journal.ToVersion)
+		clicky.Infof("📁 PostgreSQL %d WAL is in %s, PostgreSQL %d will use %s", journal.FromVersion, oldWALDir, journal.ToVersion, journal.WALDir)
+		// initdb refuses to use a non-empty WAL directory, it can only be left over from an earlier attempt
+		if err := os.RemoveAll(journal.WALDir); err != nil {
+			return fmt.Errorf("failed to clean up %s: %w", journal.WALDir, err)
+		}
+	}
+
+	journal.RetiredPaths = nil
+	if !keepOldFiles {
+		if journal.RetiredPaths, err = clusterExternalPaths(p.DataDir, journal.FromVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExternalPaths deletes directories outside of the data directory that an upgrade created or retired
+func removeExternalPaths(paths []string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
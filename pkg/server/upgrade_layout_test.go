@@ -0,0 +1,297 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// catalogVersions are the PG_<version>_<catalog version> names initdb uses in tablespaces
+var catalogVersions = map[int]string{15: "PG_15_202209061", 16: "PG_16_202307071", 17: "PG_17_202406281"}
+
+// writeExternalLayout turns a fake cluster into one created with initdb --waldir and a tablespace,
+// both living under root: pg_wal links to walDir and pg_tblspc/16384 to root/tblspc
+func writeExternalLayout(t *testing.T, dataDir, root, walDir string, version int) {
+	t.Helper()
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dataDir, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(walDir, filepath.Join(dataDir, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(walDir, "000000010000000000000001"), []byte(strconv.Itoa(version)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tablespace := filepath.Join(root, "tblspc")
+	if err := os.MkdirAll(filepath.Join(tablespace, catalogVersions[version], "16385"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, "pg_tblspc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(tablespace, filepath.Join(dataDir, "pg_tblspc", "16384")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// layoutRoot returns a temporary directory with symlinks resolved, so paths compare equal to EvalSymlinks results
+func layoutRoot(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func assertExists(t *testing.T, path string, exists bool) {
+	t.Helper()
+	_, err := os.Lstat(path)
+	if exists && err != nil {
+		t.Errorf("expected %s to exist: %v", path, err)
+	} else if !exists && !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", path, err)
+	}
+}
+
+func TestExternalWALDir(t *testing.T) {
+	root := layoutRoot(t)
+
+	internal := filepath.Join(root, "internal")
+	writeFakeCluster(t, internal, 16)
+	if dir, err := externalWALDir(internal); err != nil || dir != "" {
+		t.Errorf("expected no external WAL directory, got %q (%v)", dir, err)
+	}
+
+	external := filepath.Join(root, "external")
+	writeFakeCluster(t, external, 16)
+	writeExternalLayout(t, external, root, filepath.Join(root, "wal", "pg_wal"), 16)
+	if dir, err := externalWALDir(external); err != nil || dir != filepath.Join(root, "wal", "pg_wal") {
+		t.Errorf("expected external WAL directory, got %q (%v)", dir, err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "wal")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := externalWALDir(external); err == nil {
+		t.Error("expected error for dangling pg_wal symlink")
+	}
+}
+
+func TestUpgradeWALDir(t *testing.T) {
+	tests := []struct {
+		old     string
+		version int
+		want    string
+	}{
+		{"/wal/pg_wal", 17, "/wal/pg_wal-17"},
+		{"/wal/pg_wal-16", 17, "/wal/pg_wal-17"},
+		{"/mnt/wal-disk/16", 17, "/mnt/wal-disk/16-17"},
+	}
+	for _, tt := range tests {
+		if got := upgradeWALDir(tt.old, tt.version); got != tt.want {
+			t.Errorf("upgradeWALDir(%q, %d) = %q, want %q", tt.old, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestTablespaceVersionDirs(t *testing.T) {
+	root := layoutRoot(t)
+	dataDir := filepath.Join(root, "data")
+	writeFakeCluster(t, dataDir, 16)
+
+	if dirs, err := tablespaceVersionDirs(dataDir, 16); err != nil || len(dirs) != 0 {
+		t.Errorf("expected no tablespaces, got %v (%v)", dirs, err)
+	}
+
+	writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal"), 16)
+	if err := os.MkdirAll(filepath.Join(root, "tblspc", catalogVersions[17]), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{16, 17} {
+		name := catalogVersions[version]
+		dirs, err := tablespaceVersionDirs(dataDir, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{filepath.Join(root, "tblspc", name)}; !reflect.DeepEqual(dirs, want) {
+			t.Errorf("PostgreSQL %d: expected %v, got %v", version, want, dirs)
+		}
+	}
+}
+
+func TestCheckSnapshotTablespaces(t *testing.T) {
+	root := layoutRoot(t)
+	dataDir := filepath.Join(root, "data")
+	writeFakeCluster(t, dataDir, 16)
+	p := &Postgres{DataDir: dataDir}
+
+	link := UpgradeOptions{Mode: UpgradeModeLink, Backup: BackupStrategyCopy}
+	if err := p.checkSnapshotTablespaces(link); err != nil {
+		t.Errorf("expected link mode without tablespaces to be allowed, got %v", err)
+	}
+
+	writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal"), 16)
+	if err := p.checkSnapshotTablespaces(link); err == nil {
+		t.Error("expected link mode with tablespaces and a snapshot to be refused")
+	}
+	for _, opts := range []UpgradeOptions{
+		{Mode: UpgradeModeLink, Backup: BackupStrategyNone},
+		{Mode: UpgradeModeCopy, Backup: BackupStrategyCopy},
+		{Mode: UpgradeModeClone, Backup: BackupStrategyClone},
+	} {
+		if err := p.checkSnapshotTablespaces(opts); err != nil {
+			t.Errorf("expected mode %s with backup %s to be allowed, got %v", opts.Mode, opts.Backup, err)
+		}
+	}
+}
+
+func TestPrepareExternalPaths(t *testing.T) {
+	for _, keepOldFiles := range []bool{true, false} {
+		t.Run("keep="+strconv.FormatBool(keepOldFiles), func(t *testing.T) {
+			root := layoutRoot(t)
+			dataDir := filepath.Join(root, "data")
+			writeFakeCluster(t, dataDir, 16)
+			writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal"), 16)
+			// Left over from an earlier attempt
+			if err := os.MkdirAll(filepath.Join(root, "wal", "pg_wal-17", "archive_status"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+			p := &Postgres{DataDir: dataDir}
+			if err := p.prepareExternalPaths(journal, keepOldFiles); err != nil {
+				t.Fatal(err)
+			}
+
+			if journal.WALDir != filepath.Join(root, "wal", "pg_wal-17") {
+				t.Errorf("unexpected WAL directory %s", journal.WALDir)
+			}
+			assertExists(t, journal.WALDir, false)
+
+			var retired []string
+			if !keepOldFiles {
+				retired = []string{filepath.Join(root, "tblspc", catalogVersions[16]), filepath.Join(root, "wal", "pg_wal")}
+			}
+			if !reflect.DeepEqual(journal.RetiredPaths, retired) {
+				t.Errorf("expected retired paths %v, got %v", retired, journal.RetiredPaths)
+			}
+		})
+	}
+}
+
+func TestRecoverUpgradeRemovesExternalPathsOfNewCluster(t *testing.T) {
+	root := layoutRoot(t)
+	dataDir := filepath.Join(root, "data")
+	writeFakeCluster(t, dataDir, 16)
+	writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal"), 16)
+
+	// pg_upgrade was interrupted after creating the new cluster's WAL and tablespace directories
+	journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+	journal.WALDir = filepath.Join(root, "wal", "pg_wal-17")
+	writeFakeCluster(t, journal.NewDataDir(), 17)
+	writeExternalLayout(t, journal.NewDataDir(), root, journal.WALDir, 17)
+	if err := journal.Record(UpgradeStepPgUpgrade); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.RecoverUpgrade(); err != nil {
+		t.Fatalf("RecoverUpgrade failed: %v", err)
+	}
+
+	assertExists(t, journal.WALDir, false)
+	assertExists(t, filepath.Join(root, "tblspc", catalogVersions[17]), false)
+	assertExists(t, filepath.Join(root, "wal", "pg_wal", "000000010000000000000001"), true)
+	assertExists(t, filepath.Join(root, "tblspc", catalogVersions[16], "16385"), true)
+	if dir, err := externalWALDir(dataDir); err != nil || dir != filepath.Join(root, "wal", "pg_wal") {
+		t.Errorf("expected old cluster to keep its WAL directory, got %q (%v)", dir, err)
+	}
+}
+
+func TestUpgradeSwapKeepsExternalLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot bool
+	}{
+		{name: "old files retired"},
+		{name: "old files kept for snapshot", snapshot: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := layoutRoot(t)
+			dataDir := filepath.Join(root, "data")
+			writeFakeCluster(t, dataDir, 16)
+			writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal"), 16)
+
+			journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+			if err := (&Postgres{DataDir: dataDir}).prepareExternalPaths(journal, tt.snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if tt.snapshot {
+				journal.SnapshotPath = filepath.Join(dataDir, "backups", "data-16")
+			}
+			writeFakeCluster(t, journal.NewDataDir(), 17)
+			writeExternalLayout(t, journal.NewDataDir(), root, journal.WALDir, 17)
+			if err := journal.Record(UpgradeStepSwap); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &Postgres{DataDir: dataDir}
+			if err := p.RecoverUpgrade(); err != nil {
+				t.Fatalf("RecoverUpgrade failed: %v", err)
+			}
+
+			if marker := readMarker(t, dataDir); marker != "17" {
+				t.Errorf("expected new cluster in data dir, got marker %s", marker)
+			}
+			if dir, err := externalWALDir(dataDir); err != nil || dir != filepath.Join(root, "wal", "pg_wal-17") {
+				t.Errorf("expected new cluster to use its own WAL directory, got %q (%v)", dir, err)
+			}
+			if dirs, err := tablespaceVersionDirs(dataDir, 17); err != nil || len(dirs) != 1 {
+				t.Errorf("expected new cluster to keep its tablespace, got %v (%v)", dirs, err)
+			}
+			assertExists(t, filepath.Join(root, "wal", "pg_wal"), tt.snapshot)
+			assertExists(t, filepath.Join(root, "tblspc", catalogVersions[16]), tt.snapshot)
+			if tt.snapshot {
+				if dir, err := externalWALDir(journal.SnapshotPath); err != nil || dir != filepath.Join(root, "wal", "pg_wal") {
+					t.Errorf("expected snapshot to keep the old WAL directory, got %q (%v)", dir, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRetiredExternalPaths(t *testing.T) {
+	root := layoutRoot(t)
+
+	// Rolling back to a snapshot that still uses the pre-upgrade WAL and tablespace directories
+	current := filepath.Join(root, "data")
+	writeFakeCluster(t, current, 17)
+	writeExternalLayout(t, current, root, filepath.Join(root, "wal", "pg_wal-17"), 17)
+	snapshot := filepath.Join(root, "snapshot")
+	writeFakeCluster(t, snapshot, 16)
+	writeExternalLayout(t, snapshot, root, filepath.Join(root, "wal", "pg_wal"), 16)
+
+	retired, err := retiredExternalPaths(current, 17, snapshot, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "tblspc", catalogVersions[17]), filepath.Join(root, "wal", "pg_wal-17")}
+	if !reflect.DeepEqual(retired, want) {
+		t.Errorf("expected %v, got %v", want, retired)
+	}
+
+	// Both clusters share the WAL directory, e.g. a snapshot of the same major version
+	if retired, err = retiredExternalPaths(current, 17, current, 17); err != nil || len(retired) != 0 {
+		t.Errorf("expected nothing to be retired, got %v (%v)", retired, err)
+	}
+}
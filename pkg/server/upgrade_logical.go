@@ -0,0 +1,612 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/commons/properties"
+	"github.com/lib/pq"
+)
+
+// logicalUpgradeName names the publications, subscriptions and replication slots created by a logical upgrade
+const logicalUpgradeName = "postgres_cli_upgrade"
+
+// ReplicationProgress is recorded in the upgrade journal while the new cluster catches up with the old one
+type ReplicationProgress struct {
+	// Port the new cluster listens on while replicating
+	Port        int       `json:"port"`
+	Databases   []string  `json:"databases,omitempty"`
+	TablesTotal int64     `json:"tables_total"`
+	TablesReady int64     `json:"tables_ready"`
+	LagBytes    int64     `json:"lag_bytes" pretty:"format=bytes"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"`
+}
+
+// Synced returns true once every table has finished its initial copy
+func (r ReplicationProgress) Synced() bool {
+	return r.TablesReady >= r.TablesTotal
+}
+
+type logicalDatabase struct {
+	Name     string
+	Encoding string
+	Collate  string
+	Ctype    string
+	Owner    string
+	Slot     string
+}
+
+// logicalUpgrade holds the state of an upgrade via logical replication, the old (source) cluster
+// keeps serving clients until the cutover while the new (target) cluster replicates from it
+type logicalUpgrade struct {
+	journal   *UpgradeJournal
+	source    *Postgres
+	target    *Postgres
+	databases []logicalDatabase
+	workDir   string
+}
+
+// upgradeLogical upgrades by replicating every database into a new cluster on another port, clients are only
+// locked out of the old cluster for the final cutover once replication has caught up
+func (p *Postgres) upgradeLogical(fromVersion, toVersion int, opts UpgradeOptions) error {
+	source := &Postgres{
+		Config:   p.Config,
+		DataDir:  p.DataDir,
+		BinDir:   p.resolveBinDir(fromVersion),
+		Port:     p.Port,
+		Username: p.Username,
+		Password: p.Password,
+		Database: "postgres",
+	}
+	if source.Port == 0 {
+		source.Port = 5432
+	}
+	if source.Username == "" {
+		source.Username = "postgres"
+	}
+	port := opts.ReplicationPort
+	if port == 0 {
+		port = source.Port + 1
+	}
+
+	if !source.IsRunning() {
+		if err := source.Start(); err != nil {
+			return fmt.Errorf("failed to start PostgreSQL %d: %w", fromVersion, err)
+		}
+	}
+	if err := source.ensureLogicalWAL(); err != nil {
+		return err
+	}
+	source.dropLogicalUpgradeObjects()
+
+	databases, err := source.logicalDatabases()
+	if err != nil {
+		return err
+	}
+	if err := source.checkReplicationCapacity(len(databases)); err != nil {
+		return err
+	}
+
+	journal := NewUpgradeJournal(p.DataDir, fromVersion, toVersion, toVersion)
+	journal.Strategy = UpgradeStrategyLogical
+	if opts.Backup != BackupStrategyNone {
+		journal.SnapshotPath = filepath.Join(p.DataDir, "backups", fmt.Sprintf("data-%d", fromVersion))
+	}
+	journal.Replication = &ReplicationProgress{Port: port}
+	for _, db := range databases {
+		journal.Replication.Databases = append(journal.Replication.Databases, db.Name)
+	}
+
+	workDir, err := os.MkdirTemp("", "postgres-upgrade-")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	upgrade := &logicalUpgrade{
+		journal:   journal,
+		source:    source,
+		databases: databases,
+		workDir:   workDir,
+		target: &Postgres{
+			DataDir:  journal.NewDataDir(),
+			BinDir:   p.resolveBinDir(toVersion),
+			Port:     port,
+			Username: "postgres",
+			Database: "postgres",
+		},
+	}
+	if err := upgrade.run(); err != nil {
+		return p.abortUpgrade(journal, upgrade.abort(err))
+	}
+
+	// From here on an interrupted upgrade is resumed rather than rolled back
+	if err := journal.Record(UpgradeStepSwap); err != nil {
+		return err
+	}
+	fmt.Printf("📦 Moving PostgreSQL %d data to main location...\n", toVersion)
+	if err := p.swapDataDirectories(journal); err != nil {
+		return fmt.Errorf("failed to move upgraded data, it will be resumed on next start: %w", err)
+	}
+	if err := p.cleanupUpgrade(journal); err != nil {
+		return err
+	}
+
+	return p.completeUpgrade(fromVersion, toVersion, journal.SnapshotPath, opts)
+}
+
+func (u *logicalUpgrade) run() error {
+	journal := u.journal
+
+	// The retired cluster is kept as the snapshot together with its WAL and tablespace directories
+	if err := u.source.prepareExternalPaths(journal, journal.SnapshotPath != ""); err != nil {
+		return err
+	}
+	if err := journal.Record(UpgradeStepInitDB); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(u.target.DataDir); err != nil {
+		return fmt.Errorf("failed to clean up existing upgrade directory: %w", err)
+	}
+	oldConf, err := u.source.GetCurrentConf()
+	if err != nil {
+		return fmt.Errorf("failed to detect old cluster configuration: %w", err)
+	}
+	fmt.Printf("🔧 Initializing PostgreSQL %d cluster...\n", journal.ToVersion)
+	if err := u.source.initNewClusterWithConf(u.target.BinDir, u.target.DataDir, oldConf.ToConf().ForInitDB(), journal.WALDir); err != nil {
+		return fmt.Errorf("failed to initialize new cluster: %w", err)
+	}
+
+	// Every subscription keeps an apply worker running, with additional workers for the initial table copy
+	workers := len(u.databases) + 4
+	if _, err := u.target.StartTempServer(TempServerOptions{
+		Port: u.target.Port,
+		Settings: map[string]string{
+			"max_logical_replication_workers": strconv.Itoa(workers),
+			"max_worker_processes":            strconv.Itoa(workers + 8),
+		},
+	}); err != nil {
+		return err
+	}
+
+	if err := journal.Record(UpgradeStepSchema); err != nil {
+		return err
+	}
+	fmt.Printf("📜 Copying roles, tablespaces and schema to PostgreSQL %d on port %d...\n", journal.ToVersion, u.target.Port)
+	if err := u.copyGlobals(); err != nil {
+		return err
+	}
+	for _, db := range u.databases {
+		if err := u.copySchema(db); err != nil {
+			return fmt.Errorf("failed to copy schema of %s: %w", db.Name, err)
+		}
+	}
+
+	if err := journal.Record(UpgradeStepReplicate); err != nil {
+		return err
+	}
+	for _, db := range u.databases {
+		if err := u.subscribe(db); err != nil {
+			return fmt.Errorf("failed to start replication of %s: %w", db.Name, err)
+		}
+	}
+	if err := u.waitForReplication(properties.Duration(24*time.Hour, "upgrade.replication.timeout"), false); err != nil {
+		return err
+	}
+
+	if err := journal.Record(UpgradeStepCutover); err != nil {
+		return err
+	}
+	fmt.Printf("✂️  Cutting over to PostgreSQL %d, the old cluster no longer accepts clients...\n", journal.ToVersion)
+	if err := u.isolateSource(); err != nil {
+		return err
+	}
+	if err := u.waitForReplication(properties.Duration(5*time.Minute, "upgrade.cutover.timeout"), true); err != nil {
+		return err
+	}
+	for _, db := range u.databases {
+		if err := u.syncSequences(db); err != nil {
+			return fmt.Errorf("failed to copy sequences of %s: %w", db.Name, err)
+		}
+	}
+
+	for _, db := range u.databases {
+		if _, err := u.target.on(db.Name).SQL("DROP SUBSCRIPTION " + pq.QuoteIdentifier(logicalUpgradeName)); err != nil {
+			return fmt.Errorf("failed to drop subscription in %s: %w", db.Name, err)
+		}
+		// The old cluster is kept as the rollback snapshot, so it is left without publications
+		if _, err := u.source.on(db.Name).SQL("DROP PUBLICATION IF EXISTS " + pq.QuoteIdentifier(logicalUpgradeName)); err != nil {
+			logger.Warnf("failed to drop publication in %s: %v", db.Name, err)
+		}
+	}
+
+	if err := u.target.StopTempServer(); err != nil {
+		return err
+	}
+	if err := u.source.StopTempServer(); err != nil {
+		return fmt.Errorf("failed to stop PostgreSQL %d: %w", journal.FromVersion, err)
+	}
+
+	if _, err := u.source.carryOverConfig(u.source.DataDir, u.target.DataDir, journal.FromVersion, journal.ToVersion); err != nil {
+		return fmt.Errorf("failed to carry over configuration: %w", err)
+	}
+
+	fmt.Printf("🔍 Running post-upgrade checks for PostgreSQL %d...\n", journal.ToVersion)
+	return u.source.validateCluster(u.target.BinDir, u.target.DataDir, journal.ToVersion)
+}
+
+// abort undoes the replication setup on a best effort basis before the upgrade is rolled back
+func (u *logicalUpgrade) abort(cause error) error {
+	if u.target.IsRunning() {
+		for _, db := range u.databases {
+			if _, err := u.target.on(db.Name).SQL("DROP SUBSCRIPTION IF EXISTS " + pq.QuoteIdentifier(logicalUpgradeName)); err != nil {
+				logger.Debugf("failed to drop subscription in %s: %v", db.Name, err)
+			}
+		}
+		if err := u.target.StopTempServer(); err != nil {
+			logger.Warnf("failed to stop PostgreSQL %d: %v", u.journal.ToVersion, err)
+		}
+	}
+	if u.source.Host != "" && u.source.IsRunning() {
+		// Isolated for the cutover, the old cluster is restarted for the clients
+		if err := u.source.StopTempServer(); err != nil {
+			logger.Warnf("failed to stop PostgreSQL %d: %v", u.journal.FromVersion, err)
+		}
+		u.source.Host = ""
+		if err := u.source.Start(); err != nil {
+			logger.Warnf("failed to restart PostgreSQL %d: %v", u.journal.FromVersion, err)
+		}
+	}
+	if u.source.IsRunning() {
+		u.source.dropLogicalUpgradeObjects()
+	}
+	return cause
+}
+
+// isolateSource restarts the old cluster on a private socket, so that no client can write to it while the
+// replication catches up for the last time, and points the subscriptions to that socket
+func (u *logicalUpgrade) isolateSource() error {
+	socketDir := filepath.Join(u.workDir, "cutover")
+	if err := os.Mkdir(socketDir, 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	u.journal.CutoverSocketDir = socketDir
+	if err := u.journal.save(); err != nil {
+		return err
+	}
+
+	// A fast shutdown disconnects the clients and rolls back their open transactions
+	if err := u.source.StopTempServer(); err != nil {
+		return fmt.Errorf("failed to stop PostgreSQL %d: %w", u.journal.FromVersion, err)
+	}
+	u.source.Host = socketDir
+	if _, err := u.source.StartTempServer(TempServerOptions{
+		UnixSocketOnly: true,
+		Settings: map[string]string{
+			"unix_socket_directories": socketDir,
+			"port":                    strconv.Itoa(u.source.Port),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to restart PostgreSQL %d on a private socket: %w", u.journal.FromVersion, err)
+	}
+
+	for _, db := range u.databases {
+		if _, err := u.target.on(db.Name).SQL(fmt.Sprintf("ALTER SUBSCRIPTION %s CONNECTION %s",
+			pq.QuoteIdentifier(logicalUpgradeName), pq.QuoteLiteral(u.conninfo(db)))); err != nil {
+			return fmt.Errorf("failed to point the subscription of %s to the private socket: %w", db.Name, err)
+		}
+	}
+	return nil
+}
+
+// copyGlobals copies roles and tablespaces, the new cluster creates its own subdirectory in each tablespace
+func (u *logicalUpgrade) copyGlobals() error {
+	for _, globals := range []string{"--roles-only", "--tablespaces-only"} {
+		file := filepath.Join(u.workDir, strings.TrimPrefix(globals, "--")+".sql")
+		// The dump is taken with the newer pg_dumpall, which understands the old server
+		if err := u.source.client(u.target.BinDir, "pg_dumpall", globals, "-f", file); err != nil {
+			return err
+		}
+		// Roles that already exist in the new cluster (i.e. postgres) fail to be created, so errors are not fatal
+		if err := u.target.client(u.target.BinDir, "psql", "-X", "-q", "-d", "postgres", "-f", file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *logicalUpgrade) copySchema(db logicalDatabase) error {
+	if db.Name != "postgres" {
+		create := fmt.Sprintf("CREATE DATABASE %s WITH TEMPLATE template0 ENCODING %s LC_COLLATE %s LC_CTYPE %s OWNER %s",
+			pq.QuoteIdentifier(db.Name), pq.QuoteLiteral(db.Encoding), pq.QuoteLiteral(db.Collate),
+			pq.QuoteLiteral(db.Ctype), pq.QuoteIdentifier(db.Owner))
+		if _, err := u.target.SQL(create); err != nil {
+			return err
+		}
+	}
+
+	schema := filepath.Join(u.workDir, db.Slot+".sql")
+	if err := u.source.client(u.target.BinDir, "pg_dump", "--schema-only", "--no-publications", "--no-subscriptions",
+		"-d", db.Name, "-f", schema); err != nil {
+		return err
+	}
+	return u.target.client(u.target.BinDir, "psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-d", db.Name, "-f", schema)
+}
+
+func (u *logicalUpgrade) subscribe(db logicalDatabase) error {
+	name := pq.QuoteIdentifier(logicalUpgradeName)
+	if _, err := u.source.on(db.Name).SQL(fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", name)); err != nil {
+		return err
+	}
+
+	_, err := u.target.on(db.Name).SQL(fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s WITH (slot_name = %s)",
+		name, pq.QuoteLiteral(u.conninfo(db)), name, pq.QuoteLiteral(db.Slot)))
+	return err
+}
+
+// conninfo is the connection string the subscription of db connects to the old cluster with, over its private
+// socket once it is isolated
+func (u *logicalUpgrade) conninfo(db logicalDatabase) string {
+	host := u.source.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return logicalConnInfo(map[string]string{
+		"host":     host,
+		"port":     strconv.Itoa(u.source.Port),
+		"dbname":   db.Name,
+		"user":     u.source.Username,
+		"password": u.source.Password.Value(),
+	})
+}
+
+// waitForReplication polls until every table has been copied and the replication lag is small enough
+// to cut over, or until it is zero when exact is set and the old cluster no longer accepts writes
+func (u *logicalUpgrade) waitForReplication(timeout time.Duration, exact bool) error {
+	var maxLag int64 = 16 * 1024 * 1024
+	if exact {
+		maxLag = 0
+	}
+
+	start := time.Now()
+	lastReport := time.Time{}
+	for {
+		progress, err := u.progress()
+		if err != nil {
+			return err
+		}
+		u.journal.Replication = progress
+		if err := u.journal.save(); err != nil {
+			return err
+		}
+
+		if progress.Synced() && progress.LagBytes <= maxLag {
+			clicky.Infof("✅ Replication caught up: %d/%d tables, lag %d bytes", progress.TablesReady, progress.TablesTotal, progress.LagBytes)
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timed out after %s waiting for replication: %d/%d tables copied, lag %d bytes",
+				timeout, progress.TablesReady, progress.TablesTotal, progress.LagBytes)
+		}
+		if !u.target.IsRunning() {
+			return fmt.Errorf("PostgreSQL %d stopped while replicating", u.journal.ToVersion)
+		}
+		if time.Since(lastReport) > 30*time.Second {
+			clicky.Infof("⏳ Replicating: %d/%d tables copied, lag %d bytes", progress.TablesReady, progress.TablesTotal, progress.LagBytes)
+			lastReport = time.Now()
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (u *logicalUpgrade) progress() (*ReplicationProgress, error) {
+	progress := &ReplicationProgress{
+		Port:      u.target.Port,
+		Databases: u.journal.Replication.Databases,
+		UpdatedAt: time.Now(),
+	}
+
+	var slots []string
+	for _, db := range u.databases {
+		slots = append(slots, db.Slot)
+		rows, err := u.target.on(db.Name).SQL(`SELECT count(*) AS total, count(*) FILTER (WHERE srsubstate = 'r') AS ready
+			FROM pg_subscription_rel r JOIN pg_subscription s ON s.oid = r.srsubid WHERE s.subname = $1
+			AND s.subdbid = (SELECT oid FROM pg_database WHERE datname = current_database())`, logicalUpgradeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query replication state of %s: %w", db.Name, err)
+		}
+		if len(rows) > 0 {
+			progress.TablesTotal += sqlInt64(rows[0]["total"])
+			progress.TablesReady += sqlInt64(rows[0]["ready"])
+		}
+	}
+
+	rows, err := u.source.SQL(`SELECT COALESCE(sum(pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)), 0)::bigint AS lag
+		FROM pg_replication_slots WHERE slot_name = ANY($1)`, pq.Array(slots))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query replication lag: %w", err)
+	}
+	if len(rows) > 0 {
+		progress.LagBytes = sqlInt64(rows[0]["lag"])
+	}
+	return progress, nil
+}
+
+// syncSequences copies sequence values, which are not replicated, once writes have stopped
+func (u *logicalUpgrade) syncSequences(db logicalDatabase) error {
+	sequences, err := u.source.on(db.Name).SQL("SELECT schemaname::text, sequencename::text, last_value FROM pg_sequences WHERE last_value IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	for _, seq := range sequences {
+		name := pq.QuoteIdentifier(fmt.Sprintf("%v", seq["schemaname"])) + "." + pq.QuoteIdentifier(fmt.Sprintf("%v", seq["sequencename"]))
+		if _, err := u.target.on(db.Name).SQL("SELECT setval($1, $2, true)", name, sqlInt64(seq["last_value"])); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// rollbackLogicalReplication undoes the parts of an interrupted logical upgrade that live outside
+// the new cluster's directory, the new cluster itself is removed with the rest of the rollback
+func (p *Postgres) rollbackLogicalReplication(journal *UpgradeJournal) {
+	target := &Postgres{DataDir: journal.NewDataDir(), BinDir: p.resolveBinDir(journal.ToVersion)}
+	if target.IsRunning() {
+		if err := target.StopTempServer(); err != nil {
+			logger.Warnf("failed to stop PostgreSQL %d: %v", journal.ToVersion, err)
+		}
+	}
+
+	// An interrupted cutover leaves the old cluster running on its private socket, out of reach of the clients
+	if journal.CutoverSocketDir != "" {
+		if pidFile, err := readPostmasterPID(p.DataDir); err == nil && pidFile.SocketDir == journal.CutoverSocketDir &&
+			isPostmaster(pidFile.PID, p.DataDir) {
+			source := &Postgres{DataDir: p.DataDir, BinDir: p.resolveBinDir(journal.FromVersion)}
+			if err := source.StopTempServer(); err != nil {
+				logger.Warnf("failed to stop PostgreSQL %d: %v", journal.FromVersion, err)
+			}
+		}
+	}
+
+	clicky.Warnf("⚠️  Publications and replication slots named %s* may remain in PostgreSQL %d, they are removed by the next logical upgrade",
+		logicalUpgradeName, journal.FromVersion)
+}
+
+// ensureLogicalWAL switches wal_level to logical, which requires a restart of the server
+func (p *Postgres) ensureLogicalWAL() error {
+	rows, err := p.SQL("SHOW wal_level")
+	if err != nil {
+		return fmt.Errorf("failed to read wal_level: %w", err)
+	}
+	if len(rows) > 0 && fmt.Sprintf("%v", rows[0]["wal_level"]) == "logical" {
+		return nil
+	}
+
+	clicky.Warnf("⚠️  Restarting PostgreSQL to set wal_level = logical")
+	if _, err := p.SQL("ALTER SYSTEM SET wal_level = logical"); err != nil {
+		return fmt.Errorf("failed to set wal_level: %w", err)
+	}
+	if err := p.Stop(); err != nil {
+		return err
+	}
+	return p.Start()
+}
+
+// checkReplicationCapacity ensures there are enough replication slots and WAL senders for one
+// subscription per database plus the temporary slots used for the initial table copy
+func (p *Postgres) checkReplicationCapacity(databases int) error {
+	rows, err := p.SQL(`SELECT current_setting('max_replication_slots')::int AS max_slots,
+		current_setting('max_wal_senders')::int AS max_senders,
+		(SELECT count(*) FROM pg_replication_slots) AS used_slots`)
+	if err != nil {
+		return fmt.Errorf("failed to read replication settings: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	needed := int64(databases) + 2
+	if free := sqlInt64(rows[0]["max_slots"]) - sqlInt64(rows[0]["used_slots"]); free < needed {
+		return fmt.Errorf("logical upgrade of %d databases needs %d free replication slots but only %d are available, increase max_replication_slots",
+			databases, needed, free)
+	}
+	if senders := sqlInt64(rows[0]["max_senders"]); senders < needed {
+		return fmt.Errorf("logical upgrade of %d databases needs max_wal_senders >= %d (currently %d)", databases, needed, senders)
+	}
+	return nil
+}
+
+func (p *Postgres) logicalDatabases() ([]logicalDatabase, error) {
+	rows, err := p.SQL(`SELECT datname::text, pg_encoding_to_char(encoding)::text AS encoding, datcollate::text, datctype::text,
+		pg_get_userbyid(datdba)::text AS owner, oid::text FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	var databases []logicalDatabase
+	for _, row := range rows {
+		databases = append(databases, logicalDatabase{
+			Name:     fmt.Sprintf("%v", row["datname"]),
+			Encoding: fmt.Sprintf("%v", row["encoding"]),
+			Collate:  fmt.Sprintf("%v", row["datcollate"]),
+			Ctype:    fmt.Sprintf("%v", row["datctype"]),
+			Owner:    fmt.Sprintf("%v", row["owner"]),
+			Slot:     fmt.Sprintf("%s_%v", logicalUpgradeName, row["oid"]),
+		})
+	}
+	return databases, nil
+}
+
+// dropLogicalUpgradeObjects removes publications and replication slots left behind by an interrupted logical upgrade
+func (p *Postgres) dropLogicalUpgradeObjects() {
+	if _, err := p.SQL(`SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots
+		WHERE starts_with(slot_name, $1) AND NOT active`, logicalUpgradeName+"_"); err != nil {
+		logger.Warnf("failed to drop stale replication slots: %v", err)
+	}
+	databases, err := p.connectableDatabases()
+	if err != nil {
+		logger.Warnf("failed to list databases: %v", err)
+		return
+	}
+	for _, database := range databases {
+		if _, err := p.on(database).SQL("DROP PUBLICATION IF EXISTS " + pq.QuoteIdentifier(logicalUpgradeName)); err != nil {
+			logger.Debugf("failed to drop publication in %s: %v", database, err)
+		}
+	}
+}
+
+// on returns a copy of p connected to another database
+func (p *Postgres) on(database string) *Postgres {
+	db := *p
+	db.Database = database
+	return &db
+}
+
+// client runs a client binary such as psql or pg_dump from binDir against p over TCP
+func (p *Postgres) client(binDir, name string, args ...string) error {
+	args = append([]string{"-h", "localhost", "-p", strconv.Itoa(p.Port), "-U", p.Username}, args...)
+	cmd := clicky.Exec(filepath.Join(binDir, name), args...)
+	if !p.Password.IsEmpty() {
+		cmd.Env = map[string]string{"PGPASSWORD": p.Password.Value()}
+	}
+	process := cmd.Run()
+	if process.Err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", name, process.Err, process.Out())
+	}
+	return nil
+}
+
+// logicalConnInfo builds a libpq connection string, quoting every value
+func logicalConnInfo(params map[string]string) string {
+	var parts []string
+	for _, key := range []string{"host", "port", "dbname", "user", "password"} {
+		value, ok := params[key]
+		if !ok || value == "" {
+			continue
+		}
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `'`, `\'`)
+		parts = append(parts, fmt.Sprintf("%s='%s'", key, value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// sqlInt64 converts a numeric value returned by SQL to an int64
+func sqlInt64(value any) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogicalConnInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{
+			name:   "plain values",
+			params: map[string]string{"host": "localhost", "port": "5432", "dbname": "app", "user": "postgres"},
+			want:   "host='localhost' port='5432' dbname='app' user='postgres'",
+		},
+		{
+			name:   "empty password is omitted",
+			params: map[string]string{"host": "localhost", "dbname": "app", "password": ""},
+			want:   "host='localhost' dbname='app'",
+		},
+		{
+			name:   "quotes and backslashes are escaped",
+			params: map[string]string{"dbname": "my db", "password": `it's\secret`},
+			want:   `dbname='my db' password='it\'s\\secret'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logicalConnInfo(tt.params); got != tt.want {
+				t.Errorf("logicalConnInfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogicalUpgradeConnInfo(t *testing.T) {
+	u := &logicalUpgrade{source: &Postgres{Port: 5432, Username: "postgres"}}
+	db := logicalDatabase{Name: "app"}
+	if got, want := u.conninfo(db), "host='localhost' port='5432' dbname='app' user='postgres'"; got != want {
+		t.Errorf("conninfo() = %q, want %q", got, want)
+	}
+
+	// Isolated for the cutover, the old cluster is only reachable over its private socket
+	u.source.Host = "/tmp/postgres-upgrade-1/cutover"
+	if got, want := u.conninfo(db), "host='/tmp/postgres-upgrade-1/cutover' port='5432' dbname='app' user='postgres'"; got != want {
+		t.Errorf("conninfo() = %q, want %q", got, want)
+	}
+}
+
+func TestReplicationProgressSynced(t *testing.T) {
+	tests := []struct {
+		progress ReplicationProgress
+		want     bool
+	}{
+		{ReplicationProgress{}, true},
+		{ReplicationProgress{TablesTotal: 3, TablesReady: 2}, false},
+		{ReplicationProgress{TablesTotal: 3, TablesReady: 3, LagBytes: 1024}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.progress.Synced(); got != tt.want {
+			t.Errorf("%+v Synced() = %v, want %v", tt.progress, got, tt.want)
+		}
+	}
+}
+
+func TestSQLInt64(t *testing.T) {
+	tests := []struct {
+		value any
+		want  int64
+	}{
+		{int64(42), 42},
+		{float64(42), 42},
+		{"1234567890123", 1234567890123},
+		{nil, 0},
+		{"not a number", 0},
+	}
+	for _, tt := range tests {
+		if got := sqlInt64(tt.value); got != tt.want {
+			t.Errorf("sqlInt64(%#v) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupUpgradeKeepsSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 17)
+
+	journal := NewUpgradeJournal(dataDir, 16, 17, 17)
+	journal.Strategy = UpgradeStrategyLogical
+	journal.SnapshotPath = filepath.Join(dataDir, "backups", "data-16")
+	writeFakeCluster(t, journal.RetiredDataDir(), 16)
+	if err := journal.Record(UpgradeStepSwap); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.cleanupUpgrade(journal); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := readPGVersion(journal.SnapshotPath); err != nil || version != 16 {
+		t.Errorf("expected PostgreSQL 16 snapshot in %s, got %d (%v)", journal.SnapshotPath, version, err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "upgrades")); !os.IsNotExist(err) {
+		t.Errorf("expected upgrades directory to be removed, got %v", err)
+	}
+}
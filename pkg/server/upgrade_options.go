@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/text"
+
+	"github.com/flanksource/postgres/pkg/sysinfo"
+)
+
+// UpgradeMode is the pg_upgrade file transfer mode
+type UpgradeMode string
+
+const (
+	// UpgradeModeCopy copies all data files into the new cluster, the old cluster stays usable
+	UpgradeModeCopy UpgradeMode = "copy"
+	// UpgradeModeLink hard links data files, fast and needs no extra space but the old cluster
+	// cannot be started once the new one has been
+	UpgradeModeLink UpgradeMode = "link"
+	// UpgradeModeClone uses reflinks (copy-on-write), only supported on some filesystems
+	UpgradeModeClone UpgradeMode = "clone"
+)
+
+// BackupStrategy controls how the pre-upgrade snapshot in backups/data-N is taken
+type BackupStrategy string
+
+const (
+	BackupStrategyCopy  BackupStrategy = "copy"
+	BackupStrategyClone BackupStrategy = "clone"
+	BackupStrategyNone  BackupStrategy = "none"
+)
+
+// UpgradeStrategy is how the data is moved into the new major version
+type UpgradeStrategy string
+
+const (
+	// UpgradeStrategyPgUpgrade stops the cluster and runs pg_upgrade, downtime grows with the catalog size
+	UpgradeStrategyPgUpgrade UpgradeStrategy = "pg_upgrade"
+	// UpgradeStrategyLogical replicates into a new cluster while the old one keeps serving,
+	// only the cut-over to the new cluster needs downtime
+	UpgradeStrategyLogical UpgradeStrategy = "logical"
+)
+
+// upgradeCatalogOverhead approximates the size of a freshly initialized cluster plus the
+// catalog that pg_upgrade restores into it when data files are linked or cloned
+const upgradeCatalogOverhead = 128 * 1024 * 1024
+
+type UpgradeOptions struct {
+	// Strategy is how the upgrade is performed, defaults to pg_upgrade
+	Strategy UpgradeStrategy
+	// ReplicationPort is the port the new cluster listens on while it is replicating from the old one
+	// with the logical strategy, defaults to the old cluster's port + 1
+	ReplicationPort int
+	// Mode is the pg_upgrade transfer mode, defaults to copy
+	Mode UpgradeMode
+	// Jobs is the number of parallel pg_upgrade jobs, defaults to the detected CPU count
+	Jobs int
+	// Backup is how the pre-upgrade snapshot is taken, defaults to copy
+	Backup BackupStrategy
+	// Stepwise upgrades through every installed major version between the current and target
+	// version instead of jumping directly to the target
+	Stepwise bool
+	// PostUpgrade applies extension updates and reports collation changes once the upgrade completes,
+	// and marks planner statistics for regeneration by RunPostUpgradeAnalyze
+	PostUpgrade bool
+	// Retention prunes older pre-upgrade snapshots and leftover upgrade directories once the upgrade
+	// completes, the zero value keeps everything
+	Retention RetentionPolicy
+}
+
+func (o *UpgradeOptions) applyDefaults() error {
+	switch o.Strategy {
+	case "":
+		o.Strategy = UpgradeStrategyPgUpgrade
+	case UpgradeStrategyPgUpgrade:
+	case UpgradeStrategyLogical:
+		if o.Mode != "" && o.Mode != UpgradeModeCopy {
+			return fmt.Errorf("upgrade mode %s is not supported with the logical strategy", o.Mode)
+		}
+		if o.Stepwise {
+			return fmt.Errorf("stepwise upgrades are not supported with the logical strategy")
+		}
+	default:
+		return fmt.Errorf("invalid upgrade strategy %q, must be one of pg_upgrade, logical", o.Strategy)
+	}
+
+	switch o.Mode {
+	case "":
+		o.Mode = UpgradeModeCopy
+	case UpgradeModeCopy, UpgradeModeLink, UpgradeModeClone:
+	default:
+		return fmt.Errorf("invalid upgrade mode %q, must be one of copy, link, clone", o.Mode)
+	}
+
+	switch o.Backup {
+	case "":
+		o.Backup = BackupStrategyCopy
+	case BackupStrategyCopy, BackupStrategyClone, BackupStrategyNone:
+	default:
+		return fmt.Errorf("invalid backup strategy %q, must be one of copy, clone, none", o.Backup)
+	}
+
+	if o.Jobs <= 0 {
+		o.Jobs = 1
+		if info, err := sysinfo.DetectSystemInfo(); err == nil && info.EffectiveCPUCount() > 0 {
+			o.Jobs = info.EffectiveCPUCount()
+		}
+	}
+	return nil
+}
+
+// pgUpgradeArgs returns the pg_upgrade flags for the transfer mode and parallelism
+func (o UpgradeOptions) pgUpgradeArgs() []string {
+	var args []string
+	switch o.Mode {
+	case UpgradeModeLink:
+		args = append(args, "--link")
+	case UpgradeModeClone:
+		args = append(args, "--clone")
+	}
+	if o.Jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", o.Jobs))
+	}
+	return args
+}
+
+// estimateUpgradeSpace returns the free space in bytes needed to upgrade a cluster of the given size
+func estimateUpgradeSpace(clusterSize int64, opts UpgradeOptions) int64 {
+	var required int64 = upgradeCatalogOverhead
+
+	if opts.Mode == UpgradeModeCopy || opts.Mode == "" {
+		required += clusterSize
+	}
+	// With the logical strategy the old cluster is kept as the snapshot, no copy is taken
+	if (opts.Backup == BackupStrategyCopy || opts.Backup == "") && opts.Strategy != UpgradeStrategyLogical {
+		required += clusterSize
+	}
+
+	// Leave headroom for WAL generated while the new cluster is started and analyzed
+	return required + required/10
+}
+
+// clusterSize is the size of the cluster in the data directory, excluding backups and upgrades
+func clusterSize(dataDir string) (int64, error) {
+	entries, err := dataDirEntries(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, name := range entries {
+		size, err := calculateDirectorySize(filepath.Join(dataDir, name))
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func availableDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats for %s: %w", path, err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// checkSnapshotTablespaces refuses link mode with a pre-upgrade snapshot when the cluster has tablespaces. The
+// snapshot only copies the pg_tblspc links, while pg_upgrade --link hard links the tablespace files into the new
+// cluster, which then changes the files a rollback would restore.
+func (p *Postgres) checkSnapshotTablespaces(opts UpgradeOptions) error {
+	if opts.Mode != UpgradeModeLink || opts.Backup == BackupStrategyNone {
+		return nil
+	}
+	locations, err := tablespaceLocations(p.DataDir)
+	if err != nil {
+		return err
+	}
+	if len(locations) > 0 {
+		return fmt.Errorf("link mode shares the files of %d tablespaces with the new cluster, the pre-upgrade snapshot could not restore them: use --mode=copy or --mode=clone, or --backup-strategy=none to upgrade without rollback",
+			len(locations))
+	}
+	return nil
+}
+
+// checkUpgradeDiskSpace fails before anything is written if the data directory's filesystem
+// cannot hold the new cluster and the snapshot for the chosen mode and backup strategy
+func (p *Postgres) checkUpgradeDiskSpace(opts UpgradeOptions) error {
+	size, err := clusterSize(p.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to calculate cluster size: %w", err)
+	}
+	available, err := availableDiskSpace(p.DataDir)
+	if err != nil {
+		return err
+	}
+
+	required := estimateUpgradeSpace(size, opts)
+	clicky.Infof("💾 Disk space: cluster %s, required %s (mode=%s, backup=%s), available %s",
+		text.HumanizeBytes(uint64(size)), text.HumanizeBytes(uint64(required)), opts.Mode, opts.Backup,
+		text.HumanizeBytes(uint64(available)))
+
+	if available < required {
+		return fmt.Errorf("insufficient disk space in %s: %s required for mode=%s backup=%s, only %s available (consider --link or --backup-strategy=clone|none)",
+			p.DataDir, text.HumanizeBytes(uint64(required)), opts.Mode, opts.Backup, text.HumanizeBytes(uint64(available)))
+	}
+	return nil
+}
+
+// backupDataDirectory snapshots the cluster into backupPath, excluding backups and upgrades.
+// The copy is made into a temporary directory first so that a partial copy never looks valid.
+func (p *Postgres) backupDataDirectory(backupPath string, strategy BackupStrategy) error {
+	if strategy == BackupStrategyNone {
+		clicky.Warnf("⚠️  Skipping pre-upgrade snapshot, rollback will not be possible")
+		return nil
+	}
+
+	entries, err := dataDirEntries(p.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	tmpPath := backupPath + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return fmt.Errorf("failed to remove stale backup %s: %w", tmpPath, err)
+	}
+	if err := os.MkdirAll(tmpPath, 0700); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	args := []string{"-a"}
+	if strategy == BackupStrategyClone {
+		args = append(args, "--reflink=always")
+	}
+	for _, name := range entries {
+		args = append(args, filepath.Join(p.DataDir, name))
+	}
+	args = append(args, tmpPath+string(filepath.Separator))
+
+	if res := clicky.Exec("cp", args...).Run().Result(); res.Error != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("failed to copy data directory: %s", res.Pretty().ANSI())
+	}
+
+	if _, err := readPGVersion(tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("backup is incomplete: %w", err)
+	}
+
+	// Replace any snapshot left over from an earlier attempt only once the new copy is complete
+	if err := os.RemoveAll(backupPath); err != nil {
+		return fmt.Errorf("failed to remove previous backup %s: %w", backupPath, err)
+	}
+	os.Remove(snapshotMetadataPath(backupPath))
+	if err := os.Rename(tmpPath, backupPath); err != nil {
+		return fmt.Errorf("failed to finalize backup: %w", err)
+	}
+	return syncDir(filepath.Dir(backupPath))
+}
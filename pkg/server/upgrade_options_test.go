@@ -0,0 +1,132 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUpgradeOptionsDefaults(t *testing.T) {
+	opts := UpgradeOptions{}
+	if err := opts.applyDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Strategy != UpgradeStrategyPgUpgrade {
+		t.Errorf("expected default strategy pg_upgrade, got %s", opts.Strategy)
+	}
+	if opts.Mode != UpgradeModeCopy {
+		t.Errorf("expected default mode copy, got %s", opts.Mode)
+	}
+	if opts.Backup != BackupStrategyCopy {
+		t.Errorf("expected default backup copy, got %s", opts.Backup)
+	}
+	if opts.Jobs < 1 {
+		t.Errorf("expected jobs to default to the CPU count, got %d", opts.Jobs)
+	}
+
+	invalid := UpgradeOptions{Mode: "move"}
+	if err := invalid.applyDefaults(); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+	invalid = UpgradeOptions{Backup: "tar"}
+	if err := invalid.applyDefaults(); err == nil {
+		t.Error("expected error for invalid backup strategy")
+	}
+	invalid = UpgradeOptions{Strategy: UpgradeStrategyLogical, Mode: UpgradeModeLink}
+	if err := invalid.applyDefaults(); err == nil {
+		t.Error("expected error for link mode with the logical strategy")
+	}
+	invalid = UpgradeOptions{Strategy: UpgradeStrategyLogical, Stepwise: true}
+	if err := invalid.applyDefaults(); err == nil {
+		t.Error("expected error for stepwise with the logical strategy")
+	}
+}
+
+func TestPgUpgradeArgs(t *testing.T) {
+	tests := []struct {
+		opts UpgradeOptions
+		want []string
+	}{
+		{opts: UpgradeOptions{Mode: UpgradeModeCopy, Jobs: 1}, want: nil},
+		{opts: UpgradeOptions{Mode: UpgradeModeLink, Jobs: 4}, want: []string{"--link", "--jobs=4"}},
+		{opts: UpgradeOptions{Mode: UpgradeModeClone, Jobs: 1}, want: []string{"--clone"}},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.pgUpgradeArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pgUpgradeArgs(%+v) = %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateUpgradeSpace(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+	withHeadroom := func(n int64) int64 { return n + n/10 }
+
+	tests := []struct {
+		name string
+		opts UpgradeOptions
+		want int64
+	}{
+		{"copy with copy backup", UpgradeOptions{Mode: UpgradeModeCopy, Backup: BackupStrategyCopy}, withHeadroom(2*gb + upgradeCatalogOverhead)},
+		{"link with copy backup", UpgradeOptions{Mode: UpgradeModeLink, Backup: BackupStrategyCopy}, withHeadroom(gb + upgradeCatalogOverhead)},
+		{"link without backup", UpgradeOptions{Mode: UpgradeModeLink, Backup: BackupStrategyNone}, withHeadroom(upgradeCatalogOverhead)},
+		{"clone with clone backup", UpgradeOptions{Mode: UpgradeModeClone, Backup: BackupStrategyClone}, withHeadroom(upgradeCatalogOverhead)},
+		{"logical keeps the old cluster", UpgradeOptions{Strategy: UpgradeStrategyLogical, Mode: UpgradeModeCopy, Backup: BackupStrategyCopy}, withHeadroom(gb + upgradeCatalogOverhead)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateUpgradeSpace(gb, tt.opts); got != tt.want {
+				t.Errorf("estimateUpgradeSpace() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupDataDirectory(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 16)
+	if err := os.MkdirAll(filepath.Join(dataDir, "upgrades", "17"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(dataDir, "backups", "data-16")
+	// A stale snapshot from an earlier attempt is replaced
+	if err := os.MkdirAll(filepath.Join(backupPath, "stale"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.backupDataDirectory(backupPath, BackupStrategyCopy); err != nil {
+		t.Fatalf("backupDataDirectory failed: %v", err)
+	}
+
+	if version, err := readPGVersion(backupPath); err != nil || version != 16 {
+		t.Errorf("expected PG_VERSION 16 in backup, got %d (%v)", version, err)
+	}
+	if marker := readMarker(t, backupPath); marker != "16" {
+		t.Errorf("unexpected marker %s", marker)
+	}
+	for _, excluded := range []string{"backups", "upgrades", "stale"} {
+		if _, err := os.Stat(filepath.Join(backupPath, excluded)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be excluded from the backup", excluded)
+		}
+	}
+	if _, err := os.Stat(backupPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected temporary backup directory to be removed")
+	}
+}
+
+func TestBackupDataDirectoryNone(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFakeCluster(t, dataDir, 16)
+	backupPath := filepath.Join(dataDir, "backups", "data-16")
+
+	p := &Postgres{DataDir: dataDir}
+	if err := p.backupDataDirectory(backupPath, BackupStrategyNone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+		t.Errorf("expected no backup to be taken")
+	}
+}
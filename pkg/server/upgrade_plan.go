@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/flanksource/postgres/pkg/utils"
+)
+
+var (
+	installedBinDirsOnce sync.Once
+	installedBinDirs     map[int]string
+)
+
+// detectInstalledBinDirs returns utils.DetectInstalledBinDirs, which runs postgres --version in every candidate
+// directory and is therefore only called once per process
+func detectInstalledBinDirs() map[int]string {
+	installedBinDirsOnce.Do(func() {
+		installedBinDirs = utils.DetectInstalledBinDirs()
+	})
+	return installedBinDirs
+}
+
+// InstalledVersions returns the PostgreSQL major versions with binaries installed, in ascending order
+func InstalledVersions() []int {
+	var versions []int
+	for version := range detectInstalledBinDirs() {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// LatestInstalledVersion returns the newest PostgreSQL major version with binaries installed
+func LatestInstalledVersion() (int, error) {
+	versions := InstalledVersions()
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("no PostgreSQL installations found")
+	}
+	return versions[len(versions)-1], nil
+}
+
+// planUpgradePath returns the versions to upgrade through to get from one major version to another.
+// By default pg_upgrade jumps directly to the target, with stepwise every installed major version
+// in between is visited. Both ends must be installed since pg_upgrade needs the old and new binaries.
+func planUpgradePath(from, to int, installed []int, stepwise bool) ([]int, error) {
+	if from >= to {
+		return nil, fmt.Errorf("target version %d must be newer than the current version %d", to, from)
+	}
+
+	available := make(map[int]bool, len(installed))
+	for _, version := range installed {
+		available[version] = true
+	}
+	if !available[from] {
+		return nil, fmt.Errorf("binaries for the current version %d are not installed (installed: %v)", from, installed)
+	}
+	if !available[to] {
+		return nil, fmt.Errorf("binaries for the target version %d are not installed (installed: %v)", to, installed)
+	}
+
+	if !stepwise {
+		return []int{to}, nil
+	}
+
+	var path []int
+	for version := from + 1; version <= to; version++ {
+		if available[version] {
+			path = append(path, version)
+		}
+	}
+	return path, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanUpgradePath(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  int
+		installed []int
+		stepwise  bool
+		want      []int
+		wantErr   bool
+	}{
+		{name: "direct jump", from: 14, to: 17, installed: []int{14, 15, 16, 17}, want: []int{17}},
+		{name: "direct jump without intermediates", from: 14, to: 18, installed: []int{14, 18}, want: []int{18}},
+		{name: "stepwise", from: 14, to: 17, installed: []int{14, 15, 16, 17}, stepwise: true, want: []int{15, 16, 17}},
+		{name: "stepwise skips missing majors", from: 14, to: 18, installed: []int{14, 16, 18}, stepwise: true, want: []int{16, 18}},
+		{name: "stepwise stops at target", from: 15, to: 16, installed: []int{15, 16, 17}, stepwise: true, want: []int{16}},
+		{name: "target not installed", from: 14, to: 17, installed: []int{14, 16}, wantErr: true},
+		{name: "current not installed", from: 14, to: 17, installed: []int{15, 16, 17}, wantErr: true},
+		{name: "downgrade", from: 17, to: 16, installed: []int{16, 17}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planUpgradePath(tt.from, tt.to, tt.installed, tt.stepwise)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planUpgradePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planUpgradePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+	"github.com/lib/pq"
+
+	"github.com/flanksource/postgres/pkg/extensions"
+)
+
+const (
+	// upgradeStatusFile records the outcome of the last upgrade and its post-upgrade phase, it is shown by server status
+	upgradeStatusFile = "upgrade_status.json"
+	// updateExtensionsScript is generated by pg_upgrade in its working directory when extensions need updating,
+	// it is moved into the new cluster so that the post-upgrade phase can apply it once the cluster is started
+	updateExtensionsScript = "update_extensions.sql"
+	// deleteOldClusterScript is generated by pg_upgrade and would delete PGDATA, which holds the new cluster
+	// after the swap, the retired cluster is removed by cleanupUpgrade instead
+	deleteOldClusterScript = "delete_old_cluster.sh"
+)
+
+// UpgradeTaskState is the state of a post-upgrade task
+type UpgradeTaskState string
+
+const (
+	UpgradeTaskPending   UpgradeTaskState = "pending"
+	UpgradeTaskRunning   UpgradeTaskState = "running"
+	UpgradeTaskCompleted UpgradeTaskState = "completed"
+	UpgradeTaskFailed    UpgradeTaskState = "failed"
+	UpgradeTaskSkipped   UpgradeTaskState = "skipped"
+)
+
+type UpgradeTask struct {
+	State      UpgradeTaskState `json:"state"`
+	StartedAt  time.Time        `json:"started_at,omitempty"`
+	FinishedAt time.Time        `json:"finished_at,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+func (t *UpgradeTask) start() {
+	t.State = UpgradeTaskRunning
+	t.StartedAt = time.Now()
+}
+
+func (t *UpgradeTask) finish(err error) {
+	t.FinishedAt = time.Now()
+	if err != nil {
+		t.State = UpgradeTaskFailed
+		t.Error = err.Error()
+		return
+	}
+	t.State = UpgradeTaskCompleted
+	t.Error = ""
+}
+
+// ExtensionUpdate is an ALTER EXTENSION ... UPDATE run by the post-upgrade phase
+type ExtensionUpdate struct {
+	Database    string `json:"database"`
+	Name        string `json:"name"`
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Error       string `json:"error,omitempty"`
+}
+
+// CollationIndex is an index using a collation whose version changed, it may be corrupt and should be reindexed
+type CollationIndex struct {
+	Database        string `json:"database"`
+	Table           string `json:"table"`
+	Index           string `json:"index"`
+	Collation       string `json:"collation"`
+	RecordedVersion string `json:"recorded_version"`
+	ActualVersion   string `json:"actual_version"`
+}
+
+// UpgradeStatus is persisted to PGDATA after an upgrade completes
+type UpgradeStatus struct {
+	FromVersion int       `json:"from_version"`
+	ToVersion   int       `json:"to_version"`
+	UpgradedAt  time.Time `json:"upgraded_at"`
+
+	// ExtensionScript applies the update_extensions.sql generated by pg_upgrade
+	ExtensionScript  UpgradeTask       `json:"extension_script"`
+	ExtensionUpdates []ExtensionUpdate `json:"extension_updates,omitempty"`
+	Collations       UpgradeTask       `json:"collations"`
+	CollationIndexes []CollationIndex  `json:"collation_indexes,omitempty"`
+	// Analyze runs vacuumdb --analyze-in-stages in the background once the server is started
+	Analyze UpgradeTask `json:"analyze"`
+
+	dataDir string
+}
+
+// LoadUpgradeStatus reads the status of the last upgrade, returning nil if the cluster was never upgraded
+func LoadUpgradeStatus(dataDir string) (*UpgradeStatus, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, upgradeStatusFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade status: %w", err)
+	}
+
+	var status UpgradeStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse upgrade status %s: %w", filepath.Join(dataDir, upgradeStatusFile), err)
+	}
+	status.dataDir = dataDir
+	return &status, nil
+}
+
+func (s *UpgradeStatus) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgrade status: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.dataDir, upgradeStatusFile), data); err != nil {
+		return fmt.Errorf("failed to write upgrade status: %w", err)
+	}
+	return nil
+}
+
+// collectUpgradeScripts picks up the scripts pg_upgrade leaves in its working directory
+func collectUpgradeScripts(workDir, newDataDir string) error {
+	if err := os.Remove(filepath.Join(workDir, deleteOldClusterScript)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", deleteOldClusterScript, err)
+	}
+
+	script := filepath.Join(workDir, updateExtensionsScript)
+	data, err := os.ReadFile(script)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", script, err)
+	}
+	// The working directory may be on a different filesystem than PGDATA, so copy rather than rename
+	if err := os.WriteFile(filepath.Join(newDataDir, updateExtensionsScript), data, 0600); err != nil {
+		return fmt.Errorf("failed to save %s: %w", updateExtensionsScript, err)
+	}
+	return os.Remove(script)
+}
+
+// finalizeUpgrade runs the post-upgrade phase against the upgraded cluster: the extension update
+// script generated by pg_upgrade is applied, registry extensions are updated to their default
+// version and indexes on collations whose version changed are reported. Planner statistics are
+// left to RunPostUpgradeAnalyze, which the supervisor runs once the server accepts connections.
+func (p *Postgres) finalizeUpgrade(status *UpgradeStatus) error {
+	cluster := p.WithoutAuth()
+	cluster.Port = p.Port
+
+	if err := cluster.Start(); err != nil {
+		return fmt.Errorf("failed to start upgraded cluster: %w", err)
+	}
+	defer func() {
+		if err := cluster.Stop(); err != nil {
+			logger.Warnf("failed to stop upgraded cluster after post-upgrade phase: %v", err)
+		}
+	}()
+
+	script := filepath.Join(p.DataDir, updateExtensionsScript)
+	if _, err := os.Stat(script); err == nil {
+		clicky.Infof("🧩 Applying %s", updateExtensionsScript)
+		status.ExtensionScript.start()
+		err := cluster.runScript(script)
+		status.ExtensionScript.finish(err)
+		if err == nil {
+			os.Remove(script)
+		}
+	} else {
+		status.ExtensionScript.State = UpgradeTaskSkipped
+	}
+
+	databases, err := cluster.connectableDatabases()
+	if err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	for _, database := range databases {
+		db := cluster.WithoutAuth()
+		db.Port = cluster.Port
+		db.Database = database
+		status.ExtensionUpdates = append(status.ExtensionUpdates, db.updateRegistryExtensions()...)
+	}
+
+	status.Collations.start()
+	var collationErr error
+	for _, database := range databases {
+		db := cluster.WithoutAuth()
+		db.Port = cluster.Port
+		db.Database = database
+		indexes, err := db.collationChangedIndexes(status.ToVersion)
+		if err != nil {
+			collationErr = fmt.Errorf("%s: %w", database, err)
+			continue
+		}
+		status.CollationIndexes = append(status.CollationIndexes, indexes...)
+	}
+	status.Collations.finish(collationErr)
+
+	for _, update := range status.ExtensionUpdates {
+		if update.Error != "" {
+			clicky.Warnf("⚠️  Failed to update extension %s in %s: %s", update.Name, update.Database, update.Error)
+		} else {
+			clicky.Infof("🧩 Updated extension %s in %s from %s to %s", update.Name, update.Database, update.FromVersion, update.ToVersion)
+		}
+	}
+	for _, index := range status.CollationIndexes {
+		clicky.Warnf("⚠️  Index %s on %s in %s uses collation %s which changed from %s to %s, run REINDEX INDEX %s",
+			index.Index, index.Table, index.Database, index.Collation, index.RecordedVersion, index.ActualVersion, index.Index)
+	}
+
+	status.Analyze.State = UpgradeTaskPending
+	return nil
+}
+
+// runScript runs a psql script such as update_extensions.sql, which may \connect to other databases
+func (p *Postgres) runScript(path string) error {
+	args := []string{"-X", "-v", "ON_ERROR_STOP=1", "-h", "localhost", "-d", "postgres", "-f", path}
+	if p.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(p.Port))
+	}
+	process := clicky.Exec(filepath.Join(p.BinDir, "psql"), args...).Run()
+	if process.Err != nil {
+		return fmt.Errorf("psql -f %s failed: %w, output: %s", path, process.Err, process.Out())
+	}
+	return nil
+}
+
+// connectableDatabases lists the databases accepting connections, name columns are cast to text in the queries
+// of this file as lib/pq returns them as raw bytes
+func (p *Postgres) connectableDatabases() ([]string, error) {
+	results, err := p.SQL("SELECT datname::text FROM pg_database WHERE datallowconn ORDER BY datname")
+	if err != nil {
+		return nil, err
+	}
+	var databases []string
+	for _, row := range results {
+		databases = append(databases, fmt.Sprintf("%v", row["datname"]))
+	}
+	return databases, nil
+}
+
+// updateRegistryExtensions updates the registry extensions installed in p.Database whose version
+// differs from the default version shipped with the new binaries
+func (p *Postgres) updateRegistryExtensions() []ExtensionUpdate {
+	results, err := p.SQL(`SELECT e.extname::text, e.extversion, a.default_version
+		FROM pg_extension e JOIN pg_available_extensions a ON a.name = e.extname
+		WHERE e.extversion IS DISTINCT FROM a.default_version ORDER BY e.extname`)
+	if err != nil {
+		return []ExtensionUpdate{{Database: p.Database, Error: err.Error()}}
+	}
+
+	registry := extensions.GetDefaultRegistry()
+	var updates []ExtensionUpdate
+	for _, row := range results {
+		name := fmt.Sprintf("%v", row["extname"])
+		if _, ok := registry.GetBySQL(name); !ok {
+			continue
+		}
+		update := ExtensionUpdate{
+			Database:    p.Database,
+			Name:        name,
+			FromVersion: fmt.Sprintf("%v", row["extversion"]),
+			ToVersion:   fmt.Sprintf("%v", row["default_version"]),
+		}
+		if _, err := p.SQL(fmt.Sprintf("ALTER EXTENSION %s UPDATE", pq.QuoteIdentifier(name))); err != nil {
+			update.Error = err.Error()
+		}
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+// collationChangedIndexes returns the indexes in p.Database that use a collation whose version
+// recorded in the catalog no longer matches the version provided by the operating system
+func (p *Postgres) collationChangedIndexes(version int) ([]CollationIndex, error) {
+	query := `SELECT DISTINCT i.indrelid::regclass::text AS table_name, i.indexrelid::regclass::text AS index_name,
+		c.collname::text, c.collversion AS recorded_version, pg_collation_actual_version(c.oid) AS actual_version
+		FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indcollation::oid[]) AS coll(oid)
+		JOIN pg_collation c ON c.oid = coll.oid
+		WHERE c.collversion IS NOT NULL AND c.collversion IS DISTINCT FROM pg_collation_actual_version(c.oid)`
+
+	// The database default collation is versioned in pg_database from PostgreSQL 15
+	if version >= 15 {
+		query += `
+		UNION
+		SELECT DISTINCT i.indrelid::regclass::text, i.indexrelid::regclass::text,
+			'default', d.datcollversion, pg_database_collation_actual_version(d.oid)
+		FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indcollation::oid[]) AS coll(oid)
+		JOIN pg_database d ON d.datname = current_database()
+		WHERE coll.oid = 100 AND d.datcollversion IS NOT NULL
+			AND d.datcollversion IS DISTINCT FROM pg_database_collation_actual_version(d.oid)`
+	}
+
+	results, err := p.SQL(query + " ORDER BY 1, 2")
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []CollationIndex
+	for _, row := range results {
+		indexes = append(indexes, CollationIndex{
+			Database:        p.Database,
+			Table:           fmt.Sprintf("%v", row["table_name"]),
+			Index:           fmt.Sprintf("%v", row["index_name"]),
+			Collation:       fmt.Sprintf("%v", row["collname"]),
+			RecordedVersion: fmt.Sprintf("%v", row["recorded_version"]),
+			ActualVersion:   fmt.Sprintf("%v", row["actual_version"]),
+		})
+	}
+	return indexes, nil
+}
+
+// RunPostUpgradeAnalyze regenerates planner statistics after an upgrade with
+// vacuumdb --all --analyze-in-stages. It waits up to timeout for the server to accept
+// connections and records progress in the upgrade status, it does nothing if no analyze is pending.
+func (p *Postgres) RunPostUpgradeAnalyze(timeout time.Duration) error {
+	status, err := LoadUpgradeStatus(p.DataDir)
+	if err != nil || status == nil || status.Analyze.State != UpgradeTaskPending {
+		return err
+	}
+	if err := p.ensureBinDir(); err != nil {
+		return err
+	}
+
+	args := []string{"-h", "localhost"}
+	if p.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(p.Port))
+	}
+	if p.Username != "" {
+		args = append(args, "-U", p.Username)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if p.IsRunning() && clicky.Exec(filepath.Join(p.BinDir, "pg_isready"), args...).Run().Err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for PostgreSQL to accept connections")
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	status.Analyze.start()
+	if err := status.save(); err != nil {
+		return err
+	}
+
+	vacuumdb := clicky.Exec(filepath.Join(p.BinDir, "vacuumdb"), append(args, "--all", "--analyze-in-stages")...)
+	if !p.Password.IsEmpty() {
+		vacuumdb.Env = map[string]string{"PGPASSWORD": p.Password.Value()}
+	}
+	process := vacuumdb.Run()
+	if process.Err != nil {
+		err = fmt.Errorf("vacuumdb failed: %w, output: %s", process.Err, process.Out())
+	}
+	status.Analyze.finish(err)
+	if saveErr := status.save(); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpgradeStatusRoundTrip(t *testing.T) {
+	dataDir := t.TempDir()
+
+	status, err := LoadUpgradeStatus(dataDir)
+	if err != nil || status != nil {
+		t.Fatalf("expected no status for a cluster that was never upgraded, got %+v (%v)", status, err)
+	}
+
+	status = &UpgradeStatus{FromVersion: 14, ToVersion: 17, UpgradedAt: time.Now(), dataDir: dataDir}
+	status.ExtensionScript.start()
+	status.ExtensionScript.finish(nil)
+	status.Collations.start()
+	status.Collations.finish(errors.New("permission denied"))
+	status.Analyze.State = UpgradeTaskPending
+	status.CollationIndexes = []CollationIndex{{Database: "app", Index: "users_name_idx", Collation: "default"}}
+	if err := status.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadUpgradeStatus(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.FromVersion != 14 || loaded.ToVersion != 17 {
+		t.Errorf("unexpected versions: %+v", loaded)
+	}
+	if loaded.ExtensionScript.State != UpgradeTaskCompleted {
+		t.Errorf("expected extension script completed, got %s", loaded.ExtensionScript.State)
+	}
+	if loaded.Collations.State != UpgradeTaskFailed || loaded.Collations.Error != "permission denied" {
+		t.Errorf("expected collation check failed, got %+v", loaded.Collations)
+	}
+	if loaded.Analyze.State != UpgradeTaskPending {
+		t.Errorf("expected analyze pending, got %s", loaded.Analyze.State)
+	}
+	if len(loaded.CollationIndexes) != 1 {
+		t.Errorf("expected 1 collation index, got %d", len(loaded.CollationIndexes))
+	}
+}
+
+func TestCollectUpgradeScripts(t *testing.T) {
+	workDir := t.TempDir()
+	newDataDir := t.TempDir()
+
+	files := map[string]string{
+		deleteOldClusterScript: "rm -rf /var/lib/postgresql/data\n",
+		updateExtensionsScript: "\\connect app\nALTER EXTENSION \"vector\" UPDATE;\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := collectUpgradeScripts(workDir, newDataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(workDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed from the working directory", name)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(newDataDir, updateExtensionsScript))
+	if err != nil {
+		t.Fatalf("expected %s in the new cluster: %v", updateExtensionsScript, err)
+	}
+	if string(data) != files[updateExtensionsScript] {
+		t.Errorf("unexpected script content: %q", data)
+	}
+
+	// Nothing to collect when pg_upgrade did not generate any scripts
+	if err := collectUpgradeScripts(t.TempDir(), newDataDir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunPostUpgradeAnalyzeNotPending(t *testing.T) {
+	dataDir := t.TempDir()
+	p := &Postgres{DataDir: dataDir}
+
+	if err := p.RunPostUpgradeAnalyze(time.Millisecond); err != nil {
+		t.Errorf("expected no-op without an upgrade status, got %v", err)
+	}
+
+	status := &UpgradeStatus{FromVersion: 16, ToVersion: 17, Analyze: UpgradeTask{State: UpgradeTaskCompleted}, dataDir: dataDir}
+	if err := status.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RunPostUpgradeAnalyze(time.Millisecond); err != nil {
+		t.Errorf("expected no-op when analyze already completed, got %v", err)
+	}
+}
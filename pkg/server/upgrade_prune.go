@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/properties"
+	"github.com/flanksource/commons/text"
+)
+
+// UpgradeArtifactKind distinguishes pre-upgrade snapshots from directories left behind by failed upgrades
+type UpgradeArtifactKind string
+
+const (
+	UpgradeArtifactSnapshot UpgradeArtifactKind = "snapshot"
+	UpgradeArtifactLeftover UpgradeArtifactKind = "leftover"
+)
+
+// UpgradeArtifact is a directory in backups/ or upgrades/ that takes space on the data volume
+type UpgradeArtifact struct {
+	Kind    UpgradeArtifactKind `json:"kind"`
+	Version int                 `json:"version,omitempty"`
+	Path    string              `json:"path"`
+	Size    int64               `json:"size" pretty:"format=bytes"`
+	Created time.Time           `json:"created"`
+	Age     string              `json:"age"`
+	Prune   bool                `json:"prune"`
+	Reason  string              `json:"reason"`
+	// WAL and tablespace directories outside PGDATA that only this snapshot uses
+	ExternalPaths []string `json:"external_paths,omitempty"`
+}
+
+// RetentionPolicy decides which pre-upgrade snapshots are kept, a zero value keeps everything
+type RetentionPolicy struct {
+	// Keep is the number of snapshots to keep, newest version first (0 = no limit)
+	Keep int
+	// MaxAge prunes snapshots older than this (0 = no limit)
+	MaxAge time.Duration
+}
+
+// DefaultRetentionPolicy keeps the snapshot of the latest upgrade, it can be changed with the
+// upgrade.backups.keep and upgrade.backups.max-age properties
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		Keep:   properties.Int(1, "upgrade.backups.keep"),
+		MaxAge: properties.Duration(0, "upgrade.backups.max-age"),
+	}
+}
+
+func (r RetentionPolicy) String() string {
+	keep, maxAge := "all", "unlimited"
+	if r.Keep > 0 {
+		keep = fmt.Sprint(r.Keep)
+	}
+	if r.MaxAge > 0 {
+		maxAge = r.MaxAge.String()
+	}
+	return fmt.Sprintf("keep=%s max-age=%s", keep, maxAge)
+}
+
+// ListUpgradeArtifacts returns the pre-upgrade snapshots and leftover upgrade directories, marking
+// the ones that the retention policy would prune. Nothing is pruned while an upgrade is in progress.
+func (p *Postgres) ListUpgradeArtifacts(policy RetentionPolicy) ([]UpgradeArtifact, error) {
+	journal, err := LoadUpgradeJournal(p.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := p.ListUpgradeSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	artifacts := retainSnapshots(snapshots, policy, journal != nil, time.Now())
+
+	// Partial snapshot copies are never valid, they are replaced by the next backup attempt anyway
+	partial, err := filepath.Glob(filepath.Join(p.DataDir, "backups", "data-*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range partial {
+		artifacts = append(artifacts, leftoverArtifact(path, journal == nil, "incomplete snapshot copy"))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(p.DataDir, "upgrades"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read upgrades directory: %w", err)
+	}
+	for _, entry := range entries {
+		artifacts = append(artifacts, leftoverArtifact(filepath.Join(p.DataDir, "upgrades", entry.Name()), journal == nil, "left over from an earlier upgrade"))
+	}
+
+	if err := p.resolveSnapshotExternalPaths(artifacts); err != nil {
+		return nil, err
+	}
+	for i := range artifacts {
+		artifacts[i].Age = formatRelativeTime(artifacts[i].Created)
+	}
+	return artifacts, nil
+}
+
+// retainSnapshots applies the retention policy to snapshots sorted by version, newest first
+func retainSnapshots(snapshots []UpgradeSnapshot, policy RetentionPolicy, inProgress bool, now time.Time) []UpgradeArtifact {
+	var artifacts []UpgradeArtifact
+	for i, snapshot := range snapshots {
+		artifact := UpgradeArtifact{
+			Kind:    UpgradeArtifactSnapshot,
+			Version: snapshot.Version,
+			Path:    snapshot.Path,
+			Size:    snapshot.Size,
+			Created: snapshot.Created,
+			Reason:  "within retention",
+		}
+		switch {
+		case inProgress:
+			artifact.Reason = "upgrade in progress"
+		case policy.Keep > 0 && i >= policy.Keep:
+			artifact.Prune = true
+			artifact.Reason = fmt.Sprintf("exceeds keep=%d", policy.Keep)
+		case policy.MaxAge > 0 && now.Sub(snapshot.Created) > policy.MaxAge:
+			artifact.Prune = true
+			artifact.Reason = fmt.Sprintf("older than %s", policy.MaxAge)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts
+}
+
+func leftoverArtifact(path string, prune bool, reason string) UpgradeArtifact {
+	artifact := UpgradeArtifact{Kind: UpgradeArtifactLeftover, Path: path, Prune: prune, Reason: reason}
+	if stat, err := os.Stat(path); err == nil {
+		artifact.Created = stat.ModTime()
+	}
+	artifact.Size, _ = calculateDirectorySize(path)
+	if !prune {
+		artifact.Reason = "upgrade in progress"
+	}
+	return artifact
+}
+
+// resolveSnapshotExternalPaths finds the external WAL and tablespace directories of the snapshots that
+// will be pruned, excluding those still used by the current cluster or by a snapshot that is kept
+func (p *Postgres) resolveSnapshotExternalPaths(artifacts []UpgradeArtifact) error {
+	if !slices.ContainsFunc(artifacts, func(a UpgradeArtifact) bool { return a.Kind == UpgradeArtifactSnapshot && a.Prune }) {
+		return nil
+	}
+	version, err := readPGVersion(p.DataDir)
+	if err != nil {
+		return err
+	}
+	inUse, err := clusterExternalPaths(p.DataDir, version)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if artifact.Kind == UpgradeArtifactSnapshot && !artifact.Prune {
+			paths, err := clusterExternalPaths(artifact.Path, artifact.Version)
+			if err != nil {
+				return err
+			}
+			inUse = append(inUse, paths...)
+		}
+	}
+
+	for i, artifact := range artifacts {
+		if artifact.Kind != UpgradeArtifactSnapshot || !artifact.Prune {
+			continue
+		}
+		paths, err := clusterExternalPaths(artifact.Path, artifact.Version)
+		if err != nil {
+			// A snapshot with dangling links still has to be prunable
+			continue
+		}
+		for _, path := range paths {
+			if !slices.Contains(inUse, path) {
+				artifacts[i].ExternalPaths = append(artifacts[i].ExternalPaths, path)
+			}
+		}
+	}
+	return nil
+}
+
+// PruneUpgradeArtifacts deletes the snapshots and leftover upgrade directories the retention policy
+// selects, together with the directories outside PGDATA that only they use, and returns what was listed
+func (p *Postgres) PruneUpgradeArtifacts(policy RetentionPolicy) ([]UpgradeArtifact, error) {
+	artifacts, err := p.ListUpgradeArtifacts(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var freed int64
+	for _, artifact := range artifacts {
+		if !artifact.Prune {
+			continue
+		}
+		if p.DryRun {
+			clicky.Infof("[DRYRUN] would remove %s (%s)", artifact.Path, artifact.Reason)
+			continue
+		}
+		clicky.Infof("🧹 Removing %s %s (%s, %s)", artifact.Kind, artifact.Path, text.HumanizeBytes(uint64(artifact.Size)), artifact.Reason)
+		if err := os.RemoveAll(artifact.Path); err != nil {
+			return artifacts, fmt.Errorf("failed to remove %s: %w", artifact.Path, err)
+		}
+		if artifact.Kind == UpgradeArtifactSnapshot {
+			os.Remove(snapshotMetadataPath(artifact.Path))
+		}
+		if err := removeExternalPaths(artifact.ExternalPaths); err != nil {
+			return artifacts, err
+		}
+		freed += artifact.Size
+	}
+
+	if !p.DryRun {
+		removeIfEmpty(filepath.Join(p.DataDir, "upgrades"))
+		removeIfEmpty(filepath.Join(p.DataDir, "backups"))
+		if freed > 0 {
+			clicky.Infof("✅ Freed %s", text.HumanizeBytes(uint64(freed)))
+		}
+	}
+	return artifacts, nil
+}
+
+// WarnUpgradeArtifactUsage warns when snapshots and leftover upgrade directories take more than
+// maxPercent of the data volume, returning their share of it
+func (p *Postgres) WarnUpgradeArtifactUsage(maxPercent int) (float64, error) {
+	artifacts, err := p.ListUpgradeArtifacts(RetentionPolicy{})
+	if err != nil || len(artifacts) == 0 {
+		return 0, err
+	}
+
+	var size int64
+	for _, artifact := range artifacts {
+		size += artifact.Size
+	}
+	total, err := totalDiskSpace(p.DataDir)
+	if err != nil || total == 0 {
+		return 0, err
+	}
+
+	share := float64(size) * 100 / float64(total)
+	if maxPercent > 0 && share > float64(maxPercent) {
+		clicky.Warnf("⚠️  Upgrade snapshots and leftovers use %s (%.0f%% of the volume, more than %d%%), run 'postgres-cli server upgrade prune' to free space",
+			text.HumanizeBytes(uint64(size)), share, maxPercent)
+	}
+	return share, nil
+}
+
+func totalDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats for %s: %w", path, err)
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetainSnapshots(t *testing.T) {
+	now := time.Now()
+	snapshots := []UpgradeSnapshot{
+		{Version: 16, Path: "backups/data-16", Created: now.Add(-time.Hour)},
+		{Version: 15, Path: "backups/data-15", Created: now.Add(-10 * 24 * time.Hour)},
+		{Version: 14, Path: "backups/data-14", Created: now.Add(-40 * 24 * time.Hour)},
+	}
+
+	tests := []struct {
+		name       string
+		policy     RetentionPolicy
+		inProgress bool
+		pruned     []int
+	}{
+		{name: "keep everything"},
+		{name: "keep newest", policy: RetentionPolicy{Keep: 1}, pruned: []int{15, 14}},
+		{name: "keep two", policy: RetentionPolicy{Keep: 2}, pruned: []int{14}},
+		{name: "max age", policy: RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, pruned: []int{14}},
+		{name: "keep and max age", policy: RetentionPolicy{Keep: 2, MaxAge: 7 * 24 * time.Hour}, pruned: []int{15, 14}},
+		{name: "upgrade in progress", policy: RetentionPolicy{Keep: 1}, inProgress: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifacts := retainSnapshots(snapshots, tt.policy, tt.inProgress, now)
+			if len(artifacts) != len(snapshots) {
+				t.Fatalf("expected %d artifacts, got %d", len(snapshots), len(artifacts))
+			}
+			var pruned []int
+			for _, artifact := range artifacts {
+				if artifact.Prune {
+					pruned = append(pruned, artifact.Version)
+				}
+			}
+			if !reflect.DeepEqual(pruned, tt.pruned) {
+				t.Errorf("expected %v to be pruned, got %v", tt.pruned, pruned)
+			}
+		})
+	}
+}
+
+func TestPruneUpgradeArtifactsLeftovers(t *testing.T) {
+	for _, inProgress := range []bool{false, true} {
+		name := "no journal"
+		if inProgress {
+			name = "upgrade in progress"
+		}
+		t.Run(name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			writeFakeCluster(t, dataDir, 17)
+			leftovers := []string{
+				filepath.Join(dataDir, "upgrades", "16-old"),
+				filepath.Join(dataDir, "backups", "data-16.tmp"),
+			}
+			for _, dir := range leftovers {
+				writeFakeCluster(t, dir, 16)
+			}
+			if inProgress {
+				if err := NewUpgradeJournal(dataDir, 17, 18, 18).Record(UpgradeStepInitDB); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &Postgres{DataDir: dataDir}
+			artifacts, err := p.PruneUpgradeArtifacts(RetentionPolicy{Keep: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(artifacts) != len(leftovers) {
+				t.Fatalf("expected %d artifacts, got %+v", len(leftovers), artifacts)
+			}
+			for _, artifact := range artifacts {
+				if artifact.Kind != UpgradeArtifactLeftover || artifact.Prune == inProgress || artifact.Size == 0 {
+					t.Errorf("unexpected artifact %+v", artifact)
+				}
+			}
+			for _, dir := range leftovers {
+				assertExists(t, dir, inProgress)
+			}
+			if marker := readMarker(t, dataDir); marker != "17" {
+				t.Errorf("expected cluster to be untouched, got marker %s", marker)
+			}
+		})
+	}
+}
+
+func TestResolveSnapshotExternalPaths(t *testing.T) {
+	root := layoutRoot(t)
+	dataDir := filepath.Join(root, "data")
+	writeFakeCluster(t, dataDir, 17)
+	writeExternalLayout(t, dataDir, root, filepath.Join(root, "wal", "pg_wal-17"), 17)
+
+	// data-15 used the original WAL directory, data-16 shares the tablespace but has its own WAL
+	old := filepath.Join(dataDir, "backups", "data-15")
+	writeFakeCluster(t, old, 15)
+	writeExternalLayout(t, old, root, filepath.Join(root, "wal", "pg_wal"), 15)
+	kept := filepath.Join(dataDir, "backups", "data-16")
+	writeFakeCluster(t, kept, 16)
+	writeExternalLayout(t, kept, root, filepath.Join(root, "wal", "pg_wal-16"), 16)
+
+	artifacts := []UpgradeArtifact{
+		{Kind: UpgradeArtifactSnapshot, Version: 16, Path: kept},
+		{Kind: UpgradeArtifactSnapshot, Version: 15, Path: old, Prune: true},
+	}
+	p := &Postgres{DataDir: dataDir}
+	if err := p.resolveSnapshotExternalPaths(artifacts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(artifacts[0].ExternalPaths) != 0 {
+		t.Errorf("expected no external paths for a kept snapshot, got %v", artifacts[0].ExternalPaths)
+	}
+	want := []string{filepath.Join(root, "tblspc", catalogVersions[15]), filepath.Join(root, "wal", "pg_wal")}
+	if !reflect.DeepEqual(artifacts[1].ExternalPaths, want) {
+		t.Errorf("expected %v, got %v", want, artifacts[1].ExternalPaths)
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/postgres/pkg/config"
+)
+
+// UpgradeStepRestore copies a pre-upgrade snapshot into upgrades/<version> before it is swapped in
+const UpgradeStepRestore UpgradeStep = "restore"
+
+// UpgradeSnapshotMetadata is written next to a backups/data-N snapshot once the upgrade completes
+type UpgradeSnapshotMetadata struct {
+	FromVersion int       `json:"from_version"`
+	ToVersion   int       `json:"to_version"`
+	UpgradedAt  time.Time `json:"upgraded_at"`
+	// Latest checkpoint of the new cluster once the post-upgrade tasks stopped it, the WAL written after it is
+	// checked for changes by a rollback
+	CheckpointLSN    string `json:"checkpoint_lsn"`
+	SystemIdentifier string `json:"system_identifier,omitempty"`
+}
+
+// UpgradeSnapshot is a copy of the data directory taken before an upgrade
+type UpgradeSnapshot struct {
+	Version      int                      `json:"version"`
+	Path         string                   `json:"path"`
+	Size         int64                    `json:"size" pretty:"format=bytes"`
+	Created      time.Time                `json:"created"`
+	ClusterState string                   `json:"cluster_state,omitempty"`
+	Valid        bool                     `json:"valid"`
+	Error        string                   `json:"error,omitempty"`
+	Metadata     *UpgradeSnapshotMetadata `json:"metadata,omitempty"`
+}
+
+type RollbackOptions struct {
+	// Version to roll back to, defaults to the newest valid snapshot older than the current version
+	Version int
+	// Force rolls back even if WAL was written after the upgrade, discarding those changes
+	Force bool
+}
+
+func snapshotMetadataPath(snapshotPath string) string {
+	return snapshotPath + ".json"
+}
+
+// writeSnapshotMetadata records the state of the freshly upgraded cluster alongside the snapshot
+func (p *Postgres) writeSnapshotMetadata(snapshotPath string, fromVersion, toVersion int) error {
+	newCluster := &Postgres{DataDir: p.DataDir, BinDir: p.resolveBinDir(toVersion)}
+	controlData, err := newCluster.GetControlData()
+	if err != nil {
+		return fmt.Errorf("failed to read control data of upgraded cluster: %w", err)
+	}
+
+	meta := UpgradeSnapshotMetadata{
+		FromVersion:      fromVersion,
+		ToVersion:        toVersion,
+		UpgradedAt:       time.Now(),
+		CheckpointLSN:    controlData.LatestCheckpointLocation,
+		SystemIdentifier: controlData.DatabaseSystemIdentifier,
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(snapshotMetadataPath(snapshotPath), data, 0600)
+}
+
+// ListUpgradeSnapshots returns the snapshots in backups/data-N, validating each one with
+// pg_controldata from the matching version's binaries
+func (p *Postgres) ListUpgradeSnapshots() ([]UpgradeSnapshot, error) {
+	matches, err := filepath.Glob(filepath.Join(p.DataDir, "backups", "data-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []UpgradeSnapshot
+	for _, path := range matches {
+		if stat, err := os.Stat(path); err != nil || !stat.IsDir() {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "data-"))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, p.inspectSnapshot(path, version))
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Version > snapshots[j].Version
+	})
+	return snapshots, nil
+}
+
+func (p *Postgres) inspectSnapshot(path string, version int) UpgradeSnapshot {
+	snapshot := UpgradeSnapshot{Version: version, Path: path}
+	if stat, err := os.Stat(path); err == nil {
+		snapshot.Created = stat.ModTime()
+	}
+	snapshot.Size, _ = calculateDirectorySize(path)
+
+	if data, err := os.ReadFile(snapshotMetadataPath(path)); err == nil {
+		var meta UpgradeSnapshotMetadata
+		if err := json.Unmarshal(data, &meta); err == nil {
+			snapshot.Metadata = &meta
+		}
+	}
+
+	if pgVersion, err := readPGVersion(path); err != nil {
+		snapshot.Error = err.Error()
+		return snapshot
+	} else if pgVersion != version {
+		snapshot.Error = fmt.Sprintf("PG_VERSION is %d, expected %d", pgVersion, version)
+		return snapshot
+	}
+
+	binDir := p.resolveBinDir(version)
+	process := (&Postgres{DataDir: path, BinDir: binDir}).bin("pg_controldata", "-D", path).Run()
+	if process.Err != nil {
+		snapshot.Error = fmt.Sprintf("pg_controldata from %s failed: %v", binDir, process.Err)
+		return snapshot
+	}
+	controlData, err := config.ParseControlData(process.GetStdout())
+	if err != nil {
+		snapshot.Error = fmt.Sprintf("failed to parse control data: %v", err)
+		return snapshot
+	}
+
+	snapshot.ClusterState = controlData.DatabaseClusterState
+	if controlData.DatabaseClusterState != "shut down" {
+		snapshot.Error = fmt.Sprintf("cluster was not cleanly shut down (state: %s)", controlData.DatabaseClusterState)
+		return snapshot
+	}
+	snapshot.Valid = true
+	return snapshot
+}
+
+// Rollback swaps a pre-upgrade snapshot back into PGDATA and starts the old version
+func (p *Postgres) Rollback(opts RollbackOptions) error {
+	if err := p.RecoverUpgrade(); err != nil {
+		return fmt.Errorf("failed to recover interrupted upgrade: %w", err)
+	}
+
+	currentVersion, err := p.DetectVersion()
+	if err != nil {
+		return fmt.Errorf("failed to detect current PostgreSQL version: %w", err)
+	}
+
+	snapshots, err := p.ListUpgradeSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("no snapshots found in %s", filepath.Join(p.DataDir, "backups"))
+	}
+	clicky.MustPrint(snapshots)
+
+	var snapshot *UpgradeSnapshot
+	for i := range snapshots {
+		s := &snapshots[i]
+		if s.Version >= currentVersion {
+			continue
+		}
+		if (opts.Version == 0 && s.Valid) || s.Version == opts.Version {
+			snapshot = s
+			break
+		}
+	}
+	if snapshot == nil {
+		if opts.Version != 0 {
+			return fmt.Errorf("no snapshot of PostgreSQL %d older than the current version %d found", opts.Version, currentVersion)
+		}
+		return fmt.Errorf("no valid snapshot older than the current version %d found", currentVersion)
+	}
+	if !snapshot.Valid {
+		return fmt.Errorf("snapshot %s is not usable: %s", snapshot.Path, snapshot.Error)
+	}
+
+	// The control data of a running server is only as recent as its last checkpoint, the WAL is checked up to the
+	// shutdown checkpoint
+	running := p.IsRunning()
+	if running && !p.DryRun {
+		if err := p.Stop(); err != nil {
+			return fmt.Errorf("failed to stop PostgreSQL before rollback: %w", err)
+		}
+	}
+	if running && p.DryRun {
+		clicky.Warnf("⚠️  [DRYRUN] PostgreSQL is running, the WAL written since the upgrade is only checked once it is stopped")
+	} else if err := checkWALSinceUpgrade(snapshot, p.DataDir, p.resolveBinDir(currentVersion), opts.Force); err != nil {
+		if running {
+			if startErr := p.Start(); startErr != nil {
+				clicky.Warnf("⚠️  Failed to restart PostgreSQL %d: %v", currentVersion, startErr)
+			}
+		}
+		return err
+	}
+
+	clicky.Infof("↩️  Rolling back PostgreSQL %d to snapshot %s", currentVersion, snapshot.Path)
+
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] restoring %s into %s", snapshot.Path, p.DataDir)
+		return nil
+	}
+
+	journal := NewUpgradeJournal(p.DataDir, currentVersion, snapshot.Version, snapshot.Version)
+	if err := journal.Record(UpgradeStepRestore); err != nil {
+		return err
+	}
+
+	restoreDir := journal.NewDataDir()
+	if err := os.RemoveAll(restoreDir); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to clean up %s: %w", restoreDir, err))
+	}
+	if err := os.MkdirAll(filepath.Dir(restoreDir), 0700); err != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to create upgrade directory: %w", err))
+	}
+	if res := clicky.Exec("cp", "-a", snapshot.Path, restoreDir).Run().Result(); res.Error != nil {
+		return p.abortUpgrade(journal, fmt.Errorf("failed to copy snapshot: %s", res.Pretty().ANSI()))
+	}
+	if journal.RetiredPaths, err = retiredExternalPaths(p.DataDir, currentVersion, restoreDir, snapshot.Version); err != nil {
+		return p.abortUpgrade(journal, err)
+	}
+
+	if err := journal.Record(UpgradeStepSwap); err != nil {
+		return err
+	}
+	if err := p.swapDataDirectories(journal); err != nil {
+		return fmt.Errorf("failed to swap snapshot into the data directory, it will be resumed on next start: %w", err)
+	}
+	if err := p.cleanupUpgrade(journal); err != nil {
+		return err
+	}
+
+	p.BinDir = p.resolveBinDir(snapshot.Version)
+	clicky.Infof("✅ Restored PostgreSQL %d from %s", snapshot.Version, snapshot.Path)
+
+	return p.Start()
+}
+
+// checkWALSinceUpgrade refuses a rollback that would discard changes made after the upgrade, the cluster in
+// dataDir must be stopped
+func checkWALSinceUpgrade(snapshot *UpgradeSnapshot, dataDir, binDir string, force bool) error {
+	if snapshot.Metadata == nil || snapshot.Metadata.CheckpointLSN == "" {
+		if force {
+			clicky.Warnf("⚠️  No upgrade metadata for %s, cannot tell whether data was written after the upgrade", snapshot.Path)
+			return nil
+		}
+		return fmt.Errorf("no upgrade metadata for %s, cannot verify that no data was written after the upgrade (use --force to roll back anyway)", snapshot.Path)
+	}
+
+	current := &Postgres{DataDir: dataDir, BinDir: binDir}
+	controlData, err := current.GetControlData()
+	if err != nil {
+		return fmt.Errorf("failed to read control data of current cluster: %w", err)
+	}
+
+	upgradedLSN, err := parseLSN(snapshot.Metadata.CheckpointLSN)
+	if err != nil {
+		return err
+	}
+	currentLSN, err := parseLSN(controlData.LatestCheckpointLocation)
+	if err != nil {
+		return err
+	}
+	if currentLSN <= upgradedLSN {
+		return nil
+	}
+
+	// Every start and stop writes WAL, e.g. a shutdown checkpoint, only the records changing data count
+	var msg string
+	if controlData.DatabaseClusterState != "shut down" {
+		msg = fmt.Sprintf("PostgreSQL %d was not shut down cleanly (state: %s), cannot verify that no data was written after the upgrade",
+			snapshot.Metadata.ToVersion, controlData.DatabaseClusterState)
+	} else if records, err := current.walDataChanges(snapshot.Metadata.CheckpointLSN, controlData.LatestCheckpointLocation,
+		controlData.LatestCheckpointTimeLineID); err != nil {
+		msg = fmt.Sprintf("cannot verify that no data was written after the upgrade: %v", err)
+	} else if len(records) == 0 {
+		return nil
+	} else {
+		msg = fmt.Sprintf("%d WAL records changing data were written after the upgrade to PostgreSQL %d (checkpoint %s → %s, first: %s), rolling back discards those changes",
+			len(records), snapshot.Metadata.ToVersion, snapshot.Metadata.CheckpointLSN, controlData.LatestCheckpointLocation, records[0])
+	}
+	if !force {
+		return fmt.Errorf("%s (use --force to roll back anyway)", msg)
+	}
+	clicky.Warnf("⚠️  %s", msg)
+	return nil
+}
+
+var (
+	// walRecordPattern matches a record printed by pg_waldump, e.g.
+	// rmgr: Heap len (rec/tot): 54/254, tx: 735, lsn: 0/0301A2D8, prev 0/0301A2A0, desc: INSERT off: 3, blkref #0: rel 1663/5/16384 blk 0
+	walRecordPattern = regexp.MustCompile(`^rmgr: (\S+)\s.*desc: (.*)$`)
+	walBlockRef      = regexp.MustCompile(`rel \d+/\d+/(\d+)`)
+	// statisticsRelations are the files of pg_statistic, pg_statistic_ext_data and their indexes in a cluster
+	// created by initdb, ANALYZE writes to them
+	statisticsRelations = map[string]bool{"2619": true, "2696": true, "3429": true, "3433": true}
+)
+
+// walDataChanges returns the records that change data in the WAL between from and to, read with pg_waldump
+func (p *Postgres) walDataChanges(from, to string, timeline int) ([]string, error) {
+	args := []string{"--path", filepath.Join(p.DataDir, "pg_wal"), "--start", from, "--end", to}
+	if timeline > 0 {
+		args = append(args, "--timeline", strconv.Itoa(timeline))
+	}
+	process := clicky.Exec(filepath.Join(p.BinDir, "pg_waldump"), args...).Run()
+	if process.Err != nil {
+		return nil, fmt.Errorf("pg_waldump failed: %w, output: %s", process.Err, process.Out())
+	}
+	return walDataRecords(process.GetStdout()), nil
+}
+
+// walDataRecords returns the records of pg_waldump output that change data. Checkpoints, WAL switches, commits,
+// snapshots of the running transactions and hint bit page images are also written when no client writes, and the
+// statistics regenerated by the post-upgrade ANALYZE are regenerated again after a rollback.
+func walDataRecords(output string) []string {
+	var records []string
+	for _, line := range strings.Split(output, "\n") {
+		match := walRecordPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		rmgr, desc := match[1], match[2]
+		switch rmgr {
+		case "XLOG":
+			if !strings.HasPrefix(desc, "FPI") || strings.HasPrefix(desc, "FPI_FOR_HINT") {
+				continue
+			}
+		case "Transaction", "Standby", "CLOG", "CommitTs":
+			continue
+		}
+		if statisticsOnly(rmgr, desc) {
+			continue
+		}
+		records = append(records, strings.TrimSpace(line))
+	}
+	return records
+}
+
+// statisticsOnly returns whether a record only writes statistics, ANALYZE also updates the row counts in
+// pg_class (1259) in place
+func statisticsOnly(rmgr, desc string) bool {
+	refs := walBlockRef.FindAllStringSubmatch(desc, -1)
+	if len(refs) == 0 {
+		return false
+	}
+	for _, ref := range refs {
+		if !statisticsRelations[ref[1]] && (ref[1] != "1259" || rmgr != "Heap" || !strings.HasPrefix(desc, "INPLACE")) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLSN converts a WAL location such as 0/16B3748 into a byte position
+func parseLSN(lsn string) (uint64, error) {
+	hi, lo, ok := strings.Cut(strings.TrimSpace(lsn), "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN: %q", lsn)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %q", lsn)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %q", lsn)
+	}
+	return h<<32 | l, nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		lsn     string
+		want    uint64
+		wantErr bool
+	}{
+		{lsn: "0/0", want: 0},
+		{lsn: "0/16B3748", want: 0x16B3748},
+		{lsn: "1/0", want: 1 << 32},
+		{lsn: " 2/A0000028\n", want: 2<<32 | 0xA0000028},
+		{lsn: "", wantErr: true},
+		{lsn: "16B3748", wantErr: true},
+		{lsn: "0/XYZ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lsn, func(t *testing.T) {
+			got, err := parseLSN(tt.lsn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLSN(%q) error = %v, wantErr %v", tt.lsn, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseLSN(%q) = %d, want %d", tt.lsn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUpgradeSnapshotsRejectsInvalid(t *testing.T) {
+	dataDir := t.TempDir()
+
+	// PG_VERSION does not match the directory name
+	writeFakeCluster(t, filepath.Join(dataDir, "backups", "data-15"), 14)
+	// Empty snapshot, as left behind by a backup that silently failed
+	if err := os.MkdirAll(filepath.Join(dataDir, "backups", "data-16"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Not a snapshot
+	if err := os.MkdirAll(filepath.Join(dataDir, "backups", "data-latest"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Postgres{DataDir: dataDir}
+	snapshots, err := p.ListUpgradeSnapshots()
+	if err != nil {
+		t.Fatalf("ListUpgradeSnapshots failed: %v", err)
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d: %+v", len(snapshots), snapshots)
+	}
+	if snapshots[0].Version != 16 || snapshots[1].Version != 15 {
+		t.Errorf("expected snapshots sorted newest first, got %d, %d", snapshots[0].Version, snapshots[1].Version)
+	}
+	for _, s := range snapshots {
+		if s.Valid {
+			t.Errorf("expected snapshot %s to be invalid", s.Path)
+		}
+		if s.Error == "" {
+			t.Errorf("expected an error for snapshot %s", s.Path)
+		}
+	}
+}
+
+// fakeWALTools prints the control data and WAL records stored next to them, and records the pg_waldump arguments
+const fakeWALTools = `#!/bin/sh
+dir=$(dirname "$0")
+case "$(basename "$0")" in
+pg_controldata) cat "$dir/controldata" ;;
+pg_waldump) echo "$@" > "$dir/args"; cat "$dir/waldump" ;;
+esac
+`
+
+// walAfterRestart is the WAL of an upgraded cluster that was started and stopped a few times, and analyzed
+const walAfterRestart = `rmgr: XLOG        len (rec/tot):    114/   114, tx:          0, lsn: 0/03000028, prev 0/02000110, desc: CHECKPOINT_SHUTDOWN redo 0/3000028; tli 1; prev tli 1; fpw true; wal_level replica; xid 0:740; oid 16384; shutdown
+rmgr: XLOG        len (rec/tot):     54/    54, tx:          0, lsn: 0/030000A0, prev 0/03000028, desc: PARAMETER_CHANGE max_connections=200 max_worker_processes=8 wal_level=replica
+rmgr: Standby     len (rec/tot):     50/    50, tx:          0, lsn: 0/030000D8, prev 0/030000A0, desc: RUNNING_XACTS nextXid 740 latestCompletedXid 739 oldestRunningXid 740
+rmgr: Heap        len (rec/tot):     54/  2854, tx:        740, lsn: 0/03000110, prev 0/030000D8, desc: INSERT off: 5, flags: 0x00, blkref #0: rel 1663/5/2619 blk 18 FPW
+rmgr: Btree       len (rec/tot):     64/  2144, tx:        740, lsn: 0/03000C38, prev 0/03000110, desc: INSERT_LEAF off: 100, blkref #0: rel 1663/5/2696 blk 1 FPW
+rmgr: Heap        len (rec/tot):    188/   188, tx:          0, lsn: 0/030014A0, prev 0/03000C38, desc: INPLACE off: 12, blkref #0: rel 1663/5/1259 blk 3
+rmgr: XLOG        len (rec/tot):     49/  8193, tx:          0, lsn: 0/03001560, prev 0/030014A0, desc: FPI_FOR_HINT , blkref #0: rel 1663/5/1247 blk 0 FPW
+rmgr: Transaction len (rec/tot):     34/    34, tx:        740, lsn: 0/03003578, prev 0/03001560, desc: COMMIT 2025-01-01 00:00:00.000000 UTC
+rmgr: XLOG        len (rec/tot):    114/   114, tx:          0, lsn: 0/030035A0, prev 0/03003578, desc: CHECKPOINT_SHUTDOWN redo 0/30035A0; tli 1; prev tli 1; fpw true; wal_level replica; xid 0:741; oid 16384; shutdown
+`
+
+func TestCheckWALSinceUpgrade(t *testing.T) {
+	insert := "rmgr: Heap        len (rec/tot):     59/    59, tx:        741, lsn: 0/03003618, prev 0/030035A0, desc: INSERT+INIT off: 1, flags: 0x00, blkref #0: rel 1663/5/16384 blk 0\n"
+	tests := []struct {
+		name  string
+		state string
+		wal   string
+		force bool
+		err   string
+	}{
+		{name: "restarted", state: "shut down", wal: walAfterRestart},
+		{name: "data written", state: "shut down", wal: walAfterRestart + insert, err: "1 WAL records changing data"},
+		{name: "data written with force", state: "shut down", wal: walAfterRestart + insert, force: true},
+		{name: "crashed", state: "in production", wal: walAfterRestart, err: "not shut down cleanly"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			binDir := filepath.Join(dir, "bin")
+			if err := os.MkdirAll(binDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"pg_controldata", "pg_waldump"} {
+				if err := os.WriteFile(filepath.Join(binDir, name), []byte(fakeWALTools), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			controlData := "Database cluster state:               " + tt.state + "\n" +
+				"Latest checkpoint location:           0/30035A0\n" +
+				"Latest checkpoint's TimeLineID:       1\n"
+			if err := os.WriteFile(filepath.Join(binDir, "controldata"), []byte(controlData), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(binDir, "waldump"), []byte(tt.wal), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot := &UpgradeSnapshot{Path: filepath.Join(dir, "backups", "data-16"),
+				Metadata: &UpgradeSnapshotMetadata{FromVersion: 16, ToVersion: 17, CheckpointLSN: "0/3000028"}}
+			err := checkWALSinceUpgrade(snapshot, filepath.Join(dir, "data"), binDir, tt.force)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			args, _ := os.ReadFile(filepath.Join(binDir, "args"))
+			if expected := "--path " + filepath.Join(dir, "data", "pg_wal") + " --start 0/3000028 --end 0/30035A0 --timeline 1\n"; string(args) != expected {
+				t.Errorf("expected pg_waldump %q, got %q", expected, args)
+			}
+		})
+	}
+}
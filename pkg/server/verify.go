@@ -0,0 +1,437 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/commons/properties"
+
+	"github.com/flanksource/postgres/pkg"
+)
+
+// VerifyOptions controls what VerifyBackup restores and checks
+type VerifyOptions struct {
+	// Backup is a backup directory or archive, or the name of a WAL-G base backup, the latest one when empty
+	Backup string
+	// BackupDir is searched for the latest complete logical backup
+	BackupDir string
+	// WalG verifies a WAL-G base backup instead of a logical backup
+	WalG *pkg.WalgConf
+	// Databases to restore from a logical backup, all of them when empty
+	Databases []string
+	// Assertions are queries that must return true once the backup is restored
+	Assertions []Assertion
+	// Amcheck checks the indexes and tables of the restored databases with the amcheck extension
+	Amcheck bool
+	// ScratchDir is where the temporary cluster is created, the system temporary directory when empty
+	ScratchDir string
+	// Keep leaves the temporary cluster in ScratchDir when the verification fails
+	Keep bool
+	// Jobs is the number of tables restored in parallel from a logical backup
+	Jobs int
+	// Timeout bounds the recovery of a WAL-G base backup
+	Timeout time.Duration
+}
+
+// DefaultVerifyOptions verifies the latest backup under the backup.dir property with amcheck, the recovery of a
+// WAL-G backup can take up to the backup.verify.timeout property
+func DefaultVerifyOptions() VerifyOptions {
+	return VerifyOptions{
+		BackupDir: properties.String("backups", "backup.dir"),
+		Amcheck:   true,
+		Jobs:      1,
+		Timeout:   properties.Duration(time.Hour, "backup.verify.timeout"),
+	}
+}
+
+// Assertion is a query that must return a single true value, e.g. SELECT count(*) > 1000 FROM orders
+type Assertion struct {
+	// Database to run the query in, the restored database when a single one is restored, otherwise postgres
+	Database string `json:"database,omitempty"`
+	SQL      string `json:"sql"`
+}
+
+var assertionDatabase = regexp.MustCompile(`^([A-Za-z0-9_.-]+):\s+`)
+
+// ParseAssertion parses a query optionally prefixed by its database, e.g. "orders: SELECT count(*) > 0 FROM orders"
+func ParseAssertion(assertion string) Assertion {
+	if matches := assertionDatabase.FindStringSubmatch(assertion); matches != nil {
+		return Assertion{Database: matches[1], SQL: strings.TrimSpace(assertion[len(matches[0]):])}
+	}
+	return Assertion{SQL: strings.TrimSpace(assertion)}
+}
+
+// VerifyResult is the outcome of VerifyBackup
+type VerifyResult struct {
+	Backup          string        `json:"backup"`
+	Type            string        `json:"type"`
+	Passed          bool          `json:"passed"`
+	Checks          []VerifyCheck `json:"checks"`
+	DurationSeconds float64       `json:"duration_seconds"`
+}
+
+// VerifyCheck is a step of VerifyBackup
+type VerifyCheck struct {
+	Name            string  `json:"name"`
+	Passed          bool    `json:"passed"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Message         string  `json:"message,omitempty"`
+}
+
+// check runs a step of the verification and records its outcome and duration
+func (r *VerifyResult) check(name string, fn func() (string, error)) bool {
+	start := time.Now()
+	message, err := fn()
+	check := VerifyCheck{Name: name, Passed: err == nil, Message: message, DurationSeconds: time.Since(start).Seconds()}
+	if err != nil {
+		check.Message = err.Error()
+		clicky.Warnf("❌ %s: %v", name, err)
+	} else {
+		clicky.Infof("✅ %s (%s)", name, time.Since(start).Round(time.Millisecond))
+	}
+	r.Checks = append(r.Checks, check)
+	return err == nil
+}
+
+// VerifyBackup restores a backup into a temporary cluster that only listens on a private socket, runs the
+// assertions and amcheck against it, and removes it. A logical backup is restored with RestoreWithOptions into a
+// new cluster, a WAL-G base backup is fetched and recovered up to its consistent point. The backup is usable
+// when the result has passed.
+func (p *Postgres) VerifyBackup(opts VerifyOptions) (*VerifyResult, error) {
+	if err := p.ensureBinDir(); err != nil {
+		return nil, fmt.Errorf("failed to resolve binary directory: %w", err)
+	}
+	result := &VerifyResult{Backup: opts.Backup, Type: "logical"}
+	if opts.WalG != nil {
+		result.Type = "wal-g"
+		if result.Backup == "" {
+			result.Backup = "LATEST"
+		}
+	} else if result.Backup == "" {
+		backups, err := ListBackups(opts.BackupDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(backups) == 0 {
+			return nil, fmt.Errorf("no complete backup in %s", opts.BackupDir)
+		}
+		result.Backup = backups[len(backups)-1]
+	}
+	if p.DryRun {
+		clicky.Infof("[DRYRUN] skipping verification of %s", result.Backup)
+		return result, nil
+	}
+
+	scratch, err := os.MkdirTemp(opts.ScratchDir, "postgres-verify-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	username := p.Username
+	if username == "" {
+		username = "postgres"
+	}
+	temp := &Postgres{
+		BinDir:   p.BinDir,
+		DataDir:  filepath.Join(scratch, "data"),
+		Host:     filepath.Join(scratch, "socket"),
+		Port:     5432,
+		Username: username,
+		Database: "postgres",
+	}
+	clicky.Infof("🧪 Verifying %s in %s", result.Backup, scratch)
+
+	start := time.Now()
+	verifyInto(temp, scratch, result, opts)
+	result.DurationSeconds = time.Since(start).Seconds()
+
+	if temp.IsRunning() {
+		if err := temp.StopTempServer(); err != nil {
+			logger.Warnf("failed to stop the temporary server: %v", err)
+		}
+	}
+	if !result.Passed && opts.Keep {
+		clicky.Infof("Keeping the temporary cluster in %s", scratch)
+	} else if err := os.RemoveAll(scratch); err != nil {
+		logger.Warnf("failed to remove %s: %v", scratch, err)
+	}
+	return result, nil
+}
+
+// verifyInto restores the backup into temp and runs the checks, result has passed when all of them did
+func verifyInto(temp *Postgres, scratch string, result *VerifyResult, opts VerifyOptions) {
+	settings := map[string]string{"unix_socket_directories": temp.Host, "port": "5432"}
+	if err := os.Mkdir(temp.Host, 0700); err != nil {
+		result.check("prepare", func() (string, error) { return "", err })
+		return
+	}
+
+	var databases []string
+	steps := logicalVerifySteps(temp, settings, result, opts, &databases)
+	if opts.WalG != nil {
+		steps = walgVerifySteps(temp, scratch, settings, result, opts, &databases)
+	}
+	for _, step := range steps {
+		if !result.check(step.name, step.run) {
+			return
+		}
+	}
+
+	passed := true
+	if opts.Amcheck {
+		for _, database := range databases {
+			passed = result.check("amcheck "+database, func() (string, error) { return temp.amcheck(database) }) && passed
+		}
+	}
+	for _, assertion := range opts.Assertions {
+		if assertion.Database == "" {
+			assertion.Database = "postgres"
+			if opts.WalG == nil && len(databases) == 1 {
+				assertion.Database = databases[0]
+			}
+		}
+		passed = result.check(fmt.Sprintf("assert %s: %s", assertion.Database, assertion.SQL), func() (string, error) {
+			return "", temp.assert(assertion)
+		}) && passed
+	}
+	result.Passed = passed
+}
+
+// verifyStep is a step restoring the backup, the verification stops at the first one that fails
+type verifyStep struct {
+	name string
+	run  func() (string, error)
+}
+
+// logicalVerifySteps restore a logical backup into a new cluster and return the restored databases
+func logicalVerifySteps(temp *Postgres, settings map[string]string, result *VerifyResult, opts VerifyOptions, databases *[]string) []verifyStep {
+	return []verifyStep{
+		{"initdb", func() (string, error) {
+			return "", temp.InitDBWithOptions(InitDBOptions{Username: temp.Username, InitDBArgs: "--encoding=UTF8 --no-locale"})
+		}},
+		{"start", func() (string, error) {
+			_, err := temp.StartTempServer(TempServerOptions{UnixSocketOnly: true, Settings: settings})
+			return "", err
+		}},
+		{"restore", func() (string, error) {
+			restore := DefaultRestoreOptions()
+			restore.Databases, restore.Jobs, restore.Analyze = opts.Databases, opts.Jobs, false
+			summary, err := temp.RestoreWithOptions(result.Backup, restore)
+			if err != nil {
+				return "", err
+			}
+			for _, database := range summary.Databases {
+				*databases = append(*databases, database.Target)
+			}
+			return fmt.Sprintf("%d databases restored", len(summary.Databases)), nil
+		}},
+	}
+}
+
+// walgVerifySteps fetch a WAL-G base backup, recover it and return all its databases
+func walgVerifySteps(temp *Postgres, scratch string, settings map[string]string, result *VerifyResult, opts VerifyOptions, databases *[]string) []verifyStep {
+	walg := pkg.NewWalG(opts.WalG)
+	return []verifyStep{
+		{"fetch", func() (string, error) {
+			return "", walg.BackupFetch(result.Backup, temp.DataDir)
+		}},
+		{"recover", func() (string, error) {
+			if err := prepareWalgRecovery(temp.DataDir, scratch, walg.Environment()); err != nil {
+				return "", err
+			}
+			// The backup brings the configuration of the original server, archiving must not push the WAL of the
+			// temporary cluster into the same repository
+			settings["archive_mode"] = "off"
+			settings["ssl"] = "off"
+			settings["hba_file"] = filepath.Join(scratch, "pg_hba.conf")
+			if _, err := temp.StartTempServer(TempServerOptions{UnixSocketOnly: true, Settings: settings}); err != nil {
+				return "", err
+			}
+			return "", temp.waitForPromotion(opts.Timeout)
+		}},
+		{"list databases", func() (string, error) {
+			var err error
+			*databases, err = temp.connectableDatabases()
+			return strings.Join(*databases, ", "), err
+		}},
+	}
+}
+
+// prepareWalgRecovery configures a fetched WAL-G base backup to replay its WAL with wal-g wal-fetch up to the
+// consistent point and promote, with its own pg_hba.conf allowing local connections without a password
+func prepareWalgRecovery(dataDir, scratch string, env []string) error {
+	envFile := filepath.Join(scratch, "walg.env")
+	if err := os.WriteFile(envFile, []byte(shellEnvFile(env)), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", envFile, err)
+	}
+	if err := os.WriteFile(filepath.Join(scratch, "pg_hba.conf"), []byte("local all all trust\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write pg_hba.conf: %w", err)
+	}
+	for _, name := range []string{"postmaster.pid", "standby.signal"} {
+		if err := os.Remove(filepath.Join(dataDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery.signal: %w", err)
+	}
+	autoConf, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = autoConf.WriteString(walgRecoverySettings(envFile))
+	if closeErr := autoConf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write recovery settings: %w", err)
+	}
+	return os.Chmod(dataDir, 0700)
+}
+
+// walgRecoverySettings returns the postgresql.auto.conf settings recovering a WAL-G base backup
+func walgRecoverySettings(envFile string) string {
+	return fmt.Sprintf("\n# Added by backup verify\nrestore_command = %s\nrecovery_target = 'immediate'\nrecovery_target_action = 'promote'\n",
+		quoteSetting(walgCommand(envFile, `wal-fetch "%f" "%p"`)))
+}
+
+// shellEnvFile returns a script exporting env, a list of NAME=value
+func shellEnvFile(env []string) string {
+	var script strings.Builder
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		fmt.Fprintf(&script, "export %s=%s\n", name, shellQuote(value))
+	}
+	return script.String()
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// waitForPromotion waits until a server recovering up to recovery_target = 'immediate' has been promoted
+func (p *Postgres) waitForPromotion(timeout time.Duration) error {
+	db, err := p.GetConnection()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		var recovery bool
+		err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&recovery)
+		if err == nil && !recovery {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("recovery did not finish within %s: %w", timeout, err)
+			}
+			return fmt.Errorf("recovery did not finish within %s", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+const amcheckIndexesQuery = `SELECT c.oid::regclass::text FROM pg_index i
+JOIN pg_class c ON c.oid = i.indexrelid
+JOIN pg_am am ON am.oid = c.relam
+WHERE am.amname = 'btree' AND i.indisready AND i.indisvalid AND c.relpersistence <> 't'
+ORDER BY 1`
+
+const amcheckTablesQuery = `SELECT c.oid::regclass::text FROM pg_class c
+WHERE c.relkind IN ('r', 'm', 't') AND c.relpersistence <> 't'
+ORDER BY 1`
+
+// amcheck checks the B-tree indexes of database with bt_index_check, including that every table row is indexed,
+// and its tables with verify_heapam on PostgreSQL 14+. Databases without the amcheck extension are skipped.
+func (p *Postgres) amcheck(database string) (string, error) {
+	db, err := p.on(database).GetConnection()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS amcheck"); err != nil {
+		clicky.Warnf("⚠️  amcheck is not available in %s: %v", database, err)
+		return "skipped, amcheck is not available", nil
+	}
+
+	var failures []string
+	indexes, err := queryStrings(db, amcheckIndexesQuery)
+	if err != nil {
+		return "", err
+	}
+	for _, index := range indexes {
+		if _, err := db.Exec("SELECT bt_index_check($1::regclass, true)", index); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", index, err))
+		}
+	}
+
+	var tables []string
+	var heapam bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'verify_heapam')").Scan(&heapam); err != nil {
+		return "", err
+	}
+	if heapam {
+		if tables, err = queryStrings(db, amcheckTablesQuery); err != nil {
+			return "", err
+		}
+		for _, table := range tables {
+			var corrupt int
+			if err := db.QueryRow("SELECT count(*) FROM verify_heapam($1::regclass)", table).Scan(&corrupt); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", table, err))
+			} else if corrupt > 0 {
+				failures = append(failures, fmt.Sprintf("%s: %d corrupt tuples", table, corrupt))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("%d corrupt relations: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return fmt.Sprintf("%d indexes and %d tables checked", len(indexes), len(tables)), nil
+}
+
+func queryStrings(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// assert runs the query of an assertion, which passes when it returns a single true value
+func (p *Postgres) assert(assertion Assertion) error {
+	db, err := p.on(assertion.Database).GetConnection()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var value sql.NullBool
+	if err := db.QueryRow(assertion.SQL).Scan(&value); err == sql.ErrNoRows {
+		return fmt.Errorf("the query returned no rows")
+	} else if err != nil {
+		return err
+	}
+	if !value.Valid {
+		return fmt.Errorf("the query returned NULL")
+	}
+	if !value.Bool {
+		return fmt.Errorf("the query returned false")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		assertion string
+		expected  Assertion
+	}{
+		{assertion: "orders: SELECT count(*) > 0 FROM orders", expected: Assertion{Database: "orders", SQL: "SELECT count(*) > 0 FROM orders"}},
+		{assertion: "  SELECT 1::int = 1 ", expected: Assertion{SQL: "SELECT 1::int = 1"}},
+		{assertion: "SELECT now() > '2025-01-01 00:00:00'", expected: Assertion{SQL: "SELECT now() > '2025-01-01 00:00:00'"}},
+		{assertion: "app-v2:\tSELECT true", expected: Assertion{Database: "app-v2", SQL: "SELECT true"}},
+	}
+	for _, tt := range tests {
+		if assertion := ParseAssertion(tt.assertion); assertion != tt.expected {
+			t.Errorf("%q: expected %+v, got %+v", tt.assertion, tt.expected, assertion)
+		}
+	}
+}
+
+func TestPrepareWalgRecovery(t *testing.T) {
+	scratch := t.TempDir()
+	dataDir := filepath.Join(scratch, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"postgresql.auto.conf": "work_mem = '8MB'\n", "standby.signal": ""} {
+		if err := os.WriteFile(filepath.Join(dataDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := prepareWalgRecovery(dataDir, scratch, []string{"WALG_S3_PREFIX=s3://backups/db", "AWS_SECRET_ACCESS_KEY=it's=secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env, _ := os.ReadFile(filepath.Join(scratch, "walg.env"))
+	if expected := "export WALG_S3_PREFIX='s3://backups/db'\nexport AWS_SECRET_ACCESS_KEY='it'\\''s=secret'\n"; string(env) != expected {
+		t.Errorf("expected env file\n%s\ngot\n%s", expected, env)
+	}
+	if info, _ := os.Stat(filepath.Join(scratch, "walg.env")); info.Mode().Perm() != 0600 {
+		t.Errorf("expected the env file to be private, got %v", info.Mode())
+	}
+	autoConf, _ := os.ReadFile(filepath.Join(dataDir, "postgresql.auto.conf"))
+	for _, expected := range []string{
+		"work_mem = '8MB'\n",
+		"restore_command = '. ''" + filepath.Join(scratch, "walg.env") + `'' && exec wal-g wal-fetch "%f" "%p"'`,
+		"recovery_target = 'immediate'\n",
+		"recovery_target_action = 'promote'\n",
+	} {
+		if !strings.Contains(string(autoConf), expected) {
+			t.Errorf("expected postgresql.auto.conf to contain %q, got\n%s", expected, autoConf)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "recovery.signal")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "standby.signal")); !os.IsNotExist(err) {
+		t.Error("expected standby.signal to be removed")
+	}
+	if info, _ := os.Stat(dataDir); info.Mode().Perm() != 0700 {
+		t.Errorf("expected the data directory to be private, got %v", info.Mode())
+	}
+}
@@ -0,0 +1,140 @@
+package supervisor
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+)
+
+// orphanGrace is how long a zombie child is left to the code that started it before it is reaped as an orphan.
+// The services and os/exec wait for their processes as soon as they exit.
+var orphanGrace = 10 * time.Second
+
+type processExit struct {
+	status syscall.WaitStatus
+	err    error
+}
+
+// reaper waits on the processes started by the manager. With reapOrphans it also reaps the zombie children no
+// one waited for within orphanGrace, so that processes re-parented to PID 1 do not linger. Unlike waiting on
+// any child, this leaves the exit status of the processes started with os/exec to their Wait.
+type reaper struct {
+	reapOrphans bool
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newReaper(reapOrphans bool) *reaper {
+	r := &reaper{
+		reapOrphans: reapOrphans,
+		closed:      make(chan struct{}),
+	}
+	if reapOrphans {
+		go r.reapAll()
+	}
+	return r
+}
+
+// start runs fn to start a process and returns a channel receiving its exit status
+func (r *reaper) start(fn func() (*os.Process, error)) (*os.Process, <-chan processExit, error) {
+	process, err := fn()
+	if err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan processExit, 1)
+	go func() {
+		status, err := wait(process.Pid)
+		exited <- processExit{status, err}
+	}()
+	return process, exited, nil
+}
+
+func (r *reaper) close() {
+	r.once.Do(func() { close(r.closed) })
+}
+
+func (r *reaper) reapAll() {
+	ticker := time.NewTicker(orphanGrace / 2)
+	defer ticker.Stop()
+	// The zombie children and when they were first seen
+	zombies := map[int]time.Time{}
+	for {
+		select {
+		case <-r.closed:
+			return
+		case <-ticker.C:
+		}
+
+		pids, err := zombieChildren()
+		if err != nil {
+			logger.Warnf("orphaned processes are not reaped: %v", err)
+			return
+		}
+		now := time.Now()
+		seen := map[int]time.Time{}
+		for _, pid := range pids {
+			first, ok := zombies[pid]
+			if !ok {
+				seen[pid] = now
+				continue
+			}
+			if now.Sub(first) < orphanGrace {
+				seen[pid] = first
+				continue
+			}
+			var status syscall.WaitStatus
+			if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid {
+				logger.Debugf("Reaped orphaned process %d", pid)
+			}
+		}
+		zombies = seen
+	}
+}
+
+// zombieChildren returns the children of the current process that exited and were not waited for yet
+func zombieChildren() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., comm may contain spaces and parentheses
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 2 || fields[0] != "Z" {
+			continue
+		}
+		if ppid, _ := strconv.Atoi(fields[1]); ppid == self {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// wait blocks until pid exits
+func wait(pid int) (syscall.WaitStatus, error) {
+	for {
+		var status syscall.WaitStatus
+		_, err := syscall.Wait4(pid, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		return status, err
+	}
+}
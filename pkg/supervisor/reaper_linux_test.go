@@ -0,0 +1,80 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const prSetChildSubreaper = 36
+
+func TestManagerReapsOnlyOrphans(t *testing.T) {
+	// Orphans are re-parented to the test process as they are to PID 1
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		t.Skipf("cannot become a subreaper: %v", errno)
+	}
+	defer syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 0, 0)
+	defer func(grace time.Duration) { orphanGrace = grace }(orphanGrace)
+	orphanGrace = 100 * time.Millisecond
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "orphaner.sh")
+	content := fmt.Sprintf(`#!/bin/sh
+(sleep 0.1 & echo $! > %[1]s/orphan)
+touch %[1]s/ready
+trap 'exit 0' TERM
+while true; do sleep 0.05; done
+`, dir)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(&Service{
+		Name: "orphaner",
+		Path: script,
+		Ready: func(int) error {
+			_, err := os.Stat(filepath.Join(dir, "ready"))
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ReapOrphans = true
+	m.Output = &syncBuffer{}
+	tm := &testManager{m: m, dir: dir, signals: make(chan os.Signal, 1), done: make(chan error, 1)}
+	go func() { tm.done <- m.Run(tm.signals) }()
+	tm.waitForState(t, 0, StateRunning)
+
+	// The exit status of the commands is left to os/exec
+	for i := 0; i < 20; i++ {
+		err := exec.Command("sh", "-c", "sleep 0.01; exit 3").Run()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+			t.Fatalf("expected the command to exit with code 3, got %v", err)
+		}
+	}
+
+	pid, err := os.ReadFile(filepath.Join(dir, "orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join("/proc", strings.TrimSpace(string(pid)))
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(orphan); err == nil; _, err = os.Stat(orphan) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the orphaned process %s to be reaped", orphan)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tm.signals <- syscall.SIGTERM
+	if err := tm.wait(t); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,679 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flanksource/clicky"
+	"github.com/flanksource/commons/logger"
+)
+
+// RestartPolicy decides whether a service is started again after it exited on its own
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartNever     RestartPolicy = "never"
+)
+
+// ShouldRestart reports whether a process that exited with status is restarted
+func (r RestartPolicy) ShouldRestart(status syscall.WaitStatus) bool {
+	switch r {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return failed(status)
+	default:
+		return false
+	}
+}
+
+// State is the lifecycle state of a service
+type State string
+
+const (
+	// StatePending services wait for their dependencies to become ready
+	StatePending  State = "pending"
+	StateStarting State = "starting"
+	StateRunning  State = "running"
+	// StateBackoff services crashed and wait to be restarted
+	StateBackoff  State = "backoff"
+	StateStopping State = "stopping"
+	StateStopped  State = "stopped"
+	// StateExited services exited successfully and were not restarted
+	StateExited State = "exited"
+	StateFailed State = "failed"
+)
+
+// Status is a point in time view of a service, as reported by Manager.Status
+type Status struct {
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	PID      int       `json:"pid,omitempty"`
+	Restarts int       `json:"restarts"`
+	Started  time.Time `json:"started,omitempty"`
+	LastExit string    `json:"last_exit,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Log      string    `json:"log,omitempty"`
+}
+
+// Service is a long running process kept alive by a Manager
+type Service struct {
+	Name string
+	// Path is the executable, looked up in PATH if it contains no slash
+	Path string
+	Args []string
+	// Env is added to the environment of postgres-cli
+	Env []string
+	Dir string
+	// DependsOn are the services that are started and ready before this one, and stopped after it
+	DependsOn []string
+	// Ready returns nil once the process with pid accepts requests, services without a probe are ready once started
+	Ready func(pid int) error
+	// ReadyTimeout fails the service if it is not ready in time, 0 waits forever
+	ReadyTimeout time.Duration
+	// OnReady is run in the background the first time the service is ready, it is not run again after a restart
+	OnReady func()
+
+	Restart RestartPolicy
+	// MaxRestarts gives up after this many consecutive crashes, 0 = unlimited
+	MaxRestarts int
+	// Backoff is the delay before the first restart, doubled after each consecutive crash up to MaxBackoff.
+	// A service that stayed up for longer than MaxBackoff is no longer counted as crashing.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// StopSignal maps the signal received by the manager to the one that stops the service, SIGTERM if nil
+	StopSignal func(received os.Signal) syscall.Signal
+	// StopTimeout is how long the service is given after each stop signal, before the next of
+	// EscalationSignals and finally SIGKILL is sent. 0 waits forever
+	StopTimeout       time.Duration
+	EscalationSignals []syscall.Signal
+	// ReloadSignal is sent when the manager receives SIGHUP, 0 if the service cannot reload its configuration
+	ReloadSignal syscall.Signal
+
+	// LogFile receives the output of the service in addition to the manager's output
+	LogFile string
+}
+
+// TCPReady returns a readiness probe that succeeds once address accepts connections
+func TCPReady(address string) func(pid int) error {
+	return func(int) error {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// service is the runtime state of a Service
+type service struct {
+	*Service
+	log       *os.File
+	stop      chan os.Signal
+	ready     chan struct{}
+	readyOnce sync.Once
+	finished  chan struct{}
+	err       error
+
+	mu      sync.Mutex
+	status  Status
+	process *os.Process
+}
+
+// Manager starts services in dependency order, restarts them when they crash and stops them in reverse order
+type Manager struct {
+	// Output receives the output of all services, prefixed with their name when there is more than one.
+	// Defaults to os.Stdout
+	Output io.Writer
+	// ReapOrphans also reaps the zombie children no one waits for, which is needed when running as PID 1 so
+	// that orphaned processes do not linger. Processes started with os/exec while the manager runs are left
+	// to their Wait.
+	ReapOrphans bool
+
+	services  []*service
+	nameWidth int
+	reaper    *reaper
+	outputMu  sync.Mutex
+}
+
+// NewManager orders services so that every service comes after its dependencies
+func NewManager(services ...*Service) (*Manager, error) {
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no services to run")
+	}
+	byName := map[string]*Service{}
+	for _, s := range services {
+		if s.Name == "" || s.Path == "" {
+			return nil, fmt.Errorf("service %q requires a name and a path", s.Name)
+		}
+		if _, exists := byName[s.Name]; exists {
+			return nil, fmt.Errorf("duplicate service %s", s.Name)
+		}
+		byName[s.Name] = s
+	}
+
+	m := &Manager{}
+	visiting := map[string]bool{}
+	added := map[string]bool{}
+	var visit func(s *Service) error
+	visit = func(s *Service) error {
+		if added[s.Name] {
+			return nil
+		}
+		if visiting[s.Name] {
+			return fmt.Errorf("dependency cycle at service %s", s.Name)
+		}
+		visiting[s.Name] = true
+		for _, name := range s.DependsOn {
+			dependency, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("service %s depends on unknown service %s", s.Name, name)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		added[s.Name] = true
+		m.services = append(m.services, newService(s))
+		m.nameWidth = max(m.nameWidth, len(s.Name))
+		return nil
+	}
+	for _, s := range services {
+		if err := visit(s); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func newService(s *Service) *service {
+	if s.Restart == "" {
+		s.Restart = RestartOnFailure
+	}
+	if s.Backoff <= 0 {
+		s.Backoff = time.Second
+	}
+	s.MaxBackoff = max(s.MaxBackoff, s.Backoff)
+	return &service{
+		Service:  s,
+		stop:     make(chan os.Signal, 4),
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+		status:   Status{Name: s.Name, State: StatePending, Log: s.LogFile},
+	}
+}
+
+// Status returns the state of every service in start order
+func (m *Manager) Status() []Status {
+	var statuses []Status
+	for _, s := range m.services {
+		s.mu.Lock()
+		statuses = append(statuses, s.status)
+		s.mu.Unlock()
+	}
+	return statuses
+}
+
+// Run starts the services and supervises them until the manager is stopped by one of signals, or a service
+// exits without being restarted. SIGHUP reloads the configuration of the services, any other signal stops
+// them in reverse dependency order.
+func (m *Manager) Run(signals <-chan os.Signal) error {
+	if m.Output == nil {
+		m.Output = os.Stdout
+	}
+	if err := m.openLogs(); err != nil {
+		return err
+	}
+	defer m.closeLogs()
+	m.reaper = newReaper(m.ReapOrphans)
+	defer m.reaper.close()
+
+	ended := make(chan *service, len(m.services))
+	var started []*service
+	start := func(s *service) {
+		started = append(started, s)
+		go func() {
+			s.err = m.supervise(s)
+			close(s.finished)
+			ended <- s
+		}()
+	}
+	start(m.services[0])
+
+	var errs []error
+	stopping := false
+	for running := 1; running > 0; {
+		// The next service is started once the previous one, and thus all of its dependencies, is ready
+		var ready <-chan struct{}
+		if !stopping && len(started) < len(m.services) {
+			ready = started[len(started)-1].ready
+		}
+
+		select {
+		case <-ready:
+			start(m.services[len(started)])
+			running++
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				for _, s := range started {
+					s.reload()
+				}
+				continue
+			}
+			if stopping {
+				// A second signal is forwarded to every service at once, e.g. to escalate the shutdown
+				for _, s := range started {
+					s.requestStop(sig)
+				}
+				continue
+			}
+			clicky.Infof("Received %s, stopping %s", sig, serviceNames(started))
+			stopping = true
+			go stopAll(slices.Clone(started), sig)
+
+		case s := <-ended:
+			running--
+			if s.err != nil {
+				errs = append(errs, s.err)
+			}
+			if !stopping {
+				stopping = true
+				go stopAll(slices.Clone(started), syscall.SIGTERM)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopAll stops services in reverse start order, waiting for each to exit before stopping the next
+func stopAll(services []*service, sig os.Signal) {
+	for i := len(services) - 1; i >= 0; i-- {
+		services[i].requestStop(sig)
+		<-services[i].finished
+	}
+}
+
+func serviceNames(services []*service) string {
+	var names []string
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (m *Manager) openLogs() error {
+	for _, s := range m.services {
+		if s.LogFile == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(s.LogFile), 0755); err != nil {
+			return fmt.Errorf("failed to create log directory for %s: %w", s.Name, err)
+		}
+		log, err := os.OpenFile(s.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open log file for %s: %w", s.Name, err)
+		}
+		s.log = log
+	}
+	return nil
+}
+
+func (m *Manager) closeLogs() {
+	for _, s := range m.services {
+		if s.log != nil {
+			s.log.Close()
+		}
+	}
+}
+
+// supervise runs a service until it is stopped or its restart policy gives up
+func (m *Manager) supervise(s *service) error {
+	backoff := s.Backoff
+	restarts := 0
+	for {
+		started := time.Now()
+		status, stopped, err := m.runOnce(s)
+		if err != nil {
+			s.exited(StateFailed, status, err)
+			return err
+		}
+		if stopped {
+			if failed(status) {
+				err := fmt.Errorf("%s %s while stopping", s.Name, describeExit(status))
+				s.exited(StateFailed, status, err)
+				return err
+			}
+			s.exited(StateStopped, status, nil)
+			clicky.Infof("%s stopped", s.Name)
+			return nil
+		}
+		if !s.Restart.ShouldRestart(status) {
+			if !failed(status) {
+				s.exited(StateExited, status, nil)
+				clicky.Infof("%s exited", s.Name)
+				return nil
+			}
+			err := fmt.Errorf("%s %s", s.Name, describeExit(status))
+			s.exited(StateFailed, status, err)
+			return err
+		}
+
+		if time.Since(started) > s.MaxBackoff {
+			backoff, restarts = s.Backoff, 0
+		}
+		if s.MaxRestarts > 0 && restarts >= s.MaxRestarts {
+			err := fmt.Errorf("%s %s, giving up after %d restarts", s.Name, describeExit(status), restarts)
+			s.exited(StateFailed, status, err)
+			return err
+		}
+		restarts++
+
+		s.exited(StateBackoff, status, nil)
+		clicky.Warnf("⚠️  %s %s, restarting in %s", s.Name, describeExit(status), backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case sig := <-s.stop:
+			timer.Stop()
+			clicky.Infof("Received %s while waiting to restart %s", sig, s.Name)
+			s.setState(StateStopped)
+			return nil
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+// runOnce starts the process of a service and waits for it to exit, returning its exit status and whether it was
+// asked to stop. An error is returned if it could not be started or did not become ready in time.
+func (m *Manager) runOnce(s *service) (syscall.WaitStatus, bool, error) {
+	path := s.Path
+	if !strings.Contains(path, "/") {
+		found, err := osexec.LookPath(path)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		path = found
+	}
+
+	output, copied, err := m.pipeOutput(s)
+	if err != nil {
+		return 0, false, err
+	}
+	argv := append([]string{path}, s.Args...)
+	process, exited, err := m.reaper.start(func() (*os.Process, error) {
+		return os.StartProcess(path, argv, &os.ProcAttr{
+			Dir:   s.Dir,
+			Env:   append(os.Environ(), s.Env...),
+			Files: []*os.File{os.Stdin, output, output},
+			// A separate process group keeps a terminal's Ctrl-C from bypassing the stop signals
+			Sys: &syscall.SysProcAttr{Setpgid: true},
+		})
+	})
+	output.Close()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to start %s: %w", s.Name, err)
+	}
+	defer process.Release()
+	s.setProcess(process)
+	clicky.Infof("🚀 Started %s (pid %d): %s", s.Name, process.Pid, strings.Join(argv, " "))
+
+	probeDone := make(chan struct{})
+	defer close(probeDone)
+	readiness := make(chan error, 1)
+	go s.probe(process.Pid, probeDone, readiness)
+
+	stopping := false
+	var failure error
+	var escalate <-chan time.Time
+	escalations := s.EscalationSignals
+	stop := func(sig syscall.Signal) {
+		s.signal(sig)
+		stopping = true
+		s.setState(StateStopping)
+		if escalate == nil && s.StopTimeout > 0 {
+			escalate = time.After(s.StopTimeout)
+		}
+	}
+
+	for {
+		select {
+		case exit := <-exited:
+			s.setProcess(nil)
+			// Give the output of the last moments a chance to be written, orphaned children may hold the pipe open
+			select {
+			case <-copied:
+			case <-time.After(time.Second):
+			}
+			if exit.err != nil {
+				return 0, stopping, fmt.Errorf("failed to wait for %s: %w", s.Name, exit.err)
+			}
+			return exit.status, stopping && failure == nil, failure
+
+		case err := <-readiness:
+			if err == nil {
+				s.setReady()
+				continue
+			}
+			failure = fmt.Errorf("%s %w", s.Name, err)
+			clicky.Warnf("⚠️  %v, stopping it", failure)
+			stop(s.stopSignal(syscall.SIGTERM))
+
+		case sig := <-s.stop:
+			stopSignal := s.stopSignal(sig)
+			clicky.Infof("Stopping %s (pid %d) with %s", s.Name, process.Pid, signalName(stopSignal))
+			stop(stopSignal)
+
+		case <-escalate:
+			if len(escalations) > 0 {
+				next := escalations[0]
+				escalations = escalations[1:]
+				clicky.Warnf("⚠️  %s did not stop within %s, sending %s", s.Name, s.StopTimeout, signalName(next))
+				s.signal(next)
+				escalate = time.After(s.StopTimeout)
+			} else {
+				clicky.Warnf("⚠️  %s did not stop within %s, killing pid %d", s.Name, s.StopTimeout, process.Pid)
+				s.signal(syscall.SIGKILL)
+				escalate = nil
+			}
+		}
+	}
+}
+
+// pipeOutput returns the file a service writes its output to, copied line by line to the manager's output
+func (m *Manager) pipeOutput(s *service) (*os.File, <-chan struct{}, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output pipe for %s: %w", s.Name, err)
+	}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer r.Close()
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				m.writeLine(s, line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return w, copied, nil
+}
+
+func (m *Manager) writeLine(s *service, line string) {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	m.outputMu.Lock()
+	defer m.outputMu.Unlock()
+	if s.log != nil {
+		if _, err := s.log.WriteString(line); err != nil {
+			logger.Warnf("failed to write to %s: %v", s.LogFile, err)
+		}
+	}
+	if len(m.services) > 1 {
+		fmt.Fprintf(m.Output, "%-*s | %s", m.nameWidth, s.Name, line)
+	} else {
+		io.WriteString(m.Output, line)
+	}
+}
+
+func (s *service) stopSignal(received os.Signal) syscall.Signal {
+	if s.StopSignal == nil {
+		return syscall.SIGTERM
+	}
+	return s.StopSignal(received)
+}
+
+// requestStop asks the service to stop, without blocking if it already has pending requests
+func (s *service) requestStop(sig os.Signal) {
+	select {
+	case s.stop <- sig:
+	default:
+	}
+}
+
+func (s *service) reload() {
+	if s.ReloadSignal == 0 {
+		return
+	}
+	s.mu.Lock()
+	running := s.process != nil
+	s.mu.Unlock()
+	if running {
+		clicky.Infof("Reloading %s", s.Name)
+		s.signal(s.ReloadSignal)
+	}
+}
+
+func (s *service) signal(sig syscall.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.process == nil {
+		return
+	}
+	if err := s.process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logger.Warnf("failed to send %s to %s (pid %d): %v", signalName(sig), s.Name, s.process.Pid, err)
+	}
+}
+
+// probe reports the first successful readiness check, or an error once ReadyTimeout has passed
+func (s *service) probe(pid int, done <-chan struct{}, result chan<- error) {
+	if s.Ready == nil {
+		result <- nil
+		return
+	}
+	var deadline <-chan time.Time
+	if s.ReadyTimeout > 0 {
+		deadline = time.After(s.ReadyTimeout)
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := s.Ready(pid)
+		if err == nil {
+			result <- nil
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			result <- fmt.Errorf("did not become ready within %s: %w", s.ReadyTimeout, err)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) setProcess(process *os.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.process = process
+	if process != nil {
+		s.status.State = StateStarting
+		s.status.PID = process.Pid
+		s.status.Started = time.Now()
+		s.status.Error = ""
+	}
+}
+
+func (s *service) setReady() {
+	s.setState(StateRunning)
+	s.readyOnce.Do(func() {
+		close(s.ready)
+		if s.OnReady != nil {
+			go s.OnReady()
+		}
+	})
+}
+
+func (s *service) setState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+}
+
+// exited records the exit of the service's process, StateBackoff counts it as a restart
+func (s *service) exited(state State, status syscall.WaitStatus, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+	s.status.PID = 0
+	// A service that failed to start has no exit status
+	if state != StateFailed || status != 0 {
+		s.status.LastExit = describeExit(status)
+	}
+	if state == StateBackoff {
+		s.status.Restarts++
+	}
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+}
+
+func failed(status syscall.WaitStatus) bool {
+	return !status.Exited() || status.ExitStatus() != 0
+}
+
+func describeExit(status syscall.WaitStatus) string {
+	if status.Signaled() {
+		return fmt.Sprintf("was killed by %s", signalName(status.Signal()))
+	}
+	return fmt.Sprintf("exited with code %d", status.ExitStatus())
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return sig.String()
+}
@@ -0,0 +1,360 @@
+package supervisor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeService appends "<name> start", "<name> reload" and "<name> stop" to $EVENTS, exits with $EXIT_CODE
+// if it is set and otherwise touches $READY_FILE once it handles signals
+const fakeService = `#!/bin/sh
+trap 'echo "$NAME stop" >> "$EVENTS"; exit 0' TERM
+trap 'echo "$NAME reload" >> "$EVENTS"' HUP
+echo "$NAME start" >> "$EVENTS"
+echo "$NAME says hello"
+if [ -n "$EXIT_CODE" ]; then
+  exit $EXIT_CODE
+fi
+[ -n "$READY_FILE" ] && touch "$READY_FILE"
+while true; do sleep 0.05; done
+`
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by the manager and the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type testManager struct {
+	m       *Manager
+	dir     string
+	output  *syncBuffer
+	signals chan os.Signal
+	done    chan error
+}
+
+// newTestService returns a fakeService that is ready once it handles signals
+func newTestService(t *testing.T, dir, name string, env ...string) *Service {
+	t.Helper()
+	ready := filepath.Join(dir, name+".ready")
+	path := filepath.Join(dir, "service.sh")
+	if _, err := os.Stat(path); err != nil {
+		if err := os.WriteFile(path, []byte(fakeService), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Service{
+		Name: name,
+		Path: path,
+		Env:  append([]string{"NAME=" + name, "EVENTS=" + filepath.Join(dir, "events"), "READY_FILE=" + ready}, env...),
+		Ready: func(int) error {
+			_, err := os.Stat(ready)
+			return err
+		},
+		Restart:      RestartOnFailure,
+		Backoff:      10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+		StopTimeout:  5 * time.Second,
+		ReloadSignal: syscall.SIGHUP,
+	}
+}
+
+func startManager(t *testing.T, dir string, services ...*Service) *testManager {
+	t.Helper()
+	m, err := NewManager(services...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := &testManager{
+		m:       m,
+		dir:     dir,
+		output:  &syncBuffer{},
+		signals: make(chan os.Signal, 1),
+		done:    make(chan error, 1),
+	}
+	m.Output = tm.output
+	go func() { tm.done <- m.Run(tm.signals) }()
+	return tm
+}
+
+func (tm *testManager) events(t *testing.T) []string {
+	t.Helper()
+	content, _ := os.ReadFile(filepath.Join(tm.dir, "events"))
+	return strings.Fields(strings.ReplaceAll(string(content), " ", "_"))
+}
+
+func (tm *testManager) waitForEvents(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if events := tm.events(t); len(events) >= count {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d events, got %v", count, tm.events(t))
+	return nil
+}
+
+func (tm *testManager) waitForState(t *testing.T, index int, state State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if tm.m.Status()[index].State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s, got %+v", state, tm.m.Status()[index])
+}
+
+func (tm *testManager) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-tm.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the manager to exit")
+		return nil
+	}
+}
+
+func TestNewManagerOrdersDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*Service
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "dependencies first",
+			services: []*Service{
+				{Name: "postgrest", Path: "postgrest", DependsOn: []string{"postgresql"}},
+				{Name: "pgbouncer", Path: "pgbouncer", DependsOn: []string{"postgresql"}},
+				{Name: "postgresql", Path: "postgres"},
+			},
+			want: "postgresql,postgrest,pgbouncer",
+		},
+		{
+			name: "unknown dependency",
+			services: []*Service{
+				{Name: "pgbouncer", Path: "pgbouncer", DependsOn: []string{"postgresql"}},
+			},
+			wantErr: "unknown service postgresql",
+		},
+		{
+			name: "cycle",
+			services: []*Service{
+				{Name: "a", Path: "a", DependsOn: []string{"b"}},
+				{Name: "b", Path: "b", DependsOn: []string{"a"}},
+			},
+			wantErr: "dependency cycle",
+		},
+		{
+			name: "duplicate",
+			services: []*Service{
+				{Name: "a", Path: "a"},
+				{Name: "a", Path: "a"},
+			},
+			wantErr: "duplicate service a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewManager(tt.services...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, status := range m.Status() {
+				names = append(names, status.Name)
+				if status.State != StatePending {
+					t.Errorf("expected %s to be pending, got %s", status.Name, status.State)
+				}
+			}
+			if got := strings.Join(names, ","); got != tt.want {
+				t.Errorf("expected order %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestManagerStartsAndStopsInDependencyOrder(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestService(t, dir, "db")
+	db.LogFile = filepath.Join(dir, "logs", "db.log")
+	web := newTestService(t, dir, "web")
+	web.DependsOn = []string{"db"}
+
+	tm := startManager(t, dir, web, db)
+	tm.waitForState(t, 1, StateRunning)
+
+	tm.signals <- syscall.SIGHUP
+	tm.waitForEvents(t, 4)
+	tm.signals <- syscall.SIGTERM
+	if err := tm.wait(t); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+
+	events := tm.events(t)
+	if got := strings.Join(events[:2], ","); got != "db_start,web_start" {
+		t.Errorf("expected db to start before web, got %v", events)
+	}
+	if got := strings.Join(events[4:], ","); got != "web_stop,db_stop" {
+		t.Errorf("expected web to stop before db, got %v", events)
+	}
+	for _, status := range tm.m.Status() {
+		if status.State != StateStopped {
+			t.Errorf("expected %s to be stopped, got %s", status.Name, status.State)
+		}
+	}
+
+	if output := tm.output.String(); !strings.Contains(output, "db  | db says hello") || !strings.Contains(output, "web | web says hello") {
+		t.Errorf("expected output prefixed with the service name, got:\n%s", output)
+	}
+	if log, _ := os.ReadFile(db.LogFile); string(log) != "db says hello\n" {
+		t.Errorf("expected the db log to contain only its output, got %q", log)
+	}
+}
+
+func TestManagerRestartsCrashedService(t *testing.T) {
+	dir := t.TempDir()
+	// Crashes until the fourth start, which finds the marker left by the third
+	marker := filepath.Join(dir, "crashed")
+	script := filepath.Join(dir, "crashy.sh")
+	content := fmt.Sprintf(`#!/bin/sh
+echo start >> %[1]s/events
+if [ ! -f %[2]s ]; then
+  [ "$(wc -l < %[1]s/events)" -ge 3 ] && touch %[2]s
+  exit 1
+fi
+trap 'exit 0' TERM
+while true; do sleep 0.05; done
+`, dir, marker)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	onReady := make(chan struct{}, 4)
+	tm := startManager(t, dir, &Service{
+		Name:       "crashy",
+		Path:       script,
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnReady:    func() { onReady <- struct{}{} },
+	})
+	tm.waitForEvents(t, 4)
+	tm.waitForState(t, 0, StateRunning)
+
+	status := tm.m.Status()[0]
+	if status.State != StateRunning || status.Restarts != 3 || status.PID == 0 {
+		t.Errorf("expected a running service restarted 3 times, got %+v", status)
+	}
+	if status.LastExit != "exited with code 1" {
+		t.Errorf("expected the last exit to be recorded, got %q", status.LastExit)
+	}
+
+	tm.signals <- syscall.SIGTERM
+	if err := tm.wait(t); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if len(onReady) != 1 {
+		t.Errorf("expected OnReady to run once across restarts, ran %d times", len(onReady))
+	}
+}
+
+func TestManagerStopsOthersWhenServiceFails(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestService(t, dir, "db")
+	web := newTestService(t, dir, "web", "EXIT_CODE=3")
+	web.DependsOn = []string{"db"}
+	web.Restart = RestartNever
+
+	tm := startManager(t, dir, db, web)
+	err := tm.wait(t)
+	if err == nil || !strings.Contains(err.Error(), "web exited with code 3") {
+		t.Fatalf("expected the failure of web, got %v", err)
+	}
+	if events := strings.Join(tm.events(t), ","); events != "db_start,web_start,db_stop" {
+		t.Errorf("expected db to be stopped after web failed, got %s", events)
+	}
+
+	statuses := tm.m.Status()
+	if statuses[0].State != StateStopped {
+		t.Errorf("expected db to be stopped, got %s", statuses[0].State)
+	}
+	if statuses[1].State != StateFailed || statuses[1].Error == "" {
+		t.Errorf("expected web to have failed, got %+v", statuses[1])
+	}
+}
+
+func TestManagerFailsServiceThatIsNeverReady(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestService(t, dir, "db")
+	db.Ready = func(int) error { return fmt.Errorf("not accepting connections") }
+	db.ReadyTimeout = 100 * time.Millisecond
+	web := newTestService(t, dir, "web")
+	web.DependsOn = []string{"db"}
+
+	tm := startManager(t, dir, db, web)
+	err := tm.wait(t)
+	if err == nil || !strings.Contains(err.Error(), "did not become ready within 100ms: not accepting connections") {
+		t.Fatalf("expected a readiness failure, got %v", err)
+	}
+	if events := strings.Join(tm.events(t), ","); events != "db_start,db_stop" {
+		t.Errorf("expected web never to start, got %s", events)
+	}
+	if state := tm.m.Status()[1].State; state != StatePending {
+		t.Errorf("expected web to still be pending, got %s", state)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	exited := func(code int) syscall.WaitStatus { return syscall.WaitStatus(code << 8) }
+	killed := syscall.WaitStatus(syscall.SIGKILL)
+
+	tests := []struct {
+		policy RestartPolicy
+		status syscall.WaitStatus
+		want   bool
+	}{
+		{RestartAlways, exited(0), true},
+		{RestartAlways, exited(1), true},
+		{RestartOnFailure, exited(0), false},
+		{RestartOnFailure, exited(1), true},
+		{RestartOnFailure, killed, true},
+		{RestartNever, exited(1), false},
+		{RestartNever, killed, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.ShouldRestart(tt.status); got != tt.want {
+			t.Errorf("%s.ShouldRestart(%s) = %v, want %v", tt.policy, describeExit(tt.status), got, tt.want)
+		}
+	}
+}
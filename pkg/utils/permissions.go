@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"syscall"
 )
@@ -189,3 +190,54 @@ func IsRunningAsRoot() bool {
 func IsRunningAsPostgres() bool {
 	return os.Getuid() == 999
 }
+
+// LookupUserIDs returns the uid and gid of a user, falling back to 999:999 (the postgres user of the image)
+// if the user does not exist
+func LookupUserIDs(name string) (int, int) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 999, 999
+	}
+	uid, uidErr := strconv.Atoi(u.Uid)
+	gid, gidErr := strconv.Atoi(u.Gid)
+	if uidErr != nil || gidErr != nil {
+		return 999, 999
+	}
+	return uid, gid
+}
+
+// FixOwnership creates dir if needed, makes everything under it owned by uid:gid and restricts
+// dir to its owner, the way the official postgres image prepares PGDATA when started as root
+func FixOwnership(dir string, uid, gid int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && int(stat.Uid) == uid && int(stat.Gid) == gid {
+			return nil
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to change ownership of %s: %w", dir, err)
+	}
+	return os.Chmod(dir, 0700)
+}
+
+// DropPrivileges switches the process from root to uid:gid, like gosu does before exec'ing the server
+func DropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", uid, err)
+	}
+	return nil
+}
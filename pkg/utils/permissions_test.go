@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixOwnership(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	uid, gid := os.Getuid(), os.Getgid()
+
+	if err := FixOwnership(dataDir, uid, gid); err != nil {
+		t.Fatalf("FixOwnership failed to create missing directory: %v", err)
+	}
+
+	if err := os.Chmod(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("17\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := FixOwnership(dataDir, uid, gid); err != nil {
+		t.Fatalf("FixOwnership failed: %v", err)
+	}
+
+	info, err := os.Stat(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected mode 0700, got %o", info.Mode().Perm())
+	}
+	result, err := CheckDirectoryPermissions(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OwnerUID != uid || result.OwnerGID != gid {
+		t.Errorf("expected owner %d:%d, got %d:%d", uid, gid, result.OwnerUID, result.OwnerGID)
+	}
+}
+
+func TestLookupUserIDsFallback(t *testing.T) {
+	uid, gid := LookupUserIDs("no-such-user-for-postgres-cli")
+	if uid != 999 || gid != 999 {
+		t.Errorf("expected 999:999 for a missing user, got %d:%d", uid, gid)
+	}
+}
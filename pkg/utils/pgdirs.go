@@ -5,7 +5,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -80,6 +82,73 @@ func DetectBinDir() (string, error) {
 	return "", fmt.Errorf("PostgreSQL binary directory not found. Checked PATH and common locations")
 }
 
+// DetectInstalledBinDirs returns the binary directory of every installed PostgreSQL major version,
+// searching the same locations as DetectBinDir. If several directories provide the same major
+// version, the one found first (PGBIN, then PATH, then common locations) wins.
+func DetectInstalledBinDirs() map[int]string {
+	var candidates []string
+	if pgbin := os.Getenv("PGBIN"); pgbin != "" {
+		candidates = append(candidates, pgbin)
+	}
+	if pgPath, err := exec.LookPath("postgres"); err == nil {
+		candidates = append(candidates, filepath.Dir(pgPath))
+	}
+	for _, path := range getCommonBinPaths() {
+		if !strings.Contains(path, "*") {
+			candidates = append(candidates, path)
+			continue
+		}
+		if matches, err := filepath.Glob(path); err == nil {
+			candidates = append(candidates, matches...)
+		}
+	}
+
+	dirs := make(map[int]string)
+	for _, dir := range candidates {
+		if !isValidBinDir(dir) {
+			continue
+		}
+		version, err := BinDirMajorVersion(dir)
+		if err != nil {
+			continue
+		}
+		if _, exists := dirs[version]; !exists {
+			dirs[version] = dir
+		}
+	}
+	return dirs
+}
+
+var (
+	binDirVersionPattern  = regexp.MustCompile(`(?:postgresql|pgsql-|PostgreSQL|Versions)[/@-]?(\d+)(?:\.\d+)?/bin$`)
+	postgresVersionOutput = regexp.MustCompile(`PostgreSQL\)?\s+(\d+)`)
+)
+
+// BinDirMajorVersion returns the PostgreSQL major version of the binaries in dir, using the
+// directory layout when it encodes the version (e.g. /usr/lib/postgresql/17/bin) and
+// falling back to running postgres --version
+func BinDirMajorVersion(dir string) (int, error) {
+	if matches := binDirVersionPattern.FindStringSubmatch(filepath.ToSlash(filepath.Clean(dir))); len(matches) > 1 {
+		return strconv.Atoi(matches[1])
+	}
+
+	output, err := exec.Command(filepath.Join(dir, "postgres"), "--version").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run postgres --version in %s: %w", dir, err)
+	}
+	return ParsePostgresMajorVersion(string(output))
+}
+
+// ParsePostgresMajorVersion extracts the major version from `postgres --version` output,
+// e.g. "postgres (PostgreSQL) 17.2 (Debian 17.2-1.pgdg120+1)" returns 17
+func ParsePostgresMajorVersion(output string) (int, error) {
+	matches := postgresVersionOutput.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return 0, fmt.Errorf("unrecognized postgres version output: %q", strings.TrimSpace(output))
+	}
+	return strconv.Atoi(matches[1])
+}
+
 // DetectDataDir detects PostgreSQL data directory
 func DetectDataDir() (string, error) {
 	// 1. Check PGDATA environment variable
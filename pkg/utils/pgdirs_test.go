@@ -0,0 +1,54 @@
+package utils
+
+import "testing"
+
+func TestBinDirMajorVersion(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want int
+	}{
+		{dir: "/usr/lib/postgresql/17/bin", want: 17},
+		{dir: "/usr/lib/postgresql/14/bin/", want: 14},
+		{dir: "/usr/pgsql-16/bin", want: 16},
+		{dir: "/opt/homebrew/opt/postgresql@15/bin", want: 15},
+		{dir: "/Applications/Postgres.app/Contents/Versions/18/bin", want: 18},
+		{dir: "/opt/postgresql/13/bin", want: 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			got, err := BinDirMajorVersion(tt.dir)
+			if err != nil {
+				t.Fatalf("BinDirMajorVersion(%q) error: %v", tt.dir, err)
+			}
+			if got != tt.want {
+				t.Errorf("BinDirMajorVersion(%q) = %d, want %d", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePostgresMajorVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    int
+		wantErr bool
+	}{
+		{output: "postgres (PostgreSQL) 17.2 (Debian 17.2-1.pgdg120+1)\n", want: 17},
+		{output: "postgres (PostgreSQL) 18beta1", want: 18},
+		{output: "postgres (PostgreSQL) 14.11", want: 14},
+		{output: "command not found", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			got, err := ParsePostgresMajorVersion(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePostgresMajorVersion(%q) error = %v, wantErr %v", tt.output, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePostgresMajorVersion(%q) = %d, want %d", tt.output, got, tt.want)
+			}
+		})
+	}
+}
@@ -195,6 +195,52 @@ func (w *WalG) DeleteRetain(retainCount int) error {
 	return nil
 }
 
+// ApplyRetention deletes the backups that are neither among the newest retainCount nor younger than maxAge, a
+// zero value disables a rule. The WAL only needed by the deleted backups is deleted with them.
+func (w *WalG) ApplyRetention(retainCount int, maxAge time.Duration) error {
+	if w == nil {
+		return fmt.Errorf("WAL-G service is nil")
+	}
+	if w.Config == nil {
+		return fmt.Errorf("WAL-G configuration not provided")
+	}
+
+	if !w.Config.Enabled {
+		return fmt.Errorf("WAL-G is disabled")
+	}
+
+	args := retentionArgs(retainCount, maxAge, time.Now())
+	if args == nil {
+		return nil
+	}
+
+	env := w.buildEnvironment()
+	cmd := exec.Command("wal-g", append(append([]string{"delete"}, args...), "--confirm")...)
+	cmd.Env = env
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("WAL-G delete %s failed: %w, output: %s", args[0], err, string(output))
+	}
+
+	return nil
+}
+
+// retentionArgs returns the wal-g delete arguments applying the retention, nil when it keeps everything
+func retentionArgs(retainCount int, maxAge time.Duration, now time.Time) []string {
+	cutoff := now.Add(-maxAge).UTC().Format(time.RFC3339)
+	switch {
+	case retainCount > 0 && maxAge > 0:
+		return []string{"retain", fmt.Sprintf("%d", retainCount), "--after", cutoff}
+	case retainCount > 0:
+		return []string{"retain", fmt.Sprintf("%d", retainCount)}
+	case maxAge > 0:
+		// FIND_FULL keeps the full backup the remaining delta backups are based on
+		return []string{"before", "FIND_FULL", cutoff}
+	}
+	return nil
+}
+
 // GetStatus returns detailed WAL-G service status
 func (w *WalG) GetStatus() (*WalgStatus, error) {
 	if w == nil {
@@ -270,6 +316,11 @@ func (w *WalG) InstalledVersion() (string, error) {
 	return string(output), nil
 }
 
+// Environment returns the environment variables for WAL-G commands, e.g. for a restore_command run by PostgreSQL
+func (w *WalG) Environment() []string {
+	return w.buildEnvironment()
+}
+
 // buildEnvironment constructs the environment variables for WAL-G commands
 func (w *WalG) buildEnvironment() []string {
 	var env []string
@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionArgs(t *testing.T) {
+	now := time.Date(2025, 1, 31, 2, 0, 0, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name        string
+		retainCount int
+		maxAge      time.Duration
+		expected    []string
+	}{
+		{name: "keep everything"},
+		{name: "count", retainCount: 7, expected: []string{"retain", "7"}},
+		{name: "age", maxAge: 30 * 24 * time.Hour, expected: []string{"before", "FIND_FULL", "2025-01-01T01:00:00Z"}},
+		{name: "count and age", retainCount: 3, maxAge: 24 * time.Hour, expected: []string{"retain", "3", "--after", "2025-01-30T01:00:00Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if args := retentionArgs(tt.retainCount, tt.maxAge, now); !reflect.DeepEqual(args, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, args)
+			}
+		})
+	}
+}